@@ -0,0 +1,154 @@
+package gopack
+
+import (
+	"bytes"
+	"debug/elf"
+	"debug/macho"
+	"debug/pe"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"git.sr.ht/~jackmordaunt/gopack/internal/util"
+)
+
+// ErrUnknownBinary is returned by DetectTarget for files that aren't
+// executables of a supported target.
+var ErrUnknownBinary = errors.New("unknown binary format")
+
+// wasmMagic starts every WebAssembly module.
+var wasmMagic = []byte("\x00asm")
+
+// DetectTarget reads the target a binary was built for from its header.
+// ELF binaries are taken to be Linux, PE Windows and Mach-O Darwin. Universal
+// Mach-O binaries are darwin/universal.
+func DetectTarget(r io.ReaderAt) (Target, error) {
+	magic := make([]byte, 4)
+	if _, err := r.ReadAt(magic, 0); err != nil {
+		if err == io.EOF {
+			return Target{}, ErrUnknownBinary
+		}
+		return Target{}, err
+	}
+	switch {
+	case bytes.Equal(magic, wasmMagic):
+		return Target{Platform: JS, Architecture: WASM}, nil
+	case bytes.Equal(magic, []byte(elf.ELFMAG)):
+		f, err := elf.NewFile(r)
+		if err != nil {
+			return Target{}, fmt.Errorf("parsing elf: %w", err)
+		}
+		if f.OSABI != elf.ELFOSABI_NONE && f.OSABI != elf.ELFOSABI_LINUX {
+			return Target{}, fmt.Errorf("%w: elf for %s", ErrUnknownBinary, f.OSABI)
+		}
+		arch, ok := map[elf.Machine]Architecture{
+			elf.EM_386:     X86,
+			elf.EM_X86_64:  AMD64,
+			elf.EM_ARM:     ARM,
+			elf.EM_AARCH64: ARM64,
+		}[f.Machine]
+		if !ok {
+			return Target{}, fmt.Errorf("%w: elf for %s", ErrUnknownBinary, f.Machine)
+		}
+		return Target{Platform: Linux, Architecture: arch}, nil
+	case bytes.Equal(magic[:2], []byte("MZ")):
+		f, err := pe.NewFile(r)
+		if err != nil {
+			return Target{}, fmt.Errorf("parsing pe: %w", err)
+		}
+		arch, ok := map[uint16]Architecture{
+			pe.IMAGE_FILE_MACHINE_I386:  X86,
+			pe.IMAGE_FILE_MACHINE_AMD64: AMD64,
+			pe.IMAGE_FILE_MACHINE_ARMNT: ARM,
+			pe.IMAGE_FILE_MACHINE_ARM64: ARM64,
+		}[f.Machine]
+		if !ok {
+			return Target{}, fmt.Errorf("%w: pe for machine %#x", ErrUnknownBinary, f.Machine)
+		}
+		return Target{Platform: Windows, Architecture: arch}, nil
+	}
+	f, err := macho.NewFile(r)
+	if err != nil {
+		if _, err := macho.NewFatFile(r); err == nil {
+			return Target{Platform: Darwin, Architecture: Universal}, nil
+		}
+		return Target{}, ErrUnknownBinary
+	}
+	arch, ok := map[macho.Cpu]Architecture{
+		macho.Cpu386:   X86,
+		macho.CpuAmd64: AMD64,
+		macho.CpuArm:   ARM,
+		macho.CpuArm64: ARM64,
+	}[f.Cpu]
+	if !ok {
+		return Target{}, fmt.Errorf("%w: mach-o for %s", ErrUnknownBinary, f.Cpu)
+	}
+	return Target{Platform: Darwin, Architecture: arch}, nil
+}
+
+// LoadArtifacts reads prebuilt binaries, detecting the target of each.
+//
+// Paths are binaries or directories of them. Files in a directory that aren't
+// binaries are skipped, whereas binaries named explicitly must be recognised.
+// At most one binary is accepted per target.
+func LoadArtifacts(paths ...string) ([]Artifact, error) {
+	var (
+		artifacts []Artifact
+		seen      = map[Target]string{}
+	)
+	add := func(path string, explicit bool) error {
+		by, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("reading binary: %w", err)
+		}
+		target, err := DetectTarget(bytes.NewReader(by))
+		if errors.Is(err, ErrUnknownBinary) && !explicit {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if other, ok := seen[target]; ok {
+			return fmt.Errorf("%s: %s already provided by %s", path, target, other)
+		}
+		seen[target] = path
+		artifacts = append(artifacts, Artifact{
+			Binary: util.NewCopyBuffer(by),
+			Name:   strings.TrimSuffix(filepath.Base(path), target.Ext()),
+			Target: target,
+		})
+		return nil
+	}
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("loading binaries: %w", err)
+		}
+		if !info.IsDir() {
+			if err := add(path, true); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		entries, err := ioutil.ReadDir(path)
+		if err != nil {
+			return nil, fmt.Errorf("loading binaries: %w", err)
+		}
+		for _, e := range entries {
+			if !e.Mode().IsRegular() {
+				continue
+			}
+			if err := add(filepath.Join(path, e.Name()), false); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(artifacts) == 0 {
+		return nil, fmt.Errorf("no binaries found in %v", paths)
+	}
+	return artifacts, nil
+}
@@ -0,0 +1,92 @@
+package gopack
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testBinaries holds minimal headers of each supported format.
+var testBinaries = func() map[string][]byte {
+	le := binary.LittleEndian
+	elf := make([]byte, 64)
+	copy(elf, "\x7fELF\x02\x01\x01")
+	le.PutUint16(elf[16:], 2)
+	le.PutUint16(elf[18:], 183)
+	le.PutUint32(elf[20:], 1)
+	le.PutUint16(elf[52:], 64)
+	exe := make([]byte, 0x200)
+	copy(exe, "MZ")
+	le.PutUint32(exe[0x3C:], 0x40)
+	copy(exe[0x40:], "PE\x00\x00")
+	le.PutUint16(exe[0x44:], 0x14C)
+	macho := make([]byte, 32)
+	le.PutUint32(macho, 0xFEEDFACF)
+	le.PutUint32(macho[4:], 0x01000007)
+	le.PutUint32(macho[12:], 2)
+	return map[string][]byte{
+		"notes":      elf,
+		"notes.exe":  exe,
+		"notes-mac":  macho,
+		"notes.wasm": []byte("\x00asm\x01\x00\x00\x00"),
+	}
+}()
+
+func TestDetectTarget(t *testing.T) {
+	for name, want := range map[string]string{
+		"notes":      "linux_arm64",
+		"notes.exe":  "windows_386",
+		"notes-mac":  "darwin_amd64",
+		"notes.wasm": "js_wasm",
+	} {
+		got, err := DetectTarget(bytes.NewReader(testBinaries[name]))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if got.String() != want {
+			t.Errorf("%s: got %s, want %s", name, got, want)
+		}
+	}
+	if _, err := DetectTarget(bytes.NewReader([]byte("#!/bin/sh\n"))); !errors.Is(err, ErrUnknownBinary) {
+		t.Errorf("script: got %v, want unknown binary", err)
+	}
+}
+
+func TestLoadArtifacts(t *testing.T) {
+	dir := t.TempDir()
+	for name, by := range testBinaries {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), by, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	readme := filepath.Join(dir, "README")
+	if err := ioutil.WriteFile(readme, []byte("notes"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	artifacts, err := LoadArtifacts(dir)
+	if err != nil {
+		t.Fatalf("loading directory: %v", err)
+	}
+	if len(artifacts) != len(testBinaries) {
+		t.Errorf("got %d artifacts, want %d", len(artifacts), len(testBinaries))
+	}
+	for _, a := range artifacts {
+		if a.Target == NewTarget("windows/386") && a.Name != "notes" {
+			t.Errorf("got name %q, want the file name without extension", a.Name)
+		}
+	}
+	if _, err := LoadArtifacts(readme); !errors.Is(err, ErrUnknownBinary) {
+		t.Errorf("explicit non-binary: got %v, want unknown binary", err)
+	}
+	if _, err := LoadArtifacts(dir, filepath.Join(dir, "notes")); err == nil {
+		t.Errorf("duplicate target: expected error")
+	}
+}
@@ -0,0 +1,371 @@
+package gopack
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"git.sr.ht/~jackmordaunt/gopack/internal/util"
+)
+
+// Cache stores compiled binaries and bundles, addressed by a hash of the
+// inputs that produced them, so that unchanged targets are not rebuilt.
+//
+// Entries are touched when used, and removed by Prune once unused for long
+// enough.
+type Cache struct {
+	// Dir holds the entries, "bin/<key>" for binaries and "bundle/<key>/"
+	// for bundles.
+	Dir string
+}
+
+// DefaultCache is the cache in the user's cache directory.
+func DefaultCache() (*Cache, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return nil, fmt.Errorf("finding cache directory: %w", err)
+	}
+	return &Cache{Dir: filepath.Join(dir, "gopack")}, nil
+}
+
+// Binary returns the cached binary for key, or nil if there is none.
+func (c *Cache) Binary(key string) ([]byte, error) {
+	path := filepath.Join(c.Dir, "bin", key)
+	by, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading cached binary: %w", err)
+	}
+	touch(path)
+	return by, nil
+}
+
+// PutBinary stores the binary for key.
+func (c *Cache) PutBinary(key string, by []byte) error {
+	dir := filepath.Join(c.Dir, "bin")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("creating cache: %w", err)
+	}
+	// Written aside then renamed, so that a partial write is never used.
+	tmp, err := ioutil.TempFile(dir, key+".*")
+	if err != nil {
+		return fmt.Errorf("creating cache entry: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(by); err != nil {
+		tmp.Close()
+		return fmt.Errorf("writing cache entry: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("writing cache entry: %w", err)
+	}
+	return os.Rename(tmp.Name(), filepath.Join(dir, key))
+}
+
+// Bundle copies the cached bundle for key into dir, reporting whether there
+// was one.
+func (c *Cache) Bundle(key, dir string) (bool, error) {
+	path := filepath.Join(c.Dir, "bundle", key)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return false, nil
+	}
+	if err := (util.Copier{Recursive: true}).Copy(path, dir); err != nil {
+		return false, fmt.Errorf("copying cached bundle: %w", err)
+	}
+	touch(path)
+	return true, nil
+}
+
+// PutBundle stores the contents of dir as the bundle for key.
+func (c *Cache) PutBundle(key, dir string) error {
+	parent := filepath.Join(c.Dir, "bundle")
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return fmt.Errorf("creating cache: %w", err)
+	}
+	tmp, err := ioutil.TempDir(parent, key+".*")
+	if err != nil {
+		return fmt.Errorf("creating cache entry: %w", err)
+	}
+	defer os.RemoveAll(tmp)
+	if err := (util.Copier{Recursive: true}).Copy(dir, tmp); err != nil {
+		return fmt.Errorf("copying bundle: %w", err)
+	}
+	path := filepath.Join(parent, key)
+	if err := os.RemoveAll(path); err != nil {
+		return fmt.Errorf("replacing cache entry: %w", err)
+	}
+	return os.Rename(tmp, path)
+}
+
+// Prune removes entries unused for longer than age, returning how many were
+// removed. An age of zero empties the cache.
+func (c *Cache) Prune(age time.Duration) (int, error) {
+	var (
+		removed int
+		cutoff  = time.Now().Add(-age)
+	)
+	for _, kind := range []string{"bin", "bundle"} {
+		entries, err := ioutil.ReadDir(filepath.Join(c.Dir, kind))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return removed, fmt.Errorf("reading cache: %w", err)
+		}
+		for _, e := range entries {
+			if age > 0 && e.ModTime().After(cutoff) {
+				continue
+			}
+			if err := os.RemoveAll(filepath.Join(c.Dir, kind, e.Name())); err != nil {
+				return removed, fmt.Errorf("removing %s: %w", e.Name(), err)
+			}
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// touch marks an entry as used.
+func touch(path string) {
+	now := time.Now()
+	_ = os.Chtimes(path, now, now)
+}
+
+// hasher accumulates the inputs of a cache key.
+type hasher struct {
+	hash.Hash
+}
+
+func newHasher() hasher {
+	return hasher{sha256.New()}
+}
+
+// add writes each value, length prefixed so that values can't run together.
+func (h hasher) add(values ...interface{}) {
+	for _, v := range values {
+		var by []byte
+		switch v := v.(type) {
+		case []byte:
+			by = v
+		case string:
+			by = []byte(v)
+		default:
+			by = []byte(fmt.Sprintf("%#v", v))
+		}
+		fmt.Fprintf(h, "%d:", len(by))
+		h.Write(by)
+	}
+}
+
+func (h hasher) key() string {
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// hashTree hashes the paths, modes and contents of the files under root,
+// skipping the directories in ignore. An ignored path is relative to root,
+// while an ignored name alone, such as ".git", is skipped at any depth.
+func hashTree(root string, ignore ...string) (string, error) {
+	h := newHasher()
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			rel = filepath.ToSlash(rel)
+			for _, name := range ignore {
+				name = filepath.ToSlash(filepath.Clean(name))
+				if rel == name || (!strings.Contains(name, "/") && info.Name() == name) {
+					return filepath.SkipDir
+				}
+			}
+			return nil
+		}
+		h.add(filepath.ToSlash(rel), info.Mode().String())
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		fmt.Fprintf(h, "%d:", info.Size())
+		_, err = io.Copy(h, f)
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("hashing %s: %w", root, err)
+	}
+	return h.key(), nil
+}
+
+// toolchain identifies the Go toolchain and its environment as seen from dir,
+// which covers variables such as CGO_ENABLED, GOFLAGS and CC as well as
+// those specific to an architecture, such as GOARM.
+func toolchain(dir string) (string, error) {
+	version := exec.Command("go", "version")
+	version.Dir = dir
+	out, err := version.Output()
+	if err != nil {
+		return "", fmt.Errorf("go version: %w", err)
+	}
+	env := exec.Command("go", "env", "-json")
+	env.Dir = dir
+	vars, err := env.Output()
+	if err != nil {
+		return "", fmt.Errorf("go env: %w", err)
+	}
+	return strings.TrimSpace(string(out)) + "\n" + string(vars), nil
+}
+
+// module is the subset of "go list -m -json" output that identifies a module.
+type module struct {
+	Path    string
+	Version string
+	Main    bool
+	GoMod   string
+	Replace *module
+	Dir     string
+}
+
+// hashModules hashes the modules of the build in dir: the versions of each,
+// the go.mod and go.sum of the main module, and the files of replacements
+// that are local directories, which may lie outside the project root. Builds
+// outside of a module have none.
+func hashModules(dir string) (string, error) {
+	gomod := exec.Command("go", "env", "GOMOD")
+	gomod.Dir = dir
+	out, err := gomod.Output()
+	if err != nil {
+		return "", fmt.Errorf("go env: %w", err)
+	}
+	if path := strings.TrimSpace(string(out)); path == "" || path == os.DevNull {
+		return "", nil
+	}
+	list := exec.Command("go", "list", "-m", "-json", "all")
+	list.Dir = dir
+	out, err = list.Output()
+	if err != nil {
+		return "", fmt.Errorf("listing modules: %w", err)
+	}
+	h := newHasher()
+	for dec := json.NewDecoder(bytes.NewReader(out)); dec.More(); {
+		var m module
+		if err := dec.Decode(&m); err != nil {
+			return "", fmt.Errorf("listing modules: %w", err)
+		}
+		h.add(m.Path, m.Version)
+		if m.Main && m.GoMod != "" {
+			for _, path := range []string{m.GoMod, filepath.Join(filepath.Dir(m.GoMod), "go.sum")} {
+				by, err := ioutil.ReadFile(path)
+				if err != nil && !os.IsNotExist(err) {
+					return "", fmt.Errorf("hashing modules: %w", err)
+				}
+				h.add(by)
+			}
+		}
+		if r := m.Replace; r != nil {
+			h.add(r.Path, r.Version)
+			// Replacements without a version are local directories.
+			if r.Version == "" && r.Dir != "" {
+				tree, err := hashTree(r.Dir, ".git")
+				if err != nil {
+					return "", err
+				}
+				h.add(tree)
+			}
+		}
+	}
+	return h.key(), nil
+}
+
+// hash identifies the metadata, including the contents of supplied files and
+// the icon. Readers are replaced with buffers of their contents, so that they
+// can still be read afterwards.
+func (md *MetaData) hash() (string, error) {
+	h := newHasher()
+	read := func(r *io.Reader) error {
+		if *r == nil {
+			h.add("")
+			return nil
+		}
+		by, err := ioutil.ReadAll(*r)
+		if err != nil {
+			return err
+		}
+		*r = util.NewCopyBuffer(by)
+		h.add(by)
+		return nil
+	}
+	for _, r := range []*io.Reader{
+		&md.Darwin.ICNS,
+		&md.Darwin.Plist,
+		&md.Windows.ICO,
+		&md.Windows.Manifest,
+	} {
+		if err := read(r); err != nil {
+			return "", err
+		}
+	}
+	var arches []int
+	for arch := range md.Linux.AppImageRuntime {
+		arches = append(arches, int(arch))
+	}
+	sort.Ints(arches)
+	for _, arch := range arches {
+		r := md.Linux.AppImageRuntime[Architecture(arch)]
+		if err := read(&r); err != nil {
+			return "", err
+		}
+		md.Linux.AppImageRuntime[Architecture(arch)] = r
+		h.add(Architecture(arch).String())
+	}
+	if md.Icon != nil {
+		if err := png.Encode(h, md.Icon); err != nil {
+			return "", fmt.Errorf("hashing icon: %w", err)
+		}
+	}
+	if id := md.Darwin.Identity; id != nil {
+		h.add(Darwin.String(), id.Certificate.Raw)
+	}
+	if id := md.Windows.Identity; id != nil {
+		h.add(Windows.String(), id.Certificate.Raw)
+	}
+	if md.Darwin.DMG.Background != nil {
+		if err := png.Encode(h, md.Darwin.DMG.Background); err != nil {
+			return "", fmt.Errorf("hashing background: %w", err)
+		}
+	}
+	// Remaining fields are plain values. Readers, images and identities,
+	// hashed above, are left out.
+	plain := *md
+	plain.Icon = nil
+	plain.Darwin.ICNS, plain.Darwin.Plist, plain.Darwin.DMG.Background = nil, nil, nil
+	plain.Darwin.Identity = nil
+	plain.Windows.ICO, plain.Windows.Manifest, plain.Windows.Identity = nil, nil, nil
+	plain.Linux.AppImageRuntime = nil
+	by, err := json.Marshal(plain)
+	if err != nil {
+		return "", fmt.Errorf("hashing metadata: %w", err)
+	}
+	h.add(by)
+	return h.key(), nil
+}
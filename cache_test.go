@@ -0,0 +1,146 @@
+package gopack
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCache(t *testing.T) {
+	c := &Cache{Dir: t.TempDir()}
+	if by, err := c.Binary("missing"); err != nil || by != nil {
+		t.Fatalf("missing binary: got %q, %v", by, err)
+	}
+	if err := c.PutBinary("bin", []byte("binary")); err != nil {
+		t.Fatalf("putting binary: %v", err)
+	}
+	if by, err := c.Binary("bin"); err != nil || string(by) != "binary" {
+		t.Fatalf("got binary %q, %v", by, err)
+	}
+	src := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(src, "app"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "app", "file"), []byte("bundle"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.PutBundle("bundle", src); err != nil {
+		t.Fatalf("putting bundle: %v", err)
+	}
+	dst := filepath.Join(t.TempDir(), "out")
+	if ok, err := c.Bundle("bundle", dst); err != nil || !ok {
+		t.Fatalf("getting bundle: %t, %v", ok, err)
+	}
+	if by, err := ioutil.ReadFile(filepath.Join(dst, "app", "file")); err != nil || string(by) != "bundle" {
+		t.Fatalf("got bundle file %q, %v", by, err)
+	}
+	if ok, err := c.Bundle("missing", dst); err != nil || ok {
+		t.Fatalf("missing bundle: got %t, %v", ok, err)
+	}
+	// Age the binary, so that only it is pruned.
+	old := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(filepath.Join(c.Dir, "bin", "bin"), old, old); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := c.Prune(24 * time.Hour); err != nil || n != 1 {
+		t.Fatalf("pruning: removed %d, %v", n, err)
+	}
+	if by, _ := c.Binary("bin"); by != nil {
+		t.Errorf("aged binary not pruned")
+	}
+	if n, err := c.Prune(0); err != nil || n != 1 {
+		t.Fatalf("emptying: removed %d, %v", n, err)
+	}
+}
+
+func TestHashTree(t *testing.T) {
+	root := t.TempDir()
+	write := func(name, content string) {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hash := func() string {
+		h, err := hashTree(root, "dist", ".git")
+		if err != nil {
+			t.Fatalf("hashing: %v", err)
+		}
+		return h
+	}
+	write("main.go", "package main")
+	first := hash()
+	write("dist/notes", "output")
+	write("cmd/notes/dist/notes", "output")
+	write("internal/.git/HEAD", "ref: refs/heads/main")
+	if hash() != first {
+		t.Errorf("ignored directory changed the hash")
+	}
+	write("main.go", "package main // changed")
+	if hash() == first {
+		t.Errorf("changed file kept the hash")
+	}
+}
+
+// TestHashModules ensures that local replacements, which may lie outside the
+// project root, are part of the hash.
+func TestHashModules(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go not found")
+	}
+	dir := t.TempDir()
+	write := func(name, content string) {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hash := func() string {
+		h, err := hashModules(filepath.Join(dir, "notes"))
+		if err != nil {
+			t.Fatalf("hashing: %v", err)
+		}
+		return h
+	}
+	write("notes/go.mod", "module notes\n\nrequire example.com/lib v0.0.0\n\nreplace example.com/lib => ../lib\n")
+	write("lib/go.mod", "module example.com/lib\n")
+	write("lib/lib.go", "package lib")
+	first := hash()
+	if hash() != first {
+		t.Errorf("unchanged modules changed the hash")
+	}
+	write("lib/lib.go", "package lib // changed")
+	if hash() == first {
+		t.Errorf("changed replacement kept the hash")
+	}
+}
+
+func TestMetaDataHash(t *testing.T) {
+	var md MetaData
+	md.App.Version = "1.0.0"
+	md.Windows.Manifest = bytes.NewReader([]byte("<assembly/>"))
+	first, err := md.hash()
+	if err != nil {
+		t.Fatalf("hashing: %v", err)
+	}
+	if by, _ := ioutil.ReadAll(md.Windows.Manifest); string(by) != "<assembly/>" {
+		t.Errorf("manifest consumed by hashing, got %q", by)
+	}
+	if again, _ := md.hash(); again != first {
+		t.Errorf("hash not stable")
+	}
+	md.App.Version = "1.0.1"
+	if changed, _ := md.hash(); changed == first {
+		t.Errorf("changed metadata kept the hash")
+	}
+}
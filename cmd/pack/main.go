@@ -3,95 +3,183 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"io/ioutil"
 	"os"
-	"path/filepath"
+	"os/signal"
+	"strconv"
 	"strings"
+	"time"
 
 	"git.sr.ht/~jackmordaunt/gopack"
-	"github.com/akavel/rsrc/rsrc"
 )
 
 func main() {
-	// TODO
-	// - Accept dir to binaries, parse binary formats to figure what platform
-	// they are intended for.
-	// - Allow for zero config execution.
+	if len(os.Args) > 1 && os.Args[1] == "prune" {
+		if err := prune(os.Args[2:]); err != nil {
+			fmt.Printf("error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
 	if err := func() error {
 		var (
-			root    string
-			pkg     string
-			name    string
-			targets []gopack.Target
+			root   = "."
+			config gopack.Config
 		)
 		args, named := parse(os.Args[1:])
-		if len(args) <= 1 {
-			return fmt.Errorf("specify root of project")
+		if len(args) > 0 {
+			root = args[0]
+		}
+		path, err := gopack.FindConfig(root)
+		if err != nil {
+			return err
+		}
+		if path != "" {
+			fmt.Printf("config: %s\n", path)
+			if config, err = gopack.LoadConfig(path); err != nil {
+				return err
+			}
 		}
-		root = args[0]
+		// Arguments override the project file.
 		if len(args) > 1 {
-			pkg = args[1]
+			config.Package = args[1]
 		}
 		if len(args) > 2 {
-			name = args[2]
-		}
-		if name == "" {
-			name = pkg
+			config.Name = args[2]
 		}
 		if tlist, ok := named["targets"]; ok {
+			config.Targets = nil
 			for _, t := range strings.Split(tlist, ",") {
-				targets = append(targets, gopack.NewTarget(strings.TrimSpace(t)))
+				config.Targets = append(config.Targets, strings.TrimSpace(t))
+			}
+		}
+		if flist, ok := named["linux"]; ok {
+			config.Formats.Linux = nil
+			for _, f := range strings.Split(flist, ",") {
+				config.Formats.Linux = append(config.Formats.Linux, gopack.LinuxFormat(strings.TrimSpace(f)))
+			}
+		}
+		if dist, ok := named["dist"]; ok {
+			config.Dist = dist
+		}
+		failFast, err := boolean(named, "fail-fast")
+		if err != nil {
+			return err
+		}
+		sandbox, err := boolean(named, "sandbox")
+		if err != nil {
+			return err
+		}
+		noCache, err := boolean(named, "no-cache")
+		if err != nil {
+			return err
+		}
+		compileJobs, err := integer(named, "compile-jobs")
+		if err != nil {
+			return err
+		}
+		bundleJobs, err := integer(named, "bundle-jobs")
+		if err != nil {
+			return err
+		}
+		packer, err := config.Packer(root)
+		if err != nil {
+			return err
+		}
+		packer.FailFast = failFast
+		packer.Sandbox = sandbox
+		packer.CompileJobs = compileJobs
+		packer.BundleJobs = bundleJobs
+		// Prebuilt binaries, or directories of them, are bundled instead of
+		// compiling the project.
+		if blist, ok := named["binaries"]; ok {
+			var paths []string
+			for _, b := range strings.Split(blist, ",") {
+				paths = append(paths, strings.TrimSpace(b))
+			}
+			if packer.Artifacts, err = gopack.LoadArtifacts(paths...); err != nil {
+				return err
+			}
+			for _, a := range packer.Artifacts {
+				fmt.Printf("binary: %s\n", a.Target)
+			}
+		}
+		if !noCache {
+			if packer.Cache, err = gopack.DefaultCache(); err != nil {
+				return err
 			}
 		}
-		if len(targets) == 0 {
-			targets = gopack.DefaultTargets
-		}
-		packer := gopack.Packer{
-			Info: &gopack.ProjectInfo{
-				Root:    root,
-				Pkg:     pkg,
-				Name:    name,
-				Targets: targets,
-				Flags: map[gopack.Target]gopack.FlagSet{
-					gopack.NewTarget("windows/amd64"): {
-						Linker: []string{"-H windowsgui"},
-					},
-					gopack.NewTarget("windows/386"): {
-						Linker: []string{"-H windowsgui"},
-					},
-				},
-			},
-			PreCompile: func(root string, md gopack.MetaData, t gopack.Target) error {
-				// @Enhance editing PE binary data inline, without creating a .syso file could be
-				// more robust.
-				if t.Platform == gopack.Windows && md.Windows.ICO != nil {
-					var (
-						resource = filepath.Join(root, "rsrc.syso")
-						path     = filepath.Join(os.TempDir(), "gopack", "icon.ico")
-					)
-					buffer, err := ioutil.ReadAll(md.Windows.ICO)
-					if err != nil {
-						return fmt.Errorf("reading ico data: %w", err)
-					}
-					if err := ioutil.WriteFile(path, buffer, 0777); err != nil {
-						return fmt.Errorf("writing icon file to temporary location: %w", err)
-					}
-					if err := rsrc.Embed(resource, t.Architecture.String(), "", path); err != nil {
-						return fmt.Errorf("creating icon resource: %w", err)
-					}
-					return nil
-				}
-				return nil
-			},
-		}
-		if err := packer.Pack(); err != nil {
+		// Interrupting stops the builds and bundling, rather than leaving
+		// them half done.
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		if err := packer.PackContext(ctx); err != nil {
 			return err
 		}
 		return nil
 	}(); err != nil {
-		fmt.Printf("error: %v", err)
+		fmt.Printf("error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// prune removes cache entries unused for longer than "-age", a duration that
+// defaults to 30 days. An age of zero empties the cache.
+func prune(args []string) error {
+	_, named := parse(args)
+	age := 30 * 24 * time.Hour
+	if v, ok := named["age"]; ok {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("age: %w", err)
+		}
+		age = d
+	}
+	cache, err := gopack.DefaultCache()
+	if err != nil {
+		return err
+	}
+	n, err := cache.Prune(age)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("pruned %d entries from %s\n", n, cache.Dir)
+	return nil
+}
+
+// switches are named arguments that take no value, unless given one with
+// "=", eg "-fail-fast" or "-fail-fast=false".
+var switches = map[string]bool{
+	"fail-fast": true,
+	"sandbox":   true,
+	"no-cache":  true,
+}
+
+// boolean parses the named switch, false if absent.
+func boolean(named map[string]string, name string) (bool, error) {
+	v, ok := named[name]
+	if !ok {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", name, err)
+	}
+	return b, nil
+}
+
+// integer parses the named argument, 0 if absent.
+func integer(named map[string]string, name string) (int, error) {
+	v, ok := named[name]
+	if !ok {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", name, err)
 	}
+	return n, nil
 }
 
 // parse produces a list of positional and named arguments.
@@ -105,10 +193,12 @@ func parse(args []string) ([]string, map[string]string) {
 		arg := args[ii]
 		if isNamed := strings.HasPrefix(arg, "-"); isNamed {
 			// either it's combined via = or whitespace
-			if parts := strings.Split(arg, "="); len(parts) > 2 {
+			if parts := strings.SplitN(arg, "=", 2); len(parts) == 2 {
 				named[strings.Trim(parts[0], "-")] = parts[1]
+			} else if name := strings.Trim(arg, "-"); switches[name] || ii+1 == len(args) {
+				named[name] = "true"
 			} else {
-				named[strings.Trim(arg, "-")] = args[ii+1]
+				named[name] = args[ii+1]
 				ii++
 			}
 		} else {
@@ -0,0 +1,354 @@
+package gopack
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"git.sr.ht/~jackmordaunt/gopack/internal/toml"
+	"git.sr.ht/~jackmordaunt/gopack/internal/util"
+)
+
+// ConfigFiles lists the names of project files, in order of preference.
+var ConfigFiles = []string{"gopack.toml", "gopack.json"}
+
+// Config is the project file, found at the root of a project, declaring how
+// to pack it so that no flags are needed.
+//
+// A gopack.toml might look like:
+//
+//	name = "notes"
+//	package = "cmd/notes"
+//	targets = ["windows/amd64", "darwin/amd64", "linux/amd64"]
+//
+//	[flags.windows]
+//	linker = ["-H windowsgui", "-s -w"]
+//
+//	[app]
+//	name = "Notes"
+//	id = "com.example.Notes"
+//	version = "1.0.0"
+//
+//	[icons]
+//	png = "assets/icon.png"
+//
+//	[darwin]
+//	certificate = "certs/developer-id.p12"
+//
+//	[darwin.entitlements]
+//	hardened_runtime = true
+//	camera = true
+//
+//	[darwin.dmg]
+//	background = "assets/dmg.png"
+//	icon_size = 96
+//
+//	[windows]
+//	certificate = "certs/code-signing.pfx"
+//	timestamp_url = "http://timestamp.digicert.com"
+//
+//	[linux]
+//	depends = ["libwayland-client0", "libxkbcommon0"]
+//
+//	[linux.snap]
+//	grade = "devel"
+//
+//	[formats]
+//	linux = ["tarball", "deb"]
+//
+// gopack.json has the same structure.
+type Config struct {
+	// Name of the executable and bundles.
+	// Defaults to the name of the package directory.
+	Name string `json:"name"`
+	// Package to build, relative to the root.
+	// Defaults to the root.
+	Package string `json:"package"`
+	// Dist is the output directory, relative to the root.
+	// Defaults to "dist".
+	Dist string `json:"dist"`
+	// Targets to build for, as "platform/arch".
+	// Defaults to DefaultTargets.
+	Targets []string `json:"targets"`
+	// Flags for the compiler and linker, keyed by either "platform/arch" or
+	// "platform" to apply to every architecture. Flags for a specific target
+	// replace those for its platform.
+	// Windows defaults to linking a GUI application, "-H windowsgui".
+	Flags map[string]FlagSet `json:"flags"`
+	// App describes the application.
+	App App `json:"app"`
+	// Icons are paths, relative to the root, to icon files. Formats that
+	// aren't supplied are converted from the png.
+	Icons struct {
+		PNG  string `json:"png"`
+		ICNS string `json:"icns"`
+		ICO  string `json:"ico"`
+	} `json:"icons"`
+	// Darwin configures the macOS bundle.
+	Darwin struct {
+		// Certificate is a path, relative to the root, to the identity that
+		// signs the application: a .p12 file, or a PEM file holding the
+		// certificate and key. The password of a .p12 is read from the
+		// GOPACK_CERTIFICATE_PASSWORD environment variable. Without one the
+		// signature is ad-hoc.
+		Certificate string `json:"certificate"`
+		// Entitlements granted to the application, as the
+		// [darwin.entitlements] table.
+		Entitlements Entitlements `json:"entitlements"`
+		// DMG configures the Finder window of the disk image, as DMGLayout.
+		// Sizes and positions are [x, y] points.
+		DMG struct {
+			// Background is a path, relative to the root, to a png.
+			// Defaults to "background.png" found in the project.
+			Background   string `json:"background"`
+			Window       [2]int `json:"window"`
+			IconSize     int    `json:"icon_size"`
+			App          [2]int `json:"app"`
+			Applications [2]int `json:"applications"`
+		} `json:"dmg"`
+	} `json:"darwin"`
+	// Windows configures the generated manifest and signature.
+	Windows struct {
+		// ExecutionLevel requested of UAC. Defaults to "asInvoker".
+		ExecutionLevel string `json:"execution_level"`
+		// Certificate is a path, relative to the root, to the identity that
+		// signs the executable, as for Darwin: a .pfx file, or a PEM file.
+		Certificate string `json:"certificate"`
+		// TimestampURL of an RFC 3161 timestamp authority, eg
+		// "http://timestamp.digicert.com".
+		TimestampURL string `json:"timestamp_url"`
+	} `json:"windows"`
+	// Linux configures the Linux packages, as MetaData.Linux.
+	Linux struct {
+		// Depends lists the Debian packages required at runtime.
+		Depends []string `json:"depends"`
+		// Requires lists the RPM capabilities required at runtime.
+		Requires []string `json:"requires"`
+		// NoInstallScript omits the install.sh script from tarballs.
+		NoInstallScript bool `json:"no_install_script"`
+		// Flatpak configures the flatpak-builder manifest.
+		Flatpak struct {
+			Runtime        string   `json:"runtime"`
+			RuntimeVersion string   `json:"runtime_version"`
+			SDK            string   `json:"sdk"`
+			FinishArgs     []string `json:"finish_args"`
+			FromSource     bool     `json:"from_source"`
+		} `json:"flatpak"`
+		// Snap configures the snap.
+		Snap struct {
+			Name        string   `json:"name"`
+			Base        string   `json:"base"`
+			Grade       string   `json:"grade"`
+			Confinement string   `json:"confinement"`
+			Plugs       []string `json:"plugs"`
+		} `json:"snap"`
+	} `json:"linux"`
+	// Formats selects the bundles to produce.
+	Formats struct {
+		// Linux formats. Defaults to LinuxFormats.
+		Linux []LinuxFormat `json:"linux"`
+	} `json:"formats"`
+}
+
+// FindConfig returns the path to the project file in root, or an empty string
+// if there is none.
+func FindConfig(root string) (string, error) {
+	for _, name := range ConfigFiles {
+		path := filepath.Join(root, name)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		} else if !os.IsNotExist(err) {
+			return "", fmt.Errorf("finding %s: %w", name, err)
+		}
+	}
+	return "", nil
+}
+
+// LoadConfig reads the project file at path, decoded according to its
+// extension.
+func LoadConfig(path string) (Config, error) {
+	var c Config
+	by, err := ioutil.ReadFile(path)
+	if err != nil {
+		return c, fmt.Errorf("reading %s: %w", path, err)
+	}
+	switch ext := filepath.Ext(path); ext {
+	case ".json":
+	case ".toml":
+		// TOML is decoded generically, then routed through JSON so that both
+		// formats share the struct tags.
+		doc, err := toml.Unmarshal(by)
+		if err != nil {
+			return c, fmt.Errorf("parsing %s: %w", path, err)
+		}
+		if by, err = json.Marshal(doc); err != nil {
+			return c, fmt.Errorf("parsing %s: %w", path, err)
+		}
+	default:
+		return c, fmt.Errorf("%s: unsupported config format %q", path, ext)
+	}
+	d := json.NewDecoder(bytes.NewReader(by))
+	d.DisallowUnknownFields()
+	if err := d.Decode(&c); err != nil {
+		return c, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return c, nil
+}
+
+// Packer creates a Packer for the project at root as described by the
+// config.
+func (c Config) Packer(root string) (Packer, error) {
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return Packer{}, fmt.Errorf("resolving root: %w", err)
+	}
+	info := &ProjectInfo{
+		Root:  root,
+		Pkg:   c.Package,
+		Name:  c.Name,
+		Dist:  c.Dist,
+		Flags: Flags{},
+	}
+	if info.Name == "" {
+		info.Name = filepath.Base(filepath.Join(abs, c.Package))
+	}
+	for _, s := range c.Targets {
+		t, err := parseTarget(s)
+		if err != nil {
+			return Packer{}, err
+		}
+		info.Targets = append(info.Targets, t)
+	}
+	if len(info.Targets) == 0 {
+		info.Targets = DefaultTargets
+	}
+	for _, t := range info.Targets {
+		flags, ok := c.Flags[fmt.Sprintf("%s/%s", t.Platform, t.Architecture)]
+		if !ok {
+			flags, ok = c.Flags[t.Platform.String()]
+		}
+		if !ok && t.Platform == Windows {
+			flags = FlagSet{Linker: []string{"-H windowsgui"}}
+		}
+		info.Flags[t] = flags
+	}
+	for key := range c.Flags {
+		if !strings.Contains(key, "/") {
+			var p Platform
+			if p.FromStr(key).String() != key {
+				return Packer{}, fmt.Errorf("flags: unknown platform %q", key)
+			}
+		} else if _, err := parseTarget(key); err != nil {
+			return Packer{}, fmt.Errorf("flags: %w", err)
+		}
+	}
+	md := MetaData{App: c.App}
+	md.Windows.ExecutionLevel = c.Windows.ExecutionLevel
+	md.Windows.TimestampURL = c.Windows.TimestampURL
+	if err := c.Darwin.Entitlements.Validate(); err != nil {
+		return Packer{}, err
+	}
+	md.Darwin.Entitlements = c.Darwin.Entitlements
+	dmg := c.Darwin.DMG
+	md.Darwin.DMG = DMGLayout{
+		Window:       image.Pt(dmg.Window[0], dmg.Window[1]),
+		IconSize:     dmg.IconSize,
+		App:          image.Pt(dmg.App[0], dmg.App[1]),
+		Applications: image.Pt(dmg.Applications[0], dmg.Applications[1]),
+	}
+	linux := c.Linux
+	md.Linux.Package.Depends = linux.Depends
+	md.Linux.Package.Requires = linux.Requires
+	md.Linux.NoInstallScript = linux.NoInstallScript
+	md.Linux.Flatpak.Runtime = linux.Flatpak.Runtime
+	md.Linux.Flatpak.RuntimeVersion = linux.Flatpak.RuntimeVersion
+	md.Linux.Flatpak.SDK = linux.Flatpak.SDK
+	md.Linux.Flatpak.FinishArgs = linux.Flatpak.FinishArgs
+	md.Linux.Flatpak.FromSource = linux.Flatpak.FromSource
+	md.Linux.Snap.Name = linux.Snap.Name
+	md.Linux.Snap.Base = linux.Snap.Base
+	md.Linux.Snap.Grade = linux.Snap.Grade
+	md.Linux.Snap.Confinement = linux.Snap.Confinement
+	md.Linux.Snap.Plugs = linux.Snap.Plugs
+	read := func(path string) ([]byte, error) {
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(root, path)
+		}
+		return ioutil.ReadFile(path)
+	}
+	if dmg.Background != "" {
+		by, err := read(dmg.Background)
+		if err != nil {
+			return Packer{}, fmt.Errorf("reading dmg background: %w", err)
+		}
+		if md.Darwin.DMG.Background, err = png.Decode(bytes.NewReader(by)); err != nil {
+			return Packer{}, fmt.Errorf("decoding dmg background: %w", err)
+		}
+	}
+	if c.Icons.PNG != "" {
+		by, err := read(c.Icons.PNG)
+		if err != nil {
+			return Packer{}, fmt.Errorf("reading icon: %w", err)
+		}
+		if md.Icon, err = png.Decode(bytes.NewReader(by)); err != nil {
+			return Packer{}, fmt.Errorf("decoding icon: %w", err)
+		}
+	}
+	if c.Icons.ICNS != "" {
+		by, err := read(c.Icons.ICNS)
+		if err != nil {
+			return Packer{}, fmt.Errorf("reading icns: %w", err)
+		}
+		md.Darwin.ICNS = util.NewCopyBuffer(by)
+	}
+	if c.Icons.ICO != "" {
+		by, err := read(c.Icons.ICO)
+		if err != nil {
+			return Packer{}, fmt.Errorf("reading ico: %w", err)
+		}
+		md.Windows.ICO = util.NewCopyBuffer(by)
+	}
+	identity := func(path string) (*Identity, error) {
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(root, path)
+		}
+		return LoadIdentity(path, os.Getenv("GOPACK_CERTIFICATE_PASSWORD"))
+	}
+	if c.Darwin.Certificate != "" {
+		if md.Darwin.Identity, err = identity(c.Darwin.Certificate); err != nil {
+			return Packer{}, fmt.Errorf("loading certificate: %w", err)
+		}
+	}
+	if c.Windows.Certificate != "" {
+		if md.Windows.Identity, err = identity(c.Windows.Certificate); err != nil {
+			return Packer{}, fmt.Errorf("loading certificate: %w", err)
+		}
+	}
+	return Packer{
+		Info:     info,
+		MetaData: md,
+		Linux:    c.Formats.Linux,
+	}, nil
+}
+
+// parseTarget parses "platform/arch", rejecting unknown values.
+func parseTarget(s string) (Target, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) != 2 {
+		return Target{}, fmt.Errorf("target %q: expected platform/arch", s)
+	}
+	t := NewTarget(s)
+	if t.Platform.String() != parts[0] || t.Architecture.String() != parts[1] {
+		return Target{}, fmt.Errorf("target %q: unknown platform or architecture", s)
+	}
+	if t.Architecture == Universal {
+		return Target{}, fmt.Errorf("target %q: merged from darwin/amd64 and darwin/arm64, list those instead", s)
+	}
+	return t, nil
+}
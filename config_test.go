@@ -0,0 +1,171 @@
+package gopack
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestConfig(t *testing.T) {
+	for name, doc := range map[string]string{
+		"gopack.toml": `
+name = "notes"
+package = "cmd/notes"
+targets = ["windows/amd64", "darwin/amd64", "linux/amd64"]
+
+[flags.linux]
+linker = ["-s -w"]
+
+[flags."linux/amd64"]
+compiler = ["-N"]
+
+[app]
+name = "Notes"
+version = "1.0.0"
+
+[formats]
+linux = ["deb"]
+`,
+		"gopack.json": `{
+	"name": "notes",
+	"package": "cmd/notes",
+	"targets": ["windows/amd64", "darwin/amd64", "linux/amd64"],
+	"flags": {
+		"linux": {"linker": ["-s -w"]},
+		"linux/amd64": {"compiler": ["-N"]}
+	},
+	"app": {"name": "Notes", "version": "1.0.0"},
+	"formats": {"linux": ["deb"]}
+}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			root := t.TempDir()
+			if err := ioutil.WriteFile(filepath.Join(root, name), []byte(doc), 0644); err != nil {
+				t.Fatal(err)
+			}
+			path, err := FindConfig(root)
+			if err != nil {
+				t.Fatalf("finding config: %v", err)
+			}
+			if filepath.Base(path) != name {
+				t.Fatalf("found %q, want %q", path, name)
+			}
+			c, err := LoadConfig(path)
+			if err != nil {
+				t.Fatalf("loading config: %v", err)
+			}
+			p, err := c.Packer(root)
+			if err != nil {
+				t.Fatalf("creating packer: %v", err)
+			}
+			if p.Info.Name != "notes" || p.Info.Pkg != "cmd/notes" {
+				t.Errorf("got name %q, package %q", p.Info.Name, p.Info.Pkg)
+			}
+			if len(p.Info.Targets) != 3 {
+				t.Errorf("got targets %v", p.Info.Targets)
+			}
+			flags := map[Target]FlagSet{
+				NewTarget("windows/amd64"): {Linker: []string{"-H windowsgui"}},
+				NewTarget("darwin/amd64"):  {},
+				NewTarget("linux/amd64"):   {Compiler: []string{"-N"}},
+			}
+			if !reflect.DeepEqual(map[Target]FlagSet(p.Info.Flags), flags) {
+				t.Errorf("got flags %v, want %v", p.Info.Flags, flags)
+			}
+			if p.MetaData.App.Name != "Notes" || p.MetaData.App.Version != "1.0.0" {
+				t.Errorf("got app %+v", p.MetaData.App)
+			}
+			if !reflect.DeepEqual(p.Linux, []LinuxFormat{Deb}) {
+				t.Errorf("got linux formats %v", p.Linux)
+			}
+		})
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	for _, c := range []Config{
+		{Targets: []string{"plan9/amd64"}},
+		{Targets: []string{"windows"}},
+		{Flags: map[string]FlagSet{"beos": {}}},
+	} {
+		if _, err := c.Packer(t.TempDir()); err == nil {
+			t.Errorf("%+v: expected error", c)
+		}
+	}
+	var c Config
+	c.Darwin.Entitlements.Extra = map[string]interface{}{"com.example.unknown": true}
+	if _, err := c.Packer(t.TempDir()); err == nil {
+		t.Errorf("unknown entitlement: expected error")
+	}
+	root := t.TempDir()
+	path := filepath.Join(root, "gopack.toml")
+	if err := ioutil.WriteFile(path, []byte(`unknown = 1`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadConfig(path); err == nil {
+		t.Errorf("unknown key: expected error")
+	}
+}
+
+// TestConfigPackages ensures the Linux package and disk image settings reach
+// the metadata.
+func TestConfigPackages(t *testing.T) {
+	root := t.TempDir()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 320, 200))); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "dmg.png"), buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(root, "gopack.toml")
+	if err := ioutil.WriteFile(path, []byte(`
+[darwin.dmg]
+background = "dmg.png"
+icon_size = 96
+app = [80, 100]
+
+[linux]
+depends = ["libwayland-client0"]
+no_install_script = true
+
+[linux.flatpak]
+from_source = true
+finish_args = ["--share=network"]
+
+[linux.snap]
+grade = "devel"
+plugs = ["wayland"]
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("loading config: %v", err)
+	}
+	p, err := c.Packer(root)
+	if err != nil {
+		t.Fatalf("creating packer: %v", err)
+	}
+	dmg := p.MetaData.Darwin.DMG
+	if dmg.Background == nil || dmg.Background.Bounds().Dx() != 320 {
+		t.Errorf("dmg background not loaded")
+	}
+	if dmg.IconSize != 96 || dmg.App != image.Pt(80, 100) || dmg.Window != (image.Point{}) {
+		t.Errorf("got dmg layout %+v", dmg)
+	}
+	linux := p.MetaData.Linux
+	if !reflect.DeepEqual(linux.Package.Depends, []string{"libwayland-client0"}) || !linux.NoInstallScript {
+		t.Errorf("got depends %v, no install script %t", linux.Package.Depends, linux.NoInstallScript)
+	}
+	if !linux.Flatpak.FromSource || !reflect.DeepEqual(linux.Flatpak.FinishArgs, []string{"--share=network"}) {
+		t.Errorf("got flatpak %+v", linux.Flatpak)
+	}
+	if linux.Snap.Grade != "devel" || !reflect.DeepEqual(linux.Snap.Plugs, []string{"wayland"}) {
+		t.Errorf("got snap %+v", linux.Snap)
+	}
+}
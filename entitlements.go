@@ -0,0 +1,245 @@
+package gopack
+
+import (
+	"encoding/asn1"
+	"fmt"
+	"sort"
+	"strings"
+
+	"git.sr.ht/~jackmordaunt/gopack/internal/plist"
+)
+
+// Entitlements grant a macOS application capabilities, and are embedded in
+// the code signature of its executable. Under the App Sandbox or the hardened
+// runtime, required for notarization, capabilities not entitled are denied.
+type Entitlements struct {
+	// Sandbox confines the application to the App Sandbox, as the Mac App
+	// Store requires.
+	Sandbox bool `json:"sandbox"`
+	// HardenedRuntime opts the executable into the hardened runtime, which
+	// notarization requires.
+	HardenedRuntime bool `json:"hardened_runtime"`
+	// Camera grants access to the camera.
+	Camera bool `json:"camera"`
+	// Microphone grants access to audio input.
+	Microphone bool `json:"microphone"`
+	// NetworkClient allows outgoing connections from the sandbox.
+	NetworkClient bool `json:"network_client"`
+	// NetworkServer allows incoming connections to the sandbox.
+	NetworkServer bool `json:"network_server"`
+	// JIT allows memory mapped with MAP_JIT to be made executable under the
+	// hardened runtime.
+	JIT bool `json:"jit"`
+	// UnsignedExecutableMemory allows any writable memory to be made
+	// executable under the hardened runtime.
+	UnsignedExecutableMemory bool `json:"unsigned_executable_memory"`
+	// DisableLibraryValidation allows loading libraries signed by other
+	// teams under the hardened runtime, eg plugins.
+	DisableLibraryValidation bool `json:"disable_library_validation"`
+	// Extra holds any other entitlements by key, eg
+	// "com.apple.security.files.user-selected.read-write". Keys must be
+	// known Apple entitlements, and take precedence over the fields above.
+	Extra map[string]interface{} `json:"extra"`
+}
+
+// knownEntitlements maps the keys of the entitlements Apple documents for
+// macOS applications to the kind of value they take.
+var knownEntitlements = map[string]string{
+	"com.apple.application-identifier":                                     "string",
+	"com.apple.developer.team-identifier":                                  "string",
+	"com.apple.developer.aps-environment":                                  "string",
+	"com.apple.developer.associated-domains":                               "array",
+	"com.apple.developer.icloud-container-identifiers":                     "array",
+	"com.apple.developer.icloud-services":                                  "array",
+	"com.apple.developer.ubiquity-kvstore-identifier":                      "string",
+	"com.apple.security.app-sandbox":                                       "bool",
+	"com.apple.security.application-groups":                                "array",
+	"com.apple.security.assets.movies.read-only":                           "bool",
+	"com.apple.security.assets.movies.read-write":                          "bool",
+	"com.apple.security.assets.music.read-only":                            "bool",
+	"com.apple.security.assets.music.read-write":                           "bool",
+	"com.apple.security.assets.pictures.read-only":                         "bool",
+	"com.apple.security.assets.pictures.read-write":                        "bool",
+	"com.apple.security.automation.apple-events":                           "bool",
+	"com.apple.security.cs.allow-dyld-environment-variables":               "bool",
+	"com.apple.security.cs.allow-jit":                                      "bool",
+	"com.apple.security.cs.allow-unsigned-executable-memory":               "bool",
+	"com.apple.security.cs.debugger":                                       "bool",
+	"com.apple.security.cs.disable-executable-page-protection":             "bool",
+	"com.apple.security.cs.disable-library-validation":                     "bool",
+	"com.apple.security.device.audio-input":                                "bool",
+	"com.apple.security.device.bluetooth":                                  "bool",
+	"com.apple.security.device.camera":                                     "bool",
+	"com.apple.security.device.microphone":                                 "bool",
+	"com.apple.security.device.serial":                                     "bool",
+	"com.apple.security.device.usb":                                        "bool",
+	"com.apple.security.files.bookmarks.app-scope":                         "bool",
+	"com.apple.security.files.bookmarks.document-scope":                    "bool",
+	"com.apple.security.files.downloads.read-only":                         "bool",
+	"com.apple.security.files.downloads.read-write":                        "bool",
+	"com.apple.security.files.user-selected.executable":                    "bool",
+	"com.apple.security.files.user-selected.read-only":                     "bool",
+	"com.apple.security.files.user-selected.read-write":                    "bool",
+	"com.apple.security.get-task-allow":                                    "bool",
+	"com.apple.security.inherit":                                           "bool",
+	"com.apple.security.network.client":                                    "bool",
+	"com.apple.security.network.server":                                    "bool",
+	"com.apple.security.personal-information.addressbook":                  "bool",
+	"com.apple.security.personal-information.calendars":                    "bool",
+	"com.apple.security.personal-information.location":                     "bool",
+	"com.apple.security.personal-information.photos-library":               "bool",
+	"com.apple.security.print":                                             "bool",
+	"com.apple.security.scripting-targets":                                 "dict",
+	"com.apple.security.temporary-exception.apple-events":                  "array",
+	"com.apple.security.temporary-exception.files.absolute-path.read-only": "array",
+	"keychain-access-groups":                                               "array",
+}
+
+// Validate reports unknown entitlements, values of the wrong kind, and
+// runtime exceptions without the hardened runtime they relax.
+func (e Entitlements) Validate() error {
+	var keys []string
+	for k := range e.Extra {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		kind, ok := knownEntitlements[k]
+		if !ok {
+			return fmt.Errorf("entitlements: unknown entitlement %q", k)
+		}
+		var got string
+		switch e.Extra[k].(type) {
+		case bool:
+			got = "bool"
+		case string:
+			got = "string"
+		case []interface{}, []string:
+			got = "array"
+		case map[string]interface{}:
+			got = "dict"
+		}
+		if got != kind {
+			return fmt.Errorf("entitlements: %s: expected %s, got %T", k, kind, e.Extra[k])
+		}
+		if strings.HasPrefix(k, "com.apple.security.cs.") && !e.HardenedRuntime {
+			return fmt.Errorf("entitlements: %s requires the hardened runtime", k)
+		}
+	}
+	if (e.JIT || e.UnsignedExecutableMemory || e.DisableLibraryValidation) && !e.HardenedRuntime {
+		return fmt.Errorf("entitlements: runtime exceptions require the hardened runtime")
+	}
+	return nil
+}
+
+// dict returns the entitlements keyed as in a plist, which is empty if none
+// are granted.
+func (e Entitlements) dict() (map[string]interface{}, error) {
+	if err := e.Validate(); err != nil {
+		return nil, err
+	}
+	dict := map[string]interface{}{}
+	for key, granted := range map[string]bool{
+		"com.apple.security.app-sandbox":                         e.Sandbox,
+		"com.apple.security.device.camera":                       e.Camera,
+		"com.apple.security.device.audio-input":                  e.Microphone,
+		"com.apple.security.device.microphone":                   e.Microphone && e.Sandbox,
+		"com.apple.security.network.client":                      e.NetworkClient,
+		"com.apple.security.network.server":                      e.NetworkServer,
+		"com.apple.security.cs.allow-jit":                        e.JIT,
+		"com.apple.security.cs.allow-unsigned-executable-memory": e.UnsignedExecutableMemory,
+		"com.apple.security.cs.disable-library-validation":       e.DisableLibraryValidation,
+	} {
+		if granted {
+			dict[key] = true
+		}
+	}
+	for k, v := range e.Extra {
+		if list, ok := v.([]string); ok {
+			var items []interface{}
+			for _, item := range list {
+				items = append(items, item)
+			}
+			v = items
+		}
+		dict[k] = v
+	}
+	return dict, nil
+}
+
+// Plist generates the entitlements plist, or nil if none are granted.
+func (e Entitlements) Plist() ([]byte, error) {
+	dict, err := e.dict()
+	if err != nil || len(dict) == 0 {
+		return nil, err
+	}
+	return plist.Marshal(dict)
+}
+
+// derEntitlements encodes entitlements in the DER form embedded in code
+// signatures: a version and the dict, whose entries are sorted by key.
+func derEntitlements(dict map[string]interface{}) ([]byte, error) {
+	value, err := derValue(dict)
+	if err != nil {
+		return nil, err
+	}
+	version, err := asn1.Marshal(1)
+	if err != nil {
+		return nil, err
+	}
+	inner, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 16, IsCompound: true, Bytes: value})
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(asn1.RawValue{Class: asn1.ClassApplication, Tag: 16, IsCompound: true, Bytes: append(version, inner...)})
+}
+
+// derValue encodes a plist value: dicts as sets of key value sequences,
+// arrays as sequences.
+func derValue(v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case bool, int, int64:
+		return asn1.Marshal(v)
+	case float64:
+		if v != float64(int64(v)) {
+			return nil, fmt.Errorf("unsupported entitlement value %v", v)
+		}
+		return asn1.Marshal(int64(v))
+	case string:
+		return asn1.MarshalWithParams(v, "utf8")
+	case []interface{}:
+		var content []byte
+		for _, item := range v {
+			der, err := derValue(item)
+			if err != nil {
+				return nil, err
+			}
+			content = append(content, der...)
+		}
+		return asn1.Marshal(asn1.RawValue{Tag: asn1.TagSequence, IsCompound: true, Bytes: content})
+	case map[string]interface{}:
+		var keys []string
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		var content []byte
+		for _, k := range keys {
+			key, err := asn1.MarshalWithParams(k, "utf8")
+			if err != nil {
+				return nil, err
+			}
+			value, err := derValue(v[k])
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", k, err)
+			}
+			entry, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagSequence, IsCompound: true, Bytes: append(key, value...)})
+			if err != nil {
+				return nil, err
+			}
+			content = append(content, entry...)
+		}
+		return asn1.Marshal(asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: content})
+	}
+	return nil, fmt.Errorf("unsupported entitlement value %T", v)
+}
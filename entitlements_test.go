@@ -0,0 +1,76 @@
+package gopack
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"git.sr.ht/~jackmordaunt/gopack/internal/plist"
+)
+
+func TestEntitlements(t *testing.T) {
+	e := Entitlements{
+		Sandbox:         true,
+		HardenedRuntime: true,
+		Microphone:      true,
+		JIT:             true,
+		Extra: map[string]interface{}{
+			"com.apple.security.files.user-selected.read-write": true,
+			"com.apple.security.application-groups":             []interface{}{"TEAM.notes"},
+		},
+	}
+	by, err := e.Plist()
+	if err != nil {
+		t.Fatalf("generating: %v", err)
+	}
+	v, err := plist.Unmarshal(by)
+	if err != nil {
+		t.Fatalf("parsing: %v", err)
+	}
+	want := map[string]interface{}{
+		"com.apple.security.app-sandbox":                    true,
+		"com.apple.security.device.audio-input":             true,
+		"com.apple.security.device.microphone":              true,
+		"com.apple.security.cs.allow-jit":                   true,
+		"com.apple.security.files.user-selected.read-write": true,
+		"com.apple.security.application-groups":             []interface{}{"TEAM.notes"},
+	}
+	if !reflect.DeepEqual(v, want) {
+		t.Errorf("got %v, want %v", v, want)
+	}
+	if by, err := (Entitlements{}).Plist(); err != nil || by != nil {
+		t.Errorf("got %q, %v, want no plist", by, err)
+	}
+	for name, e := range map[string]Entitlements{
+		"unknown":    {Extra: map[string]interface{}{"com.apple.security.teleport": true}},
+		"wrong kind": {Extra: map[string]interface{}{"com.apple.security.network.client": "yes"}},
+		"jit":        {JIT: true},
+		"extra jit":  {Extra: map[string]interface{}{"com.apple.security.cs.allow-jit": true}},
+	} {
+		if err := e.Validate(); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestDEREntitlements(t *testing.T) {
+	der, err := derEntitlements(map[string]interface{}{
+		"com.apple.security.app-sandbox": true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{
+		0x70, 0x2c, // application 16
+		0x02, 0x01, 0x01, // version
+		0xb0, 0x27, // context 16
+		0x31, 0x25, // dict
+		0x30, 0x23, // entry
+		0x0c, 0x1e,
+	}
+	want = append(want, "com.apple.security.app-sandbox"...)
+	want = append(want, 0x01, 0x01, 0xff)
+	if !bytes.Equal(der, want) {
+		t.Errorf("got % x, want % x", der, want)
+	}
+}
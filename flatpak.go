@@ -0,0 +1,209 @@
+package gopack
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Flatpak defaults, targeting the freedesktop runtime which is sufficient for
+// Gio programs.
+const (
+	flatpakRuntime        = "org.freedesktop.Platform"
+	flatpakRuntimeVersion = "24.08"
+	flatpakSDK            = "org.freedesktop.Sdk"
+	flatpakGoExtension    = "org.freedesktop.Sdk.Extension.golang"
+)
+
+// flatpakFinishArgs grants the sandbox access to the display servers and GPU,
+// which Gio requires to render.
+var flatpakFinishArgs = []string{
+	"--share=ipc",
+	"--socket=fallback-x11",
+	"--socket=wayland",
+	"--device=dri",
+}
+
+// flatpakManifest is the subset of the flatpak-builder manifest we generate.
+// See flatpak-manifest(5).
+type flatpakManifest struct {
+	AppID          string          `json:"app-id"`
+	Runtime        string          `json:"runtime"`
+	RuntimeVersion string          `json:"runtime-version"`
+	SDK            string          `json:"sdk"`
+	SDKExtensions  []string        `json:"sdk-extensions,omitempty"`
+	Command        string          `json:"command"`
+	FinishArgs     []string        `json:"finish-args"`
+	Modules        []flatpakModule `json:"modules"`
+}
+
+type flatpakModule struct {
+	Name          string          `json:"name"`
+	BuildSystem   string          `json:"buildsystem"`
+	BuildOptions  *flatpakOptions `json:"build-options,omitempty"`
+	BuildCommands []string        `json:"build-commands"`
+	Sources       []flatpakSource `json:"sources"`
+}
+
+type flatpakOptions struct {
+	AppendPath string            `json:"append-path,omitempty"`
+	Env        map[string]string `json:"env,omitempty"`
+}
+
+type flatpakSource struct {
+	Type       string   `json:"type"`
+	Path       string   `json:"path"`
+	Dest       string   `json:"dest,omitempty"`
+	Skip       []string `json:"skip,omitempty"`
+	OnlyArches []string `json:"only-arches,omitempty"`
+}
+
+// bundleFlatpak writes a flatpak-builder manifest named "<app-id>.json" into
+// dir, along with the files it installs.
+//
+// By default the manifest installs the prebuilt binary. If the project opts to
+// build from source, the module compiles the package at root with the Go SDK
+// extension instead, as required for Flathub submissions. The output
+// directory, dist, is left out of the sources.
+func bundleFlatpak(
+	dir, name, root, pkg, dist string,
+	arch Architecture,
+	binary io.Reader,
+	md MetaData,
+) error {
+	id := md.Linux.AppID
+	if id == "" {
+		return fmt.Errorf("flatpak requires an AppID")
+	}
+	tree, err := md.FreeDesktop(name)
+	if err != nil {
+		return err
+	}
+	opts := md.Linux.Flatpak
+	if opts.Runtime == "" {
+		opts.Runtime = flatpakRuntime
+	}
+	if opts.RuntimeVersion == "" {
+		opts.RuntimeVersion = flatpakRuntimeVersion
+	}
+	if opts.SDK == "" {
+		opts.SDK = flatpakSDK
+	}
+	if len(opts.FinishArgs) == 0 {
+		opts.FinishArgs = flatpakFinishArgs
+	}
+	module := flatpakModule{
+		Name:        name,
+		BuildSystem: "simple",
+		Sources: []flatpakSource{
+			{Type: "dir", Path: "share", Dest: "share"},
+		},
+	}
+	manifest := flatpakManifest{
+		AppID:          id,
+		Runtime:        opts.Runtime,
+		RuntimeVersion: opts.RuntimeVersion,
+		SDK:            opts.SDK,
+		Command:        name,
+		FinishArgs:     opts.FinishArgs,
+	}
+	if opts.FromSource {
+		src, err := filepath.Rel(dir, root)
+		if err != nil {
+			return fmt.Errorf("resolving project root: %w", err)
+		}
+		if filepath.IsAbs(pkg) {
+			if pkg, err = filepath.Rel(root, pkg); err != nil {
+				return fmt.Errorf("resolving package: %w", err)
+			}
+		}
+		skip := []string{".git"}
+		out, err := filepath.Rel(root, dist)
+		if err == nil && out != "." && out != ".." && !strings.HasPrefix(out, ".."+string(filepath.Separator)) {
+			skip = append(skip, filepath.ToSlash(out))
+		}
+		manifest.SDKExtensions = []string{flatpakGoExtension}
+		module.BuildOptions = &flatpakOptions{
+			AppendPath: "/usr/lib/sdk/golang/bin",
+			// Flathub builds are offline, so dependencies must be vendored.
+			Env: map[string]string{"GOFLAGS": "-mod=vendor", "CGO_ENABLED": "1"},
+		}
+		module.BuildCommands = append(module.BuildCommands, fmt.Sprintf(
+			"cd src && go build -o /app/bin/%s ./%s",
+			name,
+			path.Clean(filepath.ToSlash(pkg)),
+		))
+		module.Sources = append(module.Sources, flatpakSource{
+			Type: "dir",
+			Path: filepath.ToSlash(src),
+			Dest: "src",
+			Skip: skip,
+		})
+	} else {
+		bin, err := ioutil.ReadAll(binary)
+		if err != nil {
+			return fmt.Errorf("buffering binary: %w", err)
+		}
+		tree = append(tree, File{Path: name, Mode: 0755, Data: bin})
+		module.BuildCommands = append(module.BuildCommands, fmt.Sprintf(
+			"install -Dm755 %s /app/bin/%s",
+			name,
+			name,
+		))
+		module.Sources = append(module.Sources, flatpakSource{
+			Type:       "file",
+			Path:       name,
+			OnlyArches: []string{flatpakArch(arch)},
+		})
+	}
+	for _, f := range tree {
+		if f.Path == name {
+			continue
+		}
+		module.BuildCommands = append(module.BuildCommands, fmt.Sprintf(
+			"install -Dm%o %s /app/%s",
+			f.Mode.Perm(),
+			f.Path,
+			f.Path,
+		))
+	}
+	manifest.Modules = []flatpakModule{module}
+	var (
+		buf = bytes.NewBuffer(nil)
+		enc = json.NewEncoder(buf)
+	)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(manifest); err != nil {
+		return fmt.Errorf("encoding manifest: %w", err)
+	}
+	tree = append(tree, File{Path: id + ".json", Mode: 0644, Data: buf.Bytes()})
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return fmt.Errorf("preparing directory: %w", err)
+	}
+	if err := tree.Write(dir); err != nil {
+		return err
+	}
+	return nil
+}
+
+// flatpakArch maps an Architecture to the name used by flatpak.
+func flatpakArch(a Architecture) string {
+	switch a {
+	case X86:
+		return "i386"
+	case AMD64:
+		return "x86_64"
+	case ARM:
+		return "arm"
+	case ARM64:
+		return "aarch64"
+	}
+	return a.String()
+}
@@ -0,0 +1,74 @@
+package gopack
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestBundleFlatpak ensures the manifest installs the prebuilt binary, or
+// builds the project from source without its output directory.
+func TestBundleFlatpak(t *testing.T) {
+	var md MetaData
+	md.Linux.AppID = "com.example.Notes"
+	read := func(dir string) flatpakManifest {
+		by, err := ioutil.ReadFile(filepath.Join(dir, "com.example.Notes.json"))
+		if err != nil {
+			t.Fatalf("reading manifest: %v", err)
+		}
+		var m flatpakManifest
+		if err := json.Unmarshal(by, &m); err != nil {
+			t.Fatalf("parsing manifest: %v", err)
+		}
+		if m.AppID != "com.example.Notes" || m.Command != "notes" || len(m.Modules) != 1 {
+			t.Fatalf("got manifest %+v", m)
+		}
+		if !reflect.DeepEqual(m.FinishArgs, flatpakFinishArgs) {
+			t.Errorf("got finish args %v", m.FinishArgs)
+		}
+		return m
+	}
+	var (
+		root = t.TempDir()
+		dist = filepath.Join(root, "dist")
+		dir  = filepath.Join(dist, "linux_amd64", "flatpak")
+	)
+	if err := bundleFlatpak(dir, "notes", root, root, dist, AMD64, strings.NewReader("binary"), md); err != nil {
+		t.Fatalf("bundling: %v", err)
+	}
+	module := read(dir).Modules[0]
+	if len(module.Sources) != 2 || module.Sources[1].Path != "notes" {
+		t.Fatalf("got sources %+v", module.Sources)
+	}
+	if arches := module.Sources[1].OnlyArches; !reflect.DeepEqual(arches, []string{"x86_64"}) {
+		t.Errorf("got arches %v", arches)
+	}
+	if module.BuildCommands[0] != "install -Dm755 notes /app/bin/notes" {
+		t.Errorf("got build commands %v", module.BuildCommands)
+	}
+	for _, name := range []string{"notes", "share/applications/com.example.Notes.desktop"} {
+		if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(name))); err != nil {
+			t.Errorf("missing %s", name)
+		}
+	}
+	md.Linux.Flatpak.FromSource = true
+	if err := bundleFlatpak(dir, "notes", root, filepath.Join(root, "cmd", "notes"), dist, AMD64, nil, md); err != nil {
+		t.Fatalf("bundling from source: %v", err)
+	}
+	m := read(dir)
+	if !reflect.DeepEqual(m.SDKExtensions, []string{flatpakGoExtension}) {
+		t.Errorf("got sdk extensions %v", m.SDKExtensions)
+	}
+	module = m.Modules[0]
+	src := module.Sources[1]
+	if src.Path != "../../.." || src.Dest != "src" || !reflect.DeepEqual(src.Skip, []string{".git", "dist"}) {
+		t.Errorf("got source %+v", src)
+	}
+	if module.BuildCommands[0] != "cd src && go build -o /app/bin/notes ./cmd/notes" {
+		t.Errorf("got build commands %v", module.BuildCommands)
+	}
+}
@@ -0,0 +1,269 @@
+package gopack
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+// HicolorSizes lists the icon sizes rendered into the hicolor icon theme.
+var HicolorSizes = []int{16, 24, 32, 48, 64, 128, 256, 512}
+
+// File is an entry in a generated directory tree.
+type File struct {
+	// Path relative to the root of the tree, slash separated.
+	Path string
+	Mode os.FileMode
+	Data []byte
+}
+
+// Tree is a generated directory tree, shared by bundlers that lay out the
+// same files in different containers.
+type Tree []File
+
+// Prefix returns a copy of the tree rooted under dir.
+func (t Tree) Prefix(dir string) Tree {
+	out := make(Tree, len(t))
+	for ii, f := range t {
+		f.Path = path.Join(dir, f.Path)
+		out[ii] = f
+	}
+	return out
+}
+
+// Write the tree to disk under root, creating directories as needed.
+func (t Tree) Write(root string) error {
+	for _, f := range t {
+		dst := filepath.Join(root, filepath.FromSlash(f.Path))
+		if err := os.MkdirAll(filepath.Dir(dst), 0777); err != nil {
+			return fmt.Errorf("preparing directory: %w", err)
+		}
+		if err := ioutil.WriteFile(dst, f.Data, f.Mode); err != nil {
+			return fmt.Errorf("writing %s: %w", f.Path, err)
+		}
+	}
+	return nil
+}
+
+// FreeDesktop generates the files that integrate the executable name with
+// freedesktop.org compliant desktops. Paths are relative to an install
+// prefix such as "/usr":
+//
+//	share/applications/<id>.desktop
+//	share/icons/hicolor/<size>x<size>/apps/<id>.png
+//	share/metainfo/<id>.metainfo.xml
+//
+// Where id is the AppID, or the executable name if there is none. AppStream
+// metainfo is only generated when an AppID is specified, since AppStream
+// requires a reverse DNS identifier.
+func (md MetaData) FreeDesktop(name string) (Tree, error) {
+	id := md.desktopID(name)
+	tree := Tree{
+		{
+			Path: path.Join("share", "applications", id+".desktop"),
+			Mode: 0644,
+			Data: md.desktopEntry(name),
+		},
+	}
+	if md.Icon != nil {
+		icons, err := hicolor(md.Icon)
+		if err != nil {
+			return nil, fmt.Errorf("rendering icons: %w", err)
+		}
+		for _, size := range HicolorSizes {
+			tree = append(tree, File{
+				Path: hicolorPath(id, size),
+				Mode: 0644,
+				Data: icons[size],
+			})
+		}
+	}
+	if md.Linux.AppID != "" {
+		metainfo, err := md.metainfo(name)
+		if err != nil {
+			return nil, fmt.Errorf("generating metainfo: %w", err)
+		}
+		tree = append(tree, File{
+			Path: path.Join("share", "metainfo", id+".metainfo.xml"),
+			Mode: 0644,
+			Data: metainfo,
+		})
+	}
+	return tree, nil
+}
+
+// desktopID is the name desktop files and icons are installed under.
+func (md MetaData) desktopID(name string) string {
+	if md.Linux.AppID != "" {
+		return md.Linux.AppID
+	}
+	return name
+}
+
+// summary is the one line description of the application.
+func (md MetaData) summary(name string) string {
+	if md.Linux.Desktop.Comment != "" {
+		return md.Linux.Desktop.Comment
+	}
+	if d := strings.TrimSpace(md.Linux.Package.Description); d != "" {
+		return strings.SplitN(d, "\n", 2)[0]
+	}
+	return name
+}
+
+// desktopEntry generates a desktop entry launching the executable name.
+// See https://specifications.freedesktop.org/desktop-entry-spec/latest/.
+func (md MetaData) desktopEntry(name string) []byte {
+	var (
+		b       strings.Builder
+		desktop = md.Linux.Desktop
+		exec    = name
+	)
+	if desktop.Name == "" {
+		desktop.Name = name
+	}
+	if len(desktop.Categories) == 0 {
+		desktop.Categories = []string{"Utility"}
+	}
+	if desktop.StartupWMClass == "" {
+		desktop.StartupWMClass = name
+	}
+	if len(desktop.MimeTypes) > 0 {
+		exec += " %U"
+	}
+	field := func(key, value string) {
+		if value != "" {
+			fmt.Fprintf(&b, "%s=%s\n", key, escapeDesktop(value))
+		}
+	}
+	list := func(key string, values []string) {
+		if len(values) > 0 {
+			field(key, strings.Join(values, ";")+";")
+		}
+	}
+	b.WriteString("[Desktop Entry]\n")
+	field("Type", "Application")
+	field("Name", desktop.Name)
+	field("Comment", md.summary(name))
+	field("Exec", exec)
+	field("Icon", md.desktopID(name))
+	field("Terminal", fmt.Sprintf("%t", desktop.Terminal))
+	list("Categories", desktop.Categories)
+	list("MimeType", desktop.MimeTypes)
+	field("StartupWMClass", desktop.StartupWMClass)
+	return []byte(b.String())
+}
+
+// escapeDesktop escapes characters that cannot appear literally in desktop
+// entry values.
+func escapeDesktop(s string) string {
+	return strings.NewReplacer(
+		"\\", "\\\\",
+		"\n", "\\n",
+		"\t", "\\t",
+		"\r", "\\r",
+	).Replace(s)
+}
+
+// metainfo generates AppStream metadata describing the application.
+// See https://www.freedesktop.org/software/appstream/docs/.
+func (md MetaData) metainfo(name string) ([]byte, error) {
+	type url struct {
+		Type  string `xml:"type,attr"`
+		Value string `xml:",chardata"`
+	}
+	type release struct {
+		Version string `xml:"version,attr"`
+	}
+	type component struct {
+		XMLName         xml.Name  `xml:"component"`
+		Type            string    `xml:"type,attr"`
+		ID              string    `xml:"id"`
+		MetadataLicense string    `xml:"metadata_license"`
+		ProjectLicense  string    `xml:"project_license,omitempty"`
+		Name            string    `xml:"name"`
+		Summary         string    `xml:"summary"`
+		Description     []string  `xml:"description>p"`
+		Launchable      url       `xml:"launchable"`
+		URL             []url     `xml:"url"`
+		Binary          string    `xml:"provides>binary"`
+		Releases        []release `xml:"releases>release,omitempty"`
+		ContentRating   url       `xml:"content_rating"`
+	}
+	var (
+		info        = md.Linux.Package
+		description []string
+	)
+	if parts := strings.SplitN(strings.TrimSpace(info.Description), "\n", 2); len(parts) > 1 {
+		for _, p := range strings.Split(strings.TrimSpace(parts[1]), "\n\n") {
+			description = append(description, strings.Join(strings.Fields(p), " "))
+		}
+	} else {
+		description = []string{md.summary(name)}
+	}
+	c := component{
+		Type:            "desktop-application",
+		ID:              md.Linux.AppID,
+		MetadataLicense: "CC0-1.0",
+		ProjectLicense:  info.License,
+		Name:            md.Linux.Desktop.Name,
+		Summary:         md.summary(name),
+		Description:     description,
+		Launchable:      url{Type: "desktop-id", Value: md.desktopID(name) + ".desktop"},
+		Binary:          name,
+		ContentRating:   url{Type: "oars-1.1"},
+	}
+	if c.Name == "" {
+		c.Name = name
+	}
+	if info.Homepage != "" {
+		c.URL = append(c.URL, url{Type: "homepage", Value: info.Homepage})
+	}
+	if info.Version != "" {
+		c.Releases = append(c.Releases, release{Version: info.Version})
+	}
+	by, err := xml.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), append(by, '\n')...), nil
+}
+
+// hicolor renders the icon as png at each of the HicolorSizes.
+func hicolor(icon image.Image) (map[int][]byte, error) {
+	icons := make(map[int][]byte, len(HicolorSizes))
+	for _, size := range HicolorSizes {
+		var (
+			rect   = image.Rect(0, 0, size, size)
+			raw    = image.NewRGBA(rect)
+			buffer = bytes.NewBuffer(nil)
+			scale  = draw.CatmullRom
+		)
+		scale.Scale(raw, rect, icon, icon.Bounds(), draw.Over, nil)
+		if err := png.Encode(buffer, raw); err != nil {
+			return nil, fmt.Errorf("encoding %dx%d png: %w", size, size, err)
+		}
+		icons[size] = buffer.Bytes()
+	}
+	return icons, nil
+}
+
+// hicolorPath is the path, relative to the install prefix, of the icon at the
+// given size.
+func hicolorPath(id string, size int) string {
+	return path.Join(
+		"share", "icons", "hicolor",
+		fmt.Sprintf("%dx%d", size, size),
+		"apps",
+		id+".png",
+	)
+}
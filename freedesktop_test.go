@@ -0,0 +1,50 @@
+package gopack
+
+import (
+	"image"
+	"strings"
+	"testing"
+)
+
+// TestFreeDesktop ensures the tree is named after the AppID and that the
+// desktop entry carries the metadata.
+func TestFreeDesktop(t *testing.T) {
+	var md MetaData
+	md.Icon = image.NewRGBA(image.Rect(0, 0, 16, 16))
+	md.Linux.AppID = "com.example.App"
+	md.Linux.Desktop.Name = "Example App"
+	md.Linux.Desktop.MimeTypes = []string{"text/plain", "text/markdown"}
+	md.Linux.Package.Description = "Edits text\nA longer description."
+	tree, err := md.FreeDesktop("app")
+	if err != nil {
+		t.Fatalf("generating tree: %v", err)
+	}
+	files := map[string]string{}
+	for _, f := range tree {
+		files[f.Path] = string(f.Data)
+	}
+	if got, want := len(files), 2+len(HicolorSizes); got != want {
+		t.Errorf("file count: got %d, want %d", got, want)
+	}
+	for _, p := range []string{
+		"share/icons/hicolor/512x512/apps/com.example.App.png",
+		"share/metainfo/com.example.App.metainfo.xml",
+	} {
+		if _, ok := files[p]; !ok {
+			t.Errorf("missing %s", p)
+		}
+	}
+	desktop := files["share/applications/com.example.App.desktop"]
+	for _, want := range []string{
+		"Name=Example App\n",
+		"Comment=Edits text\n",
+		"Exec=app %U\n",
+		"Icon=com.example.App\n",
+		"MimeType=text/plain;text/markdown;\n",
+		"StartupWMClass=app\n",
+	} {
+		if !strings.Contains(desktop, want) {
+			t.Errorf("desktop entry missing %q:\n%s", want, desktop)
+		}
+	}
+}
@@ -3,10 +3,8 @@ module git.sr.ht/~jackmordaunt/gopack
 go 1.16
 
 require (
-	github.com/akavel/rsrc v0.10.2
 	github.com/gobuffalo/here v0.6.2 // indirect
 	github.com/jackmordaunt/icns v1.0.0
-	github.com/kdomanski/iso9660 v0.2.0
 	github.com/markbates/pkger v0.17.1
 	github.com/nfnt/resize v0.0.0-20180221191011-83c6a9932646 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
@@ -2,6 +2,8 @@ package gopack
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -9,24 +11,53 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"sync"
+	"time"
 
+	"git.sr.ht/~jackmordaunt/gopack/internal/pe"
 	"git.sr.ht/~jackmordaunt/gopack/internal/util"
 )
 
 // Packer packs a Go project into native artifacts and bundles.
 type Packer struct {
 	// Info contains information regarding the project to pack.
+	// Optional when packing prebuilt Artifacts.
 	Info *ProjectInfo
 	// MetaData required to produce valid application bundles.
 	MetaData MetaData
-	// Artifacts that are generated by compilation.
+	// Artifacts that are generated by compilation, or given up front to
+	// bundle prebuilt binaries.
 	Artifacts []Artifact
 	// PreCompile is run prior to compiling.
-	// Allows modification of the compilation environment, such as generating a
-	// Windows resource file to be compiled in.
+	// Allows modification of the compilation environment, such as generating
+	// code. Windows resources are embedded by the packer itself.
+	//
+	// root is an empty directory, files written into it are overlaid onto the
+	// project at the same relative path. When compiling in a Sandbox, root is
+	// the copy of the project.
 	PreCompile func(root string, md MetaData, t Target) error
+	// Sandbox compiles each target from a copy of the project rather than in
+	// place. Only needed if PreCompile must see, or remove, files of the
+	// project.
+	Sandbox bool
+	// Cache reuses binaries and bundles from previous runs whose inputs are
+	// unchanged. Nil disables caching.
+	Cache *Cache
+	// FailFast stops bundling at the first failure and returns it.
+	// By default bundling is best-effort: every artifact is attempted and all
+	// failures are returned together.
+	FailFast bool
+	// CompileJobs limits how many targets compile at once.
+	// Defaults to GOMAXPROCS.
+	CompileJobs int
+	// BundleJobs limits how many artifacts bundle at once.
+	// Defaults to GOMAXPROCS.
+	BundleJobs int
+	// Linux selects the package formats produced for Linux targets.
+	// Defaults to LinuxFormats.
+	Linux []LinuxFormat
 }
 
 // ProjectInfo contains data required to compile a Go project.
@@ -65,15 +96,18 @@ func (f Flags) Lookup(target Target) FlagSet {
 type FlagSet struct {
 	// Compiler flags.
 	// go tool compile
-	Compiler []string
+	Compiler []string `json:"compiler"`
 	// Linker flags.
 	// go tool link
-	Linker []string
+	Linker []string `json:"linker"`
 }
 
 // Artifact associates a path to a binary with the platform it's intended for.
 type Artifact struct {
 	Binary io.Reader
+	// Name of the binary, without extension, if known. Names the bundles
+	// when packing without a ProjectInfo name.
+	Name string
 	Target
 }
 
@@ -89,7 +123,7 @@ var DefaultTargets = []Target{
 	NewTarget("windows/amd64"),
 	NewTarget("windows/arm"),
 	NewTarget("darwin/amd64"),
-	// NewTarget("darwin/arm64"),
+	NewTarget("darwin/arm64"),
 	NewTarget("linux/386"),
 	NewTarget("linux/amd64"),
 	NewTarget("linux/arm"),
@@ -175,6 +209,9 @@ const (
 	ARM
 	ARM64
 	WASM
+	// Universal is a macOS binary holding both AMD64 and ARM64 code, merged
+	// from the binaries of each.
+	Universal
 )
 
 func (a Architecture) String() string {
@@ -189,6 +226,8 @@ func (a Architecture) String() string {
 		return "arm64"
 	case WASM:
 		return "wasm"
+	case Universal:
+		return "universal"
 	}
 	return "unknown"
 }
@@ -205,6 +244,8 @@ func (a *Architecture) FromStr(s string) Architecture {
 		*a = ARM64
 	case "wasm":
 		*a = WASM
+	case "universal":
+		*a = Universal
 	}
 	return *a
 }
@@ -214,70 +255,483 @@ func (a Architecture) List() []Architecture {
 }
 
 // Pack the binaries into native formats.
+//
+// The project is compiled first, unless Artifacts were given, eg prebuilt
+// binaries from LoadArtifacts. Artifacts can be packed without Info, in which
+// case metadata is loaded from the working directory and bundles are named
+// after the binaries, or else the application.
+//
+// Artifacts are bundled concurrently, up to BundleJobs at once. Failures are
+// reported as *BundleError values; by default all of them are collected into
+// a util.MultiError, unless FailFast is set in which case the first failure
+// is returned and pending stages are skipped.
 func (p Packer) Pack() error {
-	if p.Info != nil {
-		if err := p.MetaData.Load(p.Info.Root); err != nil {
-			return fmt.Errorf("loading metadata: %w", err)
+	return p.PackContext(context.Background())
+}
+
+// PackContext packs like Pack, stopping when ctx is done: compiles and
+// timestamp requests are interrupted, pending stages are skipped, the output
+// of interrupted bundles is removed and the context's error is returned.
+func (p Packer) PackContext(ctx context.Context) error {
+	if p.Info == nil {
+		if len(p.Artifacts) == 0 {
+			return fmt.Errorf("no artifacts to pack")
 		}
-		if err := p.Compile(); err != nil {
+		// Prebuilt artifacts need no project, metadata is loaded from the
+		// working directory.
+		p.Info = &ProjectInfo{Root: "."}
+	}
+	if err := p.MetaData.Load(p.Info.Root); err != nil {
+		return fmt.Errorf("loading metadata: %w", err)
+	}
+	if p.Info.Name == "" && len(p.Artifacts) > 0 {
+		info := *p.Info
+		if info.Name = p.artifactName(); info.Name == "" {
+			return fmt.Errorf("naming bundles: no project, binary or app name")
+		}
+		p.Info = &info
+	}
+	if p.MetaData.Windows.Manifest == nil {
+		manifest, err := p.MetaData.WindowsManifest(p.Info.Name)
+		if err != nil {
+			return fmt.Errorf("generating manifest: %w", err)
+		}
+		p.MetaData.Windows.Manifest = util.NewCopyBuffer(manifest)
+	}
+	if err := p.MetaData.buffer(); err != nil {
+		return fmt.Errorf("reading metadata: %w", err)
+	}
+	if len(p.Artifacts) == 0 {
+		if err := p.CompileContext(ctx); err != nil {
 			return fmt.Errorf("compiling %s: %w", p.Info.Pkg, err)
 		}
 	}
 	if len(p.Artifacts) == 0 {
 		return fmt.Errorf("no artifacts to pack")
 	}
-	wg := &sync.WaitGroup{}
+	// Binaries are buffered once, so that every stage reads them in full.
+	artifacts := make([]Artifact, len(p.Artifacts))
+	for ii, artifact := range p.Artifacts {
+		by, err := ioutil.ReadAll(artifact.Binary)
+		if err != nil {
+			return fmt.Errorf("reading %s binary: %w", artifact.Target, err)
+		}
+		artifact.Binary = util.NewCopyBuffer(by)
+		artifacts[ii] = artifact
+	}
+	artifacts, err := universal(artifacts)
+	if err != nil {
+		return fmt.Errorf("creating universal binary: %w", err)
+	}
+	p.Artifacts = artifacts
+	keys, err := p.bundleKeys()
+	if err != nil {
+		return err
+	}
+	// Resources are the same for every Windows artifact, so are created once
+	// up front rather than reading metadata from concurrent stages.
+	var res *pe.Resources
 	for _, artifact := range p.Artifacts {
+		if artifact.Platform == Windows {
+			if res, err = p.MetaData.resources(p.Info.Name); err != nil {
+				return fmt.Errorf("creating windows resources: %w", err)
+			}
+			break
+		}
+	}
+	var (
+		wg    = &sync.WaitGroup{}
+		errs  = make(chan error, len(p.Artifacts))
+		abort = make(chan struct{})
+		once  = &sync.Once{}
+		slots = jobs(p.BundleJobs)
+	)
+	for ii, artifact := range p.Artifacts {
 		var (
 			artifact = artifact
+			key      = keys[ii]
 			dir      = filepath.Join(p.Output(), artifact.Target.String())
 		)
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			switch artifact.Platform {
-			case Darwin:
-				if err := bundleMacOS(
-					dir,
-					p.Info.Name,
-					artifact.Binary,
-					p.MetaData.Darwin.ICNS,
-					p.MetaData.Darwin.Plist,
-				); err != nil {
-					fmt.Printf("bundling macos: %s\n", err)
+			select {
+			case <-abort:
+				return
+			case <-ctx.Done():
+				return
+			case slots <- struct{}{}:
+				defer func() { <-slots }()
+			}
+			if key != "" {
+				// The output is cleared so that only this bundle is cached.
+				if err := os.RemoveAll(dir); err != nil {
+					log.Printf("cleaning %s: %v", dir, err)
+				}
+				if ok, err := p.Cache.Bundle(key, dir); err != nil {
+					log.Printf("warning: %v", err)
+				} else if ok {
+					fmt.Printf("cached: %s\n", artifact.Target)
+					return
+				}
+			}
+			// A bundle interrupted part way through is removed rather than
+			// left half written in the output.
+			var started, finished bool
+			defer func() {
+				if started && !finished && ctx.Err() != nil {
+					if err := os.RemoveAll(dir); err != nil {
+						log.Printf("cleaning %s: %v", dir, err)
+					}
 				}
-			case Windows:
-				if err := bundleWindows(
-					filepath.Join(dir, fmt.Sprintf("%s.exe", p.Info.Name)),
-					artifact.Binary,
-				); err != nil {
-					fmt.Printf("bundling windows: %s\n", err)
+			}()
+			for _, s := range p.stages(artifact, res) {
+				select {
+				case <-abort:
+					return
+				case <-ctx.Done():
+					return
+				default:
+				}
+				started = true
+				if err := s.Run(ctx); err != nil {
+					errs <- &BundleError{
+						Target: artifact.Target,
+						Stage:  s.Stage,
+						Err:    err,
+					}
+					if p.FailFast {
+						once.Do(func() { close(abort) })
+					}
+					return
+				}
+			}
+			finished = true
+			if key != "" {
+				if err := p.Cache.PutBundle(key, dir); err != nil {
+					log.Printf("warning: caching bundle: %v", err)
 				}
-			case Linux:
-				fmt.Printf("warning: bundling for linux unimplemented\n")
 			}
 		}()
 	}
 	wg.Wait()
+	close(errs)
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("packing: %w", err)
+	}
+	if err := new(util.MultiError).FromChan(errs); !err.IsEmpty() {
+		if p.FailFast {
+			return (*err)[0]
+		}
+		return err
+	}
+	return nil
+}
+
+// artifactName names the bundles of prebuilt artifacts after their binary,
+// or else the application.
+func (p Packer) artifactName() string {
+	for _, artifact := range p.Artifacts {
+		if artifact.Name != "" {
+			return artifact.Name
+		}
+	}
+	return p.MetaData.App.Name
+}
+
+// bundleKeys returns the cache key of each artifact's bundle, hashed from its
+// binary, the metadata and the stages that produce it. Keys are empty if
+// there is no Cache.
+func (p *Packer) bundleKeys() ([]string, error) {
+	keys := make([]string, len(p.Artifacts))
+	if p.Cache == nil {
+		return keys, nil
+	}
+	md, err := p.MetaData.hash()
+	if err != nil {
+		return nil, fmt.Errorf("hashing metadata: %w", err)
+	}
+	for ii, artifact := range p.Artifacts {
+		by, err := ioutil.ReadAll(artifact.Binary)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s binary: %w", artifact.Target, err)
+		}
+		h := newHasher()
+		h.add("bundle", by, md, artifact.Target.String(), p.Info.Name, p.Output())
+		for _, s := range p.stages(artifact, nil) {
+			h.add(string(s.Stage))
+		}
+		keys[ii] = h.key()
+	}
+	return keys, nil
+}
+
+// stages lists the bundling stages for an artifact, in order of execution.
+// A stage only runs if the stages before it succeeded.
+func (p Packer) stages(artifact Artifact, res *pe.Resources) []stage {
+	dir := filepath.Join(p.Output(), artifact.Target.String())
+	switch artifact.Platform {
+	case Darwin:
+		return []stage{
+			{
+				Stage: StageApp,
+				Run: func(ctx context.Context) error {
+					plist, err := p.MetaData.InfoPlist(p.Info.Name)
+					if err != nil {
+						return fmt.Errorf("generating Info.plist: %w", err)
+					}
+					return bundleMacOS(
+						dir,
+						p.Info.Name,
+						artifact.Binary,
+						p.MetaData.Darwin.ICNS,
+						bytes.NewReader(plist),
+					)
+				},
+			},
+			{
+				Stage: StageSign,
+				Run: func(ctx context.Context) error {
+					app := filepath.Join(dir, fmt.Sprintf("%s.app", p.Info.Name))
+					darwin := p.MetaData.Darwin
+					return signMacOS(app, p.Info.Name, darwin.Identity, darwin.Entitlements)
+				},
+			},
+			{
+				Stage: StageDMG,
+				Run: func(ctx context.Context) error {
+					app := filepath.Join(dir, fmt.Sprintf("%s.app", p.Info.Name))
+					return dmg(
+						app,
+						dir,
+						p.Info.Name,
+						p.MetaData.Darwin.ICNS,
+						p.MetaData.Darwin.DMG,
+					)
+				},
+			},
+		}
+	case Windows:
+		return []stage{
+			{
+				Stage: StageExe,
+				Run: func(ctx context.Context) error {
+					return bundleWindows(
+						ctx,
+						filepath.Join(dir, fmt.Sprintf("%s.exe", p.Info.Name)),
+						artifact.Binary,
+						res,
+						p.MetaData.Windows.Identity,
+						p.MetaData.Windows.TimestampURL,
+					)
+				},
+			},
+		}
+	case Linux:
+		var stages []stage
+		for _, format := range p.linuxFormats() {
+			switch format {
+			case AppImage:
+				runtime := p.MetaData.Linux.AppImageRuntime[artifact.Architecture]
+				if runtime == nil && len(p.Linux) == 0 {
+					continue
+				}
+				stages = append(stages, stage{
+					Stage: StageAppImage,
+					Run: func(ctx context.Context) error {
+						return bundleAppImage(
+							filepath.Join(dir, fmt.Sprintf(
+								"%s-%s.AppImage",
+								p.Info.Name,
+								appImageArch(artifact.Architecture),
+							)),
+							p.Info.Name,
+							artifact.Architecture,
+							artifact.Binary,
+							p.MetaData,
+							runtime,
+						)
+					},
+				})
+			case Deb:
+				stages = append(stages, stage{
+					Stage: StageDeb,
+					Run: func(ctx context.Context) error {
+						return bundleDeb(
+							dir,
+							p.Info.Name,
+							artifact.Architecture,
+							artifact.Binary,
+							p.MetaData,
+						)
+					},
+				})
+			case RPM:
+				stages = append(stages, stage{
+					Stage: StageRPM,
+					Run: func(ctx context.Context) error {
+						return bundleRPM(
+							dir,
+							p.Info.Name,
+							artifact.Architecture,
+							artifact.Binary,
+							p.MetaData,
+						)
+					},
+				})
+			case Tarball:
+				stages = append(stages, stage{
+					Stage: StageTarball,
+					Run: func(ctx context.Context) error {
+						return bundleTarball(
+							dir,
+							p.Info.Name,
+							artifact.Architecture,
+							artifact.Binary,
+							p.MetaData,
+						)
+					},
+				})
+			case Flatpak:
+				stages = append(stages, stage{
+					Stage: StageFlatpak,
+					Run: func(ctx context.Context) error {
+						return bundleFlatpak(
+							filepath.Join(dir, "flatpak"),
+							p.Info.Name,
+							p.Info.Root,
+							p.Info.Pkg,
+							p.Output(),
+							artifact.Architecture,
+							artifact.Binary,
+							p.MetaData,
+						)
+					},
+				})
+			case Snap:
+				stages = append(stages, stage{
+					Stage: StageSnap,
+					Run: func(ctx context.Context) error {
+						return bundleSnap(
+							filepath.Join(dir, "snap"),
+							p.Info.Name,
+							artifact.Architecture,
+							artifact.Binary,
+							p.MetaData,
+						)
+					},
+				})
+			default:
+				format := format
+				stages = append(stages, stage{
+					Stage: Stage(format),
+					Run: func(ctx context.Context) error {
+						return fmt.Errorf("unsupported linux format %q", format)
+					},
+				})
+			}
+		}
+		return stages
+	}
 	return nil
 }
 
+// Stage identifies a step in the bundling process.
+type Stage string
+
+// Bundling stages.
+const (
+	// StageApp creates the macOS .app bundle.
+	StageApp Stage = "app"
+	// StageSign signs the macOS .app bundle.
+	StageSign Stage = "sign"
+	// StageDMG creates the macOS disk image from the .app bundle.
+	StageDMG Stage = "dmg"
+	// StageExe writes the Windows executable.
+	StageExe Stage = "exe"
+	// StageAppImage creates the Linux AppImage.
+	StageAppImage Stage = "appimage"
+	// StageDeb creates the Debian package.
+	StageDeb Stage = "deb"
+	// StageRPM creates the rpm package.
+	StageRPM Stage = "rpm"
+	// StageTarball creates the Linux tarball.
+	StageTarball Stage = "tarball"
+	// StageFlatpak creates the flatpak-builder manifest.
+	StageFlatpak Stage = "flatpak"
+	// StageSnap creates the snap.
+	StageSnap Stage = "snap"
+)
+
+// LinuxFormat identifies a package format for Linux targets.
+type LinuxFormat string
+
+// Linux package formats.
+const (
+	// AppImage requires the runtime of the architecture, in
+	// MetaData.Linux.AppImageRuntime, and by default is only produced for
+	// architectures that have one.
+	AppImage LinuxFormat = "appimage"
+	Deb      LinuxFormat = "deb"
+	RPM      LinuxFormat = "rpm"
+	Tarball  LinuxFormat = "tarball"
+	// Flatpak requires MetaData.Linux.AppID and so is not produced by
+	// default.
+	Flatpak LinuxFormat = "flatpak"
+	Snap    LinuxFormat = "snap"
+)
+
+// LinuxFormats lists the Linux package formats produced by default.
+var LinuxFormats = []LinuxFormat{Tarball, AppImage, Deb, RPM, Snap}
+
+// linuxFormats returns the Linux formats to produce, defaulting to all of
+// them.
+func (p Packer) linuxFormats() []LinuxFormat {
+	if len(p.Linux) == 0 {
+		return LinuxFormats
+	}
+	return p.Linux
+}
+
+// stage is a unit of bundling work.
+type stage struct {
+	Stage Stage
+	Run   func(ctx context.Context) error
+}
+
+// BundleError reports which Target failed to bundle, and at which Stage.
+type BundleError struct {
+	Target Target
+	Stage  Stage
+	Err    error
+}
+
+func (e *BundleError) Error() string {
+	return fmt.Sprintf("bundling %s: %s: %v", e.Target, e.Stage, e.Err)
+}
+
+func (e *BundleError) Unwrap() error {
+	return e.Err
+}
+
 // Compile the Go project.
 // Requires Go toolchain to be installed.
-// Compiles targets in parallel.
-//
-// Note: copies source files to a sandbox for clean parallel compiles.
-// This is IO heavy and was primary done because Windows requires a resource file
-// to get linked to provide an icon for the binary. The presence of such file
-// breaks compiles for other platforms.
+// Compiles targets in parallel, up to CompileJobs at once.
 //
-// @Enhance is there a more lightweight strategy that supports windows resource
-// files? Such as manipulating the compiled PE directly.
+// Targets are built in place, each into its own temporary directory, which
+// is removed once the binaries are read into Artifacts. Files that PreCompile
+// writes are overlaid onto the project with "go build -overlay", so that they
+// don't interfere between targets. If Sandbox is set, or the Go toolchain
+// predates -overlay, the project is instead copied into a sandbox per target.
 func (p *Packer) Compile() error {
-	var (
-		output = p.Output()
-		err    error
-	)
+	return p.CompileContext(context.Background())
+}
+
+// CompileContext compiles like Compile, stopping when ctx is done: running
+// builds are interrupted, the temporary directories are removed and the
+// context's error is returned.
+func (p *Packer) CompileContext(ctx context.Context) error {
+	var err error
 	if p.Info.Root == "" {
 		p.Info.Root, err = os.Getwd()
 		if err != nil {
@@ -290,77 +744,189 @@ func (p *Packer) Compile() error {
 		p.Info.Root = r
 	}
 	if p.Info.Pkg != "" {
-		p.Info.Pkg, err = util.Finder{
-			Root:  p.Info.Root,
-			IsDir: true,
-			Rel:   true,
-		}.Find(p.Info.Pkg)
-		if err != nil {
-			return fmt.Errorf("finding package: %w", err)
-		}
-		if p.Info.Pkg == "" {
-			return fmt.Errorf("package %q not found", p.Info.Pkg)
+		pkg := p.Info.Pkg
+		if info, err := os.Stat(filepath.Join(p.Info.Root, pkg)); err == nil && info.IsDir() {
+			if p.Info.Pkg = filepath.ToSlash(filepath.Clean(pkg)); p.Info.Pkg != "." {
+				p.Info.Pkg = "./" + p.Info.Pkg
+			}
+		} else {
+			p.Info.Pkg, err = util.Finder{
+				Root:  p.Info.Root,
+				IsDir: true,
+				Rel:   true,
+			}.Find(pkg)
+			if err != nil {
+				return fmt.Errorf("finding package: %w", err)
+			}
+			if p.Info.Pkg == "" {
+				return fmt.Errorf("package %q not found", pkg)
+			}
 		}
 	} else {
 		p.Info.Pkg = p.Info.Root
 	}
+	// Each call builds in its own temporary directory, removed once the
+	// binaries are read, so that concurrent packs don't collide.
+	tmp, err := ioutil.TempDir("", "gopack-")
+	if err != nil {
+		return fmt.Errorf("preparing temporary directory: %w", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(tmp); err != nil {
+			log.Printf("cleaning %s: %v", tmp, err)
+		}
+	}()
+	// Binaries are named after the project, or else the package directory.
+	name := p.Info.Name
+	if name == "" {
+		dir := p.Info.Pkg
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(p.Info.Root, dir)
+		}
+		name = filepath.Base(dir)
+	}
 	var (
-		sandbox = filepath.Join(os.TempDir(), "gopack")
+		sandbox = p.Sandbox || !overlaySupported()
+		pkg     = p.Info.Pkg
 		wg      = &sync.WaitGroup{}
+		mu      = &sync.Mutex{}
 		errs    = make(chan error, len(p.Info.Targets))
+		slots   = jobs(p.CompileJobs)
 	)
+	if filepath.IsAbs(pkg) {
+		pkg = "."
+	}
+	var tool, tree, modules string
+	if p.Cache != nil {
+		if tool, err = toolchain(p.Info.Root); err != nil {
+			return err
+		}
+		dist, err := filepath.Rel(p.Info.Root, p.Output())
+		if err != nil {
+			return fmt.Errorf("resolving output: %w", err)
+		}
+		if tree, err = hashTree(p.Info.Root, ".git", dist); err != nil {
+			return err
+		}
+		if modules, err = hashModules(p.Info.Root); err != nil {
+			return err
+		}
+	}
 	fmt.Printf("package: %s\n", p.Info.Pkg)
-	fmt.Printf("sandbox: %s\n", sandbox)
+	if sandbox {
+		fmt.Printf("sandbox: %s\n", tmp)
+	}
 	for _, target := range p.Info.Targets {
 		target := target
 		var (
 			platform = target.Platform
 			arch     = target.Architecture
-			sandbox  = filepath.Join(sandbox, target.String())
-			bin      = fmt.Sprintf(
-				"%s%s",
-				filepath.Join(
-					sandbox,
-					output,
-					fmt.Sprintf("%s_%s", platform.String(), arch.String()),
-					filepath.Base(p.Info.Pkg)),
-				target.Ext())
+			dir      = filepath.Join(tmp, target.String())
+			bin      = filepath.Join(dir, name+target.Ext())
 		)
-		if err := os.RemoveAll(sandbox); err != nil {
-			log.Printf("cleaning sandbox: %v", err)
-		}
-		if err := os.MkdirAll(sandbox, 0777); err != nil {
-			log.Printf("preparing sandbox: %v", err)
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			log.Printf("preparing %s: %v", dir, err)
 		}
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
 			if err := func() error {
-				// @Enhance parse gitignore to figure out what to ignore.
-				if err := (util.Copier{
-					Recursive: true,
-					Ignore:    []string{"dist", ".git"},
-				}).Copy(p.Info.Root, sandbox); err != nil {
-					return fmt.Errorf("creating sandbox: %w", err)
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case slots <- struct{}{}:
+					defer func() { <-slots }()
+				}
+				if err := ctx.Err(); err != nil {
+					return err
 				}
-				if p.PreCompile != nil {
-					if err := p.PreCompile(sandbox, p.MetaData, target); err != nil {
+				var (
+					root   = p.Info.Root
+					args   = []string{"build", "-o", bin}
+					source = tree
+				)
+				if sandbox {
+					root = filepath.Join(dir, "sandbox")
+					// @Enhance parse gitignore to figure out what to ignore.
+					if err := (util.Copier{
+						Recursive: true,
+						Ignore:    []string{"dist", ".git"},
+					}).Copy(p.Info.Root, root); err != nil {
+						return fmt.Errorf("creating sandbox: %w", err)
+					}
+					if err := ctx.Err(); err != nil {
+						return err
+					}
+					if p.PreCompile != nil {
+						if err := p.PreCompile(root, p.MetaData, target); err != nil {
+							return fmt.Errorf("pre compile: %w", err)
+						}
+					}
+					if p.Cache != nil && p.PreCompile != nil {
+						// The sandbox is the source, as changed by PreCompile.
+						if source, err = hashTree(root); err != nil {
+							return err
+						}
+					}
+				} else if p.PreCompile != nil {
+					overlay := filepath.Join(dir, "overlay")
+					if err := os.MkdirAll(overlay, 0777); err != nil {
+						return fmt.Errorf("preparing overlay: %w", err)
+					}
+					if err := p.PreCompile(overlay, p.MetaData, target); err != nil {
 						return fmt.Errorf("pre compile: %w", err)
 					}
+					path, err := writeOverlay(overlay, p.Info.Root, filepath.Join(dir, "overlay.json"))
+					if err != nil {
+						return fmt.Errorf("creating overlay: %w", err)
+					}
+					if path != "" {
+						args = append(args, "-overlay", path)
+					}
+					if p.Cache != nil {
+						generated, err := hashTree(overlay)
+						if err != nil {
+							return err
+						}
+						source += generated
+					}
 				}
-				cmd := exec.Command(
-					"go", "build",
-					"-o", bin,
+				var key string
+				if p.Cache != nil {
+					h := newHasher()
+					flags := p.Info.Flags.Lookup(target)
+					h.add("binary", tool, source, modules, target.String(), pkg, flags.Compiler, flags.Linker)
+					key = h.key()
+					data, err := p.Cache.Binary(key)
+					if err != nil {
+						log.Printf("warning: %v", err)
+					}
+					if data != nil {
+						fmt.Printf("cached: %s\n", target)
+						mu.Lock()
+						defer mu.Unlock()
+						p.Artifacts = append(p.Artifacts, Artifact{
+							Binary: util.NewCopyBuffer(data),
+							Target: target,
+						})
+						return nil
+					}
+				}
+				args = append(args,
 					"-ldflags", strings.Join(p.Info.Flags.Lookup(target).Linker, " "),
 					"-gcflags", strings.Join(p.Info.Flags.Lookup(target).Compiler, " "),
-					p.Info.Pkg,
+					pkg,
 				)
-				cmd.Dir = sandbox
+				cmd := exec.Command("go", args...)
+				cmd.Dir = root
 				cmd.Env = append(cmd.Env, fmt.Sprintf("GOOS=%s", platform))
 				cmd.Env = append(cmd.Env, fmt.Sprintf("GOARCH=%s", arch))
 				cmd.Env = append(cmd.Env, os.Environ()...)
 				fmt.Printf("%s\n", cmd)
-				if out, err := cmd.CombinedOutput(); err != nil {
+				if out, err := run(ctx, cmd); err != nil {
+					if ctx.Err() != nil {
+						return ctx.Err()
+					}
 					return fmt.Errorf("%s%w", func() string {
 						if len(out) == 0 {
 							return ""
@@ -372,8 +938,15 @@ func (p *Packer) Compile() error {
 				if err != nil {
 					return fmt.Errorf("reading binary: %w", err)
 				}
+				if key != "" {
+					if err := p.Cache.PutBinary(key, data); err != nil {
+						log.Printf("warning: caching binary: %v", err)
+					}
+				}
+				mu.Lock()
+				defer mu.Unlock()
 				p.Artifacts = append(p.Artifacts, Artifact{
-					Binary: bytes.NewBuffer(data),
+					Binary: util.NewCopyBuffer(data),
 					Target: target,
 				})
 				return nil
@@ -384,12 +957,104 @@ func (p *Packer) Compile() error {
 	}
 	wg.Wait()
 	close(errs)
+	// Only the directory of this call is removed, by the deferred cleanup
+	// above, leaving those of concurrent packs alone.
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	if err := new(util.MultiError).FromChan(errs); !err.IsEmpty() {
 		return err
 	}
 	return nil
 }
 
+// jobs returns a semaphore with n slots, or GOMAXPROCS if n is not positive.
+func jobs(n int) chan struct{} {
+	if n <= 0 {
+		n = runtime.GOMAXPROCS(0)
+	}
+	return make(chan struct{}, n)
+}
+
+// run runs cmd, returning its combined output. If ctx is done first, cmd is
+// interrupted so that the go command can stop the tools it started, and killed
+// if it hasn't exited after a grace period.
+func run(ctx context.Context, cmd *exec.Cmd) ([]byte, error) {
+	out := bytes.NewBuffer(nil)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	select {
+	case err := <-done:
+		return out.Bytes(), err
+	case <-ctx.Done():
+	}
+	// Interrupt is not supported on Windows.
+	if err := cmd.Process.Signal(os.Interrupt); err != nil {
+		_ = cmd.Process.Kill()
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		_ = cmd.Process.Kill()
+		<-done
+	}
+	return out.Bytes(), ctx.Err()
+}
+
+// writeOverlay writes the overlay file that places the files under dir into
+// root, as understood by "go build -overlay", to path. If dir is empty no
+// file is written and the returned path is empty.
+func writeOverlay(dir, root, path string) (string, error) {
+	replace := map[string]string{}
+	if err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		replace[filepath.Join(root, rel)] = p
+		return nil
+	}); err != nil {
+		return "", err
+	}
+	if len(replace) == 0 {
+		return "", nil
+	}
+	by, err := json.Marshal(struct{ Replace map[string]string }{replace})
+	if err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(path, by, 0644); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// overlaySupported reports whether the Go toolchain supports "go build
+// -overlay", added in Go 1.16.
+func overlaySupported() bool {
+	out, err := exec.Command("go", "env", "GOVERSION").Output()
+	if err != nil {
+		// GOVERSION itself was added in Go 1.16.
+		return false
+	}
+	var major, minor int
+	if _, err := fmt.Sscanf(strings.TrimSpace(string(out)), "go%d.%d", &major, &minor); err != nil {
+		// Development builds, "devel ...", are assumed to be recent.
+		return strings.HasPrefix(string(out), "devel")
+	}
+	return major > 1 || minor >= 16
+}
+
 // Output returns the output directory to place artifacts into.
 func (p Packer) Output() string {
 	if p.Info != nil {
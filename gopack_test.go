@@ -0,0 +1,372 @@
+package gopack
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"git.sr.ht/~jackmordaunt/gopack/internal/pe/petest"
+	"git.sr.ht/~jackmordaunt/gopack/internal/util"
+)
+
+func TestCompile(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go toolchain not found")
+	}
+	if testing.Short() {
+		t.Skip("compiles with the go toolchain")
+	}
+	root := t.TempDir()
+	for name, content := range map[string]string{
+		"go.mod":             "module example\n\ngo 1.16\n",
+		"cmd/notes/main.go":  "package main\n\nfunc main() { println(generated) }\n",
+		"cmd/notes/other.go": "package main\n",
+	} {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, sandbox := range []bool{false, true} {
+		p := Packer{
+			Info: &ProjectInfo{
+				Root:    root,
+				Pkg:     "cmd/notes",
+				Targets: []Target{NewTarget("linux/amd64"), NewTarget("windows/amd64")},
+			},
+			Sandbox: sandbox,
+			// The package only compiles with the generated file.
+			PreCompile: func(dir string, md MetaData, t Target) error {
+				path := filepath.Join(dir, "cmd", "notes", "generated.go")
+				if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+					return err
+				}
+				return ioutil.WriteFile(path, []byte("package main\n\nconst generated = \""+t.String()+"\"\n"), 0644)
+			},
+		}
+		if err := p.Compile(); err != nil {
+			t.Fatalf("sandbox %t: compiling: %v", sandbox, err)
+		}
+		if len(p.Artifacts) != 2 {
+			t.Fatalf("sandbox %t: got %d artifacts, want 2", sandbox, len(p.Artifacts))
+		}
+		if _, err := os.Stat(filepath.Join(root, "cmd", "notes", "generated.go")); !os.IsNotExist(err) {
+			t.Fatalf("sandbox %t: generated file written into the project", sandbox)
+		}
+	}
+}
+
+// TestCompileRoot ensures a package at the root of the project builds a
+// binary named after the project directory, and that the temporary directory
+// is removed afterwards.
+func TestCompileRoot(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go toolchain not found")
+	}
+	if testing.Short() {
+		t.Skip("compiles with the go toolchain")
+	}
+	root := filepath.Join(t.TempDir(), "notes")
+	if err := os.Mkdir(root, 0777); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{
+		"go.mod":  "module example\n\ngo 1.16\n",
+		"main.go": "package main\n\nfunc main() {}\n",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(root, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tmp := t.TempDir()
+	defer os.Setenv("TMPDIR", os.Getenv("TMPDIR"))
+	os.Setenv("TMPDIR", tmp)
+	p := Packer{
+		Info: &ProjectInfo{
+			Root:    root,
+			Pkg:     ".",
+			Targets: []Target{NewTarget("linux/amd64"), NewTarget("windows/amd64")},
+		},
+	}
+	if err := p.Compile(); err != nil {
+		t.Fatalf("compiling: %v", err)
+	}
+	if len(p.Artifacts) != 2 {
+		t.Fatalf("got %d artifacts, want 2", len(p.Artifacts))
+	}
+	if left, _ := filepath.Glob(filepath.Join(tmp, "gopack-*")); len(left) != 0 {
+		t.Errorf("temporary directories left behind: %v", left)
+	}
+}
+
+func TestCompileCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	tmp := t.TempDir()
+	defer os.Setenv("TMPDIR", os.Getenv("TMPDIR"))
+	os.Setenv("TMPDIR", tmp)
+	// Stands in for the build of a concurrent pack.
+	other, err := ioutil.TempDir("", "gopack-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := Packer{
+		Info: &ProjectInfo{
+			Root:    t.TempDir(),
+			Targets: []Target{NewTarget("linux/amd64")},
+		},
+	}
+	if err := p.CompileContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want cancellation", err)
+	}
+	left, _ := filepath.Glob(filepath.Join(tmp, "gopack-*"))
+	if len(left) != 1 || left[0] != other {
+		t.Errorf("got temporary directories %v, want only %s", left, other)
+	}
+}
+
+func TestRunInterrupted(t *testing.T) {
+	if _, err := exec.LookPath("sleep"); err != nil {
+		t.Skip("sleep not found")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := run(ctx, exec.Command("sleep", "10")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want deadline exceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("command ran for %v after cancellation", elapsed)
+	}
+}
+
+// TestPackFailures ensures that bundling failures are collected by default,
+// and that FailFast returns the first and skips pending artifacts.
+func TestPackFailures(t *testing.T) {
+	for _, failFast := range []bool{false, true} {
+		root := t.TempDir()
+		p := Packer{
+			Info: &ProjectInfo{Name: "notes", Root: root},
+			Artifacts: []Artifact{
+				{Binary: bytes.NewReader(testBinaries["notes"]), Target: NewTarget("linux/amd64")},
+				{Binary: bytes.NewReader(testBinaries["notes"]), Target: NewTarget("linux/arm64")},
+			},
+			FailFast:   failFast,
+			BundleJobs: 1,
+			Linux:      []LinuxFormat{Tarball, "bogus"},
+		}
+		err := p.Pack()
+		var bundleErr *BundleError
+		if !errors.As(err, &bundleErr) || bundleErr.Stage != "bogus" {
+			t.Fatalf("fail fast %t: got %v, want a bundle error", failFast, err)
+		}
+		var multi *util.MultiError
+		if got := errors.As(err, &multi); got == failFast {
+			t.Errorf("fail fast %t: got %T", failFast, err)
+		}
+		if !failFast && len(*multi) != 2 {
+			t.Errorf("got %d errors, want one per artifact", len(*multi))
+		}
+		// One artifact bundles at a time, so failing fast stops the second
+		// before it starts.
+		want := 2
+		if failFast {
+			want = 1
+		}
+		tarballs, _ := filepath.Glob(filepath.Join(root, "dist", "*", "*.tar.gz"))
+		if len(tarballs) != want {
+			t.Errorf("fail fast %t: got tarballs %v, want %d", failFast, tarballs, want)
+		}
+	}
+}
+
+// TestPackCancelled ensures that cancelling a pack interrupts a stage waiting
+// on the network, and removes the output of the bundle.
+func TestPackCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var cancelled time.Time
+	tsa := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = ioutil.ReadAll(r.Body)
+		cancelled = time.Now()
+		cancel()
+		<-r.Context().Done()
+	}))
+	defer tsa.Close()
+	var (
+		root = t.TempDir()
+		dir  = filepath.Join(root, "dist", "windows_amd64")
+	)
+	// Stands in for output already written by the interrupted bundle.
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "partial"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	p := Packer{
+		Info: &ProjectInfo{Name: "notes", Root: root},
+		Artifacts: []Artifact{
+			{Binary: bytes.NewReader(petest.Image()), Target: NewTarget("windows/amd64")},
+		},
+	}
+	p.MetaData.Windows.Identity = testIdentity(t)
+	p.MetaData.Windows.TimestampURL = tsa.URL
+	if err := p.PackContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want %v", err, context.Canceled)
+	}
+	if elapsed := time.Since(cancelled); elapsed > 5*time.Second {
+		t.Errorf("timestamping ran for %v after cancellation", elapsed)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("interrupted bundle left in the output: %v", err)
+	}
+}
+
+// TestPackPrebuilt ensures prebuilt artifacts pack without a ProjectInfo,
+// named after their binary, with metadata from the working directory.
+func TestPackPrebuilt(t *testing.T) {
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.Chdir(wd) }()
+	if err := os.Mkdir("bin", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join("bin", "notes"), testBinaries["notes"], 0755); err != nil {
+		t.Fatal(err)
+	}
+	artifacts, err := LoadArtifacts("bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := Packer{Artifacts: artifacts, Linux: []LinuxFormat{Tarball}}
+	if err := p.Pack(); err != nil {
+		t.Fatalf("packing: %v", err)
+	}
+	tarballs, _ := filepath.Glob(filepath.Join("dist", "linux_arm64", "notes-*.tar.gz"))
+	if len(tarballs) != 1 {
+		t.Errorf("got tarballs %v, want one named after the binary", tarballs)
+	}
+}
+
+// TestBundleJobs ensures no more than BundleJobs artifacts bundle at once,
+// and that zero means GOMAXPROCS.
+func TestBundleJobs(t *testing.T) {
+	if got, want := cap(jobs(0)), runtime.GOMAXPROCS(0); got != want {
+		t.Errorf("default jobs: got %d, want %d", got, want)
+	}
+	var (
+		mu            sync.Mutex
+		running, most int
+	)
+	// Each artifact is signed, so the timestamp authority sees how many are
+	// bundling at once.
+	tsa := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		running++
+		if running > most {
+			most = running
+		}
+		mu.Unlock()
+		time.Sleep(100 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer tsa.Close()
+	p := Packer{
+		Info:       &ProjectInfo{Name: "notes", Root: t.TempDir()},
+		BundleJobs: 2,
+	}
+	for _, target := range []string{"windows/386", "windows/amd64", "windows/arm", "windows/arm64"} {
+		p.Artifacts = append(p.Artifacts, Artifact{
+			Binary: bytes.NewReader(petest.Image()),
+			Target: NewTarget(target),
+		})
+	}
+	p.MetaData.Windows.Identity = testIdentity(t)
+	p.MetaData.Windows.TimestampURL = tsa.URL
+	var multi *util.MultiError
+	if err := p.Pack(); !errors.As(err, &multi) || len(*multi) != len(p.Artifacts) {
+		t.Fatalf("got %v, want every timestamp to fail", err)
+	}
+	if most > p.BundleJobs {
+		t.Errorf("%d artifacts bundled at once, want at most %d", most, p.BundleJobs)
+	}
+}
+
+// TestPackReader ensures every stage packages the whole binary when the
+// artifact is a plain reader, which can only be read once.
+func TestPackReader(t *testing.T) {
+	bin := make([]byte, 64<<10)
+	if _, err := rand.Read(bin); err != nil {
+		t.Fatal(err)
+	}
+	root := t.TempDir()
+	p := Packer{
+		Info: &ProjectInfo{Name: "notes", Root: root},
+		Artifacts: []Artifact{
+			{Binary: bytes.NewReader(bin), Target: NewTarget("linux/amd64")},
+		},
+		Linux: []LinuxFormat{Tarball, Deb, RPM},
+	}
+	if err := p.Pack(); err != nil {
+		t.Fatalf("packing: %v", err)
+	}
+	dir := filepath.Join(root, "dist", "linux_amd64")
+	for _, pattern := range []string{"*.tar.gz", "*.deb", "*.rpm"} {
+		matches, _ := filepath.Glob(filepath.Join(dir, pattern))
+		if len(matches) != 1 {
+			t.Fatalf("%s: got %v", pattern, matches)
+		}
+		by, err := ioutil.ReadFile(matches[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !gzipContains(by, bin) {
+			t.Errorf("%s doesn't contain the binary", filepath.Base(matches[0]))
+		}
+	}
+}
+
+// gzipContains reports whether any gzip stream embedded in b decompresses to
+// data containing want.
+func gzipContains(b, want []byte) bool {
+	magic := []byte{0x1f, 0x8b, 0x08}
+	for off := bytes.Index(b, magic); off >= 0; {
+		if gz, err := gzip.NewReader(bytes.NewReader(b[off:])); err == nil {
+			gz.Multistream(false)
+			if data, _ := ioutil.ReadAll(gz); bytes.Contains(data, want) {
+				return true
+			}
+		}
+		next := bytes.Index(b[off+1:], magic)
+		if next < 0 {
+			break
+		}
+		off += 1 + next
+	}
+	return false
+}
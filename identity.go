@@ -0,0 +1,101 @@
+package gopack
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"git.sr.ht/~jackmordaunt/gopack/internal/pkcs12"
+)
+
+// Identity is a certificate and its private key, which sign bundles.
+type Identity struct {
+	// Certificate identifies the signer.
+	Certificate *x509.Certificate
+	// Chain holds intermediate certificates, embedded in signatures so that
+	// they can be verified up to a root.
+	Chain []*x509.Certificate
+	// Key is the private key of the certificate.
+	Key crypto.Signer
+}
+
+// LoadIdentity reads an identity from a PKCS#12 file (".p12" or ".pfx"), as
+// exported by Keychain Access, or from a PEM file holding the certificate,
+// followed by its chain, and an unencrypted private key.
+func LoadIdentity(path, password string) (*Identity, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading identity: %w", err)
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".p12", ".pfx":
+		key, certs, err := pkcs12.Decode(data, password)
+		if err != nil {
+			return nil, fmt.Errorf("decoding %s: %w", path, err)
+		}
+		return &Identity{Certificate: certs[0], Chain: certs[1:], Key: key}, nil
+	}
+	var (
+		id   Identity
+		rest = data
+	)
+	for {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		switch block.Type {
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("parsing certificate: %w", err)
+			}
+			if id.Certificate == nil {
+				id.Certificate = cert
+			} else {
+				id.Chain = append(id.Chain, cert)
+			}
+		case "PRIVATE KEY", "RSA PRIVATE KEY", "EC PRIVATE KEY":
+			if id.Key, err = parseKey(block); err != nil {
+				return nil, fmt.Errorf("parsing private key: %w", err)
+			}
+		case "ENCRYPTED PRIVATE KEY":
+			return nil, fmt.Errorf("%s: encrypted PEM keys are not supported, export a .p12 instead", path)
+		}
+	}
+	if id.Certificate == nil || id.Key == nil {
+		return nil, fmt.Errorf("%s: expected a certificate and private key", path)
+	}
+	if pub, ok := id.Key.Public().(interface{ Equal(crypto.PublicKey) bool }); !ok || !pub.Equal(id.Certificate.PublicKey) {
+		return nil, fmt.Errorf("%s: private key doesn't match the certificate", path)
+	}
+	return &id, nil
+}
+
+// parseKey parses a PEM private key of any of the common encodings.
+func parseKey(block *pem.Block) (crypto.Signer, error) {
+	var (
+		key interface{}
+		err error
+	)
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key %T", key)
+	}
+	return signer, nil
+}
@@ -0,0 +1,74 @@
+package gopack
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testIdentity returns an identity with a self-signed certificate.
+func testIdentity(t *testing.T) *Identity {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "Notes"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Identity{Certificate: cert, Key: key}
+}
+
+func TestLoadIdentity(t *testing.T) {
+	var (
+		id    = testIdentity(t)
+		other = testIdentity(t)
+	)
+	encode := func(key interface{}) []byte {
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return append(
+			pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: id.Certificate.Raw}),
+			pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})...,
+		)
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "identity.pem")
+	if err := ioutil.WriteFile(path, encode(id.Key), 0600); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadIdentity(path, "")
+	if err != nil {
+		t.Fatalf("loading: %v", err)
+	}
+	if !loaded.Certificate.Equal(id.Certificate) || len(loaded.Chain) != 0 {
+		t.Errorf("got certificate %v, chain %d", loaded.Certificate.Subject, len(loaded.Chain))
+	}
+	mismatched := filepath.Join(dir, "mismatched.pem")
+	if err := ioutil.WriteFile(mismatched, encode(other.Key), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadIdentity(mismatched, ""); err == nil {
+		t.Errorf("loaded a key that doesn't match the certificate")
+	}
+}
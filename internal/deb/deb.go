@@ -0,0 +1,212 @@
+// deb format encoding.
+//
+// A Debian binary package is an ar archive of three members: the format
+// version, a tarball of control files and a tarball of the files to install.
+//
+// See deb(5) and deb-control(5).
+package deb
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Control contains the fields of the binary package control file.
+type Control struct {
+	Package      string
+	Version      string
+	Architecture string
+	Maintainer   string
+	Section      string
+	Priority     string
+	Homepage     string
+	Depends      []string
+	// Description is a single line synopsis optionally followed by an
+	// extended description on subsequent lines.
+	Description string
+}
+
+// File to install, with a slash separated path relative to the filesystem
+// root.
+type File struct {
+	Path string
+	Mode os.FileMode
+	Data []byte
+}
+
+// Package is a binary package.
+type Package struct {
+	Control Control
+	Files   []File
+	// ModTime is stamped on archive members. Defaults to the time of writing.
+	ModTime time.Time
+}
+
+// WriteTo encodes the package as a .deb archive into dst.
+func (p Package) WriteTo(dst io.Writer) (int64, error) {
+	modTime := p.ModTime
+	if modTime.IsZero() {
+		modTime = time.Now()
+	}
+	files := make([]File, len(p.Files))
+	copy(files, p.Files)
+	sort.Slice(files, func(ii, jj int) bool {
+		return files[ii].Path < files[jj].Path
+	})
+	var (
+		size    int64
+		md5sums strings.Builder
+	)
+	for _, f := range files {
+		size += int64(len(f.Data))
+		fmt.Fprintf(&md5sums, "%x  %s\n", md5.Sum(f.Data), strings.TrimPrefix(path.Clean("/"+f.Path), "/"))
+	}
+	data, err := tarball(modTime, files)
+	if err != nil {
+		return 0, fmt.Errorf("data: %w", err)
+	}
+	control, err := tarball(modTime, []File{
+		{Path: "control", Mode: 0644, Data: p.Control.encode((size + 1023) / 1024)},
+		{Path: "md5sums", Mode: 0644, Data: []byte(md5sums.String())},
+	})
+	if err != nil {
+		return 0, fmt.Errorf("control: %w", err)
+	}
+	ar := &archive{w: dst}
+	ar.header()
+	ar.member("debian-binary", modTime, []byte("2.0\n"))
+	ar.member("control.tar.gz", modTime, control)
+	ar.member("data.tar.gz", modTime, data)
+	return ar.n, ar.err
+}
+
+// encode the control file. Installed size is in KiB.
+func (c Control) encode(installed int64) []byte {
+	var b strings.Builder
+	field := func(name, value string) {
+		if value != "" {
+			fmt.Fprintf(&b, "%s: %s\n", name, value)
+		}
+	}
+	field("Package", c.Package)
+	field("Version", c.Version)
+	field("Architecture", c.Architecture)
+	field("Maintainer", c.Maintainer)
+	field("Installed-Size", fmt.Sprintf("%d", installed))
+	field("Depends", strings.Join(c.Depends, ", "))
+	field("Section", c.Section)
+	field("Priority", c.Priority)
+	field("Homepage", c.Homepage)
+	lines := strings.Split(strings.TrimSpace(c.Description), "\n")
+	field("Description", lines[0])
+	// Extended description lines are indented, with blank lines written as a
+	// single dot.
+	for _, line := range lines[1:] {
+		if line = strings.TrimSpace(line); line == "" {
+			line = "."
+		}
+		fmt.Fprintf(&b, " %s\n", line)
+	}
+	return []byte(b.String())
+}
+
+// tarball creates a gzipped tar archive of files, rooted at "./", including
+// entries for every parent directory.
+func tarball(modTime time.Time, files []File) ([]byte, error) {
+	var (
+		buf  = bytes.NewBuffer(nil)
+		gz   = gzip.NewWriter(buf)
+		tw   = tar.NewWriter(gz)
+		dirs = map[string]bool{}
+	)
+	header := func(name string, mode os.FileMode, size int64, kind byte) error {
+		return tw.WriteHeader(&tar.Header{
+			Typeflag: kind,
+			Name:     name,
+			Mode:     int64(mode.Perm()),
+			Size:     size,
+			ModTime:  modTime,
+			Uname:    "root",
+			Gname:    "root",
+			Format:   tar.FormatGNU,
+		})
+	}
+	var mkdir func(dir string) error
+	mkdir = func(dir string) error {
+		if dirs[dir] {
+			return nil
+		}
+		if dir != "." {
+			if err := mkdir(path.Dir(dir)); err != nil {
+				return err
+			}
+		}
+		dirs[dir] = true
+		return header("./"+strings.TrimPrefix(dir+"/", "./"), 0755, 0, tar.TypeDir)
+	}
+	for _, f := range files {
+		name := strings.TrimPrefix(path.Clean("/"+f.Path), "/")
+		if err := mkdir(path.Dir(name)); err != nil {
+			return nil, fmt.Errorf("writing directory: %w", err)
+		}
+		if err := header("./"+name, f.Mode, int64(len(f.Data)), tar.TypeReg); err != nil {
+			return nil, fmt.Errorf("writing header: %w", err)
+		}
+		if _, err := tw.Write(f.Data); err != nil {
+			return nil, fmt.Errorf("writing %s: %w", name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// archive writes the common ar format, retaining the first error.
+type archive struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (a *archive) write(b []byte) {
+	if a.err != nil {
+		return
+	}
+	n, err := a.w.Write(b)
+	a.n += int64(n)
+	a.err = err
+}
+
+func (a *archive) header() {
+	a.write([]byte("!<arch>\n"))
+}
+
+func (a *archive) member(name string, modTime time.Time, data []byte) {
+	a.write([]byte(fmt.Sprintf(
+		"%-16s%-12d%-6d%-6d%-8s%-10d`\n",
+		name,
+		modTime.Unix(),
+		0,
+		0,
+		"100644",
+		len(data),
+	)))
+	a.write(data)
+	// Members are aligned to even offsets.
+	if len(data)%2 != 0 {
+		a.write([]byte("\n"))
+	}
+}
@@ -0,0 +1,100 @@
+package deb
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestPackage ensures the ar members appear in the order dpkg requires and
+// that the control file carries the package fields.
+func TestPackage(t *testing.T) {
+	pkg := Package{
+		Control: Control{
+			Package:      "app",
+			Version:      "1.2.3",
+			Architecture: "amd64",
+			Maintainer:   "Jane <jane@example.com>",
+			Depends:      []string{"libc6", "libx11-6"},
+			Description:  "An app\nThat does things.\n\nMany things.",
+		},
+		Files: []File{
+			{Path: "usr/bin/app", Mode: 0755, Data: []byte("binary")},
+		},
+	}
+	buf := bytes.NewBuffer(nil)
+	if _, err := pkg.WriteTo(buf); err != nil {
+		t.Fatalf("writing package: %v", err)
+	}
+	members, err := members(buf.Bytes())
+	if err != nil {
+		t.Fatalf("reading archive: %v", err)
+	}
+	var names []string
+	for _, m := range members {
+		names = append(names, m.name)
+	}
+	if got, want := strings.Join(names, ","), "debian-binary,control.tar.gz,data.tar.gz"; got != want {
+		t.Fatalf("members: got %s, want %s", got, want)
+	}
+	control, err := extract(members[1].data, "./control")
+	if err != nil {
+		t.Fatalf("reading control: %v", err)
+	}
+	for _, want := range []string{
+		"Package: app\n",
+		"Depends: libc6, libx11-6\n",
+		"Description: An app\n That does things.\n .\n Many things.\n",
+	} {
+		if !strings.Contains(control, want) {
+			t.Errorf("control missing %q:\n%s", want, control)
+		}
+	}
+	if data, err := extract(members[2].data, "./usr/bin/app"); err != nil || data != "binary" {
+		t.Errorf("data: got %q, %v", data, err)
+	}
+}
+
+type member struct {
+	name string
+	data []byte
+}
+
+func members(ar []byte) ([]member, error) {
+	var out []member
+	ar = bytes.TrimPrefix(ar, []byte("!<arch>\n"))
+	for len(ar) > 0 {
+		size, err := strconv.Atoi(strings.TrimSpace(string(ar[48:58])))
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, member{
+			name: strings.TrimSpace(string(ar[:16])),
+			data: ar[60 : 60+size],
+		})
+		ar = ar[60+size+size%2:]
+	}
+	return out, nil
+}
+
+func extract(tgz []byte, name string) (string, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(tgz))
+	if err != nil {
+		return "", err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		h, err := tr.Next()
+		if err != nil {
+			return "", err
+		}
+		if h.Name == name {
+			by, err := ioutil.ReadAll(tr)
+			return string(by), err
+		}
+	}
+}
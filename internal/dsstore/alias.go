@@ -0,0 +1,111 @@
+package dsstore
+
+import (
+	"bytes"
+	"path"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// hfsEpoch is the unix time of the HFS epoch, 1904-01-01.
+const hfsEpoch = 2082844800
+
+// Alias tags.
+const (
+	tagFolderName    = 0
+	tagCNIDPath      = 1
+	tagCarbonPath    = 2
+	tagUnicodeName   = 14
+	tagUnicodeVolume = 15
+	tagPOSIXPath     = 18
+	tagMountPoint    = 19
+)
+
+// Alias describes a file on an HFS+ volume, from which a version 2 Alias
+// Manager record is built. The Finder resolves aliases by volume name and
+// catalog node ID, falling back to the path.
+type Alias struct {
+	// Volume name and creation date.
+	Volume  string
+	Created time.Time
+	// Path of the file from the root of the volume, slash separated.
+	Path string
+	// ID is the catalog node ID of the file, and Parents those of the
+	// folders containing it, nearest first, excluding the root.
+	ID      uint32
+	Parents []uint32
+}
+
+// Bytes encodes the alias record.
+func (a Alias) Bytes() []byte {
+	var (
+		date   = uint32(a.Created.Unix() + hfsEpoch)
+		dir    = path.Dir(strings.Trim(a.Path, "/"))
+		name   = path.Base(a.Path)
+		parent = uint32(2) // root folder
+	)
+	if len(a.Parents) > 0 {
+		parent = a.Parents[0]
+	}
+	body := bytes.NewBuffer(nil)
+	put(body,
+		uint16(0), // kind, file
+		pascal(a.Volume, 28),
+		date,
+		[]byte("H+"),
+		uint16(5), // disk type, ejectable
+		parent,
+		pascal(name, 64),
+		a.ID,
+		date,
+		[4]byte{}, // type
+		[4]byte{}, // creator
+		int16(-1), // levels from
+		int16(-1), // levels to
+		uint32(0), // volume attributes
+		uint16(0), // volume file system ID
+		[10]byte{},
+	)
+	tag := func(t int16, data []byte) {
+		put(body, t, uint16(len(data)), data)
+		if len(data)%2 != 0 {
+			body.WriteByte(0)
+		}
+	}
+	if dir != "." {
+		tag(tagFolderName, []byte(path.Base(dir)))
+		cnids := bytes.NewBuffer(nil)
+		put(cnids, a.Parents)
+		tag(tagCNIDPath, cnids.Bytes())
+	}
+	tag(tagCarbonPath, []byte(a.Volume+":"+strings.Replace(strings.Trim(a.Path, "/"), "/", ":", -1)))
+	tag(tagUnicodeName, unicode(name))
+	tag(tagUnicodeVolume, unicode(a.Volume))
+	tag(tagPOSIXPath, []byte("/"+strings.Trim(a.Path, "/")))
+	tag(tagMountPoint, []byte("/Volumes/"+a.Volume))
+	put(body, int16(-1), uint16(0))
+	out := bytes.NewBuffer(nil)
+	put(out, [4]byte{}, uint16(8+body.Len()), uint16(2))
+	out.Write(body.Bytes())
+	return out.Bytes()
+}
+
+// pascal encodes a length prefixed string in a field of n bytes.
+func pascal(s string, n int) []byte {
+	if len(s) > n-1 {
+		s = s[:n-1]
+	}
+	b := make([]byte, n)
+	b[0] = byte(len(s))
+	copy(b[1:], s)
+	return b
+}
+
+// unicode encodes a length prefixed UTF-16 string.
+func unicode(s string) []byte {
+	chars := utf16.Encode([]rune(s))
+	b := bytes.NewBuffer(nil)
+	put(b, uint16(len(chars)), chars)
+	return b.Bytes()
+}
@@ -0,0 +1,165 @@
+// dsstore format encoding.
+//
+// Writes the ".DS_Store" files in which the Finder keeps the view settings of
+// a folder: window bounds, background, icon size and the position of each
+// item. The file is a B-tree of records stored in a buddy allocated file.
+// Records are written into a single leaf node, which is plenty for the
+// handful of records describing a disk image window.
+//
+// See https://metacpan.org/dist/Mac-Finder-DSStore/view/DSStoreFormat.pod.
+package dsstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf16"
+)
+
+// pageSize is the size of a B-tree node.
+const pageSize = 0x1000
+
+// Store accumulates records.
+type Store struct {
+	records []record
+}
+
+type record struct {
+	name string
+	code string
+	kind string
+	data []byte
+}
+
+// Long sets a 32 bit integer property of the file name.
+func (s *Store) Long(name, code string, v uint32) {
+	s.add(name, code, "long", be32(v))
+}
+
+// Bool sets a boolean property of the file name.
+func (s *Store) Bool(name, code string, v bool) {
+	var b byte
+	if v {
+		b = 1
+	}
+	s.add(name, code, "bool", []byte{b})
+}
+
+// Type sets a four character code property of the file name.
+func (s *Store) Type(name, code, v string) {
+	s.add(name, code, "type", []byte(v))
+}
+
+// Blob sets an opaque property of the file name.
+func (s *Store) Blob(name, code string, v []byte) {
+	s.add(name, code, "blob", append(be32(uint32(len(v))), v...))
+}
+
+// Location sets the position of the icon of the file name, in points from the
+// top left of the window to the centre of the icon.
+func (s *Store) Location(name string, x, y int) {
+	b := bytes.NewBuffer(nil)
+	_ = binary.Write(b, binary.BigEndian, []uint32{uint32(x), uint32(y), 0xFFFFFFFF, 0xFFFF0000})
+	s.Blob(name, "Iloc", b.Bytes())
+}
+
+func (s *Store) add(name, code, kind string, data []byte) {
+	s.records = append(s.records, record{name: name, code: code, kind: kind, data: data})
+}
+
+// Bytes encodes the store.
+//
+// The allocator space is laid out as:
+//
+//	0x0000 header
+//	0x0020 DSDB block, locating the B-tree
+//	0x0800 allocator bookkeeping
+//	0x1000 leaf node
+//
+// with the remaining space on the free lists.
+func (s *Store) Bytes() ([]byte, error) {
+	records := append([]record{}, s.records...)
+	sort.SliceStable(records, func(ii, jj int) bool {
+		a, b := strings.ToLower(records[ii].name), strings.ToLower(records[jj].name)
+		if a != b {
+			return a < b
+		}
+		return records[ii].code < records[jj].code
+	})
+	leaf := bytes.NewBuffer(nil)
+	put(leaf, uint32(0), uint32(len(records)))
+	for _, r := range records {
+		if len(r.code) != 4 || len(r.kind) != 4 {
+			return nil, fmt.Errorf("%s: invalid code %q", r.name, r.code)
+		}
+		name := utf16.Encode([]rune(r.name))
+		put(leaf, uint32(len(name)), name)
+		leaf.WriteString(r.code)
+		leaf.WriteString(r.kind)
+		leaf.Write(r.data)
+	}
+	if leaf.Len() > pageSize {
+		return nil, fmt.Errorf("records exceed a single node")
+	}
+	const (
+		dsdbBlock = 1
+		leafBlock = 2
+	)
+	dsdb := bytes.NewBuffer(nil)
+	put(dsdb,
+		uint32(leafBlock),
+		uint32(0), // levels above the leaves
+		uint32(len(records)),
+		uint32(1), // nodes
+		uint32(pageSize),
+	)
+	// Block addresses hold the offset with log2 of the size in the low bits.
+	var (
+		rootAddr = uint32(0x0800 | 11)
+		dsdbAddr = uint32(0x0020 | 5)
+		leafAddr = uint32(0x1000 | 12)
+	)
+	root := bytes.NewBuffer(nil)
+	offsets := make([]uint32, 256)
+	offsets[0], offsets[dsdbBlock], offsets[leafBlock] = rootAddr, dsdbAddr, leafAddr
+	put(root, uint32(3), uint32(0), offsets)
+	// Table of contents.
+	put(root, uint32(1), uint8(4), []byte("DSDB"), uint32(dsdbBlock))
+	// Free lists, one per power of two size. Blocks above 0x1000 are free
+	// at their natural alignment up to the 4GiB address space.
+	free := map[int][]uint32{6: {0x40}, 7: {0x80}, 8: {0x100}, 9: {0x200}, 10: {0x400}}
+	for ii := 13; ii < 32; ii++ {
+		free[ii] = []uint32{1 << uint(ii)}
+	}
+	for ii := 0; ii < 32; ii++ {
+		put(root, uint32(len(free[ii])), free[ii])
+	}
+	out := make([]byte, 4+0x2000)
+	binary.BigEndian.PutUint32(out, 1)
+	header := bytes.NewBuffer(nil)
+	put(header, []byte("Bud1"), uint32(0x0800), uint32(0x0800), uint32(0x0800))
+	copy(out[4:], header.Bytes())
+	copy(out[4+0x0020:], dsdb.Bytes())
+	copy(out[4+0x0800:], root.Bytes())
+	copy(out[4+0x1000:], leaf.Bytes())
+	return out, nil
+}
+
+func be32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+// put encodes each value into buf in order, big endian.
+func put(buf *bytes.Buffer, values ...interface{}) {
+	for _, v := range values {
+		if b, ok := v.([]byte); ok {
+			buf.Write(b)
+			continue
+		}
+		_ = binary.Write(buf, binary.BigEndian, v)
+	}
+}
@@ -0,0 +1,68 @@
+package dsstore
+
+import (
+	"encoding/binary"
+	"testing"
+	"unicode/utf16"
+)
+
+// TestBytes ensures records can be found by following the allocator to the
+// B-tree, and come out sorted.
+func TestBytes(t *testing.T) {
+	s := &Store{}
+	s.Location("b.app", 10, 20)
+	s.Long(".", "vSrn", 1)
+	s.Location("Applications", 30, 40)
+	b, err := s.Bytes()
+	if err != nil {
+		t.Fatalf("encoding: %v", err)
+	}
+	be := binary.BigEndian
+	if be.Uint32(b) != 1 || string(b[4:8]) != "Bud1" {
+		t.Fatalf("bad header")
+	}
+	alloc := b[4:]
+	root := alloc[be.Uint32(alloc[4:]):]
+	block := func(n int) []byte {
+		addr := be.Uint32(root[8+4*n:])
+		return alloc[addr&^0x1F : addr&^0x1F+1<<(addr&0x1F)]
+	}
+	if toc := root[8+1024:]; string(toc[5:9]) != "DSDB" {
+		t.Fatalf("missing DSDB")
+	}
+	dsdb := block(int(be.Uint32(root[8+1024+9:])))
+	leaf := block(int(be.Uint32(dsdb)))
+	if count := be.Uint32(leaf[4:]); count != 3 || be.Uint32(dsdb[8:]) != 3 {
+		t.Fatalf("record count: got %d", count)
+	}
+	var names []string
+	p := leaf[8:]
+	for ii := 0; ii < 3; ii++ {
+		n := int(be.Uint32(p))
+		chars := make([]uint16, n)
+		for jj := range chars {
+			chars[jj] = be.Uint16(p[4+2*jj:])
+		}
+		var (
+			name = string(utf16.Decode(chars))
+			code = string(p[4+2*n : 8+2*n])
+			kind = string(p[8+2*n : 12+2*n])
+		)
+		names = append(names, name+"/"+code)
+		p = p[12+2*n:]
+		switch kind {
+		case "long":
+			p = p[4:]
+		case "blob":
+			p = p[4+be.Uint32(p):]
+		default:
+			t.Fatalf("unexpected type %s", kind)
+		}
+	}
+	want := []string{"./vSrn", "Applications/Iloc", "b.app/Iloc"}
+	for ii := range want {
+		if names[ii] != want[ii] {
+			t.Errorf("record %d: got %s, want %s", ii, names[ii], want[ii])
+		}
+	}
+}
@@ -0,0 +1,685 @@
+// hfs format encoding.
+//
+// Writes HFS+ volumes as mounted by macOS from disk images. Only what is
+// needed to describe a plain file hierarchy is implemented: a catalog B-tree
+// of folders, files and symbolic links, each file stored in a single
+// contiguous extent. There is no journal, extended attributes, hard links or
+// resource forks.
+//
+// Names are compared with an ASCII approximation of the HFS+ case folding
+// rules and are not decomposed, which is sufficient for the names that
+// appear in application bundles.
+//
+// See Apple Technical Note TN1150 for a description of the format.
+package hfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+const (
+	// BlockSize is the allocation block size.
+	BlockSize = 4096
+	// nodeSize is the B-tree node size, used for both the catalog and extents
+	// overflow files.
+	nodeSize = 4096
+
+	signature = 0x482B // "H+"
+	version   = 4
+	// lastMountedVersion identifies the implementation that last wrote the
+	// volume, Mac OS X uses "10.0".
+	lastMountedVersion = 0x31302E30
+
+	volumeUnmounted = 1 << 8
+
+	rootParentID = 1
+	rootFolderID = 2
+	extentsID    = 3
+	catalogID    = 4
+	firstUserID  = 16
+
+	recordFolder       = 1
+	recordFile         = 2
+	recordFolderThread = 3
+	recordFileThread   = 4
+
+	fileThreadExists = 0x0002
+
+	nodeLeaf   = -1
+	nodeIndex  = 0
+	nodeHeader = 1
+
+	bigKeys           = 2
+	variableIndexKeys = 4
+	caseFolding       = 0xCF
+
+	catalogMaxKeyLength = 516
+	extentsMaxKeyLength = 10
+
+	modeDir     = 0040000
+	modeFile    = 0100000
+	modeSymlink = 0120000
+
+	// hfsEpoch is the unix time of the HFS epoch, 1904-01-01.
+	hfsEpoch = 2082844800
+)
+
+// Finder flags.
+const (
+	// HasCustomIcon tells the Finder to display the icon stored in the item
+	// rather than the default. For a volume, the icon is ".VolumeIcon.icns".
+	HasCustomIcon = 0x0400
+	// IsInvisible hides the item in the Finder.
+	IsInvisible = 0x4000
+)
+
+// Volume accumulates a file hierarchy in memory and encodes it as an HFS+
+// volume.
+type Volume struct {
+	// Name of the volume, as displayed when mounted.
+	Name string
+	// ModTime is stamped on the volume and every item.
+	// Defaults to the time of writing.
+	ModTime time.Time
+	// FreeSpace to leave on the volume, in bytes.
+	FreeSpace int64
+
+	root   *node
+	nextID uint32
+}
+
+// node is an item in the file hierarchy.
+type node struct {
+	name     string
+	mode     os.FileMode
+	data     []byte
+	flags    uint16
+	children map[string]*node
+	// id is the catalog node ID, assigned on insertion.
+	id     uint32
+	parent uint32
+
+	// Populated while writing.
+	start uint32
+}
+
+func (n *node) isDir() bool {
+	return n.mode.IsDir()
+}
+
+func (n *node) isSymlink() bool {
+	return n.mode&os.ModeSymlink != 0
+}
+
+// blocks is the number of allocation blocks occupied by the data fork.
+func (n *node) blocks() uint32 {
+	return uint32((len(n.data) + BlockSize - 1) / BlockSize)
+}
+
+// sorted lists the children in catalog order.
+func (n *node) sorted() []*node {
+	children := make([]*node, 0, len(n.children))
+	for _, c := range n.children {
+		children = append(children, c)
+	}
+	sort.Slice(children, func(ii, jj int) bool {
+		return compare(children[ii].name, children[jj].name) < 0
+	})
+	return children
+}
+
+// Mkdir creates the folder at p, and any missing parents.
+func (v *Volume) Mkdir(p string, mode os.FileMode) error {
+	_, err := v.insert(p, &node{mode: os.ModeDir | mode.Perm()})
+	return err
+}
+
+// Create a regular file at p containing data. Missing parent folders are
+// created with 0755 permissions.
+func (v *Volume) Create(p string, mode os.FileMode, data []byte) error {
+	_, err := v.insert(p, &node{mode: mode.Perm(), data: data})
+	return err
+}
+
+// Symlink creates a symbolic link at p pointing to target.
+func (v *Volume) Symlink(target, p string) error {
+	_, err := v.insert(p, &node{mode: os.ModeSymlink | 0755, data: []byte(target)})
+	return err
+}
+
+// SetFlags sets Finder flags on the item at p. The root folder is "/".
+func (v *Volume) SetFlags(p string, flags uint16) error {
+	n, err := v.lookup(p)
+	if err != nil {
+		return err
+	}
+	n.flags |= flags
+	return nil
+}
+
+// ID returns the catalog node ID of the item at p, which is fixed once the
+// item has been added.
+func (v *Volume) ID(p string) (uint32, error) {
+	n, err := v.lookup(p)
+	if err != nil {
+		return 0, err
+	}
+	return n.id, nil
+}
+
+// init creates the root folder.
+func (v *Volume) init() {
+	if v.root == nil {
+		v.root = &node{
+			mode:     os.ModeDir | 0755,
+			children: map[string]*node{},
+			id:       rootFolderID,
+			parent:   rootParentID,
+		}
+		v.nextID = firstUserID
+	}
+}
+
+func (v *Volume) lookup(p string) (*node, error) {
+	v.init()
+	n := v.root
+	for _, part := range split(p) {
+		next, ok := n.children[part]
+		if !ok {
+			return nil, fmt.Errorf("%s: not found", p)
+		}
+		n = next
+	}
+	return n, nil
+}
+
+// insert n at path p, creating parent folders as needed.
+func (v *Volume) insert(p string, n *node) (*node, error) {
+	v.init()
+	parts := split(p)
+	if len(parts) == 0 {
+		return nil, fmt.Errorf("%s: invalid path", p)
+	}
+	dir := v.root
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := dir.children[part]
+		if !ok {
+			next = &node{
+				name:     part,
+				mode:     os.ModeDir | 0755,
+				children: map[string]*node{},
+				id:       v.nextID,
+				parent:   dir.id,
+			}
+			v.nextID++
+			dir.children[part] = next
+		}
+		if !next.isDir() {
+			return nil, fmt.Errorf("%s: %s is not a folder", p, part)
+		}
+		dir = next
+	}
+	name := parts[len(parts)-1]
+	if len(utf16.Encode([]rune(name))) > 255 {
+		return nil, fmt.Errorf("%s: name too long", p)
+	}
+	if existing, ok := dir.children[name]; ok {
+		if existing.isDir() && n.isDir() {
+			existing.mode = n.mode
+			return existing, nil
+		}
+		return nil, fmt.Errorf("%s: already exists", p)
+	}
+	n.name = name
+	n.id = v.nextID
+	n.parent = dir.id
+	v.nextID++
+	if n.isDir() {
+		n.children = map[string]*node{}
+	}
+	dir.children[name] = n
+	return n, nil
+}
+
+func split(p string) []string {
+	p = strings.Trim(path.Clean("/"+p), "/")
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
+
+// Bytes encodes the volume.
+func (v *Volume) Bytes() ([]byte, error) {
+	v.init()
+	if v.Name == "" {
+		return nil, fmt.Errorf("volume name required")
+	}
+	v.root.name = v.Name
+	modTime := v.ModTime
+	if modTime.IsZero() {
+		modTime = time.Now()
+	}
+	var (
+		nodes []*node
+		files uint32
+		dirs  uint32
+		walk  func(n *node)
+	)
+	walk = func(n *node) {
+		nodes = append(nodes, n)
+		for _, c := range n.sorted() {
+			if c.isDir() {
+				dirs++
+			} else {
+				files++
+			}
+			walk(c)
+		}
+	}
+	walk(v.root)
+	date := uint32(modTime.Unix() + hfsEpoch)
+	// The catalog size doesn't depend on where files are placed, so measure
+	// it before laying out the volume.
+	catalog, err := v.catalog(nodes, date)
+	if err != nil {
+		return nil, fmt.Errorf("building catalog: %w", err)
+	}
+	var (
+		catalogBlocks = uint32(len(catalog) / BlockSize)
+		extentsBlocks = uint32(nodeSize / BlockSize)
+		dataBlocks    uint32
+		freeBlocks    = uint32((v.FreeSpace + BlockSize - 1) / BlockSize)
+		bitmapBlocks  = uint32(1)
+		total         uint32
+	)
+	for _, n := range nodes {
+		if !n.isDir() {
+			dataBlocks += n.blocks()
+		}
+	}
+	// The first block holds the volume header and the last the alternate
+	// volume header. The bitmap size depends on the total, so iterate until
+	// stable.
+	for {
+		total = 1 + bitmapBlocks + extentsBlocks + catalogBlocks + dataBlocks + freeBlocks + 1
+		need := (total + BlockSize*8 - 1) / (BlockSize * 8)
+		if need <= bitmapBlocks {
+			break
+		}
+		bitmapBlocks = need
+	}
+	var (
+		bitmapStart  = uint32(1)
+		extentsStart = bitmapStart + bitmapBlocks
+		catalogStart = extentsStart + extentsBlocks
+		next         = catalogStart + catalogBlocks
+	)
+	for _, n := range nodes {
+		if !n.isDir() && len(n.data) > 0 {
+			n.start = next
+			next += n.blocks()
+		}
+	}
+	if catalog, err = v.catalog(nodes, date); err != nil {
+		return nil, fmt.Errorf("building catalog: %w", err)
+	}
+	used := next
+	img := make([]byte, int64(total)*BlockSize)
+	// Allocation bitmap, most significant bit first.
+	bitmap := img[bitmapStart*BlockSize : extentsStart*BlockSize]
+	mark := func(block uint32) {
+		bitmap[block/8] |= 0x80 >> (block % 8)
+	}
+	for b := uint32(0); b < used; b++ {
+		mark(b)
+	}
+	mark(total - 1)
+	copy(img[extentsStart*BlockSize:], btree(nil, extentsMaxKeyLength, bigKeys, nodeSize*int(extentsBlocks)))
+	copy(img[catalogStart*BlockSize:], catalog)
+	for _, n := range nodes {
+		if !n.isDir() {
+			copy(img[int64(n.start)*BlockSize:], n.data)
+		}
+	}
+	header := bytes.NewBuffer(nil)
+	put(header,
+		uint16(signature),
+		uint16(version),
+		uint32(volumeUnmounted),
+		uint32(lastMountedVersion),
+		uint32(0), // journal info block
+		date,      // create
+		date,      // modify
+		uint32(0), // backup
+		date,      // checked
+		files,
+		dirs,
+		uint32(BlockSize),
+		total,
+		total-used-1,
+		used,
+		uint32(BlockSize), // resource fork clump size
+		uint32(BlockSize), // data fork clump size
+		v.nextID,
+		uint32(1), // write count
+		uint64(1), // encodings bitmap, MacRoman
+		[8]uint32{},
+		fork(uint64(bitmapBlocks)*BlockSize, bitmapStart, bitmapBlocks),
+		fork(uint64(extentsBlocks)*BlockSize, extentsStart, extentsBlocks),
+		fork(uint64(catalogBlocks)*BlockSize, catalogStart, catalogBlocks),
+		fork(0, 0, 0), // attributes
+		fork(0, 0, 0), // startup
+	)
+	copy(img[1024:], header.Bytes())
+	copy(img[len(img)-1024:], header.Bytes())
+	return img, nil
+}
+
+// forkData describes the extents of a fork. Only the first extent is used.
+type forkData struct {
+	LogicalSize uint64
+	ClumpSize   uint32
+	TotalBlocks uint32
+	Extents     [8][2]uint32
+}
+
+func fork(size uint64, start, blocks uint32) forkData {
+	f := forkData{
+		LogicalSize: size,
+		ClumpSize:   blocks * BlockSize,
+		TotalBlocks: blocks,
+	}
+	if blocks > 0 {
+		f.Extents[0] = [2]uint32{start, blocks}
+	}
+	return f
+}
+
+// catalog encodes the catalog B-tree describing nodes.
+func (v *Volume) catalog(nodes []*node, date uint32) ([]byte, error) {
+	type record struct {
+		parent uint32
+		name   string
+		data   []byte
+	}
+	var records []record
+	for _, n := range nodes {
+		parent := n.parent
+		thread := bytes.NewBuffer(nil)
+		body := bytes.NewBuffer(nil)
+		if n.isDir() {
+			put(thread, int16(recordFolderThread), int16(0), parent)
+			put(body,
+				int16(recordFolder),
+				uint16(0),
+				uint32(len(n.children)),
+				n.id,
+				[5]uint32{date, date, date, date, 0},
+				permissions(modeDir|uint16(n.mode.Perm())),
+				[8]byte{}, // window bounds
+				n.flags,
+				[6]byte{}, // location, reserved
+				[16]byte{},
+				uint32(0), // text encoding
+				uint32(0),
+			)
+		} else {
+			var (
+				mode             = modeFile | uint16(n.mode.Perm())
+				fileType, author uint32
+			)
+			if n.isSymlink() {
+				mode = modeSymlink | uint16(n.mode.Perm())
+				fileType, author = 0x736C6E6B, 0x72686170 // "slnk", "rhap"
+			}
+			put(thread, int16(recordFileThread), int16(0), parent)
+			put(body,
+				int16(recordFile),
+				uint16(fileThreadExists),
+				uint32(0),
+				n.id,
+				[5]uint32{date, date, date, date, 0},
+				permissions(mode),
+				fileType,
+				author,
+				n.flags,
+				[6]byte{}, // location, reserved
+				[16]byte{},
+				uint32(0), // text encoding
+				uint32(0),
+				fork(uint64(len(n.data)), n.start, n.blocks()),
+				fork(0, 0, 0),
+			)
+		}
+		thread.Write(unistr(n.name))
+		records = append(records,
+			record{parent: parent, name: n.name, data: body.Bytes()},
+			record{parent: n.id, data: thread.Bytes()},
+		)
+	}
+	sort.Slice(records, func(ii, jj int) bool {
+		a, b := records[ii], records[jj]
+		if a.parent != b.parent {
+			return a.parent < b.parent
+		}
+		return compare(a.name, b.name) < 0
+	})
+	var entries []entry
+	for _, r := range records {
+		entries = append(entries, entry{key: catalogKey(r.parent, r.name), data: r.data})
+	}
+	tree := btree(entries, catalogMaxKeyLength, bigKeys|variableIndexKeys, 0)
+	if tree == nil {
+		return nil, fmt.Errorf("catalog too large")
+	}
+	return tree, nil
+}
+
+// permissions encodes HFSPlusBSDInfo, owned by the unknown user and group
+// so that files are accessible to whoever mounts the volume.
+func permissions(mode uint16) []byte {
+	buf := bytes.NewBuffer(nil)
+	put(buf, uint32(99), uint32(99), uint8(0), uint8(0), mode, uint32(0))
+	return buf.Bytes()
+}
+
+func catalogKey(parent uint32, name string) []byte {
+	buf := bytes.NewBuffer(nil)
+	u := unistr(name)
+	put(buf, uint16(4+len(u)), parent)
+	buf.Write(u)
+	return buf.Bytes()
+}
+
+// unistr encodes HFSUniStr255.
+func unistr(s string) []byte {
+	buf := bytes.NewBuffer(nil)
+	chars := utf16.Encode([]rune(s))
+	put(buf, uint16(len(chars)), chars)
+	return buf.Bytes()
+}
+
+// compare orders names as the catalog does, ignoring case.
+func compare(a, b string) int {
+	x, y := fold(a), fold(b)
+	for ii := 0; ii < len(x) && ii < len(y); ii++ {
+		if x[ii] != y[ii] {
+			if x[ii] < y[ii] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return len(x) - len(y)
+}
+
+func fold(s string) []uint16 {
+	chars := utf16.Encode([]rune(s))
+	for ii, c := range chars {
+		if c >= 'A' && c <= 'Z' {
+			chars[ii] = c + 'a' - 'A'
+		}
+	}
+	return chars
+}
+
+// entry is a B-tree record.
+type entry struct {
+	key  []byte
+	data []byte
+}
+
+// btree encodes records into a B-tree file of at least size bytes.
+// Leaves are filled in order and index levels built above them until a
+// single root remains. Returns nil if the tree doesn't fit in the node map
+// of the header node.
+func btree(records []entry, maxKey uint16, attributes uint32, size int) []byte {
+	var nodes [][]byte
+	// Node 0 is the header, added last once the tree is known.
+	nodes = append(nodes, nil)
+	pack := func(kind int8, height uint8, records []entry) []entry {
+		var (
+			firsts []entry
+			start  = len(nodes)
+			batch  []entry
+			used   = 14 + 2
+		)
+		flush := func() {
+			nodes = append(nodes, encodeNode(kind, height, batch))
+			firsts = append(firsts, entry{key: batch[0].key, data: be32(uint32(len(nodes) - 1))})
+			batch, used = nil, 14+2
+		}
+		for _, r := range records {
+			size := len(r.key) + len(r.data)
+			if used+size+2 > nodeSize && len(batch) > 0 {
+				flush()
+			}
+			batch = append(batch, r)
+			used += size + 2
+		}
+		if len(batch) > 0 {
+			flush()
+		}
+		// Link siblings.
+		for ii := start; ii < len(nodes); ii++ {
+			if ii > start {
+				binary.BigEndian.PutUint32(nodes[ii][4:], uint32(ii-1))
+			}
+			if ii < len(nodes)-1 {
+				binary.BigEndian.PutUint32(nodes[ii][0:], uint32(ii+1))
+			}
+		}
+		return firsts
+	}
+	var (
+		depth      uint16
+		root       uint32
+		firstLeaf  uint32
+		lastLeaf   uint32
+		leafRecord = uint32(len(records))
+	)
+	if len(records) > 0 {
+		level := pack(nodeLeaf, 1, records)
+		firstLeaf = uint32(1)
+		lastLeaf = uint32(len(nodes) - 1)
+		depth = 1
+		// Each level indexes the first key of every node in the level below.
+		for len(level) > 1 {
+			depth++
+			level = pack(nodeIndex, uint8(depth), level)
+		}
+		root = binary.BigEndian.Uint32(level[0].data)
+	}
+	total := len(nodes)
+	if want := (size + nodeSize - 1) / nodeSize; total < want {
+		total = want
+	}
+	// The header node's map record has a bit per node.
+	mapSize := nodeSize - 14 - 106 - 128 - 2*4
+	if total > mapSize*8 {
+		return nil
+	}
+	header := bytes.NewBuffer(nil)
+	put(header,
+		depth,
+		root,
+		leafRecord,
+		firstLeaf,
+		lastLeaf,
+		uint16(nodeSize),
+		maxKey,
+		uint32(total),
+		uint32(total-len(nodes)),
+		uint16(0),
+		uint32(nodeSize), // clump size
+		uint8(0),         // HFS B-tree
+		uint8(caseFolding),
+		attributes,
+		[16]uint32{},
+	)
+	bitmap := make([]byte, mapSize)
+	for ii := 0; ii < len(nodes); ii++ {
+		bitmap[ii/8] |= 0x80 >> (ii % 8)
+	}
+	nodes[0] = encodeRaw(nodeHeader, 0, [][]byte{header.Bytes(), make([]byte, 128), bitmap})
+	out := make([]byte, total*nodeSize)
+	for ii, n := range nodes {
+		copy(out[ii*nodeSize:], n)
+	}
+	return out
+}
+
+// encodeNode encodes a leaf or index node.
+func encodeNode(kind int8, height uint8, records []entry) []byte {
+	var raw [][]byte
+	for _, r := range records {
+		rec := append([]byte{}, r.key...)
+		rec = append(rec, r.data...)
+		raw = append(raw, rec)
+	}
+	return encodeRaw(kind, height, raw)
+}
+
+// encodeRaw lays out records in a node, followed by the offsets table which
+// grows backwards from the end of the node.
+func encodeRaw(kind int8, height uint8, records [][]byte) []byte {
+	node := make([]byte, nodeSize)
+	node[8] = byte(kind)
+	node[9] = height
+	binary.BigEndian.PutUint16(node[10:], uint16(len(records)))
+	offset := 14
+	for ii, r := range records {
+		binary.BigEndian.PutUint16(node[nodeSize-2*(ii+1):], uint16(offset))
+		copy(node[offset:], r)
+		offset += len(r)
+	}
+	// Offset of free space.
+	binary.BigEndian.PutUint16(node[nodeSize-2*(len(records)+1):], uint16(offset))
+	return node
+}
+
+func be32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+// put encodes each value into buf in order, big endian.
+func put(buf *bytes.Buffer, values ...interface{}) {
+	for _, v := range values {
+		if b, ok := v.([]byte); ok {
+			buf.Write(b)
+			continue
+		}
+		_ = binary.Write(buf, binary.BigEndian, v)
+	}
+}
@@ -0,0 +1,185 @@
+package hfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"path"
+	"testing"
+	"unicode/utf16"
+)
+
+// TestRoundTrip ensures that an encoded volume can be walked back into the
+// hierarchy that was written, by descending the catalog from its root node.
+func TestRoundTrip(t *testing.T) {
+	large := make([]byte, BlockSize*3+100)
+	rand.New(rand.NewSource(1)).Read(large)
+	want := map[string]string{
+		"/App.app/Contents/Info.plist":      "<plist/>",
+		"/App.app/Contents/MacOS/App":       string(large),
+		"/App.app/Contents/Resources/":      "dir",
+		"/App.app/Contents/Resources/empty": "",
+		"/Applications":                     "-> /Applications",
+	}
+	// Enough siblings to spill the catalog over several leaf nodes and
+	// require an index level.
+	for ii := 0; ii < 300; ii++ {
+		want[fmt.Sprintf("/many/File-%03d", ii)] = fmt.Sprintf("%d", ii)
+	}
+	v := &Volume{Name: "App"}
+	for p, content := range want {
+		var err error
+		switch {
+		case content == "dir":
+			err = v.Mkdir(p, 0755)
+		case len(content) > 3 && content[:3] == "-> ":
+			err = v.Symlink(content[3:], p)
+		default:
+			err = v.Create(p, 0755, []byte(content))
+		}
+		if err != nil {
+			t.Fatalf("adding %s: %v", p, err)
+		}
+	}
+	img, err := v.Bytes()
+	if err != nil {
+		t.Fatalf("writing volume: %v", err)
+	}
+	if len(img)%BlockSize != 0 {
+		t.Fatalf("volume not a whole number of blocks: %d", len(img))
+	}
+	if !bytes.Equal(img[1024:1536], img[len(img)-1024:len(img)-512]) {
+		t.Fatalf("alternate volume header differs")
+	}
+	got, name, err := read(img)
+	if err != nil {
+		t.Fatalf("reading volume: %v", err)
+	}
+	if name != "App" {
+		t.Errorf("volume name: got %q, want %q", name, "App")
+	}
+	for p, content := range want {
+		if content == "dir" {
+			p = path.Clean(p)
+		}
+		if got[p] != content {
+			t.Errorf("%s: got %d bytes, want %d bytes", p, len(got[p]), len(content))
+		}
+	}
+}
+
+// read decodes the subset of HFS+ written by Volume into a map of path to
+// content. Folders map to "dir" and symlinks to "-> target".
+func read(img []byte) (map[string]string, string, error) {
+	be := binary.BigEndian
+	vh := img[1024:]
+	if be.Uint16(vh) != signature {
+		return nil, "", fmt.Errorf("bad signature")
+	}
+	blockSize := int(be.Uint32(vh[40:]))
+	// Catalog fork data follows two other forks at offset 112.
+	catalog := vh[112+80*2:]
+	start := int(be.Uint32(catalog[16:]))
+	tree := img[start*blockSize : start*blockSize+int(be.Uint64(catalog))]
+	node := func(n int) []byte { return tree[n*nodeSize : (n+1)*nodeSize] }
+	records := func(n []byte) [][]byte {
+		count := int(be.Uint16(n[10:]))
+		var out [][]byte
+		for ii := 0; ii < count; ii++ {
+			a := be.Uint16(n[nodeSize-2*(ii+1):])
+			b := be.Uint16(n[nodeSize-2*(ii+2):])
+			out = append(out, n[a:b])
+		}
+		return out
+	}
+	header := records(node(0))[0]
+	// Descend from the root along the first pointer to the first leaf, then
+	// follow the leaf chain.
+	n := int(be.Uint32(header[2:]))
+	for int8(node(n)[8]) == nodeIndex {
+		key := records(node(n))[0]
+		n = int(be.Uint32(key[2+be.Uint16(key):]))
+	}
+	if n != int(be.Uint32(header[10:])) {
+		return nil, "", fmt.Errorf("root doesn't lead to first leaf")
+	}
+	type item struct {
+		parent uint32
+		name   string
+		kind   int16
+		data   string
+	}
+	var (
+		items = map[uint32]item{}
+		prev  []byte
+		leafs uint32
+	)
+	decode := func(b []byte) string {
+		l := be.Uint16(b)
+		chars := make([]uint16, l)
+		for ii := range chars {
+			chars[ii] = be.Uint16(b[2+2*ii:])
+		}
+		return string(utf16.Decode(chars))
+	}
+	for n != 0 {
+		for _, r := range records(node(n)) {
+			leafs++
+			klen := int(be.Uint16(r))
+			key := r[2 : 2+klen]
+			if prev != nil {
+				pp, pn := be.Uint32(prev), decode(prev[4:])
+				cp, cn := be.Uint32(key), decode(key[4:])
+				if pp > cp || (pp == cp && compare(pn, cn) >= 0) {
+					return nil, "", fmt.Errorf("catalog out of order: %d/%s, %d/%s", pp, pn, cp, cn)
+				}
+			}
+			prev = key
+			parent, name := be.Uint32(key), decode(key[4:])
+			rec := r[2+klen:]
+			switch kind := int16(be.Uint16(rec)); kind {
+			case recordFolder:
+				items[be.Uint32(rec[8:])] = item{parent: parent, name: name, kind: kind}
+			case recordFile:
+				id := be.Uint32(rec[8:])
+				mode := be.Uint16(rec[42:])
+				fork := rec[88:]
+				size := be.Uint64(fork)
+				first := int(be.Uint32(fork[16:]))
+				data := string(img[first*blockSize : first*blockSize+int(size)])
+				if mode&0170000 == modeSymlink {
+					data = "-> " + data
+				}
+				items[id] = item{parent: parent, name: name, kind: kind, data: data}
+			case recordFolderThread, recordFileThread:
+			default:
+				return nil, "", fmt.Errorf("unknown record type %d", kind)
+			}
+		}
+		n = int(be.Uint32(node(n)))
+	}
+	if leafs != be.Uint32(header[6:]) {
+		return nil, "", fmt.Errorf("leaf records: got %d, header says %d", leafs, be.Uint32(header[6:]))
+	}
+	var resolve func(id uint32) string
+	resolve = func(id uint32) string {
+		if id == rootFolderID {
+			return ""
+		}
+		it := items[id]
+		return resolve(it.parent) + "/" + it.name
+	}
+	out := map[string]string{}
+	for id, it := range items {
+		if id == rootFolderID {
+			continue
+		}
+		if it.kind == recordFolder {
+			out[resolve(id)] = "dir"
+		} else {
+			out[resolve(id)] = it.data
+		}
+	}
+	return out, items[rootFolderID].name, nil
+}
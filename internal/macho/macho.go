@@ -0,0 +1,84 @@
+// macho format encoding.
+//
+// Merges thin Mach-O executables into a universal ("fat") binary holding a
+// slice per architecture, equivalent to "lipo -create", and writes code
+// signatures into them, equivalent to "codesign".
+//
+// See <mach-o/fat.h> in Apple's cctools, and <Kernel/kern/cs_blobs.h> for
+// the structures of code signatures.
+package macho
+
+import (
+	"bytes"
+	"debug/macho"
+	"encoding/binary"
+	"fmt"
+)
+
+// FatMagic identifies a universal binary.
+const FatMagic = 0xCAFEBABE
+
+// Fat merges thin executables into a universal binary, in the order given.
+//
+// Slices are aligned to the page size of their architecture, 16KiB for ARM
+// and 4KiB otherwise.
+func Fat(slices ...[]byte) ([]byte, error) {
+	if len(slices) == 0 {
+		return nil, fmt.Errorf("no slices")
+	}
+	type arch struct {
+		cpu, sub    uint32
+		offset, len uint64
+		align       uint32
+	}
+	var (
+		archs  = make([]arch, len(slices))
+		seen   = map[macho.Cpu]bool{}
+		offset = uint64(8 + 20*len(slices))
+	)
+	for ii, s := range slices {
+		f, err := macho.NewFile(bytes.NewReader(s))
+		if err != nil {
+			return nil, fmt.Errorf("slice %d: %w", ii, err)
+		}
+		if seen[f.Cpu] {
+			return nil, fmt.Errorf("slice %d: duplicate architecture %s", ii, f.Cpu)
+		}
+		seen[f.Cpu] = true
+		a := arch{cpu: uint32(f.Cpu), sub: f.SubCpu, len: uint64(len(s)), align: 12}
+		if f.Cpu == macho.CpuArm || f.Cpu == macho.CpuArm64 {
+			a.align = 14
+		}
+		a.offset = align(offset, 1<<a.align)
+		offset = a.offset + a.len
+		archs[ii] = a
+	}
+	if offset > 1<<32-1 {
+		return nil, fmt.Errorf("universal binary of %d bytes exceeds 4GiB", offset)
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, offset))
+	put(buf, uint32(FatMagic), uint32(len(archs)))
+	for _, a := range archs {
+		put(buf, a.cpu, a.sub, uint32(a.offset), uint32(a.len), a.align)
+	}
+	for ii, a := range archs {
+		buf.Write(make([]byte, a.offset-uint64(buf.Len())))
+		buf.Write(slices[ii])
+	}
+	return buf.Bytes(), nil
+}
+
+func align(n, to uint64) uint64 {
+	return (n + to - 1) &^ (to - 1)
+}
+
+// put writes each value big-endian, as are the structures of the fat header.
+func put(buf *bytes.Buffer, values ...interface{}) {
+	for _, v := range values {
+		if b, ok := v.([]byte); ok {
+			buf.Write(b)
+			continue
+		}
+		_ = binary.Write(buf, binary.BigEndian, v)
+	}
+}
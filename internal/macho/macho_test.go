@@ -0,0 +1,209 @@
+package macho
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"debug/macho"
+	"encoding/binary"
+	"testing"
+)
+
+// thin returns a minimal executable header for cpu.
+func thin(cpu macho.Cpu) []byte {
+	by := make([]byte, 32)
+	binary.LittleEndian.PutUint32(by, macho.Magic64)
+	binary.LittleEndian.PutUint32(by[4:], uint32(cpu))
+	binary.LittleEndian.PutUint32(by[12:], uint32(macho.TypeExec))
+	return by
+}
+
+func TestFat(t *testing.T) {
+	amd64, arm64 := thin(macho.CpuAmd64), thin(macho.CpuArm64)
+	by, err := Fat(amd64, arm64)
+	if err != nil {
+		t.Fatalf("merging: %v", err)
+	}
+	f, err := macho.NewFatFile(bytes.NewReader(by))
+	if err != nil {
+		t.Fatalf("parsing: %v", err)
+	}
+	if len(f.Arches) != 2 {
+		t.Fatalf("got %d slices, want 2", len(f.Arches))
+	}
+	for ii, want := range []struct {
+		cpu    macho.Cpu
+		offset uint32
+		slice  []byte
+	}{
+		{macho.CpuAmd64, 1 << 12, amd64},
+		{macho.CpuArm64, 1 << 14, arm64},
+	} {
+		a := f.Arches[ii]
+		if a.Cpu != want.cpu || a.Offset != want.offset {
+			t.Errorf("slice %d: got %s at %#x, want %s at %#x", ii, a.Cpu, a.Offset, want.cpu, want.offset)
+		}
+		if !bytes.Equal(by[a.Offset:a.Offset+a.Size], want.slice) {
+			t.Errorf("slice %d: contents differ", ii)
+		}
+	}
+	if _, err := Fat(amd64, amd64); err == nil {
+		t.Errorf("duplicate architecture: expected error")
+	}
+	if _, err := Fat([]byte("not mach-o")); err == nil {
+		t.Errorf("invalid slice: expected error")
+	}
+}
+
+// testExecutable builds an executable with a __TEXT segment holding one
+// section and a __LINKEDIT segment, laid out as the Go linker does.
+func testExecutable(cpu macho.Cpu) []byte {
+	buf := bytes.NewBuffer(nil)
+	w := func(values ...interface{}) {
+		for _, v := range values {
+			if s, ok := v.(string); ok {
+				name := make([]byte, 16)
+				copy(name, s)
+				buf.Write(name)
+				continue
+			}
+			_ = binary.Write(buf, binary.LittleEndian, v)
+		}
+	}
+	w(uint32(macho.Magic64), uint32(cpu), uint32(0), uint32(macho.TypeExec), uint32(2), uint32(72+80+72), uint32(0), uint32(0))
+	w(uint32(lcSegment64), uint32(72+80), "__TEXT", uint64(0x100000000), uint64(0x3000), uint64(0), uint64(0x3000), uint32(5), uint32(5), uint32(1), uint32(0))
+	w("__text", "__TEXT", uint64(0x100001000), uint64(0x2000), uint32(0x1000), uint32(4), uint32(0), uint32(0), uint32(0), uint32(0), uint32(0), uint32(0))
+	w(uint32(lcSegment64), uint32(72), "__LINKEDIT", uint64(0x100004000), uint64(0x1000), uint64(0x3000), uint64(0x123), uint32(1), uint32(1), uint32(0), uint32(0))
+	buf.Write(make([]byte, 0x1000-buf.Len()))
+	buf.Write(bytes.Repeat([]byte{0xC3}, 0x2123))
+	return buf.Bytes()
+}
+
+// superBlob returns the blobs of the code signature of a thin executable,
+// keyed by slot.
+func superBlob(t *testing.T, exe []byte) map[uint32][]byte {
+	f, err := macho.NewFile(bytes.NewReader(exe))
+	if err != nil {
+		t.Fatalf("parsing: %v", err)
+	}
+	for _, l := range f.Loads {
+		raw := l.Raw()
+		if binary.LittleEndian.Uint32(raw) != lcCodeSignature {
+			continue
+		}
+		off, size := binary.LittleEndian.Uint32(raw[8:]), binary.LittleEndian.Uint32(raw[12:])
+		if int(off+size) != len(exe) {
+			t.Fatalf("signature at %#x of %#x bytes, file is %#x bytes", off, size, len(exe))
+		}
+		var (
+			be    = binary.BigEndian
+			sb    = exe[off:]
+			blobs = map[uint32][]byte{}
+		)
+		if be.Uint32(sb) != magicSuperBlob {
+			t.Fatalf("got super blob magic %#x", be.Uint32(sb))
+		}
+		for ii := uint32(0); ii < be.Uint32(sb[8:]); ii++ {
+			slot, at := be.Uint32(sb[12+8*ii:]), be.Uint32(sb[16+8*ii:])
+			blobs[slot] = sb[at : at+be.Uint32(sb[at+4:])]
+		}
+		return blobs
+	}
+	t.Fatalf("no code signature")
+	return nil
+}
+
+func TestSign(t *testing.T) {
+	exe := testExecutable(macho.CpuArm64)
+	info := []byte("<plist/>")
+	signed, err := Sign(exe, Signature{Identifier: "com.example.Notes", InfoPlist: info})
+	if err != nil {
+		t.Fatalf("signing: %v", err)
+	}
+	blobs := superBlob(t, signed)
+	cd := blobs[slotCodeDirectory]
+	be := binary.BigEndian
+	if flags := be.Uint32(cd[12:]); flags != FlagAdhoc {
+		t.Errorf("got flags %#x, want ad-hoc", flags)
+	}
+	var (
+		hashes  = be.Uint32(cd[16:])
+		special = be.Uint32(cd[24:])
+		pages   = be.Uint32(cd[28:])
+		limit   = be.Uint32(cd[32:])
+	)
+	if got := string(cd[directorySize : directorySize+len("com.example.Notes")]); got != "com.example.Notes" {
+		t.Errorf("got identifier %q", got)
+	}
+	if want := sha256.Sum256(info); !bytes.Equal(cd[hashes-slotInfo*32:hashes-slotInfo*32+32], want[:]) {
+		t.Errorf("Info.plist hash not sealed")
+	}
+	if want := sha256.Sum256(blobs[slotRequirements]); special != slotRequirements || !bytes.Equal(cd[hashes-64:hashes-32], want[:]) {
+		t.Errorf("requirements hash not sealed")
+	}
+	for ii := uint32(0); ii < pages; ii++ {
+		end := (ii + 1) * pageSize
+		if end > limit {
+			end = limit
+		}
+		want := sha256.Sum256(signed[ii*pageSize : end])
+		if !bytes.Equal(cd[hashes+32*ii:hashes+32*ii+32], want[:]) {
+			t.Errorf("page %d: hash mismatch", ii)
+		}
+	}
+	// Signing again replaces the signature, rather than adding another.
+	again, err := Sign(signed, Signature{Identifier: "com.example.Notes", InfoPlist: info})
+	if err != nil {
+		t.Fatalf("signing again: %v", err)
+	}
+	if !bytes.Equal(again, signed) {
+		t.Errorf("signing again changed the executable")
+	}
+	cms := []byte("cms")
+	var directory []byte
+	signed, err = Sign(exe, Signature{
+		Identifier:      "com.example.Notes",
+		TeamID:          "ABCDE12345",
+		Entitlements:    []byte("<plist/>"),
+		EntitlementsDER: []byte{0x70, 0x00},
+		Sign: func(cd []byte) ([]byte, error) {
+			directory = cd
+			return cms, nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("signing with certificate: %v", err)
+	}
+	blobs = superBlob(t, signed)
+	if !bytes.Equal(blobs[slotCodeDirectory], directory) {
+		t.Errorf("signed code directory differs from the one embedded")
+	}
+	if !bytes.Equal(blobs[slotSignature][8:], cms) || be.Uint32(blobs[slotCodeDirectory][12:])&FlagAdhoc != 0 {
+		t.Errorf("signature not embedded")
+	}
+	if be.Uint32(blobs[slotEntitlements]) != magicEntitlements || be.Uint32(blobs[slotDER]) != magicDER {
+		t.Errorf("entitlements not embedded")
+	}
+	cd = blobs[slotCodeDirectory]
+	hashes = be.Uint32(cd[16:])
+	if want := sha256.Sum256(blobs[slotDER]); be.Uint32(cd[24:]) != slotDER || !bytes.Equal(cd[hashes-slotDER*32:hashes-slotDER*32+32], want[:]) {
+		t.Errorf("DER entitlements not sealed")
+	}
+}
+
+func TestSignFat(t *testing.T) {
+	fat, err := Fat(testExecutable(macho.CpuAmd64), testExecutable(macho.CpuArm64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := Sign(fat, Signature{Identifier: "com.example.Notes"})
+	if err != nil {
+		t.Fatalf("signing: %v", err)
+	}
+	f, err := macho.NewFatFile(bytes.NewReader(signed))
+	if err != nil {
+		t.Fatalf("parsing: %v", err)
+	}
+	for _, a := range f.Arches {
+		superBlob(t, signed[a.Offset:a.Offset+a.Size])
+	}
+}
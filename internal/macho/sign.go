@@ -0,0 +1,337 @@
+package macho
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"debug/macho"
+	"encoding/binary"
+	"fmt"
+)
+
+// Code directory flags.
+const (
+	// FlagAdhoc marks a signature without a certificate.
+	FlagAdhoc = 0x2
+	// FlagRuntime opts the executable into the hardened runtime.
+	FlagRuntime = 0x10000
+)
+
+// Magic numbers of the blobs in a code signature.
+const (
+	magicRequirements  = 0xFADE0C01
+	magicCodeDirectory = 0xFADE0C02
+	magicSuperBlob     = 0xFADE0CC0
+	magicEntitlements  = 0xFADE7171
+	magicDER           = 0xFADE7172
+	magicBlobWrapper   = 0xFADE0B01
+)
+
+// Slots of the blobs in a code signature. Slots from 1 to 7 are special
+// slots, whose hashes are stored in the code directory.
+const (
+	slotCodeDirectory = 0
+	slotInfo          = 1
+	slotRequirements  = 2
+	slotResources     = 3
+	slotEntitlements  = 5
+	slotDER           = 7
+	slotSignature     = 0x10000
+)
+
+const (
+	lcCodeSignature = 0x1D
+	lcSegment64     = 0x19
+	// pageSize is the unit of code that is hashed.
+	pageSize = 1 << 12
+	// directorySize is the size of a version 0x20400 code directory header.
+	directorySize = 88
+	// execSegMain marks the executable segment as that of a main binary.
+	execSegMain = 0x1
+)
+
+// Signature configures the code signature written by Sign.
+type Signature struct {
+	// Identifier of the code, the bundle ID of an application.
+	Identifier string
+	// TeamID of the signing certificate, if any.
+	TeamID string
+	// Flags of the code directory, eg FlagRuntime. FlagAdhoc is added if
+	// there is no Sign function.
+	Flags uint32
+	// InfoPlist and Resources are the Info.plist and CodeResources of the
+	// bundle the executable belongs to, which are sealed by their hashes.
+	InfoPlist, Resources []byte
+	// Entitlements is the entitlements plist, embedded in the signature.
+	Entitlements []byte
+	// EntitlementsDER is the DER encoding of the entitlements, which macOS
+	// 12 and later read in place of the plist.
+	EntitlementsDER []byte
+	// Sign returns the CMS signature of a code directory. The signature is
+	// ad-hoc if nil.
+	Sign func(codeDirectory []byte) ([]byte, error)
+}
+
+// Sign writes a code signature into an executable, replacing any existing
+// one. Universal binaries have each slice signed.
+//
+// The signature is placed at the end of the __LINKEDIT segment, which must be
+// last in the file, and is located by an LC_CODE_SIGNATURE load command that
+// is added if missing.
+func Sign(exe []byte, s Signature) ([]byte, error) {
+	if len(exe) >= 4 && binary.BigEndian.Uint32(exe) == FatMagic {
+		f, err := macho.NewFatFile(bytes.NewReader(exe))
+		if err != nil {
+			return nil, err
+		}
+		var slices [][]byte
+		for _, a := range f.Arches {
+			signed, err := sign(exe[a.Offset:a.Offset+a.Size], s)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", a.Cpu, err)
+			}
+			slices = append(slices, signed)
+		}
+		return Fat(slices...)
+	}
+	return sign(exe, s)
+}
+
+// sign signs a thin executable.
+func sign(exe []byte, s Signature) ([]byte, error) {
+	f, err := macho.NewFile(bytes.NewReader(exe))
+	if err != nil {
+		return nil, err
+	}
+	if f.Magic != macho.Magic64 {
+		return nil, fmt.Errorf("unsupported mach-o magic %#x", f.Magic)
+	}
+	text := f.Segment("__TEXT")
+	if text == nil {
+		return nil, fmt.Errorf("missing __TEXT segment")
+	}
+	var (
+		le       = binary.LittleEndian
+		ncmds    = le.Uint32(exe[16:])
+		cmdsize  = le.Uint32(exe[20:])
+		end      = uint64(len(exe))
+		linkedit = -1
+		sig      = -1
+		free     = end
+	)
+	// Find the load commands to update, and the room left for more before
+	// the first section.
+	for ii, off := uint32(0), 32; ii < ncmds; ii++ {
+		if off+8 > len(exe) {
+			return nil, fmt.Errorf("load command %d: out of bounds", ii)
+		}
+		cmd, size := le.Uint32(exe[off:]), int(le.Uint32(exe[off+4:]))
+		if size < 8 || off+size > len(exe) {
+			return nil, fmt.Errorf("load command %d: invalid size %d", ii, size)
+		}
+		switch cmd {
+		case lcCodeSignature:
+			sig = off
+		case lcSegment64:
+			if string(bytes.TrimRight(exe[off+8:off+24], "\x00")) == "__LINKEDIT" {
+				linkedit = off
+			}
+			for jj := 0; jj < int(le.Uint32(exe[off+64:])); jj++ {
+				sect := off + 72 + 80*jj
+				// Zero filled sections have no data in the file.
+				if offset := le.Uint32(exe[sect+48:]); offset != 0 && uint64(offset) < free {
+					free = uint64(offset)
+				}
+			}
+		}
+		off += size
+	}
+	if linkedit < 0 {
+		return nil, fmt.Errorf("missing __LINKEDIT segment")
+	}
+	out := append([]byte(nil), exe...)
+	if sig >= 0 {
+		// The existing signature is dropped, and its command reused.
+		dataoff := uint64(le.Uint32(exe[sig+8:]))
+		if dataoff+uint64(le.Uint32(exe[sig+12:])) != end {
+			return nil, fmt.Errorf("existing signature is not at the end of the file")
+		}
+		out = out[:dataoff]
+	} else {
+		sig = 32 + int(cmdsize)
+		if uint64(sig+16) > free {
+			return nil, fmt.Errorf("no room for the signature load command")
+		}
+		le.PutUint32(out[sig:], lcCodeSignature)
+		le.PutUint32(out[sig+4:], 16)
+		le.PutUint32(out[16:], ncmds+1)
+		le.PutUint32(out[20:], cmdsize+16)
+	}
+	if fileoff, filesize := le.Uint64(out[linkedit+40:]), le.Uint64(out[linkedit+48:]); fileoff+filesize != end {
+		return nil, fmt.Errorf("__LINKEDIT is not at the end of the file")
+	}
+	var (
+		limit    = align(uint64(len(out)), 16)
+		pages    = int((limit + pageSize - 1) / pageSize)
+		ident    = []byte(s.Identifier + "\x00")
+		team     []byte
+		special  = slotRequirements
+		flags    = s.Flags
+		reqs     = blob(magicRequirements, make([]byte, 4))
+		entitled []byte
+		der      []byte
+	)
+	if s.TeamID != "" {
+		team = []byte(s.TeamID + "\x00")
+	}
+	if s.Resources != nil {
+		special = slotResources
+	}
+	if s.Entitlements != nil {
+		entitled = blob(magicEntitlements, s.Entitlements)
+		special = slotEntitlements
+	}
+	if s.EntitlementsDER != nil {
+		der = blob(magicDER, s.EntitlementsDER)
+		special = slotDER
+	}
+	if s.Sign == nil {
+		flags |= FlagAdhoc
+	}
+	cdSize := directorySize + len(ident) + len(team) + sha256.Size*(special+pages)
+	// Space for the CMS signature is reserved by signing a placeholder of the
+	// same size, with some slack as signature encodings vary in length.
+	cmsSize := 0
+	if s.Sign != nil {
+		placeholder, err := s.Sign(make([]byte, cdSize))
+		if err != nil {
+			return nil, fmt.Errorf("signing: %w", err)
+		}
+		cmsSize = len(placeholder) + 256
+	}
+	count := 3
+	if entitled != nil {
+		count++
+	}
+	if der != nil {
+		count++
+	}
+	size := align(uint64(12+8*count+cdSize+len(reqs)+len(entitled)+len(der)+8+cmsSize), 16)
+	if limit+size > 1<<32-1 {
+		return nil, fmt.Errorf("executable too large to sign")
+	}
+	// Headers are updated before hashing, as they are part of the code.
+	le.PutUint32(out[sig+8:], uint32(limit))
+	le.PutUint32(out[sig+12:], uint32(size))
+	var (
+		fileoff  = le.Uint64(out[linkedit+40:])
+		filesize = limit + size - fileoff
+		vmsize   = align(filesize, 1<<12)
+	)
+	if f.Cpu == macho.CpuArm64 {
+		vmsize = align(filesize, 1<<14)
+	}
+	if vmsize < le.Uint64(out[linkedit+32:]) {
+		vmsize = le.Uint64(out[linkedit+32:])
+	}
+	le.PutUint64(out[linkedit+32:], vmsize)
+	le.PutUint64(out[linkedit+48:], filesize)
+	out = append(out, make([]byte, limit-uint64(len(out)))...)
+
+	cd := bytes.NewBuffer(make([]byte, 0, cdSize))
+	execFlags := uint64(0)
+	if f.Type == macho.TypeExec {
+		execFlags = execSegMain
+	}
+	teamOffset := uint32(0)
+	if team != nil {
+		teamOffset = uint32(directorySize + len(ident))
+	}
+	put(cd,
+		uint32(magicCodeDirectory), uint32(cdSize), uint32(0x20400), flags,
+		uint32(directorySize+len(ident)+len(team)+sha256.Size*special), // hash offset
+		uint32(directorySize), // identifier offset
+		uint32(special), uint32(pages), uint32(limit),
+		uint8(sha256.Size), uint8(2), uint8(0), uint8(12), // hash size, SHA-256, platform, log2 page size
+		uint32(0), uint32(0), teamOffset, uint32(0), uint64(0), // spare, scatter, team, spare, 64 bit limit
+		text.Offset, text.Filesz, execFlags,
+		ident, team,
+	)
+	for slot := special; slot > 0; slot-- {
+		var data []byte
+		switch slot {
+		case slotInfo:
+			data = s.InfoPlist
+		case slotRequirements:
+			data = reqs
+		case slotResources:
+			data = s.Resources
+		case slotEntitlements:
+			data = entitled
+		case slotDER:
+			data = der
+		}
+		if data == nil {
+			cd.Write(make([]byte, sha256.Size))
+			continue
+		}
+		h := sha256.Sum256(data)
+		cd.Write(h[:])
+	}
+	for ii := 0; ii < pages; ii++ {
+		page := out[ii*pageSize:]
+		if len(page) > pageSize {
+			page = page[:pageSize]
+		}
+		h := sha256.Sum256(page)
+		cd.Write(h[:])
+	}
+	var cms []byte
+	if s.Sign != nil {
+		if cms, err = s.Sign(cd.Bytes()); err != nil {
+			return nil, fmt.Errorf("signing: %w", err)
+		}
+		if len(cms) > cmsSize {
+			return nil, fmt.Errorf("signature larger than reserved")
+		}
+	}
+	blobs := []entry{
+		{slotCodeDirectory, cd.Bytes()},
+		{slotRequirements, reqs},
+	}
+	if entitled != nil {
+		blobs = append(blobs, entry{slotEntitlements, entitled})
+	}
+	if der != nil {
+		blobs = append(blobs, entry{slotDER, der})
+	}
+	blobs = append(blobs, entry{slotSignature, blob(magicBlobWrapper, cms)})
+	super := bytes.NewBuffer(nil)
+	length := 12 + 8*len(blobs)
+	for _, b := range blobs {
+		length += len(b.data)
+	}
+	put(super, uint32(magicSuperBlob), uint32(length), uint32(len(blobs)))
+	offset := 12 + 8*len(blobs)
+	for _, b := range blobs {
+		put(super, b.slot, uint32(offset))
+		offset += len(b.data)
+	}
+	for _, b := range blobs {
+		super.Write(b.data)
+	}
+	super.Write(make([]byte, int(size)-super.Len()))
+	return append(out, super.Bytes()...), nil
+}
+
+// entry is a blob of a super blob, and the slot it fills.
+type entry struct {
+	slot uint32
+	data []byte
+}
+
+// blob wraps data with a magic number and length.
+func blob(magic uint32, data []byte) []byte {
+	buf := bytes.NewBuffer(nil)
+	put(buf, magic, uint32(8+len(data)), data)
+	return buf.Bytes()
+}
@@ -0,0 +1,47 @@
+package pe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// SetIcon adds the images of an ICO file as icon resources, grouped under
+// the group icon resource id. Icon resources are numbered from 1, replacing
+// any existing ones.
+//
+// Explorer shows the group with the lowest ID as the icon of the executable.
+func (r *Resources) SetIcon(id uint16, ico []byte) error {
+	if len(ico) < 6 {
+		return fmt.Errorf("ico: short header")
+	}
+	var (
+		kind  = binary.LittleEndian.Uint16(ico[2:])
+		count = int(binary.LittleEndian.Uint16(ico[4:]))
+	)
+	if kind != 1 {
+		return fmt.Errorf("ico: not an icon")
+	}
+	if len(ico) < 6+16*count {
+		return fmt.Errorf("ico: short directory")
+	}
+	r.Delete(TypeIcon)
+	group := bytes.NewBuffer(nil)
+	put(group, uint16(0), uint16(1), uint16(count))
+	for ii := 0; ii < count; ii++ {
+		var (
+			entry  = ico[6+16*ii : 6+16*(ii+1)]
+			size   = binary.LittleEndian.Uint32(entry[8:])
+			offset = binary.LittleEndian.Uint32(entry[12:])
+		)
+		if uint64(offset)+uint64(size) > uint64(len(ico)) {
+			return fmt.Errorf("ico: image %d out of bounds", ii)
+		}
+		// The group entry is the directory entry with the file offset
+		// replaced by the icon resource ID.
+		put(group, entry[:12], uint16(ii+1))
+		r.Set(TypeIcon, uint16(ii+1), ico[offset:offset+size])
+	}
+	r.Set(TypeGroupIcon, id, group.Bytes())
+	return nil
+}
@@ -0,0 +1,312 @@
+package pe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// image is the parsed layout of a PE image: enough of its headers to find and
+// rewrite sections.
+type image struct {
+	data []byte
+	// Offsets of the COFF header, optional header and section table.
+	coff, optional, sections int
+	// plus is true for PE32+.
+	plus bool
+	// count of sections.
+	count int
+}
+
+// Data directory indices.
+const (
+	dirResource = 2
+	dirSecurity = 4
+)
+
+func parse(exe []byte) (*image, error) {
+	le := binary.LittleEndian
+	if len(exe) < 0x40 || string(exe[:2]) != "MZ" {
+		return nil, fmt.Errorf("not a PE image: missing MZ header")
+	}
+	pe := int(le.Uint32(exe[0x3C:]))
+	if pe+24 > len(exe) || string(exe[pe:pe+4]) != "PE\x00\x00" {
+		return nil, fmt.Errorf("not a PE image: missing PE signature")
+	}
+	img := &image{
+		data:     exe,
+		coff:     pe + 4,
+		optional: pe + 24,
+		count:    int(le.Uint16(exe[pe+6:])),
+	}
+	size := int(le.Uint16(exe[img.coff+16:]))
+	img.sections = img.optional + size
+	if size < 2 || img.sections+40*img.count > len(exe) {
+		return nil, fmt.Errorf("truncated headers")
+	}
+	switch magic := le.Uint16(exe[img.optional:]); magic {
+	case 0x10B:
+	case 0x20B:
+		img.plus = true
+	default:
+		return nil, fmt.Errorf("unknown optional header magic %#x", magic)
+	}
+	if img.directories() <= dirSecurity || img.directory(dirSecurity)+8 > img.sections {
+		return nil, fmt.Errorf("missing data directories")
+	}
+	return img, nil
+}
+
+// field returns the offset of an optional header field, given its offset in
+// PE32 and PE32+ images.
+func (img *image) field(pe32, plus int) int {
+	if img.plus {
+		return img.optional + plus
+	}
+	return img.optional + pe32
+}
+
+func (img *image) u32(off int) uint32 {
+	return binary.LittleEndian.Uint32(img.data[off:])
+}
+
+func (img *image) setU32(off int, v uint32) {
+	binary.LittleEndian.PutUint32(img.data[off:], v)
+}
+
+func (img *image) directories() int {
+	return int(img.u32(img.field(92, 108)))
+}
+
+// directory returns the offset of data directory n.
+func (img *image) directory(n int) int {
+	return img.field(96, 112) + 8*n
+}
+
+// section returns the offset of section header n.
+func (img *image) section(n int) int {
+	return img.sections + 40*n
+}
+
+// Read returns the resources of a PE image. Only resources identified by
+// number are supported, and of each only the first language is kept.
+func Read(exe []byte) (*Resources, error) {
+	img, err := parse(exe)
+	if err != nil {
+		return nil, err
+	}
+	return img.resources()
+}
+
+func (img *image) resources() (*Resources, error) {
+	r := &Resources{}
+	var (
+		rva  = img.u32(img.directory(dirResource))
+		size = img.u32(img.directory(dirResource) + 4)
+	)
+	if rva == 0 || size == 0 {
+		return r, nil
+	}
+	section, base, err := img.mapped(rva)
+	if err != nil {
+		return nil, fmt.Errorf("resource directory: %w", err)
+	}
+	le := binary.LittleEndian
+	// entries reads the directory at off, bounds checked.
+	entries := func(off uint32) ([][2]uint32, error) {
+		if uint64(off)+16 > uint64(len(section)) {
+			return nil, fmt.Errorf("directory out of bounds")
+		}
+		var (
+			named = int(le.Uint16(section[off+12:]))
+			n     = named + int(le.Uint16(section[off+14:]))
+		)
+		if named > 0 {
+			return nil, fmt.Errorf("named resources are not supported")
+		}
+		if uint64(off)+16+8*uint64(n) > uint64(len(section)) {
+			return nil, fmt.Errorf("directory out of bounds")
+		}
+		var list [][2]uint32
+		for ii := 0; ii < n; ii++ {
+			e := section[int(off)+16+8*ii:]
+			list = append(list, [2]uint32{le.Uint32(e), le.Uint32(e[4:])})
+		}
+		return list, nil
+	}
+	types, err := entries(0)
+	if err != nil {
+		return nil, err
+	}
+	for _, typ := range types {
+		if typ[1]&0x80000000 == 0 {
+			return nil, fmt.Errorf("type %d: expected directory", typ[0])
+		}
+		ids, err := entries(typ[1] &^ 0x80000000)
+		if err != nil {
+			return nil, fmt.Errorf("type %d: %w", typ[0], err)
+		}
+		for _, id := range ids {
+			if id[1]&0x80000000 == 0 {
+				return nil, fmt.Errorf("resource %d/%d: expected directory", typ[0], id[0])
+			}
+			langs, err := entries(id[1] &^ 0x80000000)
+			if err != nil || len(langs) == 0 {
+				return nil, fmt.Errorf("resource %d/%d: missing language", typ[0], id[0])
+			}
+			entry := langs[0][1]
+			if entry&0x80000000 != 0 || uint64(entry)+16 > uint64(len(section)) {
+				return nil, fmt.Errorf("resource %d/%d: bad data entry", typ[0], id[0])
+			}
+			var (
+				at   = le.Uint32(section[entry:])
+				size = le.Uint32(section[entry+4:])
+			)
+			if at < base || uint64(at-base)+uint64(size) > uint64(len(section)) {
+				return nil, fmt.Errorf("resource %d/%d: data out of bounds", typ[0], id[0])
+			}
+			data := make([]byte, size)
+			copy(data, section[at-base:])
+			r.Set(uint16(typ[0]), uint16(id[0]), data)
+		}
+	}
+	return r, nil
+}
+
+// mapped returns the file contents of the section containing rva from rva
+// onward, along with rva itself.
+func (img *image) mapped(rva uint32) ([]byte, uint32, error) {
+	for ii := 0; ii < img.count; ii++ {
+		var (
+			s     = img.section(ii)
+			va    = img.u32(s + 12)
+			size  = img.u32(s + 16)
+			start = img.u32(s + 20)
+		)
+		if rva < va || rva >= va+img.u32(s+8) {
+			continue
+		}
+		if rva-va >= size {
+			return nil, 0, fmt.Errorf("rva %#x not in file", rva)
+		}
+		var (
+			off = uint64(start) + uint64(rva-va)
+			end = uint64(start) + uint64(size)
+		)
+		if end > uint64(len(img.data)) {
+			return nil, 0, fmt.Errorf("section out of bounds")
+		}
+		return img.data[off:end], rva, nil
+	}
+	return nil, 0, fmt.Errorf("rva %#x not in any section", rva)
+}
+
+// Patch sets the resources of a PE image, as a post link step. Resources
+// already in the image are kept, except those of a type r has, which are
+// replaced.
+//
+// The resource section is rewritten if it is the last section of the image,
+// otherwise a new one is appended and the old one is left unreferenced. A
+// signature is removed, since it no longer matches, and the checksum zeroed.
+func Patch(exe []byte, r *Resources) ([]byte, error) {
+	img, err := parse(append([]byte(nil), exe...))
+	if err != nil {
+		return nil, err
+	}
+	merged, err := img.resources()
+	if err != nil {
+		return nil, fmt.Errorf("reading resources: %w", err)
+	}
+	for typ, ids := range r.entries {
+		merged.Delete(typ)
+		for id, data := range ids {
+			merged.Set(typ, id, data)
+		}
+	}
+	// Drop the signature, which sits at the end of the file.
+	if off := img.u32(img.directory(dirSecurity)); off != 0 && int(off) <= len(img.data) {
+		img.data = img.data[:off]
+		img.setU32(img.directory(dirSecurity), 0)
+		img.setU32(img.directory(dirSecurity)+4, 0)
+	}
+	var (
+		sectionAlign = img.u32(img.field(32, 32))
+		fileAlign    = img.u32(img.field(36, 36))
+		headers      = img.u32(img.field(60, 60))
+		last         = -1
+		existing     = -1
+		rva          = img.u32(img.directory(dirResource))
+	)
+	for ii := 0; ii < img.count; ii++ {
+		s := img.section(ii)
+		if last < 0 || img.u32(s+12) > img.u32(img.section(last)+12) {
+			last = ii
+		}
+		if rva != 0 && img.u32(s+12) <= rva && rva < img.u32(s+12)+img.u32(s+8) {
+			existing = ii
+		}
+	}
+	if last < 0 {
+		return nil, fmt.Errorf("no sections")
+	}
+	// The resource section header is either the last one, reused, or a new
+	// one after it.
+	n := img.count
+	if existing >= 0 && existing == last {
+		n = existing
+	} else if uint32(img.section(n+1)) > headers {
+		return nil, fmt.Errorf("no room for another section header")
+	}
+	var (
+		s  = img.section(n)
+		va uint32
+	)
+	if n == existing {
+		va = img.u32(s + 12)
+		// Reclaim the old data if nothing follows it.
+		if end := img.u32(s+20) + img.u32(s+16); int(end) >= len(img.data) {
+			img.data = img.data[:img.u32(s+20)]
+		}
+	} else {
+		va = img.u32(img.section(last)+12) + img.u32(img.section(last)+8)
+		va = uint32(align(int(va), int(sectionAlign)))
+		copy(img.data[s:s+40], make([]byte, 40))
+	}
+	section, _ := merged.Section(va)
+	var (
+		raw     = uint32(align(len(img.data), int(fileAlign)))
+		rawSize = uint32(align(len(section), int(fileAlign)))
+	)
+	// Raw data is appended, after anything such as the COFF symbol table.
+	buf := bytes.NewBuffer(img.data)
+	buf.Write(make([]byte, int(raw)-len(img.data)))
+	buf.Write(section)
+	buf.Write(make([]byte, int(rawSize)-len(section)))
+	img.data = buf.Bytes()
+	// Section header, with IMAGE_SCN_CNT_INITIALIZED_DATA and
+	// IMAGE_SCN_MEM_READ.
+	copy(img.data[s:], name(".rsrc"))
+	img.setU32(s+8, uint32(len(section)))
+	img.setU32(s+12, va)
+	img.setU32(s+16, rawSize)
+	img.setU32(s+20, raw)
+	img.setU32(s+36, 0x40000040)
+	if n == img.count {
+		img.count++
+		binary.LittleEndian.PutUint16(img.data[img.coff+2:], uint16(img.count))
+	}
+	img.setU32(img.directory(dirResource), va)
+	img.setU32(img.directory(dirResource)+4, uint32(len(section)))
+	// SizeOfImage spans every section, SizeOfInitializedData is left as is
+	// since the loader ignores it.
+	var end uint32
+	for ii := 0; ii < img.count; ii++ {
+		s := img.section(ii)
+		if e := img.u32(s+12) + img.u32(s+8); e > end {
+			end = e
+		}
+	}
+	img.setU32(img.field(56, 56), uint32(align(int(end), int(sectionAlign))))
+	img.setU32(img.field(64, 64), 0)
+	return img.data, nil
+}
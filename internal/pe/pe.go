@@ -0,0 +1,168 @@
+// pe format encoding.
+//
+// Builds the resource section (.rsrc) of Windows executables: icons, the
+// application manifest and version information. Resources are patched into
+// an executable after it is linked, so that no ".syso" object need be placed
+// in the package being built. Executables can then be Authenticode signed.
+//
+// See https://docs.microsoft.com/en-us/windows/win32/debug/pe-format.
+package pe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+)
+
+// Resource types.
+const (
+	TypeIcon      = 3
+	TypeGroupIcon = 14
+	TypeVersion   = 16
+	TypeManifest  = 24
+)
+
+// Language of every resource, US English.
+const Language = 0x0409
+
+// Resources is the set of resources in a resource section, keyed by type and
+// ID.
+type Resources struct {
+	entries map[uint16]map[uint16][]byte
+}
+
+// Set adds the resource of type typ and ID id, replacing any existing one.
+func (r *Resources) Set(typ, id uint16, data []byte) {
+	if r.entries == nil {
+		r.entries = map[uint16]map[uint16][]byte{}
+	}
+	if r.entries[typ] == nil {
+		r.entries[typ] = map[uint16][]byte{}
+	}
+	r.entries[typ][id] = data
+}
+
+// Get returns the resource of type typ and ID id, or nil.
+func (r *Resources) Get(typ, id uint16) []byte {
+	return r.entries[typ][id]
+}
+
+// Delete removes every resource of type typ.
+func (r *Resources) Delete(typ uint16) {
+	delete(r.entries, typ)
+}
+
+// Section encodes the resource section as loaded at rva. Also returned are
+// the offsets of each field holding an RVA, which must be relocated if the
+// section moves.
+//
+// The section is laid out as the directory tree, type then ID then language,
+// followed by the data entries and then the data itself.
+func (r *Resources) Section(rva uint32) ([]byte, []uint32) {
+	types := sorted(r.entries)
+	var (
+		ids = make([][]uint16, len(types))
+		// Tree sizes, each directory is 16 bytes plus 8 per entry.
+		tree    = 16 + 8*len(types)
+		entries int
+	)
+	for ii, typ := range types {
+		ids[ii] = sorted(r.entries[typ])
+		tree += 16 + 8*len(ids[ii])
+		entries += len(ids[ii])
+	}
+	// Each ID has a language directory of one entry.
+	tree += entries * (16 + 8)
+	var (
+		buf    = bytes.NewBuffer(nil)
+		relocs []uint32
+		// Offsets of the next type, ID and language directory, data entry
+		// and data.
+		next  = 16 + 8*len(types)
+		lang  = next
+		entry = tree
+		data  = tree + 16*entries
+	)
+	for _, list := range ids {
+		lang += 16 + 8*len(list)
+	}
+	directory := func(n int) {
+		put(buf, uint32(0), uint32(0), uint16(0), uint16(0), uint16(0), uint16(n))
+	}
+	// Root.
+	directory(len(types))
+	for ii, typ := range types {
+		put(buf, uint32(typ), 0x80000000|uint32(next))
+		next += 16 + 8*len(ids[ii])
+	}
+	// Types.
+	for ii := range types {
+		directory(len(ids[ii]))
+		for _, id := range ids[ii] {
+			put(buf, uint32(id), 0x80000000|uint32(lang))
+			lang += 16 + 8
+		}
+	}
+	// Languages.
+	for ii := range types {
+		for range ids[ii] {
+			directory(1)
+			put(buf, uint32(Language), uint32(entry))
+			entry += 16
+		}
+	}
+	// Data entries.
+	for ii, typ := range types {
+		for _, id := range ids[ii] {
+			relocs = append(relocs, uint32(buf.Len()))
+			put(buf, rva+uint32(data), uint32(len(r.entries[typ][id])), uint32(0), uint32(0))
+			data += align(len(r.entries[typ][id]), 8)
+		}
+	}
+	// Data.
+	for ii, typ := range types {
+		for _, id := range ids[ii] {
+			buf.Write(r.entries[typ][id])
+			buf.Write(make([]byte, align(buf.Len(), 8)-buf.Len()))
+		}
+	}
+	return buf.Bytes(), relocs
+}
+
+// name pads a section name to 8 bytes.
+func name(s string) []byte {
+	b := make([]byte, 8)
+	copy(b, s)
+	return b
+}
+
+func sorted(m interface{}) []uint16 {
+	var keys []uint16
+	switch m := m.(type) {
+	case map[uint16]map[uint16][]byte:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[uint16][]byte:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(ii, jj int) bool { return keys[ii] < keys[jj] })
+	return keys
+}
+
+func align(n, to int) int {
+	return (n + to - 1) / to * to
+}
+
+// put encodes each value into buf in order, little endian.
+func put(buf *bytes.Buffer, values ...interface{}) {
+	for _, v := range values {
+		if b, ok := v.([]byte); ok {
+			buf.Write(b)
+			continue
+		}
+		_ = binary.Write(buf, binary.LittleEndian, v)
+	}
+}
@@ -0,0 +1,222 @@
+package pe
+
+import (
+	"bytes"
+	"debug/pe"
+	"encoding/binary"
+	"testing"
+	"unicode/utf16"
+
+	"git.sr.ht/~jackmordaunt/gopack/internal/pe/petest"
+)
+
+func TestSetIcon(t *testing.T) {
+	ico := bytes.NewBuffer(nil)
+	put(ico, uint16(0), uint16(1), uint16(2))
+	put(ico, []byte{16, 16, 0, 0}, uint16(1), uint16(32), uint32(3), uint32(6+32))
+	put(ico, []byte{32, 32, 0, 0}, uint16(1), uint16(32), uint32(2), uint32(6+32+3))
+	ico.WriteString("abcde")
+	var r Resources
+	if err := r.SetIcon(1, ico.Bytes()); err != nil {
+		t.Fatalf("setting icon: %v", err)
+	}
+	if got := string(r.Get(TypeIcon, 1)); got != "abc" {
+		t.Errorf("icon 1: got %q", got)
+	}
+	if got := string(r.Get(TypeIcon, 2)); got != "de" {
+		t.Errorf("icon 2: got %q", got)
+	}
+	group := r.Get(TypeGroupIcon, 1)
+	if len(group) != 6+14*2 {
+		t.Fatalf("group: got %d bytes", len(group))
+	}
+	if id := binary.LittleEndian.Uint16(group[6+14+12:]); id != 2 {
+		t.Errorf("group: second entry has id %d", id)
+	}
+	if err := r.SetIcon(1, ico.Bytes()[:20]); err == nil {
+		t.Errorf("truncated icon: expected error")
+	}
+}
+
+func TestVersionInfo(t *testing.T) {
+	by := VersionInfo{
+		FileVersion:    [4]uint16{1, 2, 3, 4},
+		ProductVersion: [4]uint16{1, 2, 0, 0},
+		Strings: map[string]string{
+			"ProductName": "Notes",
+			"CompanyName": "",
+		},
+	}.Bytes()
+	root := parseBlock(t, by)
+	if root.key != "VS_VERSION_INFO" || int(root.length) != len(by) {
+		t.Fatalf("got root %q of length %d, want %d", root.key, root.length, len(by))
+	}
+	le := binary.LittleEndian
+	if sig := le.Uint32(root.value); sig != 0xFEEF04BD {
+		t.Errorf("got signature %#x", sig)
+	}
+	if ms, ls := le.Uint32(root.value[8:]), le.Uint32(root.value[12:]); ms != 1<<16|2 || ls != 3<<16|4 {
+		t.Errorf("got file version %#x %#x", ms, ls)
+	}
+	if len(root.children) != 2 {
+		t.Fatalf("got %d children", len(root.children))
+	}
+	table := root.children[0].children[0]
+	if table.key != "040904B0" || len(table.children) != 1 {
+		t.Fatalf("got string table %q with %d strings", table.key, len(table.children))
+	}
+	s := table.children[0]
+	if s.key != "ProductName" || s.text() != "Notes" {
+		t.Errorf("got string %q = %q", s.key, s.text())
+	}
+	translation := root.children[1].children[0]
+	if translation.key != "Translation" || le.Uint32(translation.value) != 0x04B00409 {
+		t.Errorf("got translation %q %x", translation.key, translation.value)
+	}
+}
+
+type versionBlock struct {
+	length   uint16
+	key      string
+	value    []byte
+	children []versionBlock
+}
+
+func (b versionBlock) text() string {
+	var chars []uint16
+	for ii := 0; ii+1 < len(b.value); ii += 2 {
+		chars = append(chars, binary.LittleEndian.Uint16(b.value[ii:]))
+	}
+	return string(utf16.Decode(chars[:len(chars)-1]))
+}
+
+// parseBlock reads a version structure and its children.
+func parseBlock(t *testing.T, by []byte) versionBlock {
+	le := binary.LittleEndian
+	var (
+		b      = versionBlock{length: le.Uint16(by)}
+		size   = int(le.Uint16(by[2:]))
+		text   = le.Uint16(by[4:]) == 1
+		off    = 6
+		chars  []uint16
+		padded = func(n int) int { return (n + 3) &^ 3 }
+	)
+	by = by[:b.length]
+	for c := le.Uint16(by[off:]); c != 0; c = le.Uint16(by[off:]) {
+		chars = append(chars, c)
+		off += 2
+	}
+	b.key = string(utf16.Decode(chars))
+	off = padded(off + 2)
+	if text {
+		size *= 2
+	}
+	b.value = by[off : off+size]
+	off = padded(off + size)
+	for off < len(by) {
+		child := parseBlock(t, by[off:])
+		b.children = append(b.children, child)
+		off = padded(off + int(child.length))
+	}
+	return b
+}
+
+func TestPatch(t *testing.T) {
+	var r Resources
+	r.Set(TypeManifest, 1, []byte("<assembly/>"))
+	r.Set(TypeIcon, 1, []byte("one"))
+	r.Set(TypeIcon, 2, []byte("two"))
+	exe, err := Patch(petest.Image(), &r)
+	if err != nil {
+		t.Fatalf("patching: %v", err)
+	}
+	check := func(exe []byte, sections int) *Resources {
+		f, err := pe.NewFile(bytes.NewReader(exe))
+		if err != nil {
+			t.Fatalf("parsing image: %v", err)
+		}
+		if len(f.Sections) != sections {
+			t.Fatalf("got %d sections, want %d", len(f.Sections), sections)
+		}
+		s := f.Section(".rsrc")
+		if s == nil {
+			t.Fatalf("missing .rsrc section")
+		}
+		oh := f.OptionalHeader.(*pe.OptionalHeader64)
+		if dir := oh.DataDirectory[dirResource]; dir.VirtualAddress != s.VirtualAddress {
+			t.Errorf("resource directory at %#x, section at %#x", dir.VirtualAddress, s.VirtualAddress)
+		}
+		if want := (s.VirtualAddress + s.VirtualSize + 0xFFF) &^ 0xFFF; oh.SizeOfImage != want {
+			t.Errorf("got image size %#x, want %#x", oh.SizeOfImage, want)
+		}
+		got, err := Read(exe)
+		if err != nil {
+			t.Fatalf("reading resources: %v", err)
+		}
+		return got
+	}
+	got := check(exe, 2)
+	if string(got.Get(TypeManifest, 1)) != "<assembly/>" || string(got.Get(TypeIcon, 2)) != "two" {
+		t.Errorf("resources not read back")
+	}
+	// Patching again rewrites the section in place, replacing icons but
+	// keeping the manifest.
+	var icons Resources
+	icons.Set(TypeIcon, 1, []byte("uno"))
+	if exe, err = Patch(exe, &icons); err != nil {
+		t.Fatalf("patching again: %v", err)
+	}
+	got = check(exe, 2)
+	if string(got.Get(TypeManifest, 1)) != "<assembly/>" {
+		t.Errorf("manifest not kept")
+	}
+	if string(got.Get(TypeIcon, 1)) != "uno" || got.Get(TypeIcon, 2) != nil {
+		t.Errorf("icons not replaced")
+	}
+	if _, err := Patch([]byte("not an exe"), &r); err == nil {
+		t.Errorf("invalid image: expected error")
+	}
+}
+
+func TestSign(t *testing.T) {
+	exe := petest.Image()
+	digest, err := Digest(exe)
+	if err != nil {
+		t.Fatalf("digesting: %v", err)
+	}
+	signed, err := Sign(exe, func(d []byte) ([]byte, error) {
+		if !bytes.Equal(d, digest) {
+			t.Errorf("signing digest %x, want %x", d, digest)
+		}
+		return []byte("signed data"), nil
+	})
+	if err != nil {
+		t.Fatalf("signing: %v", err)
+	}
+	le := binary.LittleEndian
+	f, err := pe.NewFile(bytes.NewReader(signed))
+	if err != nil {
+		t.Fatalf("parsing image: %v", err)
+	}
+	oh := f.OptionalHeader.(*pe.OptionalHeader64)
+	dir := oh.DataDirectory[dirSecurity]
+	if int(dir.VirtualAddress)+int(dir.Size) != len(signed) || dir.VirtualAddress%8 != 0 {
+		t.Fatalf("got certificate table at %#x, size %#x", dir.VirtualAddress, dir.Size)
+	}
+	cert := signed[dir.VirtualAddress:]
+	if length := le.Uint32(cert); length != dir.Size || le.Uint16(cert[4:]) != certRevision || le.Uint16(cert[6:]) != certPKCS7 || string(cert[8:8+11]) != "signed data" {
+		t.Errorf("got certificate % x", cert)
+	}
+	if oh.CheckSum == 0 || oh.CheckSum != Checksum(signed) {
+		t.Errorf("got checksum %#x, want %#x", oh.CheckSum, Checksum(signed))
+	}
+	// The digest is unchanged by the signature, so signing again replaces
+	// it.
+	if d, err := Digest(signed); err != nil || !bytes.Equal(d, digest) {
+		t.Errorf("digest changed by signing: %x, %v", d, err)
+	}
+	again, err := Sign(signed, func([]byte) ([]byte, error) { return []byte("signed data"), nil })
+	if err != nil || !bytes.Equal(again, signed) {
+		t.Errorf("signing again changed the image: %v", err)
+	}
+}
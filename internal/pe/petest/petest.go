@@ -0,0 +1,42 @@
+// petest provides Windows images for tests.
+package petest
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Image builds a minimal PE32+ image with a single code section, enough to
+// patch resources into and sign.
+func Image() []byte {
+	var (
+		buf      = bytes.NewBuffer(nil)
+		le       = binary.LittleEndian
+		optional = make([]byte, 240)
+		section  = make([]byte, 40)
+	)
+	buf.Write([]byte("MZ"))
+	buf.Write(make([]byte, 0x3A))
+	_ = binary.Write(buf, le, uint32(0x40))
+	buf.Write([]byte("PE\x00\x00"))
+	_ = binary.Write(buf, le, []uint16{0x8664, 1})
+	_ = binary.Write(buf, le, []uint32{0, 0, 0})
+	_ = binary.Write(buf, le, []uint16{240, 0x22})
+	le.PutUint16(optional, 0x20B)
+	le.PutUint32(optional[32:], 0x1000)
+	le.PutUint32(optional[36:], 0x200)
+	le.PutUint32(optional[56:], 0x2000)
+	le.PutUint32(optional[60:], 0x200)
+	le.PutUint32(optional[108:], 16)
+	buf.Write(optional)
+	copy(section, ".text")
+	le.PutUint32(section[8:], 0x10)
+	le.PutUint32(section[12:], 0x1000)
+	le.PutUint32(section[16:], 0x200)
+	le.PutUint32(section[20:], 0x200)
+	le.PutUint32(section[36:], 0x60000020)
+	buf.Write(section)
+	buf.Write(make([]byte, 0x200-buf.Len()))
+	buf.Write(bytes.Repeat([]byte{0xC3}, 0x200))
+	return buf.Bytes()
+}
@@ -0,0 +1,106 @@
+package pe
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+)
+
+// Certificate table entry fields, for a WIN_CERTIFICATE holding PKCS#7
+// signed data.
+const (
+	certRevision = 0x0200
+	certPKCS7    = 0x0002
+)
+
+// Sign adds an Authenticode signature to a PE image, replacing any existing
+// one. sign returns the PKCS#7 signed data over the SHA-256 digest of the
+// image, which is appended to the image as its certificate table. The
+// checksum is updated to match.
+func Sign(exe []byte, sign func(digest []byte) ([]byte, error)) ([]byte, error) {
+	img, err := parse(append([]byte(nil), exe...))
+	if err != nil {
+		return nil, err
+	}
+	dir := img.directory(dirSecurity)
+	if off := img.u32(dir); off != 0 {
+		if int(off)+int(img.u32(dir+4)) != len(img.data) {
+			return nil, fmt.Errorf("existing signature is not at the end of the file")
+		}
+		img.data = img.data[:off]
+	}
+	// The certificate table must be 8 byte aligned.
+	img.data = append(img.data, make([]byte, align(len(img.data), 8)-len(img.data))...)
+	img.setU32(dir, 0)
+	img.setU32(dir+4, 0)
+	signed, err := sign(img.digest())
+	if err != nil {
+		return nil, fmt.Errorf("signing: %w", err)
+	}
+	var (
+		off  = len(img.data)
+		size = align(8+len(signed), 8)
+		buf  = bytes.NewBuffer(img.data)
+	)
+	// The length includes the padding, as signtool writes it.
+	put(buf, uint32(size), uint16(certRevision), uint16(certPKCS7), signed)
+	buf.Write(make([]byte, size-8-len(signed)))
+	img.data = buf.Bytes()
+	img.setU32(dir, uint32(off))
+	img.setU32(dir+4, uint32(size))
+	img.setU32(img.field(64, 64), Checksum(img.data))
+	return img.data, nil
+}
+
+// Digest returns the Authenticode digest of a PE image: the SHA-256 hash of
+// the file, except for the checksum, the certificate table directory entry
+// and the certificate table itself.
+func Digest(exe []byte) ([]byte, error) {
+	img, err := parse(exe)
+	if err != nil {
+		return nil, err
+	}
+	return img.digest(), nil
+}
+
+func (img *image) digest() []byte {
+	var (
+		checksum = img.field(64, 64)
+		dir      = img.directory(dirSecurity)
+		end      = len(img.data)
+	)
+	if off := img.u32(dir); off != 0 && int(off) < end {
+		end = int(off)
+	}
+	h := sha256.New()
+	h.Write(img.data[:checksum])
+	h.Write(img.data[checksum+4 : dir])
+	h.Write(img.data[dir+8 : end])
+	return h.Sum(nil)
+}
+
+// Checksum computes the checksum of a PE image, as the loader verifies for
+// drivers: the one's complement sum of its 16 bit words, skipping the
+// checksum field, plus the length of the file.
+func Checksum(exe []byte) uint32 {
+	var (
+		skip = -1
+		sum  uint64
+	)
+	if img, err := parse(exe); err == nil {
+		skip = img.field(64, 64)
+	}
+	for ii := 0; ii < len(exe); ii += 2 {
+		if ii == skip || ii == skip+2 {
+			continue
+		}
+		word := uint64(exe[ii])
+		if ii+1 < len(exe) {
+			word |= uint64(exe[ii+1]) << 8
+		}
+		sum += word
+		sum = (sum & 0xFFFF) + (sum >> 16)
+	}
+	sum = (sum & 0xFFFF) + (sum >> 16)
+	return uint32(sum) + uint32(len(exe))
+}
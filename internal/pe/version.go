@@ -0,0 +1,105 @@
+package pe
+
+import (
+	"bytes"
+	"sort"
+	"unicode/utf16"
+)
+
+// VersionInfo is a version resource, shown in the details tab of a file's
+// properties.
+type VersionInfo struct {
+	// FileVersion and ProductVersion as major, minor, patch and build.
+	FileVersion    [4]uint16
+	ProductVersion [4]uint16
+	// Strings such as "CompanyName", "FileDescription", "FileVersion",
+	// "LegalCopyright", "OriginalFilename" and "ProductName". Empty values
+	// are omitted.
+	Strings map[string]string
+}
+
+// Bytes encodes the VS_VERSIONINFO structure of an application.
+//
+// See https://docs.microsoft.com/en-us/windows/win32/menurc/vs-versioninfo.
+func (v VersionInfo) Bytes() []byte {
+	version := func(parts [4]uint16) (uint32, uint32) {
+		return uint32(parts[0])<<16 | uint32(parts[1]), uint32(parts[2])<<16 | uint32(parts[3])
+	}
+	var (
+		fixed          = bytes.NewBuffer(nil)
+		fileMS, fileLS = version(v.FileVersion)
+		prodMS, prodLS = version(v.ProductVersion)
+	)
+	// VS_FIXEDFILEINFO, for VOS_NT_WINDOWS32 and VFT_APP.
+	put(fixed,
+		uint32(0xFEEF04BD), uint32(0x00010000),
+		fileMS, fileLS, prodMS, prodLS,
+		uint32(0x3F), uint32(0),
+		uint32(0x00040004), uint32(1), uint32(0),
+		uint32(0), uint32(0))
+	keys := make([]string, 0, len(v.Strings))
+	for k, s := range v.Strings {
+		if s != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	var table [][]byte
+	for _, k := range keys {
+		table = append(table, block(k, v.Strings[k], nil))
+	}
+	// The string table and translation are US English, in UTF-16.
+	return block("VS_VERSION_INFO", fixed.Bytes(), [][]byte{
+		block("StringFileInfo", nil, [][]byte{
+			block("040904B0", nil, table),
+		}),
+		block("VarFileInfo", nil, [][]byte{
+			block("Translation", []byte{0x09, 0x04, 0xB0, 0x04}, nil),
+		}),
+	})
+}
+
+// block encodes a version structure: its length, value length, type and
+// key, followed by the value and children, each aligned to 32 bits. A string
+// value is text, measured in characters, otherwise the value is binary.
+func block(key string, value interface{}, children [][]byte) []byte {
+	var (
+		buf    = bytes.NewBuffer(nil)
+		data   []byte
+		length int
+		kind   uint16
+	)
+	switch value := value.(type) {
+	case string:
+		data = utf16z(value)
+		length = len(data) / 2
+		kind = 1
+	case []byte:
+		data = value
+		length = len(data)
+	default:
+		kind = 1
+	}
+	put(buf, uint16(0), uint16(length), kind, utf16z(key))
+	pad(buf)
+	buf.Write(data)
+	for _, child := range children {
+		pad(buf)
+		buf.Write(child)
+	}
+	b := buf.Bytes()
+	b[0], b[1] = byte(len(b)), byte(len(b)>>8)
+	return b
+}
+
+// utf16z encodes s as null terminated UTF-16.
+func utf16z(s string) []byte {
+	buf := bytes.NewBuffer(nil)
+	put(buf, utf16.Encode([]rune(s+"\x00")))
+	return buf.Bytes()
+}
+
+// pad aligns buf to 32 bits.
+func pad(buf *bytes.Buffer) {
+	buf.Write(make([]byte, align(buf.Len(), 4)-buf.Len()))
+}
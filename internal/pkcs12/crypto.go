@@ -0,0 +1,280 @@
+package pkcs12
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/asn1"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"math/bits"
+)
+
+type pbeParams struct {
+	Salt       []byte
+	Iterations int
+}
+
+type pbes2Params struct {
+	KDF    algorithm
+	Scheme algorithm
+}
+
+type pbkdf2Params struct {
+	Salt       []byte
+	Iterations int
+	KeyLength  int       `asn1:"optional"`
+	PRF        algorithm `asn1:"optional"`
+}
+
+// decrypt decrypts data with the password based encryption scheme alg.
+func decrypt(alg algorithm, data []byte, password string) ([]byte, error) {
+	var (
+		block cipher.Block
+		iv    []byte
+		err   error
+	)
+	switch oid := alg.Algorithm; {
+	case oid.Equal(oidPBEWithSHA3DES), oid.Equal(oidPBEWithSHA128BitRC2), oid.Equal(oidPBEWithSHA40BitRC2):
+		var params pbeParams
+		if _, err := asn1.Unmarshal(alg.Parameters.FullBytes, &params); err != nil {
+			return nil, fmt.Errorf("parsing parameters: %w", err)
+		}
+		pass := bmpString(password)
+		derive := func(id byte, size int) []byte {
+			return kdf(sha1.New, params.Salt, pass, params.Iterations, id, size)
+		}
+		switch {
+		case oid.Equal(oidPBEWithSHA3DES):
+			block, err = des.NewTripleDESCipher(derive(1, 24))
+		case oid.Equal(oidPBEWithSHA128BitRC2):
+			block = newRC2(derive(1, 16), 128)
+		default:
+			block = newRC2(derive(1, 5), 40)
+		}
+		iv = derive(2, block.BlockSize())
+	case oid.Equal(oidPBES2):
+		var params pbes2Params
+		if _, err := asn1.Unmarshal(alg.Parameters.FullBytes, &params); err != nil {
+			return nil, fmt.Errorf("parsing parameters: %w", err)
+		}
+		if !params.KDF.Algorithm.Equal(oidPBKDF2) {
+			return nil, fmt.Errorf("unsupported key derivation %v", params.KDF.Algorithm)
+		}
+		var kdfParams pbkdf2Params
+		if _, err := asn1.Unmarshal(params.KDF.Parameters.FullBytes, &kdfParams); err != nil {
+			return nil, fmt.Errorf("parsing key derivation: %w", err)
+		}
+		prf := sha1.New
+		if kdfParams.PRF.Algorithm != nil {
+			if prf, err = hashFor(kdfParams.PRF.Algorithm); err != nil {
+				return nil, err
+			}
+		}
+		var size int
+		switch s := params.Scheme.Algorithm; {
+		case s.Equal(oidAES128CBC):
+			size = 16
+		case s.Equal(oidAES192CBC):
+			size = 24
+		case s.Equal(oidAES256CBC):
+			size = 32
+		case s.Equal(oidDESEDE3CBC):
+			size = 24
+		default:
+			return nil, fmt.Errorf("unsupported cipher %v", s)
+		}
+		// Unlike the legacy schemes, PBES2 takes the password as UTF-8.
+		key := pbkdf2(prf, []byte(password), kdfParams.Salt, kdfParams.Iterations, size)
+		if params.Scheme.Algorithm.Equal(oidDESEDE3CBC) {
+			block, err = des.NewTripleDESCipher(key)
+		} else {
+			block, err = aes.NewCipher(key)
+		}
+		if _, err := asn1.Unmarshal(params.Scheme.Parameters.FullBytes, &iv); err != nil {
+			return nil, fmt.Errorf("parsing iv: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported encryption %v", oid)
+	}
+	if err != nil {
+		return nil, err
+	}
+	size := block.BlockSize()
+	if len(iv) != size || len(data) == 0 || len(data)%size != 0 {
+		return nil, fmt.Errorf("invalid ciphertext")
+	}
+	out := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(out, data)
+	// A wrong password is caught by the MAC, if there is one. Otherwise it
+	// shows up as bad padding, most of the time.
+	pad := int(out[len(out)-1])
+	if pad == 0 || pad > size || !bytes.Equal(out[len(out)-pad:], bytes.Repeat([]byte{byte(pad)}, pad)) {
+		return nil, ErrIncorrectPassword
+	}
+	return out[:len(out)-pad], nil
+}
+
+// kdf derives size bytes of key material for purpose id: 1 for keys, 2 for
+// IVs and 3 for MAC keys.
+//
+// See RFC 7292, appendix B.2.
+func kdf(h func() hash.Hash, salt, password []byte, iterations int, id byte, size int) []byte {
+	const v = 64
+	fill := func(b []byte) []byte {
+		if len(b) == 0 {
+			return nil
+		}
+		out := make([]byte, v*((len(b)+v-1)/v))
+		for ii := range out {
+			out[ii] = b[ii%len(b)]
+		}
+		return out
+	}
+	var (
+		d   = bytes.Repeat([]byte{id}, v)
+		in  = append(fill(salt), fill(password)...)
+		out []byte
+	)
+	for len(out) < size {
+		hh := h()
+		hh.Write(d)
+		hh.Write(in)
+		a := hh.Sum(nil)
+		for ii := 1; ii < iterations; ii++ {
+			hh.Reset()
+			hh.Write(a)
+			a = hh.Sum(a[:0])
+		}
+		out = append(out, a...)
+		// Each block of the input is incremented by the hash, plus one.
+		b := fill(a)
+		for j := 0; j < len(in); j += v {
+			carry := 1
+			for k := v - 1; k >= 0; k-- {
+				sum := int(in[j+k]) + int(b[k]) + carry
+				in[j+k] = byte(sum)
+				carry = sum >> 8
+			}
+		}
+	}
+	return out[:size]
+}
+
+// pbkdf2 derives a key of size bytes from the password.
+//
+// See RFC 8018, section 5.2.
+func pbkdf2(h func() hash.Hash, password, salt []byte, iterations, size int) []byte {
+	prf := hmac.New(h, password)
+	var out []byte
+	for block := uint32(1); len(out) < size; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		_ = binary.Write(prf, binary.BigEndian, block)
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for ii := 1; ii < iterations; ii++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for k := range t {
+				t[k] ^= u[k]
+			}
+		}
+		out = append(out, t...)
+	}
+	return out[:size]
+}
+
+// rc2 is the RC2 block cipher, which only ever decrypts here: legacy
+// PKCS#12 files encrypt their certificates with it.
+//
+// See RFC 2268.
+type rc2 struct {
+	k [64]uint16
+}
+
+// piTable is the permutation of bytes derived from the digits of pi.
+var piTable = [256]byte{
+	0xd9, 0x78, 0xf9, 0xc4, 0x19, 0xdd, 0xb5, 0xed, 0x28, 0xe9, 0xfd, 0x79, 0x4a, 0xa0, 0xd8, 0x9d,
+	0xc6, 0x7e, 0x37, 0x83, 0x2b, 0x76, 0x53, 0x8e, 0x62, 0x4c, 0x64, 0x88, 0x44, 0x8b, 0xfb, 0xa2,
+	0x17, 0x9a, 0x59, 0xf5, 0x87, 0xb3, 0x4f, 0x13, 0x61, 0x45, 0x6d, 0x8d, 0x09, 0x81, 0x7d, 0x32,
+	0xbd, 0x8f, 0x40, 0xeb, 0x86, 0xb7, 0x7b, 0x0b, 0xf0, 0x95, 0x21, 0x22, 0x5c, 0x6b, 0x4e, 0x82,
+	0x54, 0xd6, 0x65, 0x93, 0xce, 0x60, 0xb2, 0x1c, 0x73, 0x56, 0xc0, 0x14, 0xa7, 0x8c, 0xf1, 0xdc,
+	0x12, 0x75, 0xca, 0x1f, 0x3b, 0xbe, 0xe4, 0xd1, 0x42, 0x3d, 0xd4, 0x30, 0xa3, 0x3c, 0xb6, 0x26,
+	0x6f, 0xbf, 0x0e, 0xda, 0x46, 0x69, 0x07, 0x57, 0x27, 0xf2, 0x1d, 0x9b, 0xbc, 0x94, 0x43, 0x03,
+	0xf8, 0x11, 0xc7, 0xf6, 0x90, 0xef, 0x3e, 0xe7, 0x06, 0xc3, 0xd5, 0x2f, 0xc8, 0x66, 0x1e, 0xd7,
+	0x08, 0xe8, 0xea, 0xde, 0x80, 0x52, 0xee, 0xf7, 0x84, 0xaa, 0x72, 0xac, 0x35, 0x4d, 0x6a, 0x2a,
+	0x96, 0x1a, 0xd2, 0x71, 0x5a, 0x15, 0x49, 0x74, 0x4b, 0x9f, 0xd0, 0x5e, 0x04, 0x18, 0xa4, 0xec,
+	0xc2, 0xe0, 0x41, 0x6e, 0x0f, 0x51, 0xcb, 0xcc, 0x24, 0x91, 0xaf, 0x50, 0xa1, 0xf4, 0x70, 0x39,
+	0x99, 0x7c, 0x3a, 0x85, 0x23, 0xb8, 0xb4, 0x7a, 0xfc, 0x02, 0x36, 0x5b, 0x25, 0x55, 0x97, 0x31,
+	0x2d, 0x5d, 0xfa, 0x98, 0xe3, 0x8a, 0x92, 0xae, 0x05, 0xdf, 0x29, 0x10, 0x67, 0x6c, 0xba, 0xc9,
+	0xd3, 0x00, 0xe6, 0xcf, 0xe1, 0x9e, 0xa8, 0x2c, 0x63, 0x16, 0x01, 0x3f, 0x58, 0xe2, 0x89, 0xa9,
+	0x0d, 0x38, 0x34, 0x1b, 0xab, 0x33, 0xff, 0xb0, 0xbb, 0x48, 0x0c, 0x5f, 0xb9, 0xb1, 0xcd, 0x2e,
+	0xc5, 0xf3, 0xdb, 0x47, 0xe5, 0xa5, 0x9c, 0x77, 0x0a, 0xa6, 0x20, 0x68, 0xfe, 0x7f, 0xc1, 0xad,
+}
+
+// newRC2 expands key, limited to an effective length of bits.
+func newRC2(key []byte, effective int) *rc2 {
+	var (
+		l  = make([]byte, 128)
+		t8 = (effective + 7) / 8
+		tm = byte(0xFF >> uint(8*t8-effective))
+	)
+	copy(l, key)
+	for ii := len(key); ii < 128; ii++ {
+		l[ii] = piTable[l[ii-1]+l[ii-len(key)]]
+	}
+	l[128-t8] = piTable[l[128-t8]&tm]
+	for ii := 127 - t8; ii >= 0; ii-- {
+		l[ii] = piTable[l[ii+1]^l[ii+t8]]
+	}
+	c := &rc2{}
+	for ii := range c.k {
+		c.k[ii] = uint16(l[2*ii]) | uint16(l[2*ii+1])<<8
+	}
+	return c
+}
+
+func (c *rc2) BlockSize() int { return 8 }
+
+func (c *rc2) Encrypt(dst, src []byte) {
+	panic("rc2: encryption not supported")
+}
+
+// Decrypt undoes the mixing and mashing rounds of encryption, in reverse.
+func (c *rc2) Decrypt(dst, src []byte) {
+	var (
+		le    = binary.LittleEndian
+		r     = [4]uint16{le.Uint16(src), le.Uint16(src[2:]), le.Uint16(src[4:]), le.Uint16(src[6:])}
+		j     = 63
+		shift = [4]int{1, 2, 3, 5}
+	)
+	mix := func() {
+		for ii := 3; ii >= 0; ii-- {
+			r[ii] = bits.RotateLeft16(r[ii], -shift[ii])
+			r[ii] -= c.k[j] + (r[(ii+3)%4] & r[(ii+2)%4]) + (^r[(ii+3)%4] & r[(ii+1)%4])
+			j--
+		}
+	}
+	mash := func() {
+		for ii := 3; ii >= 0; ii-- {
+			r[ii] -= c.k[r[(ii+3)%4]&63]
+		}
+	}
+	for _, rounds := range []int{5, 6, 5} {
+		for ii := 0; ii < rounds; ii++ {
+			mix()
+		}
+		if j > 0 {
+			mash()
+		}
+	}
+	for ii, w := range r {
+		le.PutUint16(dst[2*ii:], w)
+	}
+}
@@ -0,0 +1,278 @@
+// pkcs12 format encoding.
+//
+// Decodes the PKCS#12 (".p12", ".pfx") files that certificates and their
+// private keys are exported as, by Keychain Access, the Windows certificate
+// manager or openssl. Both the legacy encryption (triple DES and RC2 keyed
+// from SHA-1) and the PBES2 encryption used by openssl 3 (AES keyed with
+// PBKDF2) are supported, as is verification of the integrity MAC.
+//
+// See RFC 7292.
+package pkcs12
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"hash"
+	"unicode/utf16"
+)
+
+// ErrIncorrectPassword is returned when the password doesn't match the
+// integrity MAC.
+var ErrIncorrectPassword = errors.New("incorrect password")
+
+var (
+	oidData                = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidEncryptedData       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 6}
+	oidKeyBag              = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 1}
+	oidShroudedKeyBag      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 2}
+	oidCertBag             = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 3}
+	oidX509Certificate     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 22, 1}
+	oidSHA1                = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidSHA256              = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA384              = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidSHA512              = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+	oidPBEWithSHA3DES      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 3}
+	oidPBEWithSHA128BitRC2 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 5}
+	oidPBEWithSHA40BitRC2  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 6}
+	oidPBES2               = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2              = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACWithSHA1        = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA256      = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidHMACWithSHA384      = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 10}
+	oidHMACWithSHA512      = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 11}
+	oidDESEDE3CBC          = asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}
+	oidAES128CBC           = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC           = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC           = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+type pfx struct {
+	Version  int
+	AuthSafe contentInfo
+	MacData  macData `asn1:"optional"`
+}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"tag:0,explicit,optional"`
+}
+
+type macData struct {
+	Mac        digestInfo
+	Salt       []byte
+	Iterations int `asn1:"optional,default:1"`
+}
+
+type digestInfo struct {
+	Algorithm algorithm
+	Digest    []byte
+}
+
+type algorithm struct {
+	Algorithm  asn1.ObjectIdentifier
+	Parameters asn1.RawValue `asn1:"optional"`
+}
+
+type encryptedData struct {
+	Version              int
+	EncryptedContentInfo struct {
+		ContentType      asn1.ObjectIdentifier
+		Algorithm        algorithm
+		EncryptedContent asn1.RawValue `asn1:"tag:0,optional"`
+	}
+}
+
+type safeBag struct {
+	ID         asn1.ObjectIdentifier
+	Value      asn1.RawValue `asn1:"tag:0,explicit"`
+	Attributes asn1.RawValue `asn1:"optional"`
+}
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm algorithm
+	Data      []byte
+}
+
+type certBag struct {
+	ID   asn1.ObjectIdentifier
+	Data []byte `asn1:"tag:0,explicit"`
+}
+
+// Decode returns the private key and certificates held by a PKCS#12 file.
+// The certificate of the key is returned first, followed by the rest.
+func Decode(data []byte, password string) (crypto.Signer, []*x509.Certificate, error) {
+	var p pfx
+	if rest, err := asn1.Unmarshal(data, &p); err != nil {
+		return nil, nil, fmt.Errorf("parsing: %w", err)
+	} else if len(rest) != 0 {
+		return nil, nil, fmt.Errorf("parsing: trailing data")
+	}
+	if p.Version != 3 {
+		return nil, nil, fmt.Errorf("unsupported version %d", p.Version)
+	}
+	if !p.AuthSafe.ContentType.Equal(oidData) {
+		return nil, nil, fmt.Errorf("unsupported integrity mode %v, only password integrity is supported", p.AuthSafe.ContentType)
+	}
+	var authSafe []byte
+	if _, err := asn1.Unmarshal(p.AuthSafe.Content.Bytes, &authSafe); err != nil {
+		return nil, nil, fmt.Errorf("parsing content: %w", err)
+	}
+	if p.MacData.Mac.Algorithm.Algorithm != nil {
+		if err := p.MacData.verify(authSafe, password); err != nil {
+			return nil, nil, err
+		}
+	}
+	var contents []contentInfo
+	if _, err := asn1.Unmarshal(authSafe, &contents); err != nil {
+		return nil, nil, fmt.Errorf("parsing content: %w", err)
+	}
+	var (
+		key   crypto.Signer
+		certs []*x509.Certificate
+	)
+	for _, ci := range contents {
+		var bags []byte
+		switch {
+		case ci.ContentType.Equal(oidData):
+			if _, err := asn1.Unmarshal(ci.Content.Bytes, &bags); err != nil {
+				return nil, nil, fmt.Errorf("parsing content: %w", err)
+			}
+		case ci.ContentType.Equal(oidEncryptedData):
+			var ed encryptedData
+			if _, err := asn1.Unmarshal(ci.Content.Bytes, &ed); err != nil {
+				return nil, nil, fmt.Errorf("parsing encrypted content: %w", err)
+			}
+			info := ed.EncryptedContentInfo
+			var err error
+			if bags, err = decrypt(info.Algorithm, octets(info.EncryptedContent), password); err != nil {
+				return nil, nil, fmt.Errorf("decrypting content: %w", err)
+			}
+		default:
+			return nil, nil, fmt.Errorf("unsupported content type %v", ci.ContentType)
+		}
+		var safe []safeBag
+		if _, err := asn1.Unmarshal(bags, &safe); err != nil {
+			return nil, nil, fmt.Errorf("parsing bags: %w", err)
+		}
+		for _, bag := range safe {
+			switch {
+			case bag.ID.Equal(oidKeyBag), bag.ID.Equal(oidShroudedKeyBag):
+				if key != nil {
+					return nil, nil, fmt.Errorf("more than one private key")
+				}
+				der := bag.Value.Bytes
+				if bag.ID.Equal(oidShroudedKeyBag) {
+					var info encryptedPrivateKeyInfo
+					if _, err := asn1.Unmarshal(der, &info); err != nil {
+						return nil, nil, fmt.Errorf("parsing private key: %w", err)
+					}
+					var err error
+					if der, err = decrypt(info.Algorithm, info.Data, password); err != nil {
+						return nil, nil, fmt.Errorf("decrypting private key: %w", err)
+					}
+				}
+				k, err := x509.ParsePKCS8PrivateKey(der)
+				if err != nil {
+					return nil, nil, fmt.Errorf("parsing private key: %w", err)
+				}
+				signer, ok := k.(crypto.Signer)
+				if !ok {
+					return nil, nil, fmt.Errorf("unsupported private key %T", k)
+				}
+				key = signer
+			case bag.ID.Equal(oidCertBag):
+				var cb certBag
+				if _, err := asn1.Unmarshal(bag.Value.Bytes, &cb); err != nil {
+					return nil, nil, fmt.Errorf("parsing certificate: %w", err)
+				}
+				if !cb.ID.Equal(oidX509Certificate) {
+					continue
+				}
+				cert, err := x509.ParseCertificate(cb.Data)
+				if err != nil {
+					return nil, nil, fmt.Errorf("parsing certificate: %w", err)
+				}
+				certs = append(certs, cert)
+			}
+		}
+	}
+	if key == nil {
+		return nil, nil, fmt.Errorf("no private key")
+	}
+	pub, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported private key %T", key)
+	}
+	for ii, cert := range certs {
+		if pub.Equal(cert.PublicKey) {
+			certs[0], certs[ii] = certs[ii], certs[0]
+			return key, certs, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("no certificate for the private key")
+}
+
+// verify checks the MAC of the authenticated safe, which fails if the
+// password is wrong.
+func (m macData) verify(content []byte, password string) error {
+	h, err := hashFor(m.Mac.Algorithm.Algorithm)
+	if err != nil {
+		return fmt.Errorf("mac: %w", err)
+	}
+	key := kdf(h, m.Salt, bmpString(password), m.Iterations, 3, h().Size())
+	mac := hmac.New(h, key)
+	mac.Write(content)
+	if !hmac.Equal(mac.Sum(nil), m.Mac.Digest) {
+		return ErrIncorrectPassword
+	}
+	return nil
+}
+
+func hashFor(oid asn1.ObjectIdentifier) (func() hash.Hash, error) {
+	switch {
+	case oid.Equal(oidSHA1), oid.Equal(oidHMACWithSHA1):
+		return sha1.New, nil
+	case oid.Equal(oidSHA256), oid.Equal(oidHMACWithSHA256):
+		return sha256.New, nil
+	case oid.Equal(oidSHA384), oid.Equal(oidHMACWithSHA384):
+		return sha512.New384, nil
+	case oid.Equal(oidSHA512), oid.Equal(oidHMACWithSHA512):
+		return sha512.New, nil
+	}
+	return nil, fmt.Errorf("unsupported digest %v", oid)
+}
+
+// bmpString encodes s as big-endian UTF-16 with a terminating NUL, as
+// passwords are for the PKCS#12 key derivation.
+func bmpString(s string) []byte {
+	var out []byte
+	for _, c := range utf16.Encode([]rune(s)) {
+		out = append(out, byte(c>>8), byte(c))
+	}
+	return append(out, 0, 0)
+}
+
+// octets returns the contents of an octet string, joining the segments of a
+// constructed one.
+func octets(v asn1.RawValue) []byte {
+	if !v.IsCompound {
+		return v.Bytes
+	}
+	var out []byte
+	for rest := v.Bytes; len(rest) > 0; {
+		var seg asn1.RawValue
+		var err error
+		if rest, err = asn1.Unmarshal(rest, &seg); err != nil {
+			return out
+		}
+		out = append(out, octets(seg)...)
+	}
+	return out
+}
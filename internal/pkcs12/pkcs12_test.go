@@ -0,0 +1,80 @@
+package pkcs12
+
+import (
+	"crypto/ecdsa"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// testFiles were exported by openssl 3 from the same P-256 key and
+// self-signed certificate, with password "secret": modern with its defaults,
+// PBES2 with AES-256, and legacy with "-legacy", triple DES and RC2.
+var testFiles = map[string]string{
+	"modern": `
+MIIEPAIBAzCCA/IGCSqGSIb3DQEHAaCCA+MEggPfMIID2zCCApIGCSqGSIb3DQEHBqCCAoMwggJ/
+AgEAMIICeAYJKoZIhvcNAQcBMFcGCSqGSIb3DQEFDTBKMCkGCSqGSIb3DQEFDDAcBAiaxrPrfUiA
+6wICCAAwDAYIKoZIhvcNAgkFADAdBglghkgBZQMEASoEEDLmF32keLeUib/L3e0Dv7OAggIQH6GZ
+xk2QVdyw73I9flBPgDG0aLFMVcQ7L/eSjOpNv+8nlAzhN8LtaXyUoVAPk9tjb6m33HYgls7NMeq0
+aXDP6D72Is0AnfzPAUgmWBQ+WOC3R8qX/RG2HBhf6KpRCIAajzFT0/pYtRI80s0fUr58Hufc0WI5
+i+Q6KIcFvwn3Qo78AQgamjuTgUIk4xvrluqpnSjEpvRwFjmZQTMzyC0bTfwUpqU60q7u+eFEY/z1
+daQmWhZQx5HAhzH1Q2jmFQE4eq6MnUpI/V4SqtewUNhCrOdRKwWlo5OKib0/vFbTLgQNSBQao6B/
+hIaxpwDeENON9N1q36ARDOUeiPB/8YftkCxCiJ9zBI+ybcGPC1EkXhCHKDNJ6DbdObm98rtcgcHt
+8M1kizY0TgT3OofgZsccsnPKu97LD/W/o3koRAr0HImAwpC5i9Tq2bZXsnz3bUIlUOZFydv6iF9c
+SRLpx0Skps8NHZuAa1hqKgpuDOKdoPJQ02WANPhkFREZrSpZHlnOoMy5d5RQOZWWeb8NFuT2AWN/
+dxiYHbTQ7Dg5k0ZfarYW/lm3q/pbBi0vxnD1WsDt385YSQIHUyaaG6kVOD7OA1ju6H9RYpQ7tK6I
+siPY82lXLJaftjhyzd/kpgsZstq0izESlXUP8sFTmJ2UCu3pUOkEd6jmrjwRf0qQ8io60MYJPSkM
+L0s4IU1ezMuL6B8yMIIBQQYJKoZIhvcNAQcBoIIBMgSCAS4wggEqMIIBJgYLKoZIhvcNAQwKAQKg
+ge8wgewwVwYJKoZIhvcNAQUNMEowKQYJKoZIhvcNAQUMMBwECOLcztJ7mwmOAgIIADAMBggqhkiG
+9w0CCQUAMB0GCWCGSAFlAwQBKgQQ5uXmkuOC4mO8HFmYkX5ApASBkBRlmunr6+Onseqg03sExXRv
+YVjrA9RJpqUg0JmDJho9Eb+YHvVmNfoE3EEr+vRmXGDpL67jnb8vf+cbYyOfUrmE6RLyqjMP/1eB
+LN8h0b+JVxl11ruyxL//Rj6ln++ES5YgOgBvMunlgIUEexXc61JC7kiKnn7GsOkoHg6KhLUwHXkf
+hjMyV6NUvW80HjhW4jElMCMGCSqGSIb3DQEJFTEWBBTLUl2PNtdNQLBhPOFj3ei8/debVjBBMDEw
+DQYJYIZIAWUDBAIBBQAEINIl0lKyKKXKeqmWZyvwIrOtbiJkbY7cE8upge6/3uTxBAjyHAQeq3jp
+eAICCAA=
+`,
+	"legacy": `
+MIIDsgIBAzCCA3gGCSqGSIb3DQEHAaCCA2kEggNlMIIDYTCCAlcGCSqGSIb3DQEHBqCCAkgwggJE
+AgEAMIICPQYJKoZIhvcNAQcBMBwGCiqGSIb3DQEMAQYwDgQIrup8KL0LPjcCAggAgIICEAUySxgG
+tPwszdmStmflME/O5f4c76pl8OwEf+WxRznKJbgZI66M78oR1uz1fpn7GfP5JN0AV6tkMt9v8d4e
+jM+iXBSo9BZnFs1S5kfhdSxh2jefC/Tb/JfY0ZaMp/GV7YGdWvBH0B5hfVBKaNN2ZB27tShx15hg
+nc4p2KSzN998xYEAy6iE/K8LmsKGU0zLiB+xAiLmYkMUW2VjoCvviLZX79Qd2ttaE8s9A/wOznx3
+WoZzVSpDrL/pUJoN8fvDfs8i4soTEiLWDZ32h/PJl3MaenzF/Nc8TrdFzTj4FhOSlNJ5VeV3j5sB
+sMNF9Cp0IBvVU//IgzMQyCMyrbCkycGjYo9lyfx7IaoFi++X8I9G3ubfCSM7h/nBghUYy/LJCjcG
+dzL9NdXa4hEHTHF1bG8aq/TmPhhWJhaD0+o/CNM6uUs96W/gj9orypJT27zOhrUzkswBanmIpVIQ
+E+d14vcMnk6ptio9a/zyA3geQhbsDsJYlrh71ZofPvlYnQZ9ktNudLb4c0NaQXew+86yt8JORHej
+/vhY6fqy5VWIX3tdRexGmK7lwCVIjp4gqnuzEmny2DRdIgsCrG2LRfc7QlhlWvGFaNa/nlEhihIX
+R/kAPyJRWD1yGE6k6tbeYPeIIt3pTowJ3b4KMjAbSZy1FjPBhjwB/Hvhz5aj0nl2gws75s9IUy8t
++95ITWyxhUqV1jCCAQIGCSqGSIb3DQEHAaCB9ASB8TCB7jCB6wYLKoZIhvcNAQwKAQKggbQwgbEw
+HAYKKoZIhvcNAQwBAzAOBAgIMSRoIWQu9gICCAAEgZCVPymw5r7wCNazIfhoGDXCuX50wB/lfmNC
+xSctq+/z+fQ/y/Czs4ePmtuXl6BWfCmHHfEP0V6mh5wlZN6QRAePxHEc7hS4+R/2YyGOY2egQr18
+a6Ira7khdtJg1p8cLPGSWLFDeqqIkGRUZ8sFAET51j03fNjy79AMtoT11k4ASlCD8rMLf6GOl5Vr
+89Oy1RgxJTAjBgkqhkiG9w0BCRUxFgQUy1JdjzbXTUCwYTzhY93ovP3Xm1YwMTAhMAkGBSsOAwIa
+BQAEFLktn+8doQGZgBvNcafFOAlwfwgnBAiMnjR6YBs+fwICCAA=
+`,
+}
+
+func TestDecode(t *testing.T) {
+	for name, b64 := range testFiles {
+		data, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(b64), ""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, certs, err := Decode(data, "secret")
+		if err != nil {
+			t.Errorf("%s: decoding: %v", name, err)
+			continue
+		}
+		if len(certs) != 1 || certs[0].Subject.CommonName != "gopack test" {
+			t.Errorf("%s: got certificates %v", name, certs)
+			continue
+		}
+		if _, ok := key.(*ecdsa.PrivateKey); !ok || !key.Public().(*ecdsa.PublicKey).Equal(certs[0].PublicKey) {
+			t.Errorf("%s: key doesn't match certificate", name)
+		}
+		if _, _, err := Decode(data, "wrong"); !errors.Is(err, ErrIncorrectPassword) {
+			t.Errorf("%s: wrong password: got %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,408 @@
+// pkcs7 format encoding.
+//
+// Builds the signed-data structure of the Cryptographic Message Syntax, the
+// signature format of Mach-O code signatures and of Authenticode. Content is
+// signed with SHA-256 by an RSA or ECDSA key, over a set of signed attributes
+// that include the digest of the content. Signatures can be countersigned by
+// an RFC 3161 timestamp authority, so that they remain valid after the
+// certificate expires.
+//
+// See RFC 5652, RFC 3161 and the Authenticode PE specification.
+package pkcs7
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+	"sort"
+	"time"
+)
+
+// Object identifiers of content types.
+var (
+	OIDData       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	OIDSignedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	OIDTSTInfo    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 1, 4}
+)
+
+var (
+	oidContentType     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidMessageDigest   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidSigningTime     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 5}
+	oidSHA256          = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidRSA             = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	// Authenticode.
+	oidSpcIndirectData       = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 1, 4}
+	oidSpcStatementType      = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 1, 11}
+	oidSpcOpusInfo           = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 1, 12}
+	oidSpcPEImageData        = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 1, 15}
+	oidIndividualCodeSigning = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 1, 21}
+	oidRFC3161Countersign    = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 3, 3, 1}
+)
+
+// Signer signs content on behalf of a certificate.
+type Signer struct {
+	// Certificate identifies the signer.
+	Certificate *x509.Certificate
+	// Chain holds intermediate certificates, included so that the signature
+	// can be verified up to a root.
+	Chain []*x509.Certificate
+	// Key is the private key of the certificate.
+	Key crypto.Signer
+}
+
+// Attribute is an attribute of the signature with a single value, encoded
+// with asn1.Marshal.
+type Attribute struct {
+	Type  asn1.ObjectIdentifier
+	Value interface{}
+}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"optional"`
+}
+
+type signedData struct {
+	Version          int
+	DigestAlgorithms asn1.RawValue
+	ContentInfo      contentInfo
+	Certificates     asn1.RawValue `asn1:"optional"`
+	SignerInfos      asn1.RawValue
+}
+
+type signerInfo struct {
+	Version            int
+	IssuerAndSerial    issuerAndSerial
+	DigestAlgorithm    algorithm
+	SignedAttrs        asn1.RawValue
+	SignatureAlgorithm algorithm
+	Signature          []byte
+	UnsignedAttrs      asn1.RawValue `asn1:"optional"`
+}
+
+type issuerAndSerial struct {
+	Issuer asn1.RawValue
+	Serial *big.Int
+}
+
+type algorithm struct {
+	Algorithm  asn1.ObjectIdentifier
+	Parameters asn1.RawValue `asn1:"optional"`
+}
+
+type attribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue
+}
+
+type digestInfo struct {
+	Algorithm algorithm
+	Digest    []byte
+}
+
+type spcIndirectData struct {
+	Data struct {
+		Type  asn1.ObjectIdentifier
+		Value asn1.RawValue
+	}
+	MessageDigest digestInfo
+}
+
+type timeStampReq struct {
+	Version        int
+	MessageImprint digestInfo
+	Nonce          *big.Int `asn1:"optional"`
+	CertReq        bool     `asn1:"optional"`
+}
+
+type timeStampResp struct {
+	Status struct {
+		Status int
+		Rest   asn1.RawValue `asn1:"optional"`
+	}
+	Token asn1.RawValue `asn1:"optional"`
+}
+
+type tstInfo struct {
+	Version        int
+	Policy         asn1.ObjectIdentifier
+	MessageImprint digestInfo
+}
+
+// SignDetached signs data, returning a signed-data content info that doesn't
+// contain data itself.
+func (s Signer) SignDetached(data []byte, attrs ...Attribute) ([]byte, error) {
+	digest := sha256.Sum256(data)
+	return s.sign(OIDData, digest[:], nil, attrs)
+}
+
+// Sign signs content, the encoding of a value of the given type, returning a
+// signed-data content info that embeds it. As in PKCS #7, the digest covers
+// the contents of the encoding, without its tag and length.
+func (s Signer) Sign(contentType asn1.ObjectIdentifier, content []byte, attrs ...Attribute) ([]byte, error) {
+	var v asn1.RawValue
+	if rest, err := asn1.Unmarshal(content, &v); err != nil {
+		return nil, fmt.Errorf("parsing content: %w", err)
+	} else if len(rest) != 0 {
+		return nil, fmt.Errorf("parsing content: trailing data")
+	}
+	digest := sha256.Sum256(v.Bytes)
+	return s.sign(contentType, digest[:], content, attrs)
+}
+
+// SignAuthenticode signs the Authenticode digest of a PE image, as computed
+// by pe.Digest, returning the signed data of its certificate table.
+func (s Signer) SignAuthenticode(digest []byte) ([]byte, error) {
+	// The file link is obsolete, but still expected.
+	obsolete := bytes.NewBuffer(nil)
+	for _, c := range "<<<Obsolete>>>" {
+		obsolete.Write([]byte{0, byte(c)})
+	}
+	unicode, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, Bytes: obsolete.Bytes()})
+	if err != nil {
+		return nil, err
+	}
+	file, err := asn1.Marshal(explicit(2, unicode))
+	if err != nil {
+		return nil, err
+	}
+	image, err := asn1.Marshal(struct {
+		Flags asn1.BitString
+		File  asn1.RawValue
+	}{File: explicit(0, file)})
+	if err != nil {
+		return nil, err
+	}
+	var content spcIndirectData
+	content.Data.Type = oidSpcPEImageData
+	content.Data.Value = asn1.RawValue{FullBytes: image}
+	content.MessageDigest = digestInfo{
+		Algorithm: algorithm{Algorithm: oidSHA256, Parameters: asn1.NullRawValue},
+		Digest:    digest,
+	}
+	der, err := asn1.Marshal(content)
+	if err != nil {
+		return nil, err
+	}
+	return s.Sign(oidSpcIndirectData, der,
+		Attribute{Type: oidSpcOpusInfo, Value: struct{}{}},
+		Attribute{Type: oidSpcStatementType, Value: []asn1.ObjectIdentifier{oidIndividualCodeSigning}},
+	)
+}
+
+// Timestamp countersigns signed data with a timestamp token, proving that
+// the signature existed at the time. stamp sends an RFC 3161 request to a
+// timestamp authority and returns its response.
+//
+// The token is added as an Authenticode RFC 3161 countersignature.
+func Timestamp(signed []byte, stamp func(request []byte) ([]byte, error)) ([]byte, error) {
+	var ci contentInfo
+	if _, err := asn1.Unmarshal(signed, &ci); err != nil {
+		return nil, fmt.Errorf("parsing signed data: %w", err)
+	}
+	if !ci.ContentType.Equal(OIDSignedData) {
+		return nil, fmt.Errorf("unexpected content type %v", ci.ContentType)
+	}
+	var sd signedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		return nil, fmt.Errorf("parsing signed data: %w", err)
+	}
+	var si signerInfo
+	if rest, err := asn1.Unmarshal(sd.SignerInfos.Bytes, &si); err != nil {
+		return nil, fmt.Errorf("parsing signer info: %w", err)
+	} else if len(rest) != 0 {
+		return nil, fmt.Errorf("more than one signer")
+	}
+	nonce, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return nil, err
+	}
+	imprint := sha256.Sum256(si.Signature)
+	req, err := asn1.Marshal(timeStampReq{
+		Version: 1,
+		MessageImprint: digestInfo{
+			Algorithm: algorithm{Algorithm: oidSHA256, Parameters: asn1.NullRawValue},
+			Digest:    imprint[:],
+		},
+		Nonce:   nonce,
+		CertReq: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	by, err := stamp(req)
+	if err != nil {
+		return nil, fmt.Errorf("requesting timestamp: %w", err)
+	}
+	var resp timeStampResp
+	if _, err := asn1.Unmarshal(by, &resp); err != nil {
+		return nil, fmt.Errorf("parsing timestamp response: %w", err)
+	}
+	// Granted, or granted with modifications.
+	if resp.Status.Status > 1 || resp.Token.FullBytes == nil {
+		return nil, fmt.Errorf("timestamp rejected with status %d", resp.Status.Status)
+	}
+	info, err := parseToken(resp.Token.FullBytes)
+	if err != nil {
+		return nil, fmt.Errorf("parsing timestamp token: %w", err)
+	}
+	if !bytes.Equal(info.MessageImprint.Digest, imprint[:]) {
+		return nil, fmt.Errorf("timestamp is of another signature")
+	}
+	unsigned, err := set([]Attribute{{Type: oidRFC3161Countersign, Value: resp.Token}})
+	if err != nil {
+		return nil, err
+	}
+	si.UnsignedAttrs = asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 1, IsCompound: true, Bytes: unsigned}
+	if sd.SignerInfos.Bytes, err = asn1.Marshal(si); err != nil {
+		return nil, err
+	}
+	sd.SignerInfos.FullBytes = nil
+	content, err := asn1.Marshal(sd)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(contentInfo{
+		ContentType: OIDSignedData,
+		Content:     explicit(0, content),
+	})
+}
+
+// parseToken returns the TSTInfo of a timestamp token.
+func parseToken(token []byte) (tstInfo, error) {
+	var (
+		ci   contentInfo
+		sd   signedData
+		info tstInfo
+	)
+	if _, err := asn1.Unmarshal(token, &ci); err != nil {
+		return info, err
+	}
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		return info, err
+	}
+	if !sd.ContentInfo.ContentType.Equal(OIDTSTInfo) {
+		return info, fmt.Errorf("unexpected content type %v", sd.ContentInfo.ContentType)
+	}
+	var content []byte
+	if _, err := asn1.Unmarshal(sd.ContentInfo.Content.Bytes, &content); err != nil {
+		return info, err
+	}
+	_, err := asn1.Unmarshal(content, &info)
+	return info, err
+}
+
+// sign returns a signed-data content info over content of the given type and
+// digest. If embed is not nil it is the encoding of the content, included
+// in the signed data.
+func (s Signer) sign(contentType asn1.ObjectIdentifier, digest, embed []byte, attrs []Attribute) ([]byte, error) {
+	if s.Certificate == nil || s.Key == nil {
+		return nil, fmt.Errorf("signer requires a certificate and key")
+	}
+	var sigAlg algorithm
+	switch s.Key.Public().(type) {
+	case *rsa.PublicKey:
+		sigAlg = algorithm{Algorithm: oidRSA, Parameters: asn1.NullRawValue}
+	case *ecdsa.PublicKey:
+		sigAlg = algorithm{Algorithm: oidECDSAWithSHA256}
+	default:
+		return nil, fmt.Errorf("unsupported key %T", s.Key.Public())
+	}
+	attrs = append([]Attribute{
+		{Type: oidContentType, Value: contentType},
+		{Type: oidSigningTime, Value: time.Now().UTC()},
+		{Type: oidMessageDigest, Value: digest},
+	}, attrs...)
+	signed, err := set(attrs)
+	if err != nil {
+		return nil, err
+	}
+	// The signature covers the attributes tagged as the set they are,
+	// rather than the implicit tag they are stored with.
+	der, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: signed})
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.Sum256(der)
+	signature, err := s.Key.Sign(rand.Reader, h[:], crypto.SHA256)
+	if err != nil {
+		return nil, fmt.Errorf("signing: %w", err)
+	}
+	info, err := asn1.Marshal(signerInfo{
+		Version: 1,
+		IssuerAndSerial: issuerAndSerial{
+			Issuer: asn1.RawValue{FullBytes: s.Certificate.RawIssuer},
+			Serial: s.Certificate.SerialNumber,
+		},
+		DigestAlgorithm:    algorithm{Algorithm: oidSHA256, Parameters: asn1.NullRawValue},
+		SignedAttrs:        asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: signed},
+		SignatureAlgorithm: sigAlg,
+		Signature:          signature,
+	})
+	if err != nil {
+		return nil, err
+	}
+	digestAlg, err := asn1.Marshal(algorithm{Algorithm: oidSHA256, Parameters: asn1.NullRawValue})
+	if err != nil {
+		return nil, err
+	}
+	var certs []byte
+	for _, c := range append([]*x509.Certificate{s.Certificate}, s.Chain...) {
+		certs = append(certs, c.Raw...)
+	}
+	sd := signedData{
+		Version:          1,
+		DigestAlgorithms: asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: digestAlg},
+		ContentInfo:      contentInfo{ContentType: contentType},
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: certs},
+		SignerInfos:      asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: info},
+	}
+	if embed != nil {
+		sd.ContentInfo.Content = explicit(0, embed)
+	}
+	content, err := asn1.Marshal(sd)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(contentInfo{
+		ContentType: OIDSignedData,
+		Content:     explicit(0, content),
+	})
+}
+
+// set encodes attributes as the contents of a set, sorted as DER requires.
+func set(attrs []Attribute) ([]byte, error) {
+	var encoded [][]byte
+	for _, a := range attrs {
+		value, err := asn1.Marshal(a.Value)
+		if err != nil {
+			return nil, fmt.Errorf("encoding attribute %v: %w", a.Type, err)
+		}
+		der, err := asn1.Marshal(attribute{
+			Type:   a.Type,
+			Values: asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: value},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("encoding attribute %v: %w", a.Type, err)
+		}
+		encoded = append(encoded, der)
+	}
+	sort.Slice(encoded, func(ii, jj int) bool {
+		return bytes.Compare(encoded[ii], encoded[jj]) < 0
+	})
+	return bytes.Join(encoded, nil), nil
+}
+
+// explicit tags the encoding der.
+func explicit(tag int, der []byte) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: tag, IsCompound: true, Bytes: der}
+}
@@ -0,0 +1,219 @@
+package pkcs7
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// testSigner returns a signer with a self-signed certificate for key.
+func testSigner(t *testing.T, key crypto.Signer) Signer {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		Subject:      pkix.Name{CommonName: "gopack test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Signer{Certificate: cert, Key: key}
+}
+
+func TestSignDetached(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	extra := asn1.ObjectIdentifier{1, 2, 3}
+	for name, key := range map[string]crypto.Signer{"rsa": rsaKey, "ecdsa": ecKey} {
+		s := testSigner(t, key)
+		data := []byte("code directory")
+		der, err := s.SignDetached(data, Attribute{Type: extra, Value: "extra"})
+		if err != nil {
+			t.Fatalf("%s: signing: %v", name, err)
+		}
+		var ci contentInfo
+		if _, err := asn1.Unmarshal(der, &ci); err != nil || !ci.ContentType.Equal(OIDSignedData) {
+			t.Fatalf("%s: parsing content info: %v", name, err)
+		}
+		var sd signedData
+		if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+			t.Fatalf("%s: parsing signed data: %v", name, err)
+		}
+		if len(sd.ContentInfo.Content.Bytes) != 0 {
+			t.Errorf("%s: content embedded in detached signature", name)
+		}
+		if !bytes.Equal(sd.Certificates.Bytes, s.Certificate.Raw) {
+			t.Errorf("%s: certificate not included", name)
+		}
+		var si signerInfo
+		if _, err := asn1.Unmarshal(sd.SignerInfos.Bytes, &si); err != nil {
+			t.Fatalf("%s: parsing signer info: %v", name, err)
+		}
+		if si.IssuerAndSerial.Serial.Cmp(s.Certificate.SerialNumber) != 0 {
+			t.Errorf("%s: got serial %v", name, si.IssuerAndSerial.Serial)
+		}
+		signed, _ := asn1.Marshal(asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: si.SignedAttrs.Bytes})
+		alg := x509.SHA256WithRSA
+		if name == "ecdsa" {
+			alg = x509.ECDSAWithSHA256
+		}
+		if err := s.Certificate.CheckSignature(alg, signed, si.Signature); err != nil {
+			t.Errorf("%s: verifying: %v", name, err)
+		}
+		var attrs []attribute
+		if _, err := asn1.UnmarshalWithParams(signed, &attrs, "set"); err != nil {
+			t.Fatalf("%s: parsing attributes: %v", name, err)
+		}
+		found := map[string][]byte{}
+		for _, a := range attrs {
+			found[a.Type.String()] = a.Values.Bytes
+		}
+		want := sha256.Sum256(data)
+		var digest []byte
+		if _, err := asn1.Unmarshal(found[oidMessageDigest.String()], &digest); err != nil || !bytes.Equal(digest, want[:]) {
+			t.Errorf("%s: got digest %x, want %x", name, digest, want)
+		}
+		if found[extra.String()] == nil {
+			t.Errorf("%s: extra attribute missing", name)
+		}
+	}
+}
+
+// testAuthority returns a stamp function that timestamps requests as a
+// timestamp authority would, with the given status.
+func testAuthority(t *testing.T, tsa Signer, status int) func([]byte) ([]byte, error) {
+	return func(request []byte) ([]byte, error) {
+		var req timeStampReq
+		if _, err := asn1.Unmarshal(request, &req); err != nil {
+			t.Fatalf("parsing request: %v", err)
+		}
+		info, err := asn1.Marshal(struct {
+			Version        int
+			Policy         asn1.ObjectIdentifier
+			MessageImprint digestInfo
+			Serial         *big.Int
+			GenTime        time.Time `asn1:"generalized"`
+			Nonce          *big.Int
+		}{1, asn1.ObjectIdentifier{1, 2, 3}, req.MessageImprint, big.NewInt(1), time.Now().UTC(), req.Nonce})
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := asn1.Marshal(info)
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, err := tsa.Sign(OIDTSTInfo, content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var resp timeStampResp
+		resp.Status.Status = status
+		if status <= 1 {
+			resp.Token = asn1.RawValue{FullBytes: token}
+		}
+		return asn1.Marshal(resp)
+	}
+}
+
+func TestSignAuthenticode(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := testSigner(t, key)
+	digest := sha256.Sum256([]byte("image"))
+	der, err := s.SignAuthenticode(digest[:])
+	if err != nil {
+		t.Fatalf("signing: %v", err)
+	}
+	if der, err = Timestamp(der, testAuthority(t, s, 0)); err != nil {
+		t.Fatalf("timestamping: %v", err)
+	}
+	var (
+		ci      contentInfo
+		sd      signedData
+		si      signerInfo
+		content asn1.RawValue
+		data    spcIndirectData
+	)
+	if _, err := asn1.Unmarshal(der, &ci); err != nil {
+		t.Fatalf("parsing content info: %v", err)
+	}
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		t.Fatalf("parsing signed data: %v", err)
+	}
+	if !sd.ContentInfo.ContentType.Equal(oidSpcIndirectData) {
+		t.Errorf("got content type %v", sd.ContentInfo.ContentType)
+	}
+	if _, err := asn1.Unmarshal(sd.ContentInfo.Content.Bytes, &content); err != nil {
+		t.Fatalf("parsing content: %v", err)
+	}
+	if _, err := asn1.Unmarshal(content.FullBytes, &data); err != nil {
+		t.Fatalf("parsing indirect data: %v", err)
+	}
+	if !data.Data.Type.Equal(oidSpcPEImageData) || !bytes.Equal(data.MessageDigest.Digest, digest[:]) {
+		t.Errorf("got indirect data %v, digest %x", data.Data.Type, data.MessageDigest.Digest)
+	}
+	if _, err := asn1.Unmarshal(sd.SignerInfos.Bytes, &si); err != nil {
+		t.Fatalf("parsing signer info: %v", err)
+	}
+	signed, _ := asn1.Marshal(asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: si.SignedAttrs.Bytes})
+	if err := s.Certificate.CheckSignature(x509.ECDSAWithSHA256, signed, si.Signature); err != nil {
+		t.Errorf("verifying: %v", err)
+	}
+	var attrs []attribute
+	if _, err := asn1.UnmarshalWithParams(signed, &attrs, "set"); err != nil {
+		t.Fatalf("parsing attributes: %v", err)
+	}
+	for _, a := range attrs {
+		if !a.Type.Equal(oidMessageDigest) {
+			continue
+		}
+		// The digest covers the indirect data without its tag and length.
+		var got []byte
+		want := sha256.Sum256(content.Bytes)
+		if _, err := asn1.Unmarshal(a.Values.Bytes, &got); err != nil || !bytes.Equal(got, want[:]) {
+			t.Errorf("got message digest %x, want %x", got, want)
+		}
+	}
+	var unsigned []attribute
+	wrapped, _ := asn1.Marshal(asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: si.UnsignedAttrs.Bytes})
+	if _, err := asn1.UnmarshalWithParams(wrapped, &unsigned, "set"); err != nil {
+		t.Fatalf("parsing unsigned attributes: %v", err)
+	}
+	if len(unsigned) != 1 || !unsigned[0].Type.Equal(oidRFC3161Countersign) {
+		t.Fatalf("got unsigned attributes %v", unsigned)
+	}
+	info, err := parseToken(unsigned[0].Values.Bytes)
+	if err != nil {
+		t.Fatalf("parsing token: %v", err)
+	}
+	if imprint := sha256.Sum256(si.Signature); !bytes.Equal(info.MessageImprint.Digest, imprint[:]) {
+		t.Errorf("timestamp of another signature")
+	}
+	if _, err := Timestamp(der, testAuthority(t, s, 2)); err == nil {
+		t.Errorf("rejected timestamp: expected error")
+	}
+}
@@ -0,0 +1,176 @@
+// plist format encoding.
+//
+// Encodes property lists in Apple's XML and binary ("bplist00") formats, and
+// decodes the XML format. Values are built from bool, int, float64, string,
+// []byte, []interface{} and map[string]interface{}. Dictionary keys are
+// written in sorted order so that output is reproducible.
+package plist
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"unicode/utf16"
+)
+
+// MarshalBinary encodes v as a binary property list.
+func MarshalBinary(v interface{}) ([]byte, error) {
+	var (
+		objects [][]byte
+		refs    [][]int
+	)
+	// flatten assigns v and its children object numbers, depth first.
+	var flatten func(v interface{}) (int, error)
+	flatten = func(v interface{}) (int, error) {
+		n := len(objects)
+		objects = append(objects, nil)
+		refs = append(refs, nil)
+		buf := bytes.NewBuffer(nil)
+		switch v := v.(type) {
+		case bool:
+			if v {
+				buf.WriteByte(0x09)
+			} else {
+				buf.WriteByte(0x08)
+			}
+		case int:
+			writeInt(buf, int64(v))
+		case int64:
+			writeInt(buf, v)
+		case float64:
+			buf.WriteByte(0x23)
+			_ = binary.Write(buf, binary.BigEndian, math.Float64bits(v))
+		case string:
+			ascii := true
+			for _, r := range v {
+				if r > 0x7F {
+					ascii = false
+				}
+			}
+			if ascii {
+				writeMarker(buf, 0x50, len(v))
+				buf.WriteString(v)
+			} else {
+				chars := utf16.Encode([]rune(v))
+				writeMarker(buf, 0x60, len(chars))
+				_ = binary.Write(buf, binary.BigEndian, chars)
+			}
+		case []byte:
+			writeMarker(buf, 0x40, len(v))
+			buf.Write(v)
+		case []interface{}:
+			writeMarker(buf, 0xA0, len(v))
+			for _, e := range v {
+				ref, err := flatten(e)
+				if err != nil {
+					return 0, err
+				}
+				refs[n] = append(refs[n], ref)
+			}
+		case map[string]interface{}:
+			keys := make([]string, 0, len(v))
+			for k := range v {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			writeMarker(buf, 0xD0, len(v))
+			var values []int
+			for _, k := range keys {
+				ref, err := flatten(k)
+				if err != nil {
+					return 0, err
+				}
+				refs[n] = append(refs[n], ref)
+			}
+			for _, k := range keys {
+				ref, err := flatten(v[k])
+				if err != nil {
+					return 0, err
+				}
+				values = append(values, ref)
+			}
+			refs[n] = append(refs[n], values...)
+		default:
+			return 0, fmt.Errorf("unsupported type %T", v)
+		}
+		objects[n] = buf.Bytes()
+		return n, nil
+	}
+	if _, err := flatten(v); err != nil {
+		return nil, err
+	}
+	refSize := size(uint64(len(objects)))
+	out := bytes.NewBufferString("bplist00")
+	offsets := make([]uint64, len(objects))
+	for ii, o := range objects {
+		offsets[ii] = uint64(out.Len())
+		out.Write(o)
+		for _, r := range refs[ii] {
+			writeSized(out, uint64(r), refSize)
+		}
+	}
+	var (
+		tableOffset = uint64(out.Len())
+		offsetSize  = size(tableOffset)
+	)
+	for _, o := range offsets {
+		writeSized(out, o, offsetSize)
+	}
+	out.Write(make([]byte, 6))
+	out.WriteByte(byte(offsetSize))
+	out.WriteByte(byte(refSize))
+	_ = binary.Write(out, binary.BigEndian, []uint64{uint64(len(objects)), 0, tableOffset})
+	return out.Bytes(), nil
+}
+
+// writeMarker writes an object marker with a length, spilling lengths of 15
+// or more into a following integer object.
+func writeMarker(buf *bytes.Buffer, marker byte, n int) {
+	if n < 15 {
+		buf.WriteByte(marker | byte(n))
+		return
+	}
+	buf.WriteByte(marker | 0x0F)
+	writeInt(buf, int64(n))
+}
+
+// writeInt writes an integer object, negative values always take 8 bytes.
+func writeInt(buf *bytes.Buffer, v int64) {
+	n := 8
+	if v >= 0 {
+		n = size(uint64(v))
+	}
+	switch n {
+	case 1:
+		buf.WriteByte(0x10)
+	case 2:
+		buf.WriteByte(0x11)
+	case 4:
+		buf.WriteByte(0x12)
+	default:
+		buf.WriteByte(0x13)
+		n = 8
+	}
+	writeSized(buf, uint64(v), n)
+}
+
+// size is the number of bytes, a power of two, needed to hold v.
+func size(v uint64) int {
+	switch {
+	case v <= math.MaxUint8:
+		return 1
+	case v <= math.MaxUint16:
+		return 2
+	case v <= math.MaxUint32:
+		return 4
+	}
+	return 8
+}
+
+func writeSized(buf *bytes.Buffer, v uint64, n int) {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	buf.Write(b[8-n:])
+}
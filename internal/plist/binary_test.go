@@ -0,0 +1,25 @@
+package plist
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// TestMarshalBinary compares against the encoding produced by Python's
+// plistlib for the same value.
+func TestMarshalBinary(t *testing.T) {
+	const want = "62706c6973743030d301020304050851615162516309a2060710015178410108" +
+		"0f11131516191b1d000000000000010100000000000000090000000000000000" +
+		"000000000000001f"
+	got, err := MarshalBinary(map[string]interface{}{
+		"a": true,
+		"b": []interface{}{1, "x"},
+		"c": []byte{1},
+	})
+	if err != nil {
+		t.Fatalf("marshalling: %v", err)
+	}
+	if hex.EncodeToString(got) != want {
+		t.Fatalf("got %x, want %s", got, want)
+	}
+}
@@ -0,0 +1,201 @@
+package plist
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const header = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+`
+
+// Marshal encodes v as an XML property list, indented with tabs as Xcode
+// does. Values may additionally be time.Time, encoded as dates.
+func Marshal(v interface{}) ([]byte, error) {
+	buf := bytes.NewBufferString(header)
+	if err := marshal(buf, v, 0); err != nil {
+		return nil, err
+	}
+	buf.WriteString("</plist>\n")
+	return buf.Bytes(), nil
+}
+
+func marshal(buf *bytes.Buffer, v interface{}, depth int) error {
+	indent := strings.Repeat("\t", depth)
+	text := func(tag, s string) {
+		fmt.Fprintf(buf, "%s<%s>", indent, tag)
+		_ = xml.EscapeText(buf, []byte(s))
+		fmt.Fprintf(buf, "</%s>\n", tag)
+	}
+	switch v := v.(type) {
+	case bool:
+		fmt.Fprintf(buf, "%s<%t/>\n", indent, v)
+	case int:
+		text("integer", strconv.Itoa(v))
+	case int64:
+		text("integer", strconv.FormatInt(v, 10))
+	case float64:
+		text("real", strconv.FormatFloat(v, 'g', -1, 64))
+	case string:
+		text("string", v)
+	case []byte:
+		text("data", base64.StdEncoding.EncodeToString(v))
+	case time.Time:
+		text("date", v.UTC().Format(time.RFC3339))
+	case []interface{}:
+		if len(v) == 0 {
+			fmt.Fprintf(buf, "%s<array/>\n", indent)
+			return nil
+		}
+		fmt.Fprintf(buf, "%s<array>\n", indent)
+		for _, e := range v {
+			if err := marshal(buf, e, depth+1); err != nil {
+				return err
+			}
+		}
+		fmt.Fprintf(buf, "%s</array>\n", indent)
+	case map[string]interface{}:
+		if len(v) == 0 {
+			fmt.Fprintf(buf, "%s<dict/>\n", indent)
+			return nil
+		}
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		fmt.Fprintf(buf, "%s<dict>\n", indent)
+		for _, k := range keys {
+			fmt.Fprintf(buf, "%s\t<key>", indent)
+			_ = xml.EscapeText(buf, []byte(k))
+			buf.WriteString("</key>\n")
+			if err := marshal(buf, v[k], depth+1); err != nil {
+				return fmt.Errorf("%s: %w", k, err)
+			}
+		}
+		fmt.Fprintf(buf, "%s</dict>\n", indent)
+	default:
+		return fmt.Errorf("unsupported type %T", v)
+	}
+	return nil
+}
+
+// Unmarshal decodes an XML property list. Values are decoded into the same
+// types Marshal accepts, with integers as int64.
+func Unmarshal(data []byte) (interface{}, error) {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			if err == io.EOF {
+				return nil, fmt.Errorf("missing plist element")
+			}
+			return nil, err
+		}
+		if start, ok := tok.(xml.StartElement); ok {
+			if start.Name.Local != "plist" {
+				return nil, fmt.Errorf("unexpected element %q", start.Name.Local)
+			}
+			v, err := unmarshal(d, nil)
+			if err != nil {
+				return nil, err
+			}
+			return v, nil
+		}
+	}
+}
+
+// unmarshal decodes the next value. If start is nil the next element is
+// read first.
+func unmarshal(d *xml.Decoder, start *xml.StartElement) (interface{}, error) {
+	if start == nil {
+		for {
+			tok, err := d.Token()
+			if err != nil {
+				return nil, err
+			}
+			if s, ok := tok.(xml.StartElement); ok {
+				start = &s
+				break
+			}
+			if _, ok := tok.(xml.EndElement); ok {
+				return nil, fmt.Errorf("missing value")
+			}
+		}
+	}
+	switch start.Name.Local {
+	case "dict":
+		dict := map[string]interface{}{}
+		for {
+			tok, err := d.Token()
+			if err != nil {
+				return nil, err
+			}
+			switch tok := tok.(type) {
+			case xml.EndElement:
+				return dict, nil
+			case xml.StartElement:
+				if tok.Name.Local != "key" {
+					return nil, fmt.Errorf("expected key, got %q", tok.Name.Local)
+				}
+				var key string
+				if err := d.DecodeElement(&key, &tok); err != nil {
+					return nil, err
+				}
+				v, err := unmarshal(d, nil)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %w", key, err)
+				}
+				dict[key] = v
+			}
+		}
+	case "array":
+		array := []interface{}{}
+		for {
+			tok, err := d.Token()
+			if err != nil {
+				return nil, err
+			}
+			switch tok := tok.(type) {
+			case xml.EndElement:
+				return array, nil
+			case xml.StartElement:
+				v, err := unmarshal(d, &tok)
+				if err != nil {
+					return nil, err
+				}
+				array = append(array, v)
+			}
+		}
+	case "true", "false":
+		if err := d.Skip(); err != nil {
+			return nil, err
+		}
+		return start.Name.Local == "true", nil
+	}
+	var s string
+	if err := d.DecodeElement(&s, start); err != nil {
+		return nil, err
+	}
+	switch start.Name.Local {
+	case "string":
+		return s, nil
+	case "integer":
+		return strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	case "real":
+		return strconv.ParseFloat(strings.TrimSpace(s), 64)
+	case "data":
+		return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(s), ""))
+	case "date":
+		return time.Parse(time.RFC3339, strings.TrimSpace(s))
+	}
+	return nil, fmt.Errorf("unknown element %q", start.Name.Local)
+}
@@ -0,0 +1,40 @@
+package plist
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestRoundTrip ensures that each type decodes back to the value encoded.
+func TestRoundTrip(t *testing.T) {
+	want := map[string]interface{}{
+		"string": "a < b & c",
+		"int":    int64(-7),
+		"real":   1.5,
+		"bool":   true,
+		"data":   []byte{0, 1, 2},
+		"date":   time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		"array":  []interface{}{"x", false, []interface{}{}},
+		"dict":   map[string]interface{}{},
+	}
+	by, err := Marshal(want)
+	if err != nil {
+		t.Fatalf("marshalling: %v", err)
+	}
+	got, err := Unmarshal(by)
+	if err != nil {
+		t.Fatalf("unmarshalling: %v\n%s", err, by)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %#v, want %#v", got, want)
+	}
+	again, err := Marshal(got)
+	if err != nil {
+		t.Fatalf("marshalling: %v", err)
+	}
+	if !bytes.Equal(by, again) {
+		t.Fatalf("output not stable:\n%s\n%s", by, again)
+	}
+}
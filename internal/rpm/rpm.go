@@ -0,0 +1,503 @@
+// rpm format encoding.
+//
+// An rpm package is a lead, a signature header, the package header and a
+// compressed cpio payload. Headers are tag indexed stores, each wrapped in a
+// region as written by rpmbuild so that they verify under rpm 4.
+//
+// See https://rpm-software-management.github.io/rpm/manual/format.html.
+package rpm
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"time"
+)
+
+// Header tags.
+const (
+	tagHeaderSignatures = 62
+	tagHeaderImmutable  = 63
+	tagI18NTable        = 100
+
+	tagName              = 1000
+	tagVersion           = 1001
+	tagRelease           = 1002
+	tagSummary           = 1004
+	tagDescription       = 1005
+	tagBuildTime         = 1006
+	tagBuildHost         = 1007
+	tagSize              = 1009
+	tagVendor            = 1011
+	tagLicense           = 1014
+	tagPackager          = 1015
+	tagGroup             = 1016
+	tagURL               = 1020
+	tagOS                = 1021
+	tagArch              = 1022
+	tagFileSizes         = 1028
+	tagFileModes         = 1030
+	tagFileRDevs         = 1033
+	tagFileMTimes        = 1034
+	tagFileDigests       = 1035
+	tagFileLinkTos       = 1036
+	tagFileFlags         = 1037
+	tagFileUserName      = 1039
+	tagFileGroupName     = 1040
+	tagProvideName       = 1047
+	tagRequireFlags      = 1048
+	tagRequireName       = 1049
+	tagRequireVersion    = 1050
+	tagRPMVersion        = 1064
+	tagFileDevices       = 1095
+	tagFileInodes        = 1096
+	tagFileLangs         = 1097
+	tagProvideFlags      = 1112
+	tagProvideVersion    = 1113
+	tagDirIndexes        = 1116
+	tagBaseNames         = 1117
+	tagDirNames          = 1118
+	tagPayloadFormat     = 1124
+	tagPayloadCompressor = 1125
+	tagPayloadFlags      = 1126
+	tagFileDigestAlgo    = 5011
+)
+
+// Signature tags.
+const (
+	sigSHA1        = 269
+	sigSHA256      = 273
+	sigSize        = 1000
+	sigMD5         = 1004
+	sigPayloadSize = 1007
+)
+
+// Entry types.
+const (
+	typeInt16       = 3
+	typeInt32       = 4
+	typeString      = 6
+	typeBin         = 7
+	typeStringArray = 8
+	typeI18NString  = 9
+)
+
+// Dependency flags.
+const (
+	senseLess   = 1 << 1
+	senseEqual  = 1 << 3
+	senseRPMLib = 1 << 24
+)
+
+// digestSHA256 identifies sha256 file digests.
+const digestSHA256 = 8
+
+// leadArch numbers architectures in the lead, as in rpmrc. Others are zero.
+var leadArch = map[string]uint16{
+	"i386":    1,
+	"i686":    1,
+	"x86_64":  1,
+	"armv7hl": 12,
+	"s390x":   15,
+	"ppc64":   16,
+	"ppc64le": 16,
+	"aarch64": 19,
+	"riscv64": 22,
+}
+
+// system directories belong to the base system, so packages leave them
+// unowned.
+var system = map[string]bool{
+	"/":                       true,
+	"/etc":                    true,
+	"/opt":                    true,
+	"/usr":                    true,
+	"/usr/bin":                true,
+	"/usr/lib":                true,
+	"/usr/lib64":              true,
+	"/usr/libexec":            true,
+	"/usr/share":              true,
+	"/usr/share/applications": true,
+	"/usr/share/doc":          true,
+	"/usr/share/icons":        true,
+	"/usr/share/licenses":     true,
+	"/usr/share/man":          true,
+	"/usr/share/metainfo":     true,
+	"/usr/share/pixmaps":      true,
+}
+
+// Package is a binary rpm package.
+type Package struct {
+	Name    string
+	Version string
+	Release string
+	// Arch is the rpm architecture, eg "x86_64" or "aarch64".
+	Arch string
+	// Summary is a one line description of the package.
+	Summary     string
+	Description string
+	License     string
+	URL         string
+	Vendor      string
+	Packager    string
+	// Requires lists capabilities required at runtime.
+	Requires []string
+	// Files to install. Their parent directories, besides those of the base
+	// system, are owned by the package.
+	Files []File
+	// ModTime is stamped on the package and its files.
+	// Defaults to the time of writing.
+	ModTime time.Time
+}
+
+// File to install, with a slash separated path relative to the filesystem
+// root.
+type File struct {
+	Path string
+	Mode os.FileMode
+	Data []byte
+}
+
+// WriteTo encodes the package into dst.
+func (p Package) WriteTo(dst io.Writer) (int64, error) {
+	if p.ModTime.IsZero() {
+		p.ModTime = time.Now()
+	}
+	if p.Release == "" {
+		p.Release = "1"
+	}
+	var (
+		files = make([]File, 0, len(p.Files))
+		dirs  = map[string]bool{}
+	)
+	for _, f := range p.Files {
+		f.Path = path.Clean("/" + f.Path)
+		files = append(files, f)
+		for dir := path.Dir(f.Path); !system[dir] && !dirs[dir]; dir = path.Dir(dir) {
+			dirs[dir] = true
+			files = append(files, File{Path: dir, Mode: os.ModeDir | 0755})
+		}
+	}
+	sort.Slice(files, func(ii, jj int) bool {
+		return files[ii].Path < files[jj].Path
+	})
+	payload, size, err := p.payload(files)
+	if err != nil {
+		return 0, fmt.Errorf("payload: %w", err)
+	}
+	header := p.header(files).encode(tagHeaderImmutable)
+	var (
+		sha1sum   = sha1.Sum(header)
+		sha256sum = sha256.Sum256(header)
+		md5sum    = md5.New()
+	)
+	md5sum.Write(header)
+	md5sum.Write(payload)
+	sig := index{
+		sigSHA1:        str(fmt.Sprintf("%x", sha1sum)),
+		sigSHA256:      str(fmt.Sprintf("%x", sha256sum)),
+		sigSize:        int32s(int32(len(header) + len(payload))),
+		sigMD5:         bin(md5sum.Sum(nil)),
+		sigPayloadSize: int32s(int32(size)),
+	}.encode(tagHeaderSignatures)
+	// The signature is padded to an 8 byte boundary.
+	if rem := len(sig) % 8; rem != 0 {
+		sig = append(sig, make([]byte, 8-rem)...)
+	}
+	var n int64
+	for _, b := range [][]byte{p.lead(), sig, header, payload} {
+		written, err := dst.Write(b)
+		n += int64(written)
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// lead is the legacy fixed size preamble.
+func (p Package) lead() []byte {
+	lead := make([]byte, 96)
+	copy(lead, []byte{0xed, 0xab, 0xee, 0xdb, 3, 0})
+	binary.BigEndian.PutUint16(lead[6:], 0) // binary package
+	binary.BigEndian.PutUint16(lead[8:], leadArch[p.Arch])
+	name := fmt.Sprintf("%s-%s-%s", p.Name, p.Version, p.Release)
+	if len(name) > 65 {
+		name = name[:65]
+	}
+	copy(lead[10:76], name)
+	binary.BigEndian.PutUint16(lead[76:], 1) // linux
+	binary.BigEndian.PutUint16(lead[78:], 5) // header style signature
+	return lead
+}
+
+// header builds the package header describing files.
+func (p Package) header(files []File) index {
+	var (
+		summary     = p.Summary
+		description = p.Description
+		total       int32
+		dirs        []string
+		dirIndex    = map[string]int32{}
+		sizes       []int32
+		modes       []int16
+		rdevs       []int16
+		mtimes      []int32
+		digests     []string
+		links       []string
+		flags       []int32
+		users       []string
+		groups      []string
+		devices     []int32
+		inodes      []int32
+		langs       []string
+		indexes     []int32
+		basenames   []string
+	)
+	if summary == "" {
+		summary = p.Name
+	}
+	if description == "" {
+		description = summary
+	}
+	for ii, f := range files {
+		dir := path.Dir(f.Path) + "/"
+		if dir == "//" {
+			dir = "/"
+		}
+		if _, ok := dirIndex[dir]; !ok {
+			dirIndex[dir] = int32(len(dirs))
+			dirs = append(dirs, dir)
+		}
+		digest := ""
+		if !f.Mode.IsDir() {
+			digest = fmt.Sprintf("%x", sha256.Sum256(f.Data))
+		}
+		total += int32(len(f.Data))
+		sizes = append(sizes, int32(len(f.Data)))
+		modes = append(modes, int16(mode(f.Mode)))
+		rdevs = append(rdevs, 0)
+		mtimes = append(mtimes, int32(p.ModTime.Unix()))
+		digests = append(digests, digest)
+		links = append(links, "")
+		flags = append(flags, 0)
+		users = append(users, "root")
+		groups = append(groups, "root")
+		devices = append(devices, 1)
+		inodes = append(inodes, int32(ii+1))
+		langs = append(langs, "")
+		indexes = append(indexes, dirIndex[dir])
+		basenames = append(basenames, path.Base(f.Path))
+	}
+	var (
+		requireNames    = []string{"rpmlib(CompressedFileNames)", "rpmlib(FileDigests)", "rpmlib(PayloadFilesHavePrefix)"}
+		requireVersions = []string{"3.0.4-1", "4.6.0-1", "4.0-1"}
+		requireFlags    = []int32{}
+	)
+	for range requireNames {
+		requireFlags = append(requireFlags, senseLess|senseEqual|senseRPMLib)
+	}
+	for _, r := range p.Requires {
+		requireNames = append(requireNames, r)
+		requireVersions = append(requireVersions, "")
+		requireFlags = append(requireFlags, 0)
+	}
+	h := index{
+		tagI18NTable:         strs("C"),
+		tagName:              str(p.Name),
+		tagVersion:           str(p.Version),
+		tagRelease:           str(p.Release),
+		tagSummary:           i18n(summary),
+		tagDescription:       i18n(description),
+		tagBuildTime:         int32s(int32(p.ModTime.Unix())),
+		tagBuildHost:         str("localhost"),
+		tagSize:              int32s(total),
+		tagLicense:           str(p.License),
+		tagGroup:             i18n("Unspecified"),
+		tagOS:                str("linux"),
+		tagArch:              str(p.Arch),
+		tagProvideName:       strs(p.Name),
+		tagProvideFlags:      int32s(senseEqual),
+		tagProvideVersion:    strs(fmt.Sprintf("%s-%s", p.Version, p.Release)),
+		tagRequireName:       strs(requireNames...),
+		tagRequireVersion:    strs(requireVersions...),
+		tagRequireFlags:      int32s(requireFlags...),
+		tagRPMVersion:        str("4.16.0"),
+		tagPayloadFormat:     str("cpio"),
+		tagPayloadCompressor: str("gzip"),
+		tagPayloadFlags:      str("9"),
+	}
+	if p.URL != "" {
+		h[tagURL] = str(p.URL)
+	}
+	if p.Vendor != "" {
+		h[tagVendor] = str(p.Vendor)
+	}
+	if p.Packager != "" {
+		h[tagPackager] = str(p.Packager)
+	}
+	if len(files) > 0 {
+		h[tagFileSizes] = int32s(sizes...)
+		h[tagFileModes] = int16s(modes...)
+		h[tagFileRDevs] = int16s(rdevs...)
+		h[tagFileMTimes] = int32s(mtimes...)
+		h[tagFileDigests] = strs(digests...)
+		h[tagFileLinkTos] = strs(links...)
+		h[tagFileFlags] = int32s(flags...)
+		h[tagFileUserName] = strs(users...)
+		h[tagFileGroupName] = strs(groups...)
+		h[tagFileDevices] = int32s(devices...)
+		h[tagFileInodes] = int32s(inodes...)
+		h[tagFileLangs] = strs(langs...)
+		h[tagDirIndexes] = int32s(indexes...)
+		h[tagBaseNames] = strs(basenames...)
+		h[tagDirNames] = strs(dirs...)
+		h[tagFileDigestAlgo] = int32s(digestSHA256)
+	}
+	return h
+}
+
+// payload encodes files as a gzipped cpio archive in the "newc" format,
+// returning the compressed archive and its uncompressed size.
+func (p Package) payload(files []File) ([]byte, int, error) {
+	var (
+		archive = bytes.NewBuffer(nil)
+		mtime   = p.ModTime.Unix()
+	)
+	entry := func(ino int, mode uint32, name string, data []byte) {
+		fmt.Fprintf(archive, "070701%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X",
+			ino, mode, 0, 0, 1, mtime, len(data), 0, 1, 0, 0, len(name)+1, 0)
+		archive.WriteString(name)
+		archive.WriteByte(0)
+		pad(archive)
+		archive.Write(data)
+		pad(archive)
+	}
+	for ii, f := range files {
+		entry(ii+1, mode(f.Mode), "."+f.Path, f.Data)
+	}
+	entry(0, 0, "TRAILER!!!", nil)
+	compressed := bytes.NewBuffer(nil)
+	gz, err := gzip.NewWriterLevel(compressed, gzip.BestCompression)
+	if err != nil {
+		return nil, 0, err
+	}
+	if _, err := gz.Write(archive.Bytes()); err != nil {
+		return nil, 0, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, 0, err
+	}
+	return compressed.Bytes(), archive.Len(), nil
+}
+
+// mode converts a file mode to the unix mode stored in headers and payloads.
+func mode(m os.FileMode) uint32 {
+	if m.IsDir() {
+		return 040000 | uint32(m.Perm())
+	}
+	return 0100000 | uint32(m.Perm())
+}
+
+// pad the cpio archive to a 4 byte boundary.
+func pad(b *bytes.Buffer) {
+	if rem := b.Len() % 4; rem != 0 {
+		b.Write(make([]byte, 4-rem))
+	}
+}
+
+// index is a header store mapping tags to entries.
+type index map[int32]entry
+
+// entry is a typed header value.
+type entry struct {
+	kind  int32
+	count int32
+	data  []byte
+}
+
+// align is the byte alignment the entry's data requires.
+func (e entry) align() int {
+	switch e.kind {
+	case typeInt16:
+		return 2
+	case typeInt32:
+		return 4
+	}
+	return 1
+}
+
+// encode the header, wrapped in the region identified by region.
+//
+// The region entry is indexed first but its data, a copy of the index entry
+// with a negative offset spanning the whole index, is stored last.
+func (h index) encode(region int32) []byte {
+	tags := make([]int32, 0, len(h))
+	for tag := range h {
+		tags = append(tags, tag)
+	}
+	sort.Slice(tags, func(ii, jj int) bool { return tags[ii] < tags[jj] })
+	var (
+		count   = int32(len(tags) + 1)
+		store   = bytes.NewBuffer(nil)
+		entries = bytes.NewBuffer(nil)
+	)
+	for _, tag := range tags {
+		e := h[tag]
+		if rem := store.Len() % e.align(); rem != 0 {
+			store.Write(make([]byte, e.align()-rem))
+		}
+		_ = binary.Write(entries, binary.BigEndian, []int32{tag, e.kind, int32(store.Len()), e.count})
+		store.Write(e.data)
+	}
+	trailer := int32(store.Len())
+	_ = binary.Write(store, binary.BigEndian, []int32{region, typeBin, -count * 16, 16})
+	out := bytes.NewBuffer(nil)
+	out.Write([]byte{0x8e, 0xad, 0xe8, 0x01, 0, 0, 0, 0})
+	_ = binary.Write(out, binary.BigEndian, []int32{count, int32(store.Len())})
+	_ = binary.Write(out, binary.BigEndian, []int32{region, typeBin, trailer, 16})
+	out.Write(entries.Bytes())
+	out.Write(store.Bytes())
+	return out.Bytes()
+}
+
+func str(s string) entry {
+	return entry{kind: typeString, count: 1, data: append([]byte(s), 0)}
+}
+
+func i18n(s string) entry {
+	return entry{kind: typeI18NString, count: 1, data: append([]byte(s), 0)}
+}
+
+func strs(ss ...string) entry {
+	var data []byte
+	for _, s := range ss {
+		data = append(data, s...)
+		data = append(data, 0)
+	}
+	return entry{kind: typeStringArray, count: int32(len(ss)), data: data}
+}
+
+func bin(b []byte) entry {
+	return entry{kind: typeBin, count: int32(len(b)), data: b}
+}
+
+func int32s(v ...int32) entry {
+	buf := bytes.NewBuffer(nil)
+	_ = binary.Write(buf, binary.BigEndian, v)
+	return entry{kind: typeInt32, count: int32(len(v)), data: buf.Bytes()}
+}
+
+func int16s(v ...int16) entry {
+	buf := bytes.NewBuffer(nil)
+	_ = binary.Write(buf, binary.BigEndian, v)
+	return entry{kind: typeInt16, count: int32(len(v)), data: buf.Bytes()}
+}
@@ -0,0 +1,153 @@
+package rpm
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var testPackage = Package{
+	Name:     "app",
+	Version:  "1.2.3",
+	Arch:     "aarch64",
+	License:  "MIT",
+	Requires: []string{"libX11"},
+	Files: []File{
+		{Path: "usr/bin/app", Mode: 0755, Data: []byte("binary")},
+		{Path: "usr/share/applications/app.desktop", Mode: 0644, Data: []byte("[Desktop Entry]\n")},
+		{Path: "usr/share/icons/hicolor/256x256/apps/app.png", Mode: 0644, Data: []byte("icon")},
+	},
+}
+
+// TestPackage ensures the headers are wrapped in well formed regions and that
+// the payload follows them.
+func TestPackage(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	if _, err := testPackage.WriteTo(buf); err != nil {
+		t.Fatalf("writing package: %v", err)
+	}
+	rpm := buf.Bytes()
+	if !bytes.HasPrefix(rpm, []byte{0xed, 0xab, 0xee, 0xdb}) {
+		t.Fatalf("missing lead magic")
+	}
+	if arch := binary.BigEndian.Uint16(rpm[8:]); arch != 19 {
+		t.Errorf("lead arch: got %d, want 19", arch)
+	}
+	sig, size := parse(t, rpm[96:], tagHeaderSignatures)
+	if _, ok := sig[sigSHA256]; !ok {
+		t.Errorf("signature missing sha256 digest")
+	}
+	offset := 96 + size
+	if offset%8 != 0 {
+		offset += 8 - offset%8
+	}
+	header, size := parse(t, rpm[offset:], tagHeaderImmutable)
+	if got := strings.TrimRight(string(header[tagName]), "\x00"); got != "app" {
+		t.Errorf("name: got %q, want %q", got, "app")
+	}
+	// Directories outside the base system are owned, down to the icon's.
+	want := "/usr/bin/\x00/usr/share/applications/\x00/usr/share/icons/\x00/usr/share/icons/hicolor/\x00" +
+		"/usr/share/icons/hicolor/256x256/\x00/usr/share/icons/hicolor/256x256/apps/\x00"
+	if got := string(header[tagDirNames]); got != want {
+		t.Errorf("dirnames: got %q", got)
+	}
+	want = "app\x00app.desktop\x00hicolor\x00256x256\x00apps\x00app.png\x00"
+	if got := string(header[tagBaseNames]); got != want {
+		t.Errorf("basenames: got %q", got)
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(rpm[offset+size:]))
+	if err != nil {
+		t.Fatalf("reading payload: %v", err)
+	}
+	cpio, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatalf("reading payload: %v", err)
+	}
+	if !bytes.Contains(cpio, []byte("./usr/bin/app\x00")) || !bytes.Contains(cpio, []byte("TRAILER!!!")) {
+		t.Errorf("payload missing entries")
+	}
+}
+
+// TestRPM ensures rpm itself verifies the package and lists its files and
+// directories.
+func TestRPM(t *testing.T) {
+	if _, err := exec.LookPath("rpm"); err != nil {
+		t.Skip("rpm not found")
+	}
+	path := filepath.Join(t.TempDir(), "app.rpm")
+	buf := bytes.NewBuffer(nil)
+	if _, err := testPackage.WriteTo(buf); err != nil {
+		t.Fatalf("writing package: %v", err)
+	}
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := exec.Command("rpm", "-K", path).CombinedOutput(); err != nil {
+		t.Errorf("rpm -K: %v\n%s", err, out)
+	}
+	out, err := exec.Command("rpm", "-qlp", path).CombinedOutput()
+	if err != nil {
+		t.Fatalf("rpm -qlp: %v\n%s", err, out)
+	}
+	for _, want := range []string{
+		"/usr/bin/app",
+		"/usr/share/icons/hicolor",
+		"/usr/share/icons/hicolor/256x256/apps",
+		"/usr/share/icons/hicolor/256x256/apps/app.png",
+	} {
+		if !strings.Contains(string(out)+"\n", want+"\n") {
+			t.Errorf("rpm -qlp: missing %s in\n%s", want, out)
+		}
+	}
+}
+
+// parse a header, validating the region, and return the raw data for each
+// tag along with the encoded size of the header.
+func parse(t *testing.T, b []byte, region int32) (map[int32][]byte, int) {
+	t.Helper()
+	if !bytes.HasPrefix(b, []byte{0x8e, 0xad, 0xe8, 0x01}) {
+		t.Fatalf("missing header magic")
+	}
+	var (
+		count = int(binary.BigEndian.Uint32(b[8:]))
+		size  = int(binary.BigEndian.Uint32(b[12:]))
+		store = b[16+count*16 : 16+count*16+size]
+		tags  = map[int32][]byte{}
+		ends  []int
+	)
+	for ii := 0; ii < count; ii++ {
+		var e struct{ Tag, Type, Offset, Count int32 }
+		if err := binary.Read(bytes.NewReader(b[16+ii*16:]), binary.BigEndian, &e); err != nil {
+			t.Fatalf("reading entry: %v", err)
+		}
+		if ii == 0 {
+			if e.Tag != region || int(e.Offset) != size-16 {
+				t.Fatalf("region entry: %+v", e)
+			}
+			var trailer struct{ Tag, Type, Offset, Count int32 }
+			_ = binary.Read(bytes.NewReader(store[e.Offset:]), binary.BigEndian, &trailer)
+			if trailer.Tag != region || int(-trailer.Offset) != count*16 {
+				t.Fatalf("region trailer: %+v", trailer)
+			}
+			continue
+		}
+		ends = append(ends, int(e.Offset))
+		tags[e.Tag] = store[e.Offset:]
+	}
+	// Trim each entry to the start of the next.
+	for ii := 0; ii < len(ends); ii++ {
+		var e struct{ Tag int32 }
+		_ = binary.Read(bytes.NewReader(b[16+(ii+1)*16:]), binary.BigEndian, &e)
+		end := size - 16
+		if ii+1 < len(ends) {
+			end = ends[ii+1]
+		}
+		tags[e.Tag] = store[ends[ii]:end]
+	}
+	return tags, 16 + count*16 + size
+}
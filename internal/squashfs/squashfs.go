@@ -0,0 +1,483 @@
+// squashfs format encoding.
+//
+// Writes read-only squashfs 4.0 images, as mounted by the AppImage runtime and
+// consumed by snapd. Only the subset of the format required to describe a
+// plain file hierarchy is implemented: basic directory, file and symlink
+// inodes, gzip compression, a single owner and no fragments, xattrs or export
+// table.
+//
+// See https://dr-emann.github.io/squashfs/ for a description of the format.
+package squashfs
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	magic = 0x73717368
+	// metadataSize is the uncompressed size of a metadata block.
+	metadataSize = 8192
+	// DefaultBlockSize is the data block size used by mksquashfs.
+	DefaultBlockSize = 128 * 1024
+
+	compressionGzip = 1
+
+	flagNoFragments = 0x0010
+	flagNoXattrs    = 0x0200
+
+	metadataUncompressed = 0x8000
+	blockUncompressed    = 1 << 24
+
+	invalid     = 0xFFFFFFFFFFFFFFFF
+	noFragment  = 0xFFFFFFFF
+	typeDir     = 1
+	typeFile    = 2
+	typeSymlink = 3
+)
+
+// Writer accumulates a file hierarchy in memory and encodes it as a squashfs
+// image.
+// The zero value is ready to use.
+type Writer struct {
+	// BlockSize of data blocks, must be a power of two between 4KiB and 1MiB.
+	// Defaults to DefaultBlockSize.
+	BlockSize int
+	// ModTime is stamped on the superblock and every inode.
+	// Defaults to the time of writing.
+	ModTime time.Time
+
+	root *node
+}
+
+// node is an entry in the file hierarchy.
+type node struct {
+	name     string
+	mode     os.FileMode
+	data     []byte
+	target   string
+	children map[string]*node
+
+	// Populated while writing.
+	ino   uint32
+	ref   uint64
+	start uint32
+	sizes []uint32
+}
+
+func (n *node) kind() uint16 {
+	switch {
+	case n.mode&os.ModeSymlink != 0:
+		return typeSymlink
+	case n.mode.IsDir():
+		return typeDir
+	}
+	return typeFile
+}
+
+// sorted lists the children by name, as required by the directory table.
+func (n *node) sorted() []*node {
+	children := make([]*node, 0, len(n.children))
+	for _, c := range n.children {
+		children = append(children, c)
+	}
+	sort.Slice(children, func(ii, jj int) bool {
+		return children[ii].name < children[jj].name
+	})
+	return children
+}
+
+// Mkdir creates the directory at p, and any missing parents.
+func (w *Writer) Mkdir(p string, mode os.FileMode) error {
+	_, err := w.insert(p, &node{mode: os.ModeDir | mode.Perm()})
+	return err
+}
+
+// Create a regular file at p containing data. Missing parent directories are
+// created with 0755 permissions.
+func (w *Writer) Create(p string, mode os.FileMode, data []byte) error {
+	_, err := w.insert(p, &node{mode: mode.Perm(), data: data})
+	return err
+}
+
+// Symlink creates a symbolic link at p pointing to target.
+func (w *Writer) Symlink(target, p string) error {
+	_, err := w.insert(p, &node{mode: os.ModeSymlink | 0777, target: target})
+	return err
+}
+
+// insert n at path p, creating parent directories as needed.
+// Directories that already exist are updated in place.
+func (w *Writer) insert(p string, n *node) (*node, error) {
+	if w.root == nil {
+		w.root = &node{mode: os.ModeDir | 0755, children: map[string]*node{}}
+	}
+	parts := strings.Split(strings.Trim(path.Clean("/"+p), "/"), "/")
+	if len(parts) == 1 && parts[0] == "" {
+		if !n.mode.IsDir() {
+			return nil, fmt.Errorf("%s: root must be a directory", p)
+		}
+		w.root.mode = n.mode
+		return w.root, nil
+	}
+	dir := w.root
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := dir.children[part]
+		if !ok {
+			next = &node{name: part, mode: os.ModeDir | 0755, children: map[string]*node{}}
+			dir.children[part] = next
+		}
+		if !next.mode.IsDir() {
+			return nil, fmt.Errorf("%s: %s is not a directory", p, part)
+		}
+		dir = next
+	}
+	name := parts[len(parts)-1]
+	if existing, ok := dir.children[name]; ok {
+		if existing.mode.IsDir() && n.mode.IsDir() {
+			existing.mode = n.mode
+			return existing, nil
+		}
+		return nil, fmt.Errorf("%s: already exists", p)
+	}
+	n.name = name
+	if n.mode.IsDir() {
+		n.children = map[string]*node{}
+	}
+	dir.children[name] = n
+	return n, nil
+}
+
+// WriteTo encodes the image into dst.
+func (w *Writer) WriteTo(dst io.Writer) (int64, error) {
+	if w.root == nil {
+		w.root = &node{mode: os.ModeDir | 0755, children: map[string]*node{}}
+	}
+	var (
+		blockSize = w.BlockSize
+		modTime   = w.ModTime
+	)
+	if blockSize == 0 {
+		blockSize = DefaultBlockSize
+	}
+	if blockSize < 4096 || blockSize > 1<<20 || blockSize&(blockSize-1) != 0 {
+		return 0, fmt.Errorf("invalid block size %d", blockSize)
+	}
+	if modTime.IsZero() {
+		modTime = time.Now()
+	}
+	// Number inodes breadth first so that siblings are contiguous, which keeps
+	// directory headers small.
+	nodes := []*node{w.root}
+	w.root.ino = 1
+	for ii := 0; ii < len(nodes); ii++ {
+		for _, c := range nodes[ii].sorted() {
+			c.ino = uint32(len(nodes) + 1)
+			nodes = append(nodes, c)
+		}
+	}
+	img := bytes.NewBuffer(make([]byte, 96))
+	// Data blocks.
+	for _, n := range nodes {
+		if n.kind() != typeFile {
+			continue
+		}
+		if img.Len() > 0xFFFFFFFF {
+			return 0, fmt.Errorf("%s: image too large", n.name)
+		}
+		n.start = uint32(img.Len())
+		for off := 0; off < len(n.data); off += blockSize {
+			end := off + blockSize
+			if end > len(n.data) {
+				end = len(n.data)
+			}
+			block, compressed, err := compress(n.data[off:end])
+			if err != nil {
+				return 0, fmt.Errorf("compressing %s: %w", n.name, err)
+			}
+			size := uint32(len(block))
+			if !compressed {
+				size |= blockUncompressed
+			}
+			n.sizes = append(n.sizes, size)
+			img.Write(block)
+		}
+	}
+	// Inode and directory tables, children before parents so that directory
+	// listings can reference the inodes they contain.
+	var (
+		inodes = &metadata{}
+		dirs   = &metadata{}
+		mtime  = uint32(modTime.Unix())
+		walk   func(n, parent *node) error
+	)
+	walk = func(n, parent *node) error {
+		children := n.sorted()
+		for _, c := range children {
+			if err := walk(c, n); err != nil {
+				return err
+			}
+		}
+		block, offset := inodes.pos()
+		n.ref = uint64(block)<<16 | uint64(offset)
+		header := []interface{}{
+			n.kind(),
+			uint16(n.mode.Perm()),
+			uint16(0), // uid index
+			uint16(0), // gid index
+			mtime,
+			n.ino,
+		}
+		switch n.kind() {
+		case typeFile:
+			if err := inodes.write(append(header,
+				n.start,
+				uint32(noFragment),
+				uint32(0),
+				uint32(len(n.data)),
+				n.sizes,
+			)...); err != nil {
+				return err
+			}
+		case typeSymlink:
+			if err := inodes.write(append(header,
+				uint32(1),
+				uint32(len(n.target)),
+				[]byte(n.target),
+			)...); err != nil {
+				return err
+			}
+		case typeDir:
+			start, offset := dirs.pos()
+			listing, err := directory(children)
+			if err != nil {
+				return fmt.Errorf("%s: %w", n.name, err)
+			}
+			if err := dirs.write(listing); err != nil {
+				return err
+			}
+			if len(listing)+3 > 0xFFFF {
+				return fmt.Errorf("%s: directory too large", n.name)
+			}
+			links := uint32(2)
+			for _, c := range children {
+				if c.kind() == typeDir {
+					links++
+				}
+			}
+			parentIno := uint32(len(nodes) + 1)
+			if parent != nil {
+				parentIno = parent.ino
+			}
+			if err := inodes.write(append(header,
+				start,
+				links,
+				uint16(len(listing)+3),
+				offset,
+				parentIno,
+			)...); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(w.root, nil); err != nil {
+		return 0, fmt.Errorf("building tables: %w", err)
+	}
+	inodeTable := uint64(img.Len())
+	if err := inodes.flush(img); err != nil {
+		return 0, fmt.Errorf("writing inode table: %w", err)
+	}
+	dirTable := uint64(img.Len())
+	if err := dirs.flush(img); err != nil {
+		return 0, fmt.Errorf("writing directory table: %w", err)
+	}
+	// Single id (root) shared by every inode.
+	ids := &metadata{}
+	if err := ids.write(uint32(0)); err != nil {
+		return 0, err
+	}
+	idBlock := uint64(img.Len())
+	if err := ids.flush(img); err != nil {
+		return 0, fmt.Errorf("writing id table: %w", err)
+	}
+	idTable := uint64(img.Len())
+	if err := put(img, idBlock); err != nil {
+		return 0, err
+	}
+	bytesUsed := uint64(img.Len())
+	superblock := bytes.NewBuffer(nil)
+	if err := put(superblock,
+		uint32(magic),
+		uint32(len(nodes)),
+		mtime,
+		uint32(blockSize),
+		uint32(0), // fragment entries
+		uint16(compressionGzip),
+		uint16(log2(blockSize)),
+		uint16(flagNoFragments|flagNoXattrs),
+		uint16(1), // id count
+		uint16(4), // version major
+		uint16(0), // version minor
+		w.root.ref,
+		bytesUsed,
+		idTable,
+		uint64(invalid), // xattr table
+		inodeTable,
+		dirTable,
+		uint64(invalid), // fragment table
+		uint64(invalid), // export table
+	); err != nil {
+		return 0, fmt.Errorf("encoding superblock: %w", err)
+	}
+	out := img.Bytes()
+	copy(out, superblock.Bytes())
+	// Pad to a multiple of 4KiB, as block devices expect.
+	if rem := len(out) % 4096; rem != 0 {
+		out = append(out, make([]byte, 4096-rem)...)
+	}
+	n, err := dst.Write(out)
+	return int64(n), err
+}
+
+// directory encodes the listing for a directory containing children.
+// Entries are grouped under headers, each of which covers at most 256 inodes
+// from the same metadata block with inode numbers close to its own.
+func directory(children []*node) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	for ii := 0; ii < len(children); {
+		var (
+			head = children[ii]
+			jj   = ii
+		)
+		for ; jj < len(children) && jj-ii < 256; jj++ {
+			delta := int64(children[jj].ino) - int64(head.ino)
+			if children[jj].ref>>16 != head.ref>>16 || delta > 32767 || delta < -32768 {
+				break
+			}
+		}
+		if err := put(buf, uint32(jj-ii-1), uint32(head.ref>>16), head.ino); err != nil {
+			return nil, err
+		}
+		for _, c := range children[ii:jj] {
+			if len(c.name) > 256 {
+				return nil, fmt.Errorf("%s: name too long", c.name)
+			}
+			if err := put(buf,
+				uint16(c.ref&0xFFFF),
+				int16(int64(c.ino)-int64(head.ino)),
+				c.kind(),
+				uint16(len(c.name)-1),
+				[]byte(c.name),
+			); err != nil {
+				return nil, err
+			}
+		}
+		ii = jj
+	}
+	return buf.Bytes(), nil
+}
+
+// put encodes each value into buf in order.
+func put(buf io.Writer, values ...interface{}) error {
+	for _, v := range values {
+		if err := binary.Write(buf, binary.LittleEndian, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// metadata accumulates a table of metadata blocks.
+type metadata struct {
+	blocks  bytes.Buffer
+	pending []byte
+}
+
+// pos reports the location the next write will land at: the offset of its
+// metadata block relative to the start of the table and the offset within
+// the uncompressed block.
+func (m *metadata) pos() (uint32, uint16) {
+	return uint32(m.blocks.Len()), uint16(len(m.pending))
+}
+
+func (m *metadata) write(values ...interface{}) error {
+	buf := bytes.NewBuffer(nil)
+	if err := put(buf, values...); err != nil {
+		return fmt.Errorf("encoding metadata: %w", err)
+	}
+	m.pending = append(m.pending, buf.Bytes()...)
+	for len(m.pending) >= metadataSize {
+		if err := m.block(m.pending[:metadataSize]); err != nil {
+			return err
+		}
+		m.pending = m.pending[metadataSize:]
+	}
+	return nil
+}
+
+// block compresses and appends a single metadata block.
+func (m *metadata) block(data []byte) error {
+	out, compressed, err := compress(data)
+	if err != nil {
+		return fmt.Errorf("compressing metadata: %w", err)
+	}
+	header := uint16(len(out))
+	if !compressed {
+		header |= metadataUncompressed
+	}
+	if err := binary.Write(&m.blocks, binary.LittleEndian, header); err != nil {
+		return err
+	}
+	m.blocks.Write(out)
+	return nil
+}
+
+// flush the remaining data and copy the table into dst.
+func (m *metadata) flush(dst io.Writer) error {
+	if len(m.pending) > 0 {
+		if err := m.block(m.pending); err != nil {
+			return err
+		}
+		m.pending = nil
+	}
+	_, err := dst.Write(m.blocks.Bytes())
+	return err
+}
+
+// compress data with zlib, returning the data unmodified if compression
+// doesn't make it any smaller.
+func compress(data []byte) ([]byte, bool, error) {
+	buf := bytes.NewBuffer(nil)
+	z, err := zlib.NewWriterLevel(buf, zlib.BestCompression)
+	if err != nil {
+		return nil, false, err
+	}
+	if _, err := z.Write(data); err != nil {
+		return nil, false, err
+	}
+	if err := z.Close(); err != nil {
+		return nil, false, err
+	}
+	if buf.Len() >= len(data) {
+		return data, false, nil
+	}
+	return buf.Bytes(), true, nil
+}
+
+func log2(n int) int {
+	var l int
+	for n > 1 {
+		n >>= 1
+		l++
+	}
+	return l
+}
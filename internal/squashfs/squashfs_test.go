@@ -0,0 +1,254 @@
+package squashfs
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestRoundTrip ensures that an encoded image can be walked back into the
+// hierarchy that was written.
+func TestRoundTrip(t *testing.T) {
+	large := make([]byte, DefaultBlockSize*2+100)
+	rand.New(rand.NewSource(1)).Read(large)
+	want := map[string]string{
+		"/AppRun":                           "#!/bin/sh\n",
+		"/usr/bin/app":                      string(large),
+		"/usr/share/applications/a.desktop": "[Desktop Entry]\n",
+		"/empty":                            "",
+		"/link":                             "-> usr/bin/app",
+		"/usr/share/icons/":                 "dir",
+	}
+	// Enough siblings to spill the inode table over several metadata blocks.
+	for ii := 0; ii < 600; ii++ {
+		want[fmt.Sprintf("/many/file-%03d", ii)] = fmt.Sprintf("%d", ii)
+	}
+	w := &Writer{}
+	for p, content := range want {
+		var err error
+		switch {
+		case content == "dir":
+			err = w.Mkdir(p, 0755)
+		case len(content) > 3 && content[:3] == "-> ":
+			err = w.Symlink(content[3:], p)
+		default:
+			err = w.Create(p, 0755, []byte(content))
+		}
+		if err != nil {
+			t.Fatalf("adding %s: %v", p, err)
+		}
+	}
+	buf := bytes.NewBuffer(nil)
+	if _, err := w.WriteTo(buf); err != nil {
+		t.Fatalf("writing image: %v", err)
+	}
+	if buf.Len()%4096 != 0 {
+		t.Fatalf("image not padded: %d", buf.Len())
+	}
+	got, err := read(buf.Bytes())
+	if err != nil {
+		t.Fatalf("reading image: %v", err)
+	}
+	for p, content := range want {
+		if content == "dir" {
+			p = path.Clean(p)
+		}
+		if got[p] != content {
+			t.Errorf("%s: got %d bytes, want %d bytes", p, len(got[p]), len(content))
+		}
+	}
+}
+
+// TestUnsquashfs ensures that squashfs-tools lists the files of an image.
+func TestUnsquashfs(t *testing.T) {
+	if _, err := exec.LookPath("unsquashfs"); err != nil {
+		t.Skip("unsquashfs not found")
+	}
+	w := &Writer{}
+	if err := w.Create("/usr/bin/app", 0755, []byte("binary")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Symlink("usr/bin/app", "/AppRun"); err != nil {
+		t.Fatal(err)
+	}
+	buf := bytes.NewBuffer(nil)
+	if _, err := w.WriteTo(buf); err != nil {
+		t.Fatalf("writing image: %v", err)
+	}
+	img := filepath.Join(t.TempDir(), "app.squashfs")
+	if err := ioutil.WriteFile(img, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command("unsquashfs", "-l", img).CombinedOutput()
+	if err != nil {
+		t.Fatalf("unsquashfs -l: %v\n%s", err, out)
+	}
+	for _, want := range []string{"squashfs-root/AppRun", "squashfs-root/usr/bin/app"} {
+		if !strings.Contains(string(out), want+"\n") {
+			t.Errorf("unsquashfs -l: missing %s in\n%s", want, out)
+		}
+	}
+}
+
+// read decodes the subset of squashfs written by Writer into a map of path to
+// content. Directories map to "dir" and symlinks to "-> target".
+func read(img []byte) (map[string]string, error) {
+	var sb struct {
+		Magic, Inodes, MTime, BlockSize, Fragments uint32
+		Compression, BlockLog, Flags, IDs          uint16
+		Major, Minor                               uint16
+		Root, BytesUsed, IDTable, XattrTable       uint64
+		InodeTable, DirTable, FragTable, Export    uint64
+	}
+	if err := binary.Read(bytes.NewReader(img), binary.LittleEndian, &sb); err != nil {
+		return nil, err
+	}
+	if sb.Magic != magic || sb.Major != 4 || sb.FragTable != invalid {
+		return nil, fmt.Errorf("bad superblock: %+v", sb)
+	}
+	// The directory table is followed by the id table's only block.
+	idBlock := binary.LittleEndian.Uint64(img[sb.IDTable:])
+	inodes, err := table(img[sb.InodeTable:sb.DirTable])
+	if err != nil {
+		return nil, fmt.Errorf("inode table: %w", err)
+	}
+	dirs, err := table(img[sb.DirTable:idBlock])
+	if err != nil {
+		return nil, fmt.Errorf("directory table: %w", err)
+	}
+	out := map[string]string{}
+	var walk func(p string, ref uint64) error
+	walk = func(p string, ref uint64) error {
+		r := bytes.NewReader(inodes.at(ref))
+		var h struct {
+			Type, Mode, UID, GID uint16
+			MTime, Ino           uint32
+		}
+		if err := binary.Read(r, binary.LittleEndian, &h); err != nil {
+			return err
+		}
+		switch h.Type {
+		case typeFile:
+			var f struct{ Start, Frag, Offset, Size uint32 }
+			if err := binary.Read(r, binary.LittleEndian, &f); err != nil {
+				return err
+			}
+			var (
+				data  []byte
+				start = f.Start
+			)
+			for uint32(len(data)) < f.Size {
+				var size uint32
+				if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+					return err
+				}
+				block := img[start : start+size&^blockUncompressed]
+				start += size &^ blockUncompressed
+				if size&blockUncompressed == 0 {
+					z, err := zlib.NewReader(bytes.NewReader(block))
+					if err != nil {
+						return err
+					}
+					if block, err = ioutil.ReadAll(z); err != nil {
+						return err
+					}
+				}
+				data = append(data, block...)
+			}
+			out[p] = string(data)
+		case typeSymlink:
+			var s struct{ Links, Size uint32 }
+			if err := binary.Read(r, binary.LittleEndian, &s); err != nil {
+				return err
+			}
+			target := make([]byte, s.Size)
+			if _, err := r.Read(target); err != nil {
+				return err
+			}
+			out[p] = "-> " + string(target)
+		case typeDir:
+			var d struct {
+				Start, Links uint32
+				Size, Offset uint16
+				Parent       uint32
+			}
+			if err := binary.Read(r, binary.LittleEndian, &d); err != nil {
+				return err
+			}
+			out[p] = "dir"
+			listing := bytes.NewReader(dirs.at(uint64(d.Start)<<16 | uint64(d.Offset))[:d.Size-3])
+			for listing.Len() > 0 {
+				var head struct{ Count, Start, Ino uint32 }
+				if err := binary.Read(listing, binary.LittleEndian, &head); err != nil {
+					return err
+				}
+				for ii := uint32(0); ii <= head.Count; ii++ {
+					var e struct {
+						Offset uint16
+						Delta  int16
+						Type   uint16
+						Size   uint16
+					}
+					if err := binary.Read(listing, binary.LittleEndian, &e); err != nil {
+						return err
+					}
+					name := make([]byte, e.Size+1)
+					if _, err := listing.Read(name); err != nil {
+						return err
+					}
+					if err := walk(
+						path.Join(p, string(name)),
+						uint64(head.Start)<<16|uint64(e.Offset),
+					); err != nil {
+						return err
+					}
+				}
+			}
+		default:
+			return fmt.Errorf("%s: unexpected inode type %d", p, h.Type)
+		}
+		return nil
+	}
+	return out, walk("/", sb.Root)
+}
+
+// metatable is a decompressed metadata table.
+type metatable struct {
+	data []byte
+	// blocks maps on disk block offsets to offsets into data.
+	blocks map[uint64]int
+}
+
+func (m metatable) at(ref uint64) []byte {
+	return m.data[m.blocks[ref>>16]+int(ref&0xFFFF):]
+}
+
+func table(raw []byte) (metatable, error) {
+	m := metatable{blocks: map[uint64]int{}}
+	for off := 0; off < len(raw); {
+		header := binary.LittleEndian.Uint16(raw[off:])
+		size := int(header &^ metadataUncompressed)
+		block := raw[off+2 : off+2+size]
+		if header&metadataUncompressed == 0 {
+			z, err := zlib.NewReader(bytes.NewReader(block))
+			if err != nil {
+				return m, err
+			}
+			if block, err = ioutil.ReadAll(z); err != nil {
+				return m, err
+			}
+		}
+		m.blocks[uint64(off)] = len(m.data)
+		m.data = append(m.data, block...)
+		off += 2 + size
+	}
+	return m, nil
+}
@@ -0,0 +1,488 @@
+// toml format decoding.
+//
+// Decodes the subset of TOML v1.0.0 used by configuration files into maps:
+// tables, arrays of tables, dotted and quoted keys, strings in all four
+// forms, integers, floats, booleans, arrays and inline tables. Dates and
+// times are not supported.
+//
+// Tables decode to map[string]interface{}, arrays to []interface{},
+// integers to int64 and floats to float64.
+package toml
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Unmarshal decodes a TOML document.
+func Unmarshal(data []byte) (map[string]interface{}, error) {
+	if !utf8.Valid(data) {
+		return nil, fmt.Errorf("invalid utf-8")
+	}
+	p := &parser{src: string(data), line: 1}
+	root := map[string]interface{}{}
+	if err := p.document(root); err != nil {
+		return nil, fmt.Errorf("line %d: %w", p.line, err)
+	}
+	return root, nil
+}
+
+type parser struct {
+	src  string
+	pos  int
+	line int
+}
+
+func (p *parser) eof() bool {
+	return p.pos >= len(p.src)
+}
+
+func (p *parser) peek() byte {
+	if p.eof() {
+		return 0
+	}
+	return p.src[p.pos]
+}
+
+func (p *parser) next() byte {
+	c := p.src[p.pos]
+	p.pos++
+	if c == '\n' {
+		p.line++
+	}
+	return c
+}
+
+func (p *parser) consume(s string) bool {
+	if strings.HasPrefix(p.src[p.pos:], s) {
+		for range s {
+			p.next()
+		}
+		return true
+	}
+	return false
+}
+
+// space skips spaces and tabs.
+func (p *parser) space() {
+	for !p.eof() && (p.peek() == ' ' || p.peek() == '\t') {
+		p.next()
+	}
+}
+
+// blank skips whitespace, newlines and comments.
+func (p *parser) blank() {
+	for !p.eof() {
+		switch p.peek() {
+		case ' ', '\t', '\r', '\n':
+			p.next()
+		case '#':
+			p.comment()
+		default:
+			return
+		}
+	}
+}
+
+func (p *parser) comment() {
+	for !p.eof() && p.peek() != '\n' {
+		p.next()
+	}
+}
+
+// eol expects the end of a line, allowing a trailing comment.
+func (p *parser) eol() error {
+	p.space()
+	if p.peek() == '#' {
+		p.comment()
+	}
+	p.consume("\r")
+	if !p.eof() && !p.consume("\n") {
+		return fmt.Errorf("expected end of line, got %q", p.peek())
+	}
+	return nil
+}
+
+func (p *parser) document(root map[string]interface{}) error {
+	// Tables defined explicitly, which may not be defined again.
+	defined := map[string]bool{}
+	current := root
+	for {
+		p.blank()
+		if p.eof() {
+			return nil
+		}
+		if p.consume("[[") {
+			keys, err := p.keys()
+			if err != nil {
+				return err
+			}
+			if !p.consume("]]") {
+				return fmt.Errorf("expected ]]")
+			}
+			parent, err := descend(root, keys[:len(keys)-1])
+			if err != nil {
+				return err
+			}
+			last := keys[len(keys)-1]
+			var array []interface{}
+			switch v := parent[last].(type) {
+			case nil:
+			case []interface{}:
+				array = v
+			default:
+				return fmt.Errorf("%s is not an array of tables", strings.Join(keys, "."))
+			}
+			current = map[string]interface{}{}
+			parent[last] = append(array, current)
+		} else if p.consume("[") {
+			keys, err := p.keys()
+			if err != nil {
+				return err
+			}
+			if !p.consume("]") {
+				return fmt.Errorf("expected ]")
+			}
+			name := strings.Join(keys, "\x00")
+			if defined[name] {
+				return fmt.Errorf("table %s defined twice", strings.Join(keys, "."))
+			}
+			defined[name] = true
+			if current, err = descend(root, keys); err != nil {
+				return err
+			}
+		} else {
+			if err := p.pair(current); err != nil {
+				return err
+			}
+		}
+		if err := p.eol(); err != nil {
+			return err
+		}
+	}
+}
+
+// descend walks keys from table, creating tables as needed. Arrays of tables
+// resolve to their last element.
+func descend(table map[string]interface{}, keys []string) (map[string]interface{}, error) {
+	for _, k := range keys {
+		switch v := table[k].(type) {
+		case nil:
+			next := map[string]interface{}{}
+			table[k] = next
+			table = next
+		case map[string]interface{}:
+			table = v
+		case []interface{}:
+			if len(v) == 0 {
+				return nil, fmt.Errorf("%s is not a table", k)
+			}
+			last, ok := v[len(v)-1].(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%s is not a table", k)
+			}
+			table = last
+		default:
+			return nil, fmt.Errorf("%s is not a table", k)
+		}
+	}
+	return table, nil
+}
+
+// pair parses "key = value" into table.
+func (p *parser) pair(table map[string]interface{}) error {
+	keys, err := p.keys()
+	if err != nil {
+		return err
+	}
+	if !p.consume("=") {
+		return fmt.Errorf("expected = after key")
+	}
+	p.space()
+	v, err := p.value()
+	if err != nil {
+		return fmt.Errorf("%s: %w", strings.Join(keys, "."), err)
+	}
+	parent, err := descend(table, keys[:len(keys)-1])
+	if err != nil {
+		return err
+	}
+	last := keys[len(keys)-1]
+	if _, ok := parent[last]; ok {
+		return fmt.Errorf("%s defined twice", strings.Join(keys, "."))
+	}
+	parent[last] = v
+	return nil
+}
+
+// keys parses a dotted key, surrounded by optional whitespace.
+func (p *parser) keys() ([]string, error) {
+	var keys []string
+	for {
+		p.space()
+		var (
+			k   string
+			err error
+		)
+		switch p.peek() {
+		case '"':
+			k, err = p.basic()
+		case '\'':
+			k, err = p.literal()
+		default:
+			start := p.pos
+			for !p.eof() && isBare(p.peek()) {
+				p.next()
+			}
+			if p.pos == start {
+				return nil, fmt.Errorf("expected key, got %q", p.peek())
+			}
+			k = p.src[start:p.pos]
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+		p.space()
+		if !p.consume(".") {
+			return keys, nil
+		}
+	}
+}
+
+func isBare(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-'
+}
+
+func (p *parser) value() (interface{}, error) {
+	switch c := p.peek(); {
+	case c == '"':
+		if strings.HasPrefix(p.src[p.pos:], `"""`) {
+			return p.multiBasic()
+		}
+		return p.basic()
+	case c == '\'':
+		if strings.HasPrefix(p.src[p.pos:], `'''`) {
+			return p.multiLiteral()
+		}
+		return p.literal()
+	case c == '[':
+		return p.array()
+	case c == '{':
+		return p.inline()
+	case p.consume("true"):
+		return true, nil
+	case p.consume("false"):
+		return false, nil
+	}
+	return p.number()
+}
+
+func (p *parser) array() (interface{}, error) {
+	p.next()
+	array := []interface{}{}
+	for {
+		p.blank()
+		if p.consume("]") {
+			return array, nil
+		}
+		v, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		array = append(array, v)
+		p.blank()
+		if !p.consume(",") {
+			p.blank()
+			if !p.consume("]") {
+				return nil, fmt.Errorf("expected , or ] in array")
+			}
+			return array, nil
+		}
+	}
+}
+
+func (p *parser) inline() (interface{}, error) {
+	p.next()
+	table := map[string]interface{}{}
+	p.space()
+	if p.consume("}") {
+		return table, nil
+	}
+	for {
+		if err := p.pair(table); err != nil {
+			return nil, err
+		}
+		p.space()
+		if p.consume("}") {
+			return table, nil
+		}
+		if !p.consume(",") {
+			return nil, fmt.Errorf("expected , or } in inline table")
+		}
+	}
+}
+
+func (p *parser) number() (interface{}, error) {
+	start := p.pos
+	for !p.eof() && strings.IndexByte("+-0123456789abcdefABCDEFxob_.infa", p.peek()) >= 0 {
+		p.next()
+	}
+	s := p.src[start:p.pos]
+	if s == "" {
+		return nil, fmt.Errorf("unexpected %q", p.peek())
+	}
+	clean := strings.Replace(s, "_", "", -1)
+	if strings.HasPrefix(clean, "0x") || strings.HasPrefix(clean, "0o") || strings.HasPrefix(clean, "0b") {
+		base := map[byte]int{'x': 16, 'o': 8, 'b': 2}[clean[1]]
+		v, err := strconv.ParseInt(clean[2:], base, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid integer %q", s)
+		}
+		return v, nil
+	}
+	if v, err := strconv.ParseInt(clean, 10, 64); err == nil {
+		return v, nil
+	}
+	switch strings.TrimLeft(clean, "+-") {
+	case "inf", "nan":
+		v, _ := strconv.ParseFloat(clean, 64)
+		return v, nil
+	}
+	v, err := strconv.ParseFloat(clean, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value %q", s)
+	}
+	return v, nil
+}
+
+// basic parses a double quoted string.
+func (p *parser) basic() (string, error) {
+	p.next()
+	var b strings.Builder
+	for {
+		if p.eof() || p.peek() == '\n' {
+			return "", fmt.Errorf("unterminated string")
+		}
+		c := p.next()
+		switch c {
+		case '"':
+			return b.String(), nil
+		case '\\':
+			if err := p.escape(&b); err != nil {
+				return "", err
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+}
+
+// multiBasic parses a triple double quoted string.
+func (p *parser) multiBasic() (string, error) {
+	p.consume(`"""`)
+	// A newline immediately after the opening delimiter is trimmed.
+	if !p.consume("\n") {
+		p.consume("\r\n")
+	}
+	var b strings.Builder
+	for {
+		if p.eof() {
+			return "", fmt.Errorf("unterminated string")
+		}
+		if p.consume(`"""`) {
+			// Up to two quotes may precede the closing delimiter.
+			for ii := 0; ii < 2 && p.consume(`"`); ii++ {
+				b.WriteByte('"')
+			}
+			return b.String(), nil
+		}
+		c := p.next()
+		if c != '\\' {
+			b.WriteByte(c)
+			continue
+		}
+		// A line ending backslash trims the following whitespace.
+		rest := strings.TrimLeft(p.src[p.pos:], " \t\r")
+		if strings.HasPrefix(rest, "\n") {
+			for !p.eof() && strings.IndexByte(" \t\r\n", p.peek()) >= 0 {
+				p.next()
+			}
+			continue
+		}
+		if err := p.escape(&b); err != nil {
+			return "", err
+		}
+	}
+}
+
+func (p *parser) escape(b *strings.Builder) error {
+	if p.eof() {
+		return fmt.Errorf("unterminated escape")
+	}
+	switch c := p.next(); c {
+	case 'b':
+		b.WriteByte('\b')
+	case 't':
+		b.WriteByte('\t')
+	case 'n':
+		b.WriteByte('\n')
+	case 'f':
+		b.WriteByte('\f')
+	case 'r':
+		b.WriteByte('\r')
+	case '"', '\\':
+		b.WriteByte(c)
+	case 'u', 'U':
+		n := 4
+		if c == 'U' {
+			n = 8
+		}
+		if p.pos+n > len(p.src) {
+			return fmt.Errorf("short unicode escape")
+		}
+		r, err := strconv.ParseUint(p.src[p.pos:p.pos+n], 16, 32)
+		if err != nil {
+			return fmt.Errorf("invalid unicode escape")
+		}
+		p.pos += n
+		b.WriteRune(rune(r))
+	default:
+		return fmt.Errorf("invalid escape \\%c", c)
+	}
+	return nil
+}
+
+// literal parses a single quoted string.
+func (p *parser) literal() (string, error) {
+	p.next()
+	end := strings.IndexAny(p.src[p.pos:], "'\n")
+	if end < 0 || p.src[p.pos+end] != '\'' {
+		return "", fmt.Errorf("unterminated string")
+	}
+	s := p.src[p.pos : p.pos+end]
+	p.pos += end + 1
+	return s, nil
+}
+
+// multiLiteral parses a triple single quoted string.
+func (p *parser) multiLiteral() (string, error) {
+	p.consume("'''")
+	if !p.consume("\n") {
+		p.consume("\r\n")
+	}
+	end := strings.Index(p.src[p.pos:], "'''")
+	if end < 0 {
+		return "", fmt.Errorf("unterminated string")
+	}
+	// Up to two quotes may precede the closing delimiter.
+	for ii := 0; ii < 2 && strings.HasPrefix(p.src[p.pos+end+1:], "'''"); ii++ {
+		end++
+	}
+	s := p.src[p.pos : p.pos+end]
+	p.line += strings.Count(s, "\n")
+	p.pos += end + 3
+	return s, nil
+}
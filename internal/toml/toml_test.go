@@ -0,0 +1,84 @@
+package toml
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestUnmarshal(t *testing.T) {
+	const doc = `
+# Project file.
+name = "Example"
+"quoted key" = 'C:\path'
+count = 1_000
+ratio = 0.5
+hex = 0xff
+enabled = true
+list = [
+	"a", # first
+	"b",
+]
+point = { x = 1, y = 2 }
+site.url = "https://example.com"
+text = """
+line one \
+  continued
+line "two\""""
+
+[flags."windows/amd64"]
+linker = ["-H windowsgui"]
+
+[[app.file_associations]]
+name = "Markdown"
+extensions = ["md"]
+
+[[app.file_associations]]
+name = "Text"
+`
+	got, err := Unmarshal([]byte(doc))
+	if err != nil {
+		t.Fatalf("unmarshalling: %v", err)
+	}
+	want := map[string]interface{}{
+		"name":       "Example",
+		"quoted key": `C:\path`,
+		"count":      int64(1000),
+		"ratio":      0.5,
+		"hex":        int64(255),
+		"enabled":    true,
+		"list":       []interface{}{"a", "b"},
+		"point":      map[string]interface{}{"x": int64(1), "y": int64(2)},
+		"site":       map[string]interface{}{"url": "https://example.com"},
+		"text":       "line one continued\nline \"two\"",
+		"flags": map[string]interface{}{
+			"windows/amd64": map[string]interface{}{
+				"linker": []interface{}{"-H windowsgui"},
+			},
+		},
+		"app": map[string]interface{}{
+			"file_associations": []interface{}{
+				map[string]interface{}{"name": "Markdown", "extensions": []interface{}{"md"}},
+				map[string]interface{}{"name": "Text"},
+			},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %#v\nwant %#v", got, want)
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	for _, doc := range []string{
+		"a = ",
+		"a = 1\na = 2",
+		"[t]\n[t]",
+		"a = \"open",
+		"a = [1, 2",
+		"a = 1 b = 2",
+		"a = 2021-01-01",
+	} {
+		if _, err := Unmarshal([]byte(doc)); err == nil {
+			t.Errorf("%q: expected error", doc)
+		}
+	}
+}
@@ -0,0 +1,276 @@
+// udif format encoding.
+//
+// Wraps a raw disk image in the Universal Disk Image Format used by macOS
+// ".dmg" files: the image is split into chunks which are compressed
+// independently and described by a "mish" block table stored in an XML
+// property list, followed by a "koly" trailer locating everything.
+//
+// The image is described as a single partition without a partition map,
+// equivalent to "hdiutil create -layout NONE".
+package udif
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// SectorSize is the unit UDIF addresses the image in.
+const SectorSize = 512
+
+// chunkSectors is the uncompressed size of each chunk, matching hdiutil.
+const chunkSectors = 512
+
+// Run types.
+const (
+	runZero       = 0x00000000
+	runRaw        = 0x00000001
+	runZlib       = 0x80000005
+	runBzip2      = 0x80000006
+	runLZFSE      = 0x80000007
+	runTerminator = 0xFFFFFFFF
+)
+
+const checksumCRC32 = 2
+
+// Compression of the chunks.
+type Compression int
+
+const (
+	// Zlib compresses chunks with zlib, known to hdiutil as UDZO.
+	Zlib Compression = iota
+	// Raw stores chunks uncompressed, known to hdiutil as UDRO.
+	Raw
+	// Bzip2 compresses chunks with bzip2, known to hdiutil as UDBZ.
+	Bzip2
+	// LZFSE compresses chunks with lzfse, known to hdiutil as ULFO.
+	LZFSE
+)
+
+func (c Compression) String() string {
+	switch c {
+	case Zlib:
+		return "zlib"
+	case Raw:
+		return "raw"
+	case Bzip2:
+		return "bzip2"
+	case LZFSE:
+		return "lzfse"
+	}
+	return fmt.Sprintf("Compression(%d)", int(c))
+}
+
+// Encode writes the raw disk image as a UDIF image to w. The disk is padded
+// to a whole number of sectors. Name labels the partition, conventionally
+// "<description> (Apple_HFS : 0)".
+func Encode(w io.Writer, disk []byte, name string, c Compression) error {
+	if pad := len(disk) % SectorSize; pad != 0 {
+		disk = append(disk, make([]byte, SectorSize-pad)...)
+	}
+	var compress func([]byte) ([]byte, error)
+	var kind uint32
+	switch c {
+	case Zlib:
+		kind = runZlib
+		compress = func(b []byte) ([]byte, error) {
+			buf := bytes.NewBuffer(nil)
+			zw, err := zlib.NewWriterLevel(buf, zlib.BestCompression)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := zw.Write(b); err != nil {
+				return nil, err
+			}
+			if err := zw.Close(); err != nil {
+				return nil, err
+			}
+			return buf.Bytes(), nil
+		}
+	case Raw:
+		kind = runRaw
+		compress = func(b []byte) ([]byte, error) { return b, nil }
+	default:
+		// The standard library only decompresses bzip2, and has no lzfse.
+		return fmt.Errorf("%s compression not supported", c)
+	}
+	type run struct {
+		Type        uint32
+		Comment     uint32
+		SectorStart uint64
+		SectorCount uint64
+		CompOffset  uint64
+		CompLength  uint64
+	}
+	var (
+		data    = bytes.NewBuffer(nil)
+		runs    []run
+		sectors = uint64(len(disk) / SectorSize)
+		zero    = make([]byte, chunkSectors*SectorSize)
+	)
+	for start := 0; start < len(disk); start += chunkSectors * SectorSize {
+		end := start + chunkSectors*SectorSize
+		if end > len(disk) {
+			end = len(disk)
+		}
+		chunk := disk[start:end]
+		r := run{
+			SectorStart: uint64(start / SectorSize),
+			SectorCount: uint64(len(chunk) / SectorSize),
+			CompOffset:  uint64(data.Len()),
+		}
+		if bytes.Equal(chunk, zero[:len(chunk)]) {
+			r.Type = runZero
+		} else {
+			b, err := compress(chunk)
+			if err != nil {
+				return fmt.Errorf("compressing sector %d: %w", r.SectorStart, err)
+			}
+			// Store chunks that don't compress.
+			if len(b) >= len(chunk) {
+				r.Type, b = runRaw, chunk
+			} else {
+				r.Type = kind
+			}
+			r.CompLength = uint64(len(b))
+			data.Write(b)
+		}
+		runs = append(runs, r)
+	}
+	runs = append(runs, run{
+		Type:        runTerminator,
+		SectorStart: sectors,
+		CompOffset:  uint64(data.Len()),
+	})
+	var (
+		diskSum = crc32.ChecksumIEEE(disk)
+		dataSum = crc32.ChecksumIEEE(data.Bytes())
+		mish    = bytes.NewBuffer(nil)
+	)
+	put(mish,
+		[4]byte{'m', 'i', 's', 'h'},
+		uint32(1),              // version
+		uint64(0),              // first sector
+		sectors,                // sector count
+		uint64(0),              // data start
+		uint32(chunkSectors+8), // decompress buffer requested
+		int32(-1),              // blocks descriptor
+		[24]byte{},
+		checksum(diskSum),
+		uint32(len(runs)),
+		runs,
+	)
+	plist := blkx(name, mish.Bytes())
+	// The master checksum covers the checksum of each blkx table.
+	master := crc32.ChecksumIEEE(be32(diskSum))
+	// A stable segment ID keeps output reproducible for identical images.
+	id := sha256.Sum256(disk)
+	koly := bytes.NewBuffer(nil)
+	put(koly,
+		[4]byte{'k', 'o', 'l', 'y'},
+		uint32(4),   // version
+		uint32(512), // header size
+		uint32(1),   // flags, flattened
+		uint64(0),   // running data fork offset
+		uint64(0),   // data fork offset
+		uint64(data.Len()),
+		uint64(0), // resource fork offset
+		uint64(0), // resource fork length
+		uint32(1), // segment number
+		uint32(1), // segment count
+		id[:16],
+		checksum(dataSum),
+		uint64(data.Len()), // xml offset
+		uint64(len(plist)),
+		[120]byte{},
+		checksum(master),
+		uint32(1), // image variant
+		sectors,
+		[12]byte{},
+	)
+	for _, b := range [][]byte{data.Bytes(), plist, koly.Bytes()} {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checksum encodes a UDIFChecksum holding a CRC32.
+func checksum(sum uint32) []byte {
+	buf := bytes.NewBuffer(nil)
+	put(buf, uint32(checksumCRC32), uint32(32), sum, [31]uint32{})
+	return buf.Bytes()
+}
+
+// blkx encodes the property list holding the block table.
+func blkx(name string, mish []byte) []byte {
+	b := bytes.NewBuffer(nil)
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>resource-fork</key>
+	<dict>
+		<key>blkx</key>
+		<array>
+			<dict>
+				<key>Attributes</key>
+				<string>0x0050</string>
+				<key>CFName</key>
+				<string>`)
+	_ = xml.EscapeText(b, []byte(name))
+	b.WriteString(`</string>
+				<key>Data</key>
+				<data>
+`)
+	// Wrap the base64 the way Apple's plist writer does.
+	enc := base64.StdEncoding.EncodeToString(mish)
+	for len(enc) > 0 {
+		n := 52
+		if n > len(enc) {
+			n = len(enc)
+		}
+		b.WriteString("\t\t\t\t")
+		b.WriteString(enc[:n])
+		b.WriteString("\n")
+		enc = enc[n:]
+	}
+	b.WriteString(`				</data>
+				<key>ID</key>
+				<string>-1</string>
+				<key>Name</key>
+				<string>`)
+	_ = xml.EscapeText(b, []byte(name))
+	b.WriteString(`</string>
+			</dict>
+		</array>
+	</dict>
+</dict>
+</plist>
+`)
+	return b.Bytes()
+}
+
+func be32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+// put encodes each value into buf in order, big endian.
+func put(buf *bytes.Buffer, values ...interface{}) {
+	for _, v := range values {
+		if b, ok := v.([]byte); ok {
+			buf.Write(b)
+			continue
+		}
+		_ = binary.Write(buf, binary.BigEndian, v)
+	}
+}
@@ -0,0 +1,126 @@
+package udif
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+// TestRoundTrip ensures that the image can be expanded back into the disk it
+// was encoded from, and that the checksums agree.
+func TestRoundTrip(t *testing.T) {
+	// Mix random, zero and repetitive regions so that each kind of run is
+	// produced, with a length that isn't a whole number of chunks.
+	disk := make([]byte, chunkSectors*SectorSize*5+3*SectorSize)
+	rand.New(rand.NewSource(1)).Read(disk[:chunkSectors*SectorSize])
+	for ii := chunkSectors * SectorSize * 3; ii < len(disk); ii++ {
+		disk[ii] = byte(ii % 7)
+	}
+	for _, c := range []Compression{Zlib, Raw} {
+		t.Run(c.String(), func(t *testing.T) {
+			buf := bytes.NewBuffer(nil)
+			if err := Encode(buf, disk, "disk (Apple_HFS : 0)", c); err != nil {
+				t.Fatalf("encoding: %v", err)
+			}
+			got, err := read(buf.Bytes())
+			if err != nil {
+				t.Fatalf("decoding: %v", err)
+			}
+			if !bytes.Equal(got, disk) {
+				t.Fatalf("disk differs after round trip")
+			}
+		})
+	}
+	if err := Encode(ioutil.Discard, disk, "", LZFSE); err == nil {
+		t.Fatalf("expected error for unsupported compression")
+	}
+}
+
+// read expands a UDIF image written by Encode.
+func read(img []byte) ([]byte, error) {
+	be := binary.BigEndian
+	koly := img[len(img)-512:]
+	if string(koly[:4]) != "koly" {
+		return nil, fmt.Errorf("missing koly trailer")
+	}
+	var (
+		dataLen = be.Uint64(koly[0x20:])
+		dataSum = be.Uint32(koly[0x58:])
+		xmlOff  = be.Uint64(koly[0xD8:])
+		xmlLen  = be.Uint64(koly[0xE0:])
+		master  = be.Uint32(koly[0x168:])
+		sectors = be.Uint64(koly[0x1EC:])
+		data    = img[:dataLen]
+	)
+	if got := crc32.ChecksumIEEE(data); got != dataSum {
+		return nil, fmt.Errorf("data checksum: got %08x, want %08x", got, dataSum)
+	}
+	var plist struct {
+		Data string `xml:"dict>dict>array>dict>data"`
+	}
+	if err := xml.Unmarshal(img[xmlOff:xmlOff+xmlLen], &plist); err != nil {
+		return nil, fmt.Errorf("parsing plist: %w", err)
+	}
+	mish, err := base64.StdEncoding.DecodeString(string(bytes.Join(bytes.Fields([]byte(plist.Data)), nil)))
+	if err != nil {
+		return nil, fmt.Errorf("decoding blkx: %w", err)
+	}
+	if string(mish[:4]) != "mish" {
+		return nil, fmt.Errorf("missing mish signature")
+	}
+	if be.Uint64(mish[0x10:]) != sectors {
+		return nil, fmt.Errorf("sector count mismatch")
+	}
+	var (
+		blkxSum = be.Uint32(mish[0x48:])
+		count   = int(be.Uint32(mish[0xC8:]))
+		disk    = make([]byte, sectors*SectorSize)
+	)
+	if got := crc32.ChecksumIEEE(mish[0x48:0x4C]); got != master {
+		return nil, fmt.Errorf("master checksum: got %08x, want %08x", got, master)
+	}
+	for ii := 0; ii < count; ii++ {
+		run := mish[0xCC+40*ii:]
+		var (
+			kind   = be.Uint32(run)
+			start  = be.Uint64(run[8:]) * SectorSize
+			length = be.Uint64(run[16:]) * SectorSize
+			chunk  = data[be.Uint64(run[24:]) : be.Uint64(run[24:])+be.Uint64(run[32:])]
+		)
+		switch kind {
+		case runZero:
+		case runRaw:
+			copy(disk[start:start+length], chunk)
+		case runZlib:
+			r, err := zlib.NewReader(bytes.NewReader(chunk))
+			if err != nil {
+				return nil, err
+			}
+			b, err := ioutil.ReadAll(r)
+			if err != nil {
+				return nil, err
+			}
+			if uint64(len(b)) != length {
+				return nil, fmt.Errorf("run %d: inflated to %d bytes, want %d", ii, len(b), length)
+			}
+			copy(disk[start:], b)
+		case runTerminator:
+			if ii != count-1 {
+				return nil, fmt.Errorf("terminator before last run")
+			}
+		default:
+			return nil, fmt.Errorf("unknown run type %08x", kind)
+		}
+	}
+	if got := crc32.ChecksumIEEE(disk); got != blkxSum {
+		return nil, fmt.Errorf("blkx checksum: got %08x, want %08x", got, blkxSum)
+	}
+	return disk, nil
+}
@@ -15,6 +15,8 @@ type Finder struct {
 	IsDir bool
 	// Rel indicates to return a relative path instead of an absolute path.
 	Rel bool
+	// Ignore lists names of directories not to search.
+	Ignore []string
 }
 
 // Find the first file with the given name recursively from the root.
@@ -29,6 +31,13 @@ func (f Finder) Find(name string) (string, error) {
 		if err != nil {
 			return err
 		}
+		if info.IsDir() && path != f.Root {
+			for _, ignore := range f.Ignore {
+				if info.Name() == ignore {
+					return filepath.SkipDir
+				}
+			}
+		}
 		if info.IsDir() == f.IsDir && info.Name() == name {
 			if f.Rel {
 				path = filepath.Clean(strings.TrimPrefix(path, f.Root))
@@ -1,6 +1,7 @@
 package util
 
 import (
+	"errors"
 	"fmt"
 	"strings"
 )
@@ -19,6 +20,32 @@ func (me MultiError) IsEmpty() bool {
 	return len(me) == 0
 }
 
+// Is reports whether any of the combined errors matches target.
+func (me MultiError) Is(target error) bool {
+	for _, err := range me {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first of the combined errors that matches target.
+func (me MultiError) As(target interface{}) bool {
+	for _, err := range me {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// Unwrap returns the combined errors. errors.Is and errors.As only use it
+// from Go 1.20, earlier releases rely on the Is and As methods.
+func (me MultiError) Unwrap() []error {
+	return me
+}
+
 func (me MultiError) Error() string {
 	if len(me) == 1 {
 		return me[0].Error()
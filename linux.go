@@ -0,0 +1,364 @@
+package gopack
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"git.sr.ht/~jackmordaunt/gopack/internal/deb"
+	"git.sr.ht/~jackmordaunt/gopack/internal/rpm"
+	"git.sr.ht/~jackmordaunt/gopack/internal/squashfs"
+)
+
+// runtimeReleases publishes the AppImage runtime for each architecture.
+const runtimeReleases = "https://github.com/AppImage/type2-runtime/releases"
+
+// bundleAppImage creates a self mounting AppImage at dest.
+//
+// The AppDir is assembled in memory, encoded as a squashfs image and appended
+// to the runtime executable, which must be supplied: the runtimes published
+// by the AppImage project move between releases, so aren't fetched
+// implicitly.
+func bundleAppImage(
+	dest, name string,
+	arch Architecture,
+	binary io.Reader,
+	md MetaData,
+	runtime io.Reader,
+) error {
+	bin, err := ioutil.ReadAll(binary)
+	if err != nil {
+		return fmt.Errorf("buffering binary: %w", err)
+	}
+	if runtime == nil {
+		return fmt.Errorf("no runtime for %s: add runtime-%s from %s", arch, appImageArch(arch), runtimeReleases)
+	}
+	rt, err := ioutil.ReadAll(runtime)
+	if err != nil {
+		return fmt.Errorf("reading runtime: %w", err)
+	}
+	files, err := installLayout(name, bin, md)
+	if err != nil {
+		return err
+	}
+	fs := &squashfs.Writer{}
+	for _, f := range files {
+		if err := fs.Create(f.Path, f.Mode, f.Data); err != nil {
+			return fmt.Errorf("adding %s: %w", f.Path, err)
+		}
+	}
+	apprun := fmt.Sprintf("#!/bin/sh\nHERE=\"$(dirname \"$(readlink -f \"$0\")\")\"\nexec \"$HERE/usr/bin/%s\" \"$@\"\n", name)
+	if err := fs.Create("AppRun", 0755, []byte(apprun)); err != nil {
+		return fmt.Errorf("adding AppRun: %w", err)
+	}
+	// The AppImage tooling expects the desktop entry and icon at the root.
+	id := md.desktopID(name)
+	if err := fs.Symlink(path.Join("usr", "share", "applications", id+".desktop"), id+".desktop"); err != nil {
+		return fmt.Errorf("adding desktop entry: %w", err)
+	}
+	if md.Icon != nil {
+		if err := fs.Symlink(path.Join("usr", hicolorPath(id, 256)), id+".png"); err != nil {
+			return fmt.Errorf("adding icon: %w", err)
+		}
+		if err := fs.Symlink(id+".png", ".DirIcon"); err != nil {
+			return fmt.Errorf("adding icon: %w", err)
+		}
+	}
+	_ = os.MkdirAll(filepath.Dir(dest), 0777)
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0755)
+	if err != nil {
+		return fmt.Errorf("creating file: %w", err)
+	}
+	defer out.Close()
+	if _, err := out.Write(rt); err != nil {
+		return fmt.Errorf("writing runtime: %w", err)
+	}
+	if _, err := fs.WriteTo(out); err != nil {
+		return fmt.Errorf("writing squashfs: %w", err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("closing output file: %w", err)
+	}
+	return nil
+}
+
+// bundleDeb creates a Debian binary package in dir.
+// The package is named according to Debian convention:
+// "<package>_<version>_<arch>.deb".
+func bundleDeb(dir, name string, arch Architecture, binary io.Reader, md MetaData) error {
+	bin, err := ioutil.ReadAll(binary)
+	if err != nil {
+		return fmt.Errorf("buffering binary: %w", err)
+	}
+	files, err := installLayout(name, bin, md)
+	if err != nil {
+		return err
+	}
+	info := md.Linux.Package
+	if info.Name == "" {
+		info.Name = packageName(name)
+	}
+	if info.Version == "" {
+		info.Version = "0.0.0"
+	}
+	if info.Maintainer == "" {
+		info.Maintainer = "Unknown <unknown@localhost>"
+	}
+	if info.Description == "" {
+		info.Description = name
+	}
+	pkg := deb.Package{
+		Control: deb.Control{
+			Package:      info.Name,
+			Version:      info.Version,
+			Architecture: debArch(arch),
+			Maintainer:   info.Maintainer,
+			Section:      "misc",
+			Priority:     "optional",
+			Homepage:     info.Homepage,
+			Depends:      info.Depends,
+			Description:  info.Description,
+		},
+	}
+	for _, f := range files {
+		pkg.Files = append(pkg.Files, deb.File{Path: f.Path, Mode: f.Mode, Data: f.Data})
+	}
+	_ = os.MkdirAll(dir, 0777)
+	dest := filepath.Join(dir, fmt.Sprintf("%s_%s_%s.deb", info.Name, info.Version, debArch(arch)))
+	out, err := os.Create(dest)
+	if err != nil {
+		return fmt.Errorf("creating file: %w", err)
+	}
+	defer out.Close()
+	if _, err := pkg.WriteTo(out); err != nil {
+		return fmt.Errorf("writing package: %w", err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("closing output file: %w", err)
+	}
+	return nil
+}
+
+// bundleRPM creates an rpm package in dir.
+// The package is named according to rpm convention:
+// "<name>-<version>-<release>.<arch>.rpm".
+func bundleRPM(dir, name string, arch Architecture, binary io.Reader, md MetaData) error {
+	bin, err := ioutil.ReadAll(binary)
+	if err != nil {
+		return fmt.Errorf("buffering binary: %w", err)
+	}
+	files, err := installLayout(name, bin, md)
+	if err != nil {
+		return err
+	}
+	info := md.Linux.Package
+	if info.Name == "" {
+		info.Name = packageName(name)
+	}
+	if info.Version == "" {
+		info.Version = "0.0.0"
+	}
+	description := strings.SplitN(strings.TrimSpace(info.Description), "\n", 2)
+	pkg := rpm.Package{
+		Name:     info.Name,
+		Version:  info.Version,
+		Release:  "1",
+		Arch:     rpmArch(arch),
+		Summary:  description[0],
+		License:  info.License,
+		URL:      info.Homepage,
+		Packager: info.Maintainer,
+		Requires: info.Requires,
+	}
+	if len(description) > 1 {
+		pkg.Description = strings.TrimSpace(description[1])
+	}
+	if pkg.License == "" {
+		pkg.License = "Unknown"
+	}
+	for _, f := range files {
+		pkg.Files = append(pkg.Files, rpm.File{Path: f.Path, Mode: f.Mode, Data: f.Data})
+	}
+	_ = os.MkdirAll(dir, 0777)
+	dest := filepath.Join(dir, fmt.Sprintf(
+		"%s-%s-%s.%s.rpm",
+		pkg.Name,
+		pkg.Version,
+		pkg.Release,
+		pkg.Arch,
+	))
+	out, err := os.Create(dest)
+	if err != nil {
+		return fmt.Errorf("creating file: %w", err)
+	}
+	defer out.Close()
+	if _, err := pkg.WriteTo(out); err != nil {
+		return fmt.Errorf("writing package: %w", err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("closing output file: %w", err)
+	}
+	return nil
+}
+
+// bundleTarball creates a gzipped tarball in dir named
+// "<name>-<version>-linux-<arch>.tar.gz".
+//
+// The tarball contains a single directory laid out like an install prefix
+// (bin, share), along with an install.sh that copies it into ~/.local unless
+// disabled.
+func bundleTarball(dir, name string, arch Architecture, binary io.Reader, md MetaData) error {
+	bin, err := ioutil.ReadAll(binary)
+	if err != nil {
+		return fmt.Errorf("buffering binary: %w", err)
+	}
+	desktop, err := md.FreeDesktop(name)
+	if err != nil {
+		return err
+	}
+	version := md.Linux.Package.Version
+	if version == "" {
+		version = "0.0.0"
+	}
+	var (
+		base = fmt.Sprintf("%s-%s-linux-%s", name, version, arch)
+		tree = append(Tree{{Path: path.Join("bin", name), Mode: 0755, Data: bin}}, desktop...)
+	)
+	if !md.Linux.NoInstallScript {
+		tree = append(tree, File{
+			Path: "install.sh",
+			Mode: 0755,
+			Data: installScript(name, md.desktopID(name)),
+		})
+	}
+	_ = os.MkdirAll(dir, 0777)
+	out, err := os.Create(filepath.Join(dir, base+".tar.gz"))
+	if err != nil {
+		return fmt.Errorf("creating file: %w", err)
+	}
+	defer out.Close()
+	var (
+		gz = gzip.NewWriter(out)
+		tw = tar.NewWriter(gz)
+	)
+	for _, f := range tree.Prefix(base) {
+		if err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     f.Path,
+			Mode:     int64(f.Mode.Perm()),
+			Size:     int64(len(f.Data)),
+			ModTime:  time.Now(),
+		}); err != nil {
+			return fmt.Errorf("writing header: %w", err)
+		}
+		if _, err := tw.Write(f.Data); err != nil {
+			return fmt.Errorf("writing %s: %w", f.Path, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("closing tarball: %w", err)
+	}
+	if err := gz.Close(); err != nil {
+		return fmt.Errorf("closing tarball: %w", err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("closing output file: %w", err)
+	}
+	return nil
+}
+
+// installScript generates a script that installs the extracted tarball into
+// the user's home directory, pointing the desktop entry at the installed
+// binary.
+func installScript(name, id string) []byte {
+	return []byte(fmt.Sprintf(`#!/bin/sh
+# Installs %[1]s for the current user.
+set -e
+HERE="$(dirname "$(readlink -f "$0")")"
+PREFIX="${PREFIX:-$HOME/.local}"
+mkdir -p "$PREFIX/bin" "$PREFIX/share"
+cp "$HERE/bin/%[1]s" "$PREFIX/bin/%[1]s"
+cp -R "$HERE/share/." "$PREFIX/share/"
+sed -i "s|^Exec=%[1]s|Exec=$PREFIX/bin/%[1]s|" "$PREFIX/share/applications/%[2]s.desktop"
+if command -v update-desktop-database >/dev/null 2>&1; then
+	update-desktop-database "$PREFIX/share/applications" || true
+fi
+if command -v gtk-update-icon-cache >/dev/null 2>&1; then
+	gtk-update-icon-cache -f -t "$PREFIX/share/icons/hicolor" || true
+fi
+echo "installed %[1]s to $PREFIX"
+`, name, id))
+}
+
+// installLayout lists the files that make up an installation of the
+// application under /usr: the binary followed by the freedesktop integration.
+func installLayout(name string, binary []byte, md MetaData) (Tree, error) {
+	desktop, err := md.FreeDesktop(name)
+	if err != nil {
+		return nil, err
+	}
+	tree := Tree{{Path: path.Join("bin", name), Mode: 0755, Data: binary}}
+	return append(tree, desktop...).Prefix("usr"), nil
+}
+
+// packageName derives a package name from the application name, which package
+// managers restrict to lower case alphanumerics and a few separators.
+func packageName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '+', r == '-', r == '.':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		}
+		return '-'
+	}, name)
+}
+
+// debArch maps an Architecture to the name used by Debian.
+func debArch(a Architecture) string {
+	switch a {
+	case X86:
+		return "i386"
+	case ARM:
+		return "armhf"
+	}
+	return a.String()
+}
+
+// rpmArch maps an Architecture to the name used by rpm.
+func rpmArch(a Architecture) string {
+	switch a {
+	case X86:
+		return "i686"
+	case AMD64:
+		return "x86_64"
+	case ARM:
+		return "armv7hl"
+	case ARM64:
+		return "aarch64"
+	}
+	return a.String()
+}
+
+// appImageArch maps an Architecture to the name used by AppImage.
+func appImageArch(a Architecture) string {
+	switch a {
+	case X86:
+		return "i686"
+	case AMD64:
+		return "x86_64"
+	case ARM:
+		return "armhf"
+	case ARM64:
+		return "aarch64"
+	}
+	return a.String()
+}
@@ -0,0 +1,147 @@
+package gopack
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"image"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestBundleAppImage ensures the AppImage is the runtime followed directly by
+// the squashfs payload.
+func TestBundleAppImage(t *testing.T) {
+	var (
+		dest    = filepath.Join(t.TempDir(), "app-x86_64.AppImage")
+		runtime = []byte("\x7fELF runtime")
+		md      MetaData
+	)
+	md.Icon = image.NewRGBA(image.Rect(0, 0, 64, 64))
+	if err := bundleAppImage(
+		dest,
+		"app",
+		AMD64,
+		strings.NewReader("binary"),
+		md,
+		bytes.NewReader(runtime),
+	); err != nil {
+		t.Fatalf("bundling: %v", err)
+	}
+	by, err := ioutil.ReadFile(dest)
+	if err != nil {
+		t.Fatalf("reading AppImage: %v", err)
+	}
+	if !bytes.HasPrefix(by, runtime) {
+		t.Fatalf("AppImage does not start with runtime")
+	}
+	if magic := string(by[len(runtime) : len(runtime)+4]); magic != "hsqs" {
+		t.Fatalf("squashfs magic: got %q, want %q", magic, "hsqs")
+	}
+}
+
+// TestAppImageRuntime ensures an AppImage needs a runtime, and is only made
+// by default for architectures that have one.
+func TestAppImageRuntime(t *testing.T) {
+	var md MetaData
+	dest := filepath.Join(t.TempDir(), "app-x86_64.AppImage")
+	if err := bundleAppImage(dest, "app", AMD64, strings.NewReader("binary"), md, nil); err == nil {
+		t.Errorf("missing runtime: expected error")
+	}
+	has := func(p Packer, arch Architecture) bool {
+		for _, s := range p.stages(Artifact{Target: Target{Platform: Linux, Architecture: arch}}, nil) {
+			if s.Stage == StageAppImage {
+				return true
+			}
+		}
+		return false
+	}
+	p := Packer{Info: &ProjectInfo{Name: "app"}}
+	p.MetaData.Linux.AppImageRuntime = map[Architecture]io.Reader{
+		AMD64: strings.NewReader("\x7fELF runtime"),
+	}
+	if !has(p, AMD64) || has(p, ARM64) {
+		t.Errorf("default formats: AppImage made without a runtime, or not with one")
+	}
+	p.Linux = []LinuxFormat{AppImage}
+	if !has(p, ARM64) {
+		t.Errorf("explicit formats: AppImage not attempted")
+	}
+}
+
+// TestBundleTarball ensures the tarball holds the binary and desktop files
+// under a versioned directory, with the install script unless opted out.
+func TestBundleTarball(t *testing.T) {
+	for _, noScript := range []bool{false, true} {
+		var (
+			dir = t.TempDir()
+			md  MetaData
+		)
+		md.Linux.Package.Version = "1.2.0"
+		md.Linux.NoInstallScript = noScript
+		if err := bundleTarball(dir, "notes", AMD64, strings.NewReader("binary"), md); err != nil {
+			t.Fatalf("bundling: %v", err)
+		}
+		f, err := os.Open(filepath.Join(dir, "notes-1.2.0-linux-amd64.tar.gz"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatalf("opening gzip: %v", err)
+		}
+		var (
+			tr      = tar.NewReader(gz)
+			modes   = map[string]int64{}
+			content = map[string]string{}
+		)
+		for {
+			h, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("reading tarball: %v", err)
+			}
+			by, err := ioutil.ReadAll(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			modes[h.Name], content[h.Name] = h.Mode, string(by)
+		}
+		const base = "notes-1.2.0-linux-amd64/"
+		for name, mode := range map[string]int64{
+			"bin/notes":                        0755,
+			"share/applications/notes.desktop": 0644,
+		} {
+			if got, ok := modes[base+name]; !ok || got != mode {
+				t.Errorf("%s: got mode %o (present %t), want %o", name, got, ok, mode)
+			}
+		}
+		if content[base+"bin/notes"] != "binary" {
+			t.Errorf("binary not copied")
+		}
+		script, ok := content[base+"install.sh"]
+		if ok == noScript {
+			t.Errorf("no install script %t: install.sh present %t", noScript, ok)
+		}
+		if !noScript {
+			if modes[base+"install.sh"] != 0755 {
+				t.Errorf("install.sh not executable: %o", modes[base+"install.sh"])
+			}
+			for _, want := range []string{
+				`cp "$HERE/bin/notes" "$PREFIX/bin/notes"`,
+				`"$PREFIX/share/applications/notes.desktop"`,
+			} {
+				if !strings.Contains(script, want) {
+					t.Errorf("install.sh missing %q", want)
+				}
+			}
+		}
+	}
+}
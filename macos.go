@@ -2,13 +2,27 @@ package gopack
 
 import (
 	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/asn1"
 	"fmt"
+	"image"
+	"image/png"
 	"io"
+	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
+	"time"
 
-	"github.com/kdomanski/iso9660"
+	"git.sr.ht/~jackmordaunt/gopack/internal/dsstore"
+	"git.sr.ht/~jackmordaunt/gopack/internal/hfs"
+	"git.sr.ht/~jackmordaunt/gopack/internal/macho"
+	"git.sr.ht/~jackmordaunt/gopack/internal/pkcs7"
+	"git.sr.ht/~jackmordaunt/gopack/internal/plist"
+	"git.sr.ht/~jackmordaunt/gopack/internal/udif"
+	"git.sr.ht/~jackmordaunt/gopack/internal/util"
 )
 
 // bundleMacOS creates a macOS .app bundleMacOS on disk rooted at dest.
@@ -52,53 +66,383 @@ func bundleMacOS(dest, name string, binary, icon, plist io.Reader) error {
 	if err := cp(filepath.Join(contents, "Info.plist"), plist); err != nil {
 		return fmt.Errorf("copying plist: %w", err)
 	}
-	if err := cp(filepath.Join(resources, fmt.Sprintf("%s.icns", name)), icon); err != nil {
-		return fmt.Errorf("copying icon: %w", err)
+	if icon != nil {
+		if err := cp(filepath.Join(resources, fmt.Sprintf("%s.icns", name)), icon); err != nil {
+			return fmt.Errorf("copying icon: %w", err)
+		}
+	}
+	return nil
+}
+
+// oidCDHashes identifies the signed attribute listing the hashes of the code
+// directories a CMS signature covers.
+var oidCDHashes = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 9, 1}
+
+// signMacOS signs the application bundle at app, whose executable is name.
+//
+// The resources of the bundle are sealed by _CodeSignature/CodeResources, and
+// the executable is signed with a code signature that seals CodeResources and
+// Info.plist in turn. The signature is made by id if not nil, otherwise it is
+// ad-hoc, and embeds the entitlements.
+func signMacOS(app, name string, id *Identity, entitlements Entitlements) error {
+	var (
+		contents = filepath.Join(app, "Contents")
+		exe      = filepath.Join(contents, "MacOS", name)
+	)
+	info, err := ioutil.ReadFile(filepath.Join(contents, "Info.plist"))
+	if err != nil {
+		return fmt.Errorf("reading Info.plist: %w", err)
+	}
+	doc, err := plist.Unmarshal(info)
+	if err != nil {
+		return fmt.Errorf("parsing Info.plist: %w", err)
+	}
+	bundleID, _ := doc.(map[string]interface{})["CFBundleIdentifier"].(string)
+	if bundleID == "" {
+		return fmt.Errorf("Info.plist has no CFBundleIdentifier")
+	}
+	resources, err := codeResources(contents, filepath.Join("MacOS", name))
+	if err != nil {
+		return fmt.Errorf("sealing resources: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Join(contents, "_CodeSignature"), 0777); err != nil {
+		return fmt.Errorf("preparing directory: %w", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(contents, "_CodeSignature", "CodeResources"), resources, 0644); err != nil {
+		return fmt.Errorf("writing CodeResources: %w", err)
+	}
+	sig := macho.Signature{
+		Identifier: bundleID,
+		InfoPlist:  info,
+		Resources:  resources,
 	}
-	if err := dmg(app, filepath.Dir(app), name); err != nil {
-		return fmt.Errorf("creating disk image: %w", err)
+	if entitlements.HardenedRuntime {
+		sig.Flags |= macho.FlagRuntime
+	}
+	dict, err := entitlements.dict()
+	if err != nil {
+		return err
+	}
+	if len(dict) > 0 {
+		if sig.Entitlements, err = plist.Marshal(dict); err != nil {
+			return fmt.Errorf("encoding entitlements: %w", err)
+		}
+		if sig.EntitlementsDER, err = derEntitlements(dict); err != nil {
+			return fmt.Errorf("encoding entitlements: %w", err)
+		}
+	}
+	if id != nil {
+		if ou := id.Certificate.Subject.OrganizationalUnit; len(ou) > 0 {
+			sig.TeamID = ou[0]
+		}
+		sig.Sign = func(cd []byte) ([]byte, error) {
+			h := sha256.Sum256(cd)
+			hashes, err := plist.Marshal(map[string]interface{}{
+				"cdhashes": []interface{}{h[:20]},
+			})
+			if err != nil {
+				return nil, err
+			}
+			return pkcs7.Signer(*id).SignDetached(cd, pkcs7.Attribute{Type: oidCDHashes, Value: hashes})
+		}
+	}
+	binary, err := ioutil.ReadFile(exe)
+	if err != nil {
+		return fmt.Errorf("reading executable: %w", err)
+	}
+	if binary, err = macho.Sign(binary, sig); err != nil {
+		return fmt.Errorf("signing executable: %w", err)
+	}
+	if err := ioutil.WriteFile(exe, binary, 0755); err != nil {
+		return fmt.Errorf("writing executable: %w", err)
 	}
 	return nil
 }
 
-// // DmgMeta is the DMG metadata that appears at the end of the disk image.
-// type DmgMeta struct {
-// 	Signature             [4]byte // magic 'koly'
-// 	Version               uint32  // 4 (as of 2013)
-// 	HeaderSize            uint32  // sizeof(this) =  512 (as of 2013)
-// 	Flags                 uint32
-// 	RunningDataForkOffset uint64
-// 	DataForkOffset        uint64 // usually 0, beginning of file
-// 	DataForkLength        uint64
-// 	RsrcForkOffset        uint64 // resource fork offset and length
-// 	RsrcForkLength        uint64
-// 	SegmentNumber         uint32 // Usually 1, can be 0
-// 	SegmentCount          uint32 // Usually 1, can be 0
-// 	SegmentID             [128]byte
-// 	DataChecksumType      uint32 // Data fork checksum
-// 	DataChecksumSize      uint32
-// 	DataChecksum          [32]uint32
-// 	XMLOffset             uint64 // Position of XML property list in file
-// 	XMLLength             uint64
-// 	Reserved1             [120]byte
-// 	ChecksumType          uint32 // Master checksum
-// 	ChecksumSize          uint32
-// 	Checksum              [32]uint32
-// 	ImageVariant          uint32 // Unknown, commonly 1
-// 	SectorCount           uint64
-// 	reserved2             uint32
-// 	reserved3             uint32
-// 	reserved4             uint32
-// }
+// codeResources generates the CodeResources file of a bundle, sealing each
+// file in contents by its hash, as codesign does. The main executable,
+// Info.plist and the signature itself are sealed by the code signature
+// instead.
+func codeResources(contents, exe string) ([]byte, error) {
+	var (
+		files  = map[string]interface{}{}
+		files2 = map[string]interface{}{}
+	)
+	err := filepath.Walk(contents, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(contents, path)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if rel == "_CodeSignature" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if rel == exe || rel == "Info.plist" || rel == "PkgInfo" {
+			return nil
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var (
+			key  = filepath.ToSlash(rel)
+			sum1 = sha1.Sum(data)
+			sum2 = sha256.Sum256(data)
+		)
+		// Version 1 seals only resources, version 2 everything.
+		if strings.HasPrefix(key, "Resources/") {
+			files[key] = sum1[:]
+		}
+		files2[key] = map[string]interface{}{
+			"hash":  sum1[:],
+			"hash2": sum2[:],
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	lproj := map[string]interface{}{"optional": true, "weight": 1000.0}
+	locversion := map[string]interface{}{"omit": true, "weight": 1100.0}
+	base := map[string]interface{}{"weight": 1010.0}
+	return plist.Marshal(map[string]interface{}{
+		"files":  files,
+		"files2": files2,
+		"rules": map[string]interface{}{
+			"^Resources/":                             true,
+			"^Resources/.*\\.lproj/":                  lproj,
+			"^Resources/.*\\.lproj/locversion.plist$": locversion,
+			"^Resources/Base\\.lproj/":                base,
+			"^version.plist$":                         true,
+		},
+		"rules2": map[string]interface{}{
+			".*\\.dSYM($|/)":      map[string]interface{}{"weight": 11.0},
+			"^(.*/)?\\.DS_Store$": map[string]interface{}{"omit": true, "weight": 2000.0},
+			"^(Frameworks|SharedFrameworks|PlugIns|Plug-ins|XPCServices|Helpers|MacOS|Library/(Automator|Spotlight|LoginItems))/": map[string]interface{}{"nested": true, "weight": 10.0},
+			"^.*":                    true,
+			"^Info\\.plist$":         map[string]interface{}{"omit": true, "weight": 20.0},
+			"^PkgInfo$":              map[string]interface{}{"omit": true, "weight": 20.0},
+			"^Resources/":            map[string]interface{}{"weight": 20.0},
+			"^Resources/.*\\.lproj/": lproj,
+			"^Resources/.*\\.lproj/locversion.plist$": locversion,
+			"^Resources/Base\\.lproj/":                base,
+			"^[^/]+$":                                 map[string]interface{}{"nested": true, "weight": 10.0},
+			"^embedded\\.provisionprofile$":           map[string]interface{}{"weight": 20.0},
+			"^version\\.plist$":                       map[string]interface{}{"weight": 20.0},
+		},
+	})
+}
 
-// func (md DmgMeta) Bytes() []byte {
-// 	return nil
-// }
+// universal replaces the darwin/amd64 and darwin/arm64 artifacts with a
+// single darwin/universal artifact holding both, so that one bundle runs
+// natively on Intel and Apple Silicon. Artifacts are returned unchanged unless
+// both are present, and there is no universal artifact already.
+func universal(artifacts []Artifact) ([]Artifact, error) {
+	var (
+		amd64, arm64 = -1, -1
+		merged       []Artifact
+	)
+	for ii, a := range artifacts {
+		if a.Platform != Darwin {
+			continue
+		}
+		switch a.Architecture {
+		case AMD64:
+			amd64 = ii
+		case ARM64:
+			arm64 = ii
+		case Universal:
+			return artifacts, nil
+		}
+	}
+	if amd64 < 0 || arm64 < 0 {
+		return artifacts, nil
+	}
+	var slices [][]byte
+	for _, ii := range []int{amd64, arm64} {
+		by, err := ioutil.ReadAll(artifacts[ii].Binary)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s binary: %w", artifacts[ii].Target, err)
+		}
+		slices = append(slices, by)
+	}
+	fat, err := macho.Fat(slices...)
+	if err != nil {
+		return nil, err
+	}
+	for ii, a := range artifacts {
+		if ii != amd64 && ii != arm64 {
+			merged = append(merged, a)
+		}
+	}
+	return append(merged, Artifact{
+		Binary: util.NewCopyBuffer(fat),
+		Name:   artifacts[amd64].Name,
+		Target: Target{Platform: Darwin, Architecture: Universal},
+	}), nil
+}
 
-// dmg creates an iso disk image of src and places it into dst.
+// InfoPlist generates the Info.plist of an application bundle whose
+// executable is name. Keys from the user supplied Info.plist, if any, take
+// precedence over generated ones.
+func (md MetaData) InfoPlist(name string) ([]byte, error) {
+	var (
+		darwin  = md.Darwin
+		display = md.App.Name
+	)
+	if darwin.BundleID == "" {
+		darwin.BundleID = "com.example." + bundleID(name)
+	}
+	if darwin.Version == "" {
+		darwin.Version = "0.0.0"
+	}
+	if darwin.Build == "" {
+		darwin.Build = darwin.Version
+	}
+	if darwin.MinimumSystemVersion == "" {
+		darwin.MinimumSystemVersion = "11.0"
+	}
+	if display == "" {
+		display = name
+	}
+	info := map[string]interface{}{
+		"CFBundleDevelopmentRegion":     "en",
+		"CFBundleDisplayName":           display,
+		"CFBundleExecutable":            name,
+		"CFBundleIdentifier":            darwin.BundleID,
+		"CFBundleInfoDictionaryVersion": "6.0",
+		"CFBundleName":                  display,
+		"CFBundlePackageType":           "APPL",
+		"CFBundleShortVersionString":    darwin.Version,
+		"CFBundleVersion":               darwin.Build,
+		"LSMinimumSystemVersion":        darwin.MinimumSystemVersion,
+		"NSHighResolutionCapable":       true,
+		"NSPrincipalClass":              "NSApplication",
+	}
+	if darwin.ICNS != nil {
+		info["CFBundleIconFile"] = fmt.Sprintf("%s.icns", name)
+	}
+	if md.App.Copyright != "" {
+		info["NSHumanReadableCopyright"] = md.App.Copyright
+	}
+	var documents []interface{}
+	for _, f := range md.App.FileAssociations {
+		role := f.Role
+		if role == "" {
+			role = "Viewer"
+		}
+		var extensions []interface{}
+		for _, ext := range f.Extensions {
+			extensions = append(extensions, ext)
+		}
+		doc := map[string]interface{}{
+			"CFBundleTypeName":       f.Name,
+			"CFBundleTypeRole":       role,
+			"CFBundleTypeExtensions": extensions,
+		}
+		if f.MimeType != "" {
+			doc["CFBundleTypeMIMETypes"] = []interface{}{f.MimeType}
+		}
+		documents = append(documents, doc)
+	}
+	if len(documents) > 0 {
+		info["CFBundleDocumentTypes"] = documents
+	}
+	if len(md.App.URLSchemes) > 0 {
+		var schemes []interface{}
+		for _, s := range md.App.URLSchemes {
+			schemes = append(schemes, s)
+		}
+		info["CFBundleURLTypes"] = []interface{}{
+			map[string]interface{}{
+				"CFBundleURLName":    darwin.BundleID,
+				"CFBundleURLSchemes": schemes,
+			},
+		}
+	}
+	if darwin.Plist != nil {
+		by, err := ioutil.ReadAll(darwin.Plist)
+		if err != nil {
+			return nil, fmt.Errorf("reading Info.plist: %w", err)
+		}
+		v, err := plist.Unmarshal(by)
+		if err != nil {
+			return nil, fmt.Errorf("parsing Info.plist: %w", err)
+		}
+		user, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("parsing Info.plist: expected dict, got %T", v)
+		}
+		for k, v := range user {
+			info[k] = v
+		}
+	}
+	return plist.Marshal(info)
+}
+
+// bundleID replaces characters not allowed in a bundle identifier.
+func bundleID(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '.':
+			return r
+		}
+		return '-'
+	}, name)
+}
+
+// DMGLayout configures the Finder window shown when a disk image is mounted.
+// Positions are in points, from the top left of the window to the centre of
+// an icon. Zero values take defaults.
+type DMGLayout struct {
+	// Background image drawn behind the icons, at one point per pixel.
+	Background image.Image
+	// Window size.
+	// Defaults to the size of the background, or 640x400 without one.
+	Window image.Point
+	// IconSize defaults to 128.
+	IconSize int
+	// App is the position of the application icon.
+	// Defaults to the middle of the left half of the window.
+	App image.Point
+	// Applications is the position of the link to /Applications.
+	// Defaults to the middle of the right half of the window.
+	Applications image.Point
+}
+
+// defaults fills in zero values.
+func (l DMGLayout) defaults() DMGLayout {
+	if l.Window == (image.Point{}) {
+		l.Window = image.Pt(640, 400)
+		if l.Background != nil {
+			l.Window = l.Background.Bounds().Size()
+		}
+	}
+	if l.IconSize == 0 {
+		l.IconSize = 128
+	}
+	if l.App == (image.Point{}) {
+		l.App = image.Pt(l.Window.X/4, l.Window.Y/2)
+	}
+	if l.Applications == (image.Point{}) {
+		l.Applications = image.Pt(l.Window.X*3/4, l.Window.Y/2)
+	}
+	return l
+}
+
+// dmg creates a disk image of the .app bundle at src and places it into dst
+// as "<id>.dmg".
 //
-// Note: DMG metadata is currently ignored.
-func dmg(src, dst, id string) error {
+// The image is a compressed UDIF image holding an HFS+ volume named id, with
+// the bundle at the root next to a symlink to /Applications so that the user
+// can drag and drop to install. The Finder window is styled by a .DS_Store
+// according to layout, and the volume takes icon as its icon.
+func dmg(src, dst, id string, icon io.Reader, layout DMGLayout) error {
 	if id == "" {
 		id = "unspecified"
 	}
@@ -109,39 +453,103 @@ func dmg(src, dst, id string) error {
 	if !info.IsDir() {
 		return fmt.Errorf("%s not a directory", src)
 	}
-	writer, err := iso9660.NewWriter()
-	if err != nil {
-		return fmt.Errorf("initialising writer: %w", err)
+	var (
+		volume = &hfs.Volume{Name: id, ModTime: time.Now()}
+		root   = filepath.Dir(src)
+		app    = filepath.Base(src)
+		store  = &dsstore.Store{}
+		alias  []byte
+	)
+	layout = layout.defaults()
+	if layout.Background != nil {
+		const background = ".background/background.png"
+		buf := bytes.NewBuffer(nil)
+		if err := png.Encode(buf, layout.Background); err != nil {
+			return fmt.Errorf("encoding background: %w", err)
+		}
+		if err := volume.Create(background, 0644, buf.Bytes()); err != nil {
+			return fmt.Errorf("adding background: %w", err)
+		}
+		if err := volume.SetFlags(path.Dir(background), hfs.IsInvisible); err != nil {
+			return fmt.Errorf("hiding background: %w", err)
+		}
+		file, err := volume.ID(background)
+		if err != nil {
+			return err
+		}
+		dir, err := volume.ID(path.Dir(background))
+		if err != nil {
+			return err
+		}
+		alias = dsstore.Alias{
+			Volume:  id,
+			Created: volume.ModTime,
+			Path:    background,
+			ID:      file,
+			Parents: []uint32{dir},
+		}.Bytes()
+	}
+	if err := finderView(store, layout, alias); err != nil {
+		return err
 	}
-	defer func() { _ = writer.Cleanup() }()
-	if err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+	store.Location(app, layout.App.X, layout.App.Y)
+	store.Location("Applications", layout.Applications.X, layout.Applications.Y)
+	if err := filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
 		if info.IsDir() {
-			return nil
+			return volume.Mkdir(rel, info.Mode())
 		}
-		f, err := os.Open(path)
+		data, err := ioutil.ReadFile(p)
 		if err != nil {
-			return fmt.Errorf("opening file %s: %w", path, err)
+			return fmt.Errorf("reading file %s: %w", p, err)
 		}
-		defer f.Close()
-		err = writer.AddFile(f, strings.Trim(path, filepath.Dir(src)))
-		if err != nil {
-			return fmt.Errorf("adding file %s: %w", path, err)
+		if err := volume.Create(rel, info.Mode(), data); err != nil {
+			return fmt.Errorf("adding file %s: %w", p, err)
 		}
 		return nil
 	}); err != nil {
 		return fmt.Errorf("adding files from %s to image: %w", src, err)
 	}
-	b := bytes.NewBuffer(nil)
-	err = writer.WriteTo(b, id)
+	if err := volume.Symlink("/Applications", "Applications"); err != nil {
+		return fmt.Errorf("adding applications link: %w", err)
+	}
+	if icon != nil {
+		icns, err := ioutil.ReadAll(icon)
+		if err != nil {
+			return fmt.Errorf("reading icon: %w", err)
+		}
+		if len(icns) == 0 {
+			return fmt.Errorf("reading icon: empty")
+		}
+		if err := volume.Create(".VolumeIcon.icns", 0644, icns); err != nil {
+			return fmt.Errorf("adding volume icon: %w", err)
+		}
+		if err := volume.SetFlags("/", hfs.HasCustomIcon); err != nil {
+			return fmt.Errorf("flagging volume icon: %w", err)
+		}
+	}
+	ds, err := store.Bytes()
 	if err != nil {
-		return fmt.Errorf("writing ISO image: %w", err)
+		return fmt.Errorf("encoding .DS_Store: %w", err)
+	}
+	if err := volume.Create(".DS_Store", 0644, ds); err != nil {
+		return fmt.Errorf("adding .DS_Store: %w", err)
+	}
+	disk, err := volume.Bytes()
+	if err != nil {
+		return fmt.Errorf("writing HFS+ volume: %w", err)
+	}
+	b := bytes.NewBuffer(nil)
+	if err := udif.Encode(b, disk, fmt.Sprintf("%s (Apple_HFS : 0)", id), udif.Zlib); err != nil {
+		return fmt.Errorf("writing UDIF image: %w", err)
 	}
-	// if _, err := b.Write(DmgMeta{}.Bytes()); err != nil {
-	// 	return fmt.Errorf("writing dmg metadata")
-	// }
 	outputFile, err := os.OpenFile(
 		filepath.Join(dst, id+".dmg"),
 		os.O_WRONLY|os.O_TRUNC|os.O_CREATE,
@@ -159,3 +567,54 @@ func dmg(src, dst, id string) error {
 	}
 	return nil
 }
+
+// finderView records the window and icon view settings of the volume root.
+// A nil background alias leaves the window white.
+func finderView(store *dsstore.Store, layout DMGLayout, background []byte) error {
+	window, err := plist.MarshalBinary(map[string]interface{}{
+		"ContainerShowSidebar": false,
+		"ShowPathbar":          false,
+		"ShowSidebar":          false,
+		"ShowStatusBar":        false,
+		"ShowTabView":          false,
+		"ShowToolbar":          false,
+		"SidebarWidth":         0,
+		"WindowBounds": fmt.Sprintf(
+			"{{%d, %d}, {%d, %d}}",
+			200, 120,
+			layout.Window.X, layout.Window.Y,
+		),
+	})
+	if err != nil {
+		return fmt.Errorf("encoding window settings: %w", err)
+	}
+	view := map[string]interface{}{
+		"arrangeBy":            "none",
+		"backgroundColorBlue":  1.0,
+		"backgroundColorGreen": 1.0,
+		"backgroundColorRed":   1.0,
+		"backgroundType":       1,
+		"gridOffsetX":          0.0,
+		"gridOffsetY":          0.0,
+		"gridSpacing":          100.0,
+		"iconSize":             float64(layout.IconSize),
+		"labelOnBottom":        true,
+		"showIconPreview":      true,
+		"showItemInfo":         false,
+		"textSize":             12.0,
+		"viewOptionsVersion":   1,
+	}
+	if background != nil {
+		view["backgroundType"] = 2
+		view["backgroundImageAlias"] = background
+	}
+	icons, err := plist.MarshalBinary(view)
+	if err != nil {
+		return fmt.Errorf("encoding icon view settings: %w", err)
+	}
+	store.Blob(".", "bwsp", window)
+	store.Blob(".", "icvp", icons)
+	store.Type(".", "vstl", "icnv")
+	store.Long(".", "vSrn", 1)
+	return nil
+}
@@ -0,0 +1,160 @@
+package gopack
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"git.sr.ht/~jackmordaunt/gopack/internal/plist"
+	"git.sr.ht/~jackmordaunt/gopack/internal/util"
+)
+
+// TestInfoPlist ensures that user supplied keys are merged over generated
+// ones.
+func TestInfoPlist(t *testing.T) {
+	var md MetaData
+	md.Darwin.ICNS = strings.NewReader("icns")
+	md.Darwin.Version = "1.2.0"
+	md.Darwin.BundleID = "com.example.App"
+	md.Darwin.Plist = util.NewCopyBuffer([]byte(`<?xml version="1.0" encoding="UTF-8"?>
+<plist version="1.0">
+<dict>
+	<key>CFBundleVersion</key>
+	<string>42</string>
+	<key>NSCameraUsageDescription</key>
+	<string>Scanning &amp; stuff</string>
+	<key>LSUIElement</key>
+	<true/>
+</dict>
+</plist>
+`))
+	by, err := md.InfoPlist("App")
+	if err != nil {
+		t.Fatalf("generating: %v", err)
+	}
+	v, err := plist.Unmarshal(by)
+	if err != nil {
+		t.Fatalf("parsing generated plist: %v", err)
+	}
+	info := v.(map[string]interface{})
+	want := map[string]interface{}{
+		"CFBundleIdentifier":         "com.example.App",
+		"CFBundleExecutable":         "App",
+		"CFBundleName":               "App",
+		"CFBundleIconFile":           "App.icns",
+		"CFBundleShortVersionString": "1.2.0",
+		"CFBundleVersion":            "42",
+		"LSMinimumSystemVersion":     "11.0",
+		"NSHighResolutionCapable":    true,
+		"NSCameraUsageDescription":   "Scanning & stuff",
+		"LSUIElement":                true,
+	}
+	for k, v := range want {
+		if info[k] != v {
+			t.Errorf("%s: got %v, want %v", k, info[k], v)
+		}
+	}
+}
+
+func TestUniversal(t *testing.T) {
+	arm64 := append([]byte(nil), testBinaries["notes-mac"]...)
+	binary.LittleEndian.PutUint32(arm64[4:], 0x0100000C)
+	artifacts, err := universal([]Artifact{
+		{Binary: bytes.NewReader(testBinaries["notes-mac"]), Target: NewTarget("darwin/amd64")},
+		{Binary: bytes.NewReader(testBinaries["notes"]), Target: NewTarget("linux/arm64")},
+		{Binary: bytes.NewReader(arm64), Target: NewTarget("darwin/arm64")},
+	})
+	if err != nil {
+		t.Fatalf("merging: %v", err)
+	}
+	if len(artifacts) != 2 || artifacts[0].Target.String() != "linux_arm64" {
+		t.Fatalf("got %v, want linux and universal artifacts", artifacts)
+	}
+	u := artifacts[1]
+	if u.Target.String() != "darwin_universal" {
+		t.Fatalf("got %s, want darwin_universal", u.Target)
+	}
+	by, err := ioutil.ReadAll(u.Binary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target, err := DetectTarget(bytes.NewReader(by)); err != nil || target != u.Target {
+		t.Errorf("detected %s, %v", target, err)
+	}
+}
+
+// TestCodeResources ensures that resources are sealed, but files sealed by
+// the code signature are not.
+func TestCodeResources(t *testing.T) {
+	contents := t.TempDir()
+	for path, data := range map[string]string{
+		"Info.plist":                   "info",
+		"MacOS/notes":                  "exe",
+		"Resources/notes.icns":         "icon",
+		"_CodeSignature/CodeResources": "old",
+	} {
+		path = filepath.Join(contents, filepath.FromSlash(path))
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	by, err := codeResources(contents, filepath.Join("MacOS", "notes"))
+	if err != nil {
+		t.Fatalf("sealing: %v", err)
+	}
+	v, err := plist.Unmarshal(by)
+	if err != nil {
+		t.Fatalf("parsing: %v", err)
+	}
+	doc := v.(map[string]interface{})
+	files := doc["files"].(map[string]interface{})
+	files2 := doc["files2"].(map[string]interface{})
+	sum := sha256.Sum256([]byte("icon"))
+	icon, ok := files2["Resources/notes.icns"].(map[string]interface{})
+	if !ok || !bytes.Equal(icon["hash2"].([]byte), sum[:]) {
+		t.Errorf("got icon seal %v", files2["Resources/notes.icns"])
+	}
+	if _, ok := files["Resources/notes.icns"]; !ok {
+		t.Errorf("icon missing from files")
+	}
+	if len(files) != 1 || len(files2) != 1 {
+		t.Errorf("got files %v, files2 %v, want only the icon", files, files2)
+	}
+}
+
+// TestDMGIcon ensures a plain reader icon survives the app bundle to reach
+// the disk image, and that an empty one is an error rather than no icon.
+func TestDMGIcon(t *testing.T) {
+	icns := []byte("icns\x00\x00\x00\x08")
+	var md MetaData
+	md.Darwin.ICNS = bytes.NewReader(icns)
+	if err := md.buffer(); err != nil {
+		t.Fatal(err)
+	}
+	for _, stage := range []string{"app", "dmg"} {
+		if by, _ := ioutil.ReadAll(md.Darwin.ICNS); !bytes.Equal(by, icns) {
+			t.Errorf("%s: got icon %q, want %q", stage, by, icns)
+		}
+	}
+	var (
+		dir = t.TempDir()
+		app = filepath.Join(dir, "notes.app")
+	)
+	if err := os.MkdirAll(filepath.Join(app, "Contents"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := dmg(app, dir, "notes", md.Darwin.ICNS, DMGLayout{}); err != nil {
+		t.Fatalf("creating disk image: %v", err)
+	}
+	if err := dmg(app, dir, "notes", bytes.NewReader(nil), DMGLayout{}); err == nil {
+		t.Errorf("empty icon: expected error")
+	}
+}
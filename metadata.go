@@ -18,43 +18,214 @@ import (
 // MetaData pulls together all platform specific metadata require to create a
 // bundle.
 //
-// Note: we don't care about the structure of the platform files, hence they are
-// represented as blobs.
-//
-// @Todo Generate plist, manifest, et al from common data (author, version,
-// access requirements, etc).
-// This would allow streamlined use, as the user wouldn't need to individually
-// create such files; which is very much part of the mission statement of this
-// software.
-// If the user has already created those files for whatever reason, we can
-// fallback to copying them.
+// App describes the application in platform independent terms. Platform
+// files (Info.plist, desktop entries, package control files) are derived from
+// it, and the platform specific fields only need to be set to override it.
+// Platform files supplied as blobs are copied, or merged where the format
+// allows.
 type MetaData struct {
+	// App is the platform independent description of the application.
+	App App
 	// Icon contains the image data for the icon.
 	Icon   image.Image
 	Darwin struct {
 		// ICNS contains icon encoded as ICNS.
 		ICNS io.Reader
-		// Plist contains the Info.plist metadata file.
+		// Plist contains the Info.plist metadata file. Its keys are merged
+		// over those generated from the other fields.
 		Plist io.Reader
+		// BundleID is the CFBundleIdentifier, eg "com.example.App".
+		// Defaults to the App ID.
+		BundleID string
+		// Version is the user facing version string.
+		// Defaults to the App version, or "0.0.0".
+		Version string
+		// Build is the version of this particular build.
+		// Defaults to the App build, or the version.
+		Build string
+		// MinimumSystemVersion is the oldest release of macOS the application
+		// can launch on. Defaults to "11.0", the minimum supported by Go.
+		MinimumSystemVersion string
+		// Identity signs the application. Without one the signature is
+		// ad-hoc, which Apple Silicon requires at the least, but Gatekeeper
+		// doesn't accept for downloaded applications.
+		Identity *Identity
+		// Entitlements are embedded in the signature of the executable.
+		Entitlements Entitlements
+		// DMG configures the Finder window of the disk image.
+		// The background is loaded from "background.png" in the project.
+		DMG DMGLayout
 	}
 	Windows struct {
 		// ICO contains icon encoded as ICO.
 		ICO io.Reader
-		// Manifest contains the windows manifest metadata file.
+		// Manifest contains the windows manifest metadata file, embedded
+		// into the executable. Generated by WindowsManifest if not supplied.
 		Manifest io.Reader
+		// ExecutionLevel requested of UAC by the generated manifest, one of
+		// AsInvoker, HighestAvailable or RequireAdministrator.
+		// Defaults to AsInvoker.
+		ExecutionLevel string
+		// Identity Authenticode signs the executable. Without one it is left
+		// unsigned, and SmartScreen warns users who download it.
+		Identity *Identity
+		// TimestampURL is an RFC 3161 timestamp authority countersigning the
+		// signature, so that it stays valid after the certificate expires.
+		TimestampURL string
 	}
 	Linux struct {
-		// @Todo linux metadata stuff. flatpack, snap, appimage.
+		// AppImageRuntime contains the AppImage runtime executable for each
+		// architecture, prepended to the squashfs payload of an AppImage.
+		// Loaded from "runtime-<arch>" files in the project, using AppImage
+		// architecture names (x86_64, aarch64, i686, armhf), as published at
+		// https://github.com/AppImage/type2-runtime/releases. Runtimes are
+		// never downloaded: by default, architectures without one get no
+		// AppImage.
+		AppImageRuntime map[Architecture]io.Reader
+		// AppID is the reverse DNS identifier of the application, eg
+		// "com.example.App". When set, desktop files and icons are named
+		// after it and AppStream metainfo is generated.
+		// Defaults to the App ID.
+		AppID string
+		// Desktop configures the generated desktop entry.
+		Desktop struct {
+			// Name displayed by launchers.
+			// Defaults to the App name, or the executable name.
+			Name string
+			// Comment is a tooltip describing the application.
+			// Defaults to the first line of the package description.
+			Comment string
+			// Categories from the freedesktop menu specification.
+			// Defaults to the App categories, or "Utility".
+			Categories []string
+			// MimeTypes the application can open.
+			// Defaults to those of the App file associations and URL
+			// schemes.
+			MimeTypes []string
+			// StartupWMClass is the window class the application's windows
+			// are created with, used to group them with the launcher.
+			// Defaults to the application name.
+			StartupWMClass string
+			// Terminal indicates the application runs in a terminal.
+			Terminal bool
+		}
+		// NoInstallScript omits the install.sh script from tarballs.
+		NoInstallScript bool
+		// Flatpak configures the generated flatpak-builder manifest.
+		// Flatpak requires an AppID.
+		Flatpak struct {
+			// Runtime the application runs against.
+			// Defaults to "org.freedesktop.Platform".
+			Runtime string
+			// RuntimeVersion defaults to the current freedesktop release.
+			RuntimeVersion string
+			// SDK the application is built with.
+			// Defaults to "org.freedesktop.Sdk".
+			SDK string
+			// FinishArgs grant the sandbox permissions.
+			// Defaults to X11, Wayland, IPC and GPU access.
+			FinishArgs []string
+			// FromSource builds the project from source with the Go SDK
+			// extension instead of installing the prebuilt binary.
+			FromSource bool
+		}
+		// Snap configures the generated snap.
+		Snap struct {
+			// Name of the snap.
+			// Defaults to the package name.
+			Name string
+			// Base snap providing the runtime, eg "core22".
+			Base string
+			// Grade is either "stable" or "devel".
+			Grade string
+			// Confinement is one of "strict", "classic" or "devmode".
+			Confinement string
+			// Plugs lists the interfaces the application connects to.
+			// Defaults to the desktop, wayland, x11 and opengl interfaces.
+			Plugs []string
+		}
+		// Package describes the application to package managers.
+		Package struct {
+			// Name of the package.
+			// Defaults to the lower cased application name.
+			Name string
+			// Version of the package.
+			// Defaults to the App version, or "0.0.0".
+			Version string
+			// Maintainer in the form "Full Name <email>".
+			// Defaults to the App publisher.
+			Maintainer string
+			// Description is a one line synopsis, optionally followed by a
+			// longer description on subsequent lines.
+			// Defaults to the App description.
+			Description string
+			// Homepage URL of the project.
+			// Defaults to the App homepage.
+			Homepage string
+			// License of the software, eg "MIT".
+			// Defaults to the App license.
+			License string
+			// Depends lists the Debian packages required at runtime.
+			Depends []string
+			// Requires lists the RPM capabilities required at runtime.
+			Requires []string
+		}
 	}
 }
 
+// App describes an application independently of the platforms it is
+// packaged for.
+type App struct {
+	// Name displayed to users.
+	// Defaults to the executable name.
+	Name string `json:"name"`
+	// ID is the reverse DNS identifier of the application, eg
+	// "com.example.App".
+	ID string `json:"id"`
+	// Version is the user facing version, eg "1.2.0".
+	Version string `json:"version"`
+	// Build identifies a particular build of the version, eg "42".
+	Build string `json:"build"`
+	// Publisher of the application in the form "Name <email>".
+	Publisher string `json:"publisher"`
+	// Copyright notice, eg "Copyright © 2021 Example Ltd".
+	Copyright string `json:"copyright"`
+	// Description is a one line synopsis, optionally followed by a longer
+	// description on subsequent lines.
+	Description string `json:"description"`
+	// Homepage URL of the project.
+	Homepage string `json:"homepage"`
+	// Categories from the freedesktop menu specification, eg "Utility".
+	Categories []string `json:"categories"`
+	// License of the software, eg "MIT".
+	License string `json:"license"`
+	// FileAssociations lists the document types the application opens.
+	FileAssociations []FileAssociation `json:"file_associations"`
+	// URLSchemes the application handles, eg "myapp" for "myapp://".
+	URLSchemes []string `json:"url_schemes"`
+}
+
+// FileAssociation describes a document type the application opens.
+type FileAssociation struct {
+	// Name of the document type, eg "Markdown Document".
+	Name string `json:"name"`
+	// Extensions without the leading dot, eg "md".
+	Extensions []string `json:"extensions"`
+	// MimeType of the documents, eg "text/markdown".
+	MimeType string `json:"mime_type"`
+	// Role is "Editor" if the application edits documents, or "Viewer".
+	// Defaults to "Viewer".
+	Role string `json:"role"`
+}
+
 //go:embed default.png
 var goIcon []byte
 
 // Load metadata using defaults if not specified.
 // For icons and other resources this means buffering the files in memory.
 func (md *MetaData) Load(root string) error {
-	finder := util.Finder{Root: root}
+	// Output is skipped, lest generated files are mistaken for supplied ones.
+	finder := util.Finder{Root: root, Ignore: []string{"dist", ".git"}}
 	if md.Icon == nil {
 		icon, err := finder.Find("icon.png")
 		if err != nil {
@@ -124,6 +295,23 @@ func (md *MetaData) Load(root string) error {
 			md.Darwin.Plist = util.NewCopyBuffer(by)
 		}
 	}
+	if md.Darwin.DMG.Background == nil {
+		background, err := finder.Find("background.png")
+		if err != nil {
+			return fmt.Errorf("finding dmg background: %w", err)
+		}
+		if background != "" {
+			by, err := ioutil.ReadFile(background)
+			if err != nil {
+				return fmt.Errorf("reading %s: %w", background, err)
+			}
+			img, err := png.Decode(bytes.NewBuffer(by))
+			if err != nil {
+				return fmt.Errorf("decoding dmg background: %w", err)
+			}
+			md.Darwin.DMG.Background = img
+		}
+	}
 	if md.Windows.ICO == nil && md.Icon != nil {
 		buffer := bytes.NewBuffer(nil)
 		if err := ico.FromPNG(buffer, md.Icon); err != nil {
@@ -144,5 +332,92 @@ func (md *MetaData) Load(root string) error {
 			md.Windows.Manifest = util.NewCopyBuffer(by)
 		}
 	}
+	md.derive()
+	if md.Linux.AppImageRuntime == nil {
+		md.Linux.AppImageRuntime = map[Architecture]io.Reader{}
+	}
+	for _, arch := range Architecture(0).List() {
+		if _, ok := md.Linux.AppImageRuntime[arch]; ok {
+			continue
+		}
+		runtime, err := finder.Find(fmt.Sprintf("runtime-%s", appImageArch(arch)))
+		if err != nil {
+			return fmt.Errorf("AppImage runtime: %w", err)
+		}
+		if runtime != "" {
+			by, err := ioutil.ReadFile(runtime)
+			if err != nil {
+				return fmt.Errorf("reading %s: %w", runtime, err)
+			}
+			md.Linux.AppImageRuntime[arch] = util.NewCopyBuffer(by)
+		}
+	}
+	return nil
+}
+
+// buffer replaces the supplied readers with buffers of their contents, so
+// that every stage reads them in full.
+func (md *MetaData) buffer() error {
+	for _, r := range []*io.Reader{
+		&md.Darwin.ICNS,
+		&md.Darwin.Plist,
+		&md.Windows.ICO,
+		&md.Windows.Manifest,
+	} {
+		if *r == nil {
+			continue
+		}
+		by, err := ioutil.ReadAll(*r)
+		if err != nil {
+			return err
+		}
+		*r = util.NewCopyBuffer(by)
+	}
+	for arch, r := range md.Linux.AppImageRuntime {
+		if r == nil {
+			continue
+		}
+		by, err := ioutil.ReadAll(r)
+		if err != nil {
+			return fmt.Errorf("%s runtime: %w", appImageArch(arch), err)
+		}
+		md.Linux.AppImageRuntime[arch] = util.NewCopyBuffer(by)
+	}
 	return nil
 }
+
+// derive fills platform metadata that hasn't been specified from App.
+func (md *MetaData) derive() {
+	var (
+		app = md.App
+		set = func(dst *string, src string) {
+			if *dst == "" {
+				*dst = src
+			}
+		}
+		linux = &md.Linux
+	)
+	set(&md.Darwin.BundleID, app.ID)
+	set(&md.Darwin.Version, app.Version)
+	set(&md.Darwin.Build, app.Build)
+	set(&linux.AppID, app.ID)
+	set(&linux.Desktop.Name, app.Name)
+	set(&linux.Package.Version, app.Version)
+	set(&linux.Package.Maintainer, app.Publisher)
+	set(&linux.Package.Description, app.Description)
+	set(&linux.Package.Homepage, app.Homepage)
+	set(&linux.Package.License, app.License)
+	if len(linux.Desktop.Categories) == 0 {
+		linux.Desktop.Categories = app.Categories
+	}
+	if len(linux.Desktop.MimeTypes) == 0 {
+		for _, f := range app.FileAssociations {
+			if f.MimeType != "" {
+				linux.Desktop.MimeTypes = append(linux.Desktop.MimeTypes, f.MimeType)
+			}
+		}
+		for _, scheme := range app.URLSchemes {
+			linux.Desktop.MimeTypes = append(linux.Desktop.MimeTypes, "x-scheme-handler/"+scheme)
+		}
+	}
+}
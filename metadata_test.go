@@ -0,0 +1,39 @@
+package gopack
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestDerive ensures platform metadata is derived from App without
+// clobbering values that were set explicitly.
+func TestDerive(t *testing.T) {
+	var md MetaData
+	md.App = App{
+		Name:        "Example",
+		ID:          "com.example.Example",
+		Version:     "1.0.0",
+		Publisher:   "Jane <jane@example.com>",
+		Description: "Does things",
+		Categories:  []string{"Graphics"},
+		FileAssociations: []FileAssociation{
+			{Name: "Markdown", Extensions: []string{"md"}, MimeType: "text/markdown"},
+		},
+		URLSchemes: []string{"example"},
+	}
+	md.Linux.Package.Version = "1.0.0-1"
+	md.derive()
+	if md.Darwin.BundleID != "com.example.Example" || md.Linux.AppID != "com.example.Example" {
+		t.Errorf("id not derived: %q, %q", md.Darwin.BundleID, md.Linux.AppID)
+	}
+	if md.Linux.Package.Version != "1.0.0-1" {
+		t.Errorf("explicit version clobbered: %q", md.Linux.Package.Version)
+	}
+	if md.Linux.Package.Maintainer != md.App.Publisher {
+		t.Errorf("maintainer not derived: %q", md.Linux.Package.Maintainer)
+	}
+	want := []string{"text/markdown", "x-scheme-handler/example"}
+	if !reflect.DeepEqual(md.Linux.Desktop.MimeTypes, want) {
+		t.Errorf("mime types: got %v, want %v", md.Linux.Desktop.MimeTypes, want)
+	}
+}
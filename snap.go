@@ -0,0 +1,203 @@
+package gopack
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"git.sr.ht/~jackmordaunt/gopack/internal/squashfs"
+)
+
+// Snap defaults.
+const (
+	snapBase        = "core22"
+	snapGrade       = "stable"
+	snapConfinement = "strict"
+)
+
+// snapPlugs are the interfaces a Gio program needs to open windows and render
+// with the GPU.
+var snapPlugs = []string{"desktop", "desktop-legacy", "wayland", "x11", "opengl"}
+
+// bundleSnap creates a snap project in dir: a snapcraft project alongside the
+// populated prime tree it describes, which is then packed into
+// "<name>_<version>_<arch>.snap".
+//
+// The prime tree is laid out as snapd expects:
+//
+//	bin/<name>
+//	meta/snap.yaml
+//	meta/gui/<name>.desktop
+//	meta/gui/icon.png
+//
+// The project keeps the desktop entry and icon in snap/gui, from where
+// snapcraft copies them into meta/gui:
+//
+//	snap/snapcraft.yaml
+//	snap/gui/<name>.desktop
+//	snap/gui/icon.png
+func bundleSnap(dir, name string, arch Architecture, binary io.Reader, md MetaData) error {
+	bin, err := ioutil.ReadAll(binary)
+	if err != nil {
+		return fmt.Errorf("buffering binary: %w", err)
+	}
+	snap := md.Linux.Snap
+	if snap.Name == "" {
+		snap.Name = packageName(name)
+	}
+	if snap.Base == "" {
+		snap.Base = snapBase
+	}
+	if snap.Grade == "" {
+		snap.Grade = snapGrade
+	}
+	if snap.Confinement == "" {
+		snap.Confinement = snapConfinement
+	}
+	if len(snap.Plugs) == 0 {
+		snap.Plugs = snapPlugs
+	}
+	version := md.Linux.Package.Version
+	if version == "" {
+		version = "0.0.0"
+	}
+	// Summaries are limited to 78 characters.
+	summary := md.summary(name)
+	if r := []rune(summary); len(r) > 78 {
+		summary = string(r[:78])
+	}
+	description := strings.TrimSpace(md.Linux.Package.Description)
+	if description == "" {
+		description = summary
+	}
+	// The desktop entry launches the snap app and references the icon within
+	// the mounted snap.
+	desktop := strings.NewReplacer(
+		fmt.Sprintf("Exec=%s", name), fmt.Sprintf("Exec=%s", snap.Name),
+		fmt.Sprintf("Icon=%s\n", md.desktopID(name)), "Icon=${SNAP}/meta/gui/icon.png\n",
+	).Replace(string(md.desktopEntry(name)))
+	y := &yaml{}
+	y.field(0, "name", snap.Name)
+	y.field(0, "version", version)
+	y.field(0, "summary", summary)
+	y.field(0, "description", description)
+	y.field(0, "base", snap.Base)
+	y.field(0, "grade", snap.Grade)
+	y.field(0, "confinement", snap.Confinement)
+	y.list(0, "architectures", []string{debArch(arch)})
+	y.key(0, "apps")
+	y.key(1, snap.Name)
+	y.field(2, "command", path.Join("bin", name))
+	y.list(2, "plugs", snap.Plugs)
+	prime := Tree{
+		{Path: path.Join("bin", name), Mode: 0755, Data: bin},
+		{Path: path.Join("meta", "snap.yaml"), Mode: 0644, Data: y.bytes()},
+		{Path: path.Join("meta", "gui", snap.Name+".desktop"), Mode: 0644, Data: []byte(desktop)},
+	}
+	if md.Icon != nil {
+		icons, err := hicolor(md.Icon)
+		if err != nil {
+			return fmt.Errorf("rendering icon: %w", err)
+		}
+		prime = append(prime, File{
+			Path: path.Join("meta", "gui", "icon.png"),
+			Mode: 0644,
+			Data: icons[512],
+		})
+	}
+	// snapcraft.yaml rebuilds the same snap by dumping the prebuilt binary
+	// from the prime tree, meta is generated by snapcraft.
+	sc := &yaml{}
+	sc.field(0, "name", snap.Name)
+	sc.field(0, "version", version)
+	sc.field(0, "summary", summary)
+	sc.field(0, "description", description)
+	sc.field(0, "base", snap.Base)
+	sc.field(0, "grade", snap.Grade)
+	sc.field(0, "confinement", snap.Confinement)
+	if md.Icon != nil {
+		sc.field(0, "icon", "snap/gui/icon.png")
+	}
+	sc.key(0, "architectures")
+	sc.field(1, "- build-on", debArch(arch))
+	sc.key(0, "apps")
+	sc.key(1, snap.Name)
+	sc.field(2, "command", path.Join("bin", name))
+	sc.list(2, "plugs", snap.Plugs)
+	sc.key(0, "parts")
+	sc.key(1, snap.Name)
+	sc.field(2, "plugin", "dump")
+	sc.field(2, "source", "prime")
+	sc.list(2, "stage", []string{"bin"})
+	tree := append(
+		prime.Prefix("prime"),
+		File{Path: path.Join("snap", "snapcraft.yaml"), Mode: 0644, Data: sc.bytes()},
+	)
+	for _, f := range prime {
+		if path.Dir(f.Path) == path.Join("meta", "gui") {
+			f.Path = path.Join("snap", "gui", path.Base(f.Path))
+			tree = append(tree, f)
+		}
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return fmt.Errorf("preparing directory: %w", err)
+	}
+	if err := tree.Write(dir); err != nil {
+		return err
+	}
+	fs := &squashfs.Writer{}
+	for _, f := range prime {
+		if err := fs.Create(f.Path, f.Mode, f.Data); err != nil {
+			return fmt.Errorf("adding %s: %w", f.Path, err)
+		}
+	}
+	out, err := os.Create(filepath.Join(dir, fmt.Sprintf("%s_%s_%s.snap", snap.Name, version, debArch(arch))))
+	if err != nil {
+		return fmt.Errorf("creating file: %w", err)
+	}
+	defer out.Close()
+	if _, err := fs.WriteTo(out); err != nil {
+		return fmt.Errorf("writing squashfs: %w", err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("closing output file: %w", err)
+	}
+	return nil
+}
+
+// yaml writes a minimal block style YAML document.
+// Scalars are double quoted, which YAML shares with JSON string syntax.
+type yaml struct {
+	strings.Builder
+}
+
+func (y *yaml) indent(depth int) {
+	y.WriteString(strings.Repeat("  ", depth))
+}
+
+func (y *yaml) key(depth int, key string) {
+	y.indent(depth)
+	fmt.Fprintf(y, "%s:\n", key)
+}
+
+func (y *yaml) field(depth int, key, value string) {
+	y.indent(depth)
+	fmt.Fprintf(y, "%s: %s\n", key, strconv.Quote(value))
+}
+
+func (y *yaml) list(depth int, key string, values []string) {
+	y.key(depth, key)
+	for _, v := range values {
+		y.indent(depth + 1)
+		fmt.Fprintf(y, "- %s\n", strconv.Quote(v))
+	}
+}
+
+func (y *yaml) bytes() []byte {
+	return []byte(y.String())
+}
@@ -0,0 +1,75 @@
+package gopack
+
+import (
+	"bytes"
+	"image"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// TestBundleSnap ensures the snap and the snapcraft project describing it are
+// laid out as snapd and snapcraft expect.
+func TestBundleSnap(t *testing.T) {
+	var (
+		dir = t.TempDir()
+		md  MetaData
+	)
+	md.Icon = image.NewRGBA(image.Rect(0, 0, 64, 64))
+	md.Linux.Package.Version = "1.2.0"
+	// The summary is cut at 78 characters, not bytes.
+	md.Linux.Package.Description = strings.Repeat("é", 100)
+	if err := bundleSnap(dir, "notes", AMD64, strings.NewReader("binary"), md); err != nil {
+		t.Fatalf("bundling: %v", err)
+	}
+	for _, name := range []string{
+		"notes_1.2.0_amd64.snap",
+		"prime/bin/notes",
+		"prime/meta/snap.yaml",
+		"prime/meta/gui/notes.desktop",
+		"prime/meta/gui/icon.png",
+		"snap/snapcraft.yaml",
+		"snap/gui/notes.desktop",
+		"snap/gui/icon.png",
+	} {
+		if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(name))); err != nil {
+			t.Errorf("missing %s", name)
+		}
+	}
+	snap, err := ioutil.ReadFile(filepath.Join(dir, "notes_1.2.0_amd64.snap"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(snap, []byte("hsqs")) {
+		t.Errorf("snap is not a squashfs image")
+	}
+	meta, err := ioutil.ReadFile(filepath.Join(dir, "prime", "meta", "snap.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "summary: \"" + strings.Repeat("é", 78) + "\"\n"; !bytes.Contains(meta, []byte(want)) {
+		t.Errorf("summary not truncated to 78 characters:\n%s", meta)
+	}
+	if !utf8.Valid(meta) {
+		t.Errorf("snap.yaml is not valid UTF-8")
+	}
+	desktop, err := ioutil.ReadFile(filepath.Join(dir, "snap", "gui", "notes.desktop"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"Exec=notes", "Icon=${SNAP}/meta/gui/icon.png"} {
+		if !bytes.Contains(desktop, []byte(want)) {
+			t.Errorf("desktop entry missing %q:\n%s", want, desktop)
+		}
+	}
+	sc, err := ioutil.ReadFile(filepath.Join(dir, "snap", "snapcraft.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(sc, []byte(`icon: "snap/gui/icon.png"`)) {
+		t.Errorf("snapcraft.yaml doesn't use the snap/gui icon:\n%s", sc)
+	}
+}
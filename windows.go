@@ -1,25 +1,240 @@
 package gopack
 
 import (
+	"bytes"
+	"context"
+	"encoding/xml"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.sr.ht/~jackmordaunt/gopack/internal/pe"
+	"git.sr.ht/~jackmordaunt/gopack/internal/pkcs7"
 )
 
 // bundleWindows bundles a single binary application for windows.
 //
-// For now that just means copying it to some destination, since icon resources
-// are compiled in prior.
-func bundleWindows(dest string, binary io.Reader) error {
+// That means patching resources, if any, into the executable, signing it if
+// there is an identity, and copying it to dest.
+func bundleWindows(ctx context.Context, dest string, binary io.Reader, res *pe.Resources, id *Identity, timestampURL string) error {
 	by, err := ioutil.ReadAll(binary)
 	if err != nil {
 		return fmt.Errorf("buffering binary: %w", err)
 	}
+	if res != nil {
+		if by, err = pe.Patch(by, res); err != nil {
+			return fmt.Errorf("patching resources: %w", err)
+		}
+	}
+	if id != nil {
+		if by, err = signWindows(ctx, by, id, timestampURL); err != nil {
+			return fmt.Errorf("signing: %w", err)
+		}
+	}
 	_ = os.MkdirAll(filepath.Dir(dest), 0777)
 	if err := ioutil.WriteFile(dest, by, 0777); err != nil {
 		return fmt.Errorf("writing binary to file: %w", err)
 	}
 	return nil
 }
+
+// signWindows Authenticode signs an executable with id, countersigned by the
+// timestamp authority at timestampURL if not empty.
+func signWindows(ctx context.Context, exe []byte, id *Identity, timestampURL string) ([]byte, error) {
+	return pe.Sign(exe, func(digest []byte) ([]byte, error) {
+		signed, err := pkcs7.Signer(*id).SignAuthenticode(digest)
+		if err != nil || timestampURL == "" {
+			return signed, err
+		}
+		return pkcs7.Timestamp(signed, func(req []byte) ([]byte, error) {
+			return timestamp(ctx, timestampURL, req)
+		})
+	})
+}
+
+// timestampClient sends timestamp requests. Authorities answer in seconds,
+// the timeout keeps one that doesn't from stalling the bundle.
+var timestampClient = &http.Client{Timeout: 30 * time.Second}
+
+// timestamp sends an RFC 3161 request to the timestamp authority at url,
+// returning its response.
+func timestamp(ctx context.Context, url string, req []byte) ([]byte, error) {
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(req))
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("Content-Type", "application/timestamp-query")
+	resp, err := timestampClient.Do(r)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// Execution levels requested of UAC by a Windows manifest.
+const (
+	AsInvoker            = "asInvoker"
+	HighestAvailable     = "highestAvailable"
+	RequireAdministrator = "requireAdministrator"
+)
+
+// supportedOS lists the compatibility GUIDs of Windows Vista through 10 and
+// 11, without which Windows assumes the program predates them.
+var supportedOS = []string{
+	"{e2011457-1546-43c5-a5fe-008deee3d3f0}",
+	"{35138b9a-5d96-4fbd-8e2d-a2440225f93a}",
+	"{4a2f28e3-53b9-4441-ba9c-d69d4a4a6e38}",
+	"{1f676c76-80e1-4239-95bb-83d0f6d0da78}",
+	"{8e0f7a12-bfb3-4fe8-b9a5-48fd50a15a9a}",
+}
+
+// WindowsManifest generates the application manifest of an executable named
+// name. The manifest declares per monitor DPI awareness, so that windows are
+// not scaled up and blurred on high DPI displays, long path awareness, the
+// version 6 Common Controls and the requested UAC execution level.
+func (md MetaData) WindowsManifest(name string) ([]byte, error) {
+	var (
+		id    = md.App.ID
+		level = md.Windows.ExecutionLevel
+	)
+	if id == "" {
+		id = "com.example." + bundleID(name)
+	}
+	switch level {
+	case "":
+		level = AsInvoker
+	case AsInvoker, HighestAvailable, RequireAdministrator:
+	default:
+		return nil, fmt.Errorf("unknown execution level %q", level)
+	}
+	esc := func(s string) string {
+		buf := bytes.NewBuffer(nil)
+		_ = xml.EscapeText(buf, []byte(s))
+		return buf.String()
+	}
+	buf := bytes.NewBuffer(nil)
+	fmt.Fprintf(buf, `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<assembly xmlns="urn:schemas-microsoft-com:asm.v1" manifestVersion="1.0" xmlns:asmv3="urn:schemas-microsoft-com:asm.v3">
+	<assemblyIdentity type="win32" name="%s" version="%s" processorArchitecture="*"/>
+`, esc(id), fileVersion(md.App.Version))
+	if md.App.Description != "" {
+		fmt.Fprintf(buf, "\t<description>%s</description>\n", esc(md.App.Description))
+	}
+	buf.WriteString(`	<compatibility xmlns="urn:schemas-microsoft-com:compatibility.v1">
+		<application>
+`)
+	for _, guid := range supportedOS {
+		fmt.Fprintf(buf, "\t\t\t<supportedOS Id=\"%s\"/>\n", guid)
+	}
+	fmt.Fprintf(buf, `		</application>
+	</compatibility>
+	<trustInfo xmlns="urn:schemas-microsoft-com:asm.v3">
+		<security>
+			<requestedPrivileges>
+				<requestedExecutionLevel level="%s" uiAccess="false"/>
+			</requestedPrivileges>
+		</security>
+	</trustInfo>
+	<asmv3:application>
+		<asmv3:windowsSettings>
+			<dpiAware xmlns="http://schemas.microsoft.com/SMI/2005/WindowsSettings">true/pm</dpiAware>
+			<dpiAwareness xmlns="http://schemas.microsoft.com/SMI/2016/WindowsSettings">PerMonitorV2, PerMonitor</dpiAwareness>
+			<longPathAware xmlns="http://schemas.microsoft.com/SMI/2016/WindowsSettings">true</longPathAware>
+		</asmv3:windowsSettings>
+	</asmv3:application>
+	<dependency>
+		<dependentAssembly>
+			<assemblyIdentity type="win32" name="Microsoft.Windows.Common-Controls" version="6.0.0.0" processorArchitecture="*" publicKeyToken="6595b64144ccf1df" language="*"/>
+		</dependentAssembly>
+	</dependency>
+</assembly>
+`, level)
+	return buf.Bytes(), nil
+}
+
+// resources creates the resources embedded into the executable name: the
+// icon, manifest and version information.
+func (md MetaData) resources(name string) (*pe.Resources, error) {
+	res := &pe.Resources{}
+	if md.Windows.ICO != nil {
+		by, err := ioutil.ReadAll(md.Windows.ICO)
+		if err != nil {
+			return nil, fmt.Errorf("reading ico: %w", err)
+		}
+		if err := res.SetIcon(1, by); err != nil {
+			return nil, err
+		}
+	}
+	if md.Windows.Manifest != nil {
+		by, err := ioutil.ReadAll(md.Windows.Manifest)
+		if err != nil {
+			return nil, fmt.Errorf("reading manifest: %w", err)
+		}
+		res.Set(pe.TypeManifest, 1, by)
+	}
+	var (
+		version     = md.App.Version
+		product     = md.App.Name
+		description = md.App.Description
+	)
+	if version == "" {
+		version = "0.0.0"
+	}
+	if product == "" {
+		product = name
+	}
+	if description == "" {
+		description = product
+	}
+	res.Set(pe.TypeVersion, 1, pe.VersionInfo{
+		FileVersion:    versionParts(version),
+		ProductVersion: versionParts(version),
+		Strings: map[string]string{
+			"CompanyName":      md.App.Publisher,
+			"FileDescription":  description,
+			"FileVersion":      version,
+			"InternalName":     name,
+			"LegalCopyright":   md.App.Copyright,
+			"OriginalFilename": name + ".exe",
+			"ProductName":      product,
+			"ProductVersion":   version,
+		},
+	}.Bytes())
+	return res, nil
+}
+
+// fileVersion converts a version string such as "1.2.3-beta" into the four
+// part numeric form Windows expects, "1.2.3.0".
+func fileVersion(version string) string {
+	parts := versionParts(version)
+	return fmt.Sprintf("%d.%d.%d.%d", parts[0], parts[1], parts[2], parts[3])
+}
+
+// versionParts parses the numeric parts of a version string. A leading "v"
+// is ignored and missing or non numeric parts are zero.
+func versionParts(version string) [4]uint16 {
+	parts := [4]uint16{}
+	for ii, p := range strings.SplitN(strings.TrimPrefix(version, "v"), ".", 4) {
+		end := 0
+		for end < len(p) && p[end] >= '0' && p[end] <= '9' {
+			end++
+		}
+		n, _ := strconv.ParseUint(p[:end], 10, 16)
+		parts[ii] = uint16(n)
+		if end < len(p) {
+			// Anything after a non numeric suffix, like "-rc.1", is dropped.
+			break
+		}
+	}
+	return parts
+}
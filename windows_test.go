@@ -0,0 +1,210 @@
+package gopack
+
+import (
+	"bytes"
+	"context"
+	debugpe "debug/pe"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/xml"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"git.sr.ht/~jackmordaunt/gopack/internal/pe"
+	"git.sr.ht/~jackmordaunt/gopack/internal/pkcs7"
+)
+
+func TestWindowsManifest(t *testing.T) {
+	var md MetaData
+	md.App.ID = "com.example.Notes"
+	md.App.Version = "1.2.3"
+	md.App.Description = "Notes & things"
+	md.Windows.ExecutionLevel = HighestAvailable
+	by, err := md.WindowsManifest("notes")
+	if err != nil {
+		t.Fatalf("generating manifest: %v", err)
+	}
+	var manifest struct {
+		Identity struct {
+			Name    string `xml:"name,attr"`
+			Version string `xml:"version,attr"`
+		} `xml:"assemblyIdentity"`
+		Description string `xml:"description"`
+		Level       struct {
+			Level string `xml:"level,attr"`
+		} `xml:"trustInfo>security>requestedPrivileges>requestedExecutionLevel"`
+		Settings struct {
+			DPIAwareness  string `xml:"dpiAwareness"`
+			LongPathAware bool   `xml:"longPathAware"`
+		} `xml:"application>windowsSettings"`
+		Dependency struct {
+			Name    string `xml:"name,attr"`
+			Version string `xml:"version,attr"`
+		} `xml:"dependency>dependentAssembly>assemblyIdentity"`
+	}
+	if err := xml.Unmarshal(by, &manifest); err != nil {
+		t.Fatalf("parsing manifest: %v\n%s", err, by)
+	}
+	if manifest.Identity.Name != "com.example.Notes" || manifest.Identity.Version != "1.2.3.0" {
+		t.Errorf("got identity %+v", manifest.Identity)
+	}
+	if manifest.Description != "Notes & things" {
+		t.Errorf("got description %q", manifest.Description)
+	}
+	if manifest.Level.Level != HighestAvailable {
+		t.Errorf("got execution level %q", manifest.Level.Level)
+	}
+	if !strings.HasPrefix(manifest.Settings.DPIAwareness, "PerMonitorV2") || !manifest.Settings.LongPathAware {
+		t.Errorf("got settings %+v", manifest.Settings)
+	}
+	if manifest.Dependency.Name != "Microsoft.Windows.Common-Controls" || manifest.Dependency.Version != "6.0.0.0" {
+		t.Errorf("got dependency %+v", manifest.Dependency)
+	}
+	md.Windows.ExecutionLevel = "root"
+	if _, err := md.WindowsManifest("notes"); err == nil {
+		t.Errorf("unknown execution level: expected error")
+	}
+}
+
+func TestFileVersion(t *testing.T) {
+	for in, want := range map[string]string{
+		"":               "0.0.0.0",
+		"1":              "1.0.0.0",
+		"1.2.3":          "1.2.3.0",
+		"1.2.3.4":        "1.2.3.4",
+		"2.0.0-rc.1":     "2.0.0.0",
+		"v1.2":           "1.2.0.0",
+		"1.2.3.4.5":      "1.2.3.4",
+		"10.20.30-beta1": "10.20.30.0",
+	} {
+		if got := fileVersion(in); got != want {
+			t.Errorf("fileVersion(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestSignWindows(t *testing.T) {
+	id := testIdentity(t)
+	// A PE32 image with no sections is enough to sign.
+	exe := append([]byte(nil), testBinaries["notes.exe"]...)
+	le := binary.LittleEndian
+	le.PutUint16(exe[0x54:], 224)
+	le.PutUint16(exe[0x58:], 0x10B)
+	le.PutUint32(exe[0x58+92:], 16)
+	// The timestamp authority stands in for a real one, stamping whatever
+	// it is asked to.
+	stamped := 0
+	tsa := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stamped++
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		type digestInfo struct {
+			Algorithm struct {
+				Algorithm  asn1.ObjectIdentifier
+				Parameters asn1.RawValue `asn1:"optional"`
+			}
+			Digest []byte
+		}
+		var req struct {
+			Version        int
+			MessageImprint digestInfo
+			Nonce          *big.Int `asn1:"optional"`
+		}
+		if _, err := asn1.Unmarshal(body, &req); err != nil {
+			t.Fatalf("parsing request: %v", err)
+		}
+		info, err := asn1.Marshal(struct {
+			Version        int
+			Policy         asn1.ObjectIdentifier
+			MessageImprint digestInfo
+			Serial         *big.Int
+			GenTime        time.Time `asn1:"generalized"`
+			Nonce          *big.Int
+		}{1, asn1.ObjectIdentifier{1, 2, 3}, req.MessageImprint, big.NewInt(int64(stamped)), time.Now().UTC(), req.Nonce})
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := asn1.Marshal(info)
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, err := pkcs7.Signer(*id).Sign(pkcs7.OIDTSTInfo, content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := asn1.Marshal(struct {
+			Status struct{ Status int }
+			Token  asn1.RawValue
+		}{Token: asn1.RawValue{FullBytes: token}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Header().Set("Content-Type", "application/timestamp-reply")
+		_, _ = w.Write(resp)
+	}))
+	defer tsa.Close()
+	dest := filepath.Join(t.TempDir(), "notes.exe")
+	if err := bundleWindows(context.Background(), dest, bytes.NewReader(exe), nil, id, tsa.URL); err != nil {
+		t.Fatalf("bundling: %v", err)
+	}
+	signed, err := ioutil.ReadFile(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stamped != 1 {
+		t.Errorf("timestamped %d times, want once", stamped)
+	}
+	f, err := debugpe.NewFile(bytes.NewReader(signed))
+	if err != nil {
+		t.Fatalf("parsing image: %v", err)
+	}
+	oh := f.OptionalHeader.(*debugpe.OptionalHeader32)
+	dir := oh.DataDirectory[4]
+	if dir.VirtualAddress == 0 || int(dir.VirtualAddress+dir.Size) != len(signed) {
+		t.Fatalf("got certificate table at %#x, size %#x", dir.VirtualAddress, dir.Size)
+	}
+	// The signed data holds the digest of the image, and the signature of
+	// the certificate.
+	digest, err := pe.Digest(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := signed[dir.VirtualAddress:]
+	if !bytes.Contains(cert, digest) || !bytes.Contains(cert, id.Certificate.Raw) {
+		t.Errorf("certificate table doesn't hold the digest and certificate")
+	}
+	if want := pe.Checksum(signed); oh.CheckSum != want {
+		t.Errorf("got checksum %#x, want %#x", oh.CheckSum, want)
+	}
+	tsa.Close()
+	if err := bundleWindows(context.Background(), dest, bytes.NewReader(exe), nil, id, tsa.URL); err == nil {
+		t.Errorf("unreachable timestamp authority: expected error")
+	}
+}
+
+// TestTimestampTimeout ensures an unresponsive timestamp authority fails
+// rather than stalling the bundle.
+func TestTimestampTimeout(t *testing.T) {
+	tsa := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = ioutil.ReadAll(r.Body)
+		<-r.Context().Done()
+	}))
+	defer tsa.Close()
+	defer func(c *http.Client) { timestampClient = c }(timestampClient)
+	timestampClient = &http.Client{Timeout: 100 * time.Millisecond}
+	start := time.Now()
+	if _, err := timestamp(context.Background(), tsa.URL, nil); err == nil {
+		t.Errorf("expected error")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("timestamping ran for %v", elapsed)
+	}
+}